@@ -2,18 +2,36 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/okonomipizza/chat-client/pkg/cli"
-	"github.com/okonomipizza/chat-client/pkg/protocol"
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
 )
 
 func main() {
+	resume := flag.Bool("resume", false, "resume the session saved by the last run instead of creating or joining a room")
+	useTLS := flag.Bool("tls", false, "encrypt the tcp connection to the server with TLS")
+	tlsCA := flag.String("tls-ca", "", "trust only server certificates signed by this PEM file (default: trust the certificate seen on first connection)")
+	flag.Parse()
+
+	// パスワードなどを平文で送受信しないよう、サーバーとの tcp 接続を TLS で暗号化する
+	if *useTLS || *tlsCA != "" {
+		if err := cli.UseTLS(*tlsCA); err != nil {
+			fmt.Println("Failed to configure TLS:", err)
+			os.Exit(1)
+		}
+	}
+
 	// サーバーとの間にtcp接続を確立
-	conn, err := net.Dial("tcp", "server:8080")
+	conn, err := cli.DialServer(0)
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		fmt.Println("Server is not available now")
@@ -21,17 +39,53 @@ func main() {
 	}
 	defer conn.Close()
 
+	// tcp 接続上のデータはフレーム単位で読み書きする
+	fc := protocol.NewFramedConn(conn)
+
+	// サーバーと対応している機能や制限を交換する
+	welcome, err := protocol.Handshake(fc, cli.NewHello())
+	if err != nil {
+		var errorResponse *protocol.ErrorResponse
+		if errors.As(err, &errorResponse) {
+			fmt.Println(cli.DescribeError(errorResponse))
+		} else {
+			fmt.Println("Failed to handshake with the server:", err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Connected to %s\n", welcome.ServerIdentity)
+
 	// チャットルームの作成 or チャットルームへの参加をサーバーにリクエスト
-	actionChoice := cli.GetUserActionChoice()
-	request, err := cli.GenerateRoomRequest(actionChoice)
+	// --resume の時は、保存されているセッションの再開をリクエストする
+	var request []byte
+	if *resume {
+		var session cli.Session
+		session, err = cli.LoadSession()
+		// end-to-end で暗号化するチャットルームのセッションは、保存しておいた room key でメッセージを読む
+		if err == nil && session.RoomKey != "" {
+			var key []byte
+			key, err = cli.DecodeRoomKey(session.RoomKey)
+			cli.UseRoomKey(key)
+		}
+		if err == nil {
+			request, err = cli.CreateResumeRequest(session)
+		}
+	} else {
+		actionChoice := cli.GetUserActionChoice()
+		request, err = cli.GenerateRoomRequest(actionChoice, welcome)
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	conn.Write(request)
+	err = fc.WriteFrame(request)
+	if err != nil {
+		fmt.Println("Failed to send request to the server:", err)
+		os.Exit(1)
+	}
 
 	// サーバーからの Ack response を確認
-	err = protocol.ReceiveAckResponse(conn)
+	err = protocol.ReceiveAckResponse(fc)
 	if err != nil {
 		fmt.Printf("Failed to receive Ack response from the server: %s", err)
 		fmt.Print("Server may be unavailable")
@@ -40,27 +94,29 @@ func main() {
 	println("The server is processing your request...")
 
 	// サーバーの処理結果を受信
-	readBuf := make([]byte, 1024)
-	_, err = conn.Read(readBuf)
+	frame, err := fc.ReadFrame()
 	if err != nil {
 		fmt.Println("Failed to receive response from the server:", err)
 		os.Exit(1)
 	}
 
 	// サーバーの応答をパース
-	response, err := protocol.ParseChatRoomResponse(readBuf)
+	response, err := protocol.ParseChatRoomResponse(frame)
 	if err != nil {
 		fmt.Println("Failed to read response from the server", err)
 		os.Exit(1)
 	}
 
-	// リクエストが無効だった場合アプリを終了
-	if response.State == protocol.StateInvalid {
-		fmt.Println("Your request refused from the server")
-		os.Exit(1)
-	}
-	if response.State == protocol.StateFail {
-		fmt.Println("Server is not available now")
+	// リクエストが無効だった場合、その理由を表示してアプリを終了
+	if response.State == protocol.StateInvalid || response.State == protocol.StateFail {
+		fmt.Println(cli.DescribeError(response.Error))
+		// 再開できなくなったセッションは、次回の --resume で使わないように削除する
+		if *resume && response.Error != nil && (response.Error.Code == protocol.ErrorCodeNotMember || response.Error.Code == protocol.ErrorCodeRoomNotFound) {
+			if err := cli.RemoveSession(); err != nil {
+				fmt.Println("Failed to remove the saved session:", err)
+			}
+			fmt.Println("The saved session has expired. Start without --resume to create or join a room")
+		}
 		os.Exit(1)
 	}
 
@@ -69,6 +125,48 @@ func main() {
 	userID := response.UserID
 	fmt.Printf("Chat room ID:<%s> \n", chatRoomID)
 	fmt.Println("You are Logged in to the room")
+	if response.ReliableDelivery {
+		fmt.Println("Reliable delivery is enabled for this room")
+	}
+	if response.EndToEndSalt != "" {
+		if cli.RoomKey() == nil {
+			fmt.Println("This room is end-to-end encrypted, but the room key is not available. Join the room again to read messages")
+		} else {
+			cli.ShowRoomKeyFingerprint()
+		}
+	}
+	// host はこのユーザーがチャットルームのホストかどうかで、ホストが交代すると受信側で更新される
+	var host atomic.Bool
+	host.Store(response.Operation == protocol.OperationCreateChatRoom || response.IsHost)
+	hostDeparture := response.HostDeparture
+
+	// クライアントを再起動しても --resume で会話を続けられるよう、セッションを保存する
+	resumeToken := response.ResumeToken
+	if resumeToken != "" {
+		err = cli.SaveSession(cli.Session{RoomID: chatRoomID, UserID: userID, ResumeToken: resumeToken, RoomKey: hex.EncodeToString(cli.RoomKey())})
+		if err != nil {
+			fmt.Println("Failed to save the session, --resume will not be available:", err)
+		}
+	}
+
+	// 参加したチャットルームでこれまでに配信されたメッセージを、ライブの配信より先に表示する
+	// historyCursor は /history で次に遡る位置で、表示した中で最も古い配信の sequence
+	var historyCursor uint64
+	joined := response.Operation == protocol.OperationJoinChatRoom || response.Operation == protocol.OperationResumeSession
+	if joined && welcome.Supports(protocol.FeatureHistory) {
+		frame, err := fc.ReadFrame()
+		if err == nil {
+			var history protocol.History
+			history, err = protocol.ParseHistoryResponse(frame)
+			cli.ShowHistory(history)
+			if len(history.Messages) > 0 {
+				historyCursor = history.Messages[0].Sequence
+			}
+		}
+		if err != nil {
+			fmt.Println("Failed to receive history of the room:", err)
+		}
+	}
 
 	// ログインが成功したのでチャットを行うための udp 接続を作成する
 	conn, err = net.Dial("udp", "server:9090")
@@ -78,31 +176,31 @@ func main() {
 	}
 	defer conn.Close()
 
+	// サーバーが SessionKey を発行した時は、送信するすべてのデータグラムをその鍵で認証する
+	// 暗号化が合意された時は、チャットの内容を暗号化して送信し、配信も復号して受信する
+	// ResumeToken そのものは udp で送信せず、アドレスの登録や退出にはトークンから作成した TokenProof を含める
+	// 認証されたデータグラムでアドレスを登録できる時は、TokenProof も含めない
+	udpToken := resumeToken
+	if response.SessionKey != "" {
+		udpToken = ""
+	}
+	conn, err = cli.SignDatagrams(conn, response.SessionKey, welcome.Supports(protocol.FeatureEncryption))
+	if err != nil {
+		fmt.Println("Received invalid session key from the server:", err)
+		os.Exit(1)
+	}
+
 	// このプロセスはチャットの送信のために使用する
 	// 別のプロセスを立ち上げて、サーバーから配信されるメッセージを受信する
-	go func() {
-		for {
-			buffer := make([]byte, 1024)
-			n, err := conn.Read(buffer)
-			if err != nil {
-				fmt.Println("Error receiving data: ", err)
-				break
-			}
-
-			// ユーザー入力行をクリア(入力中の文字を残すと見た目が悪いため)
-			fmt.Print("\r\033[K") // \033[K で行をクリア
-
-			// サーバーから配信されたチャットを表示
-			fmt.Println(string(buffer[:n]))
-		}
-	}()
+	go cli.ReceiveBroadcasts(conn, chatRoomID, userID, response.ReliableDelivery, &host)
 
 	// サーバーはチャットを配信するために、チャットルームに参加しているユーザーのアドレスを保存しておく必要がある
 	// サーバーへudp アドレスを知らせるために、空のメッセージを送信
+	// セッションを再開できるサーバーには、アドレスを登録できるのが本人だけになるよう TokenProof を送信する
 	blankMessage := protocol.ChatMessage{
 		ChatRoomID: chatRoomID,
 		UserID:     userID,
-		Message:    "",
+		Message:    protocol.CreateTokenProof(protocol.ChatOperationSendUDPAddr, chatRoomID, userID, udpToken, time.Now()),
 	}
 	udpAddrSendRequestProtocol, err := blankMessage.CreateChatRequest(protocol.ChatOperationSendUDPAddr)
 	if err != nil {
@@ -114,11 +212,58 @@ func main() {
 		fmt.Printf("Error sending blank message via UDP connection: %s\n", err)
 	}
 
+	// 入力がない間もサーバーにチャットルームから外されないよう、heartbeat を送信し続ける
+	if welcome.Supports(protocol.FeatureHeartbeat) {
+		go cli.SendHeartbeats(conn, chatRoomID, userID, udpToken, welcome.Limits.HeartbeatPeriod())
+	}
+
 	// チャットの入力を受け付けてサーバーへ送信
+	// 分割して送信できる長さの入力も 1 行として読み取れるようにする
 	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("Enter message (type 'exit' to quit):\n")
+	scanner.Buffer(make([]byte, 64*1024), protocol.FragmentedMessageBytesMaxLen+1)
+	fmt.Print("Enter message (type 'exit' to quit, '/history [n]' to scroll back):\n")
+	// leave はチャットルームから退出してプロセスを終了する
+	// tcp で退出をリクエストして完了を確認し、tcp でサーバーに届かない時だけ udp で operation exit を送信する
+	leave := func(successor string) {
+		err := cli.LeaveChatRoom(chatRoomID, userID, resumeToken, successor)
+		var errorResponse *protocol.ErrorResponse
+		if errors.As(err, &errorResponse) {
+			fmt.Println(cli.DescribeError(errorResponse))
+		} else if err != nil {
+			fmt.Printf("Failed to leave the room over tcp, sending exit over udp: %s\n", err)
+			message := protocol.ChatMessage{
+				ChatRoomID: chatRoomID,
+				UserID:     userID,
+				Message:    protocol.CreateTokenProof(protocol.ChatOperationExit, chatRoomID, userID, udpToken, time.Now()),
+			}
+			protocol, err := message.CreateChatRequest(protocol.ChatOperationExit)
+			if err == nil {
+				_, err = conn.Write(protocol)
+			}
+			if err != nil {
+				fmt.Printf("Failed to send exit message to server\nError: %s\n", err)
+			}
+		}
+		if err := cli.RemoveSession(); err != nil {
+			fmt.Println("Failed to remove the saved session:", err)
+		}
+		fmt.Println("Exit from Chat room")
+		os.Exit(0)
+	}
+
+	// messageID は分割して送信するメッセージを区別するための番号
+	var messageID uint32
 	for {
-		scanner.Scan()
+		// 入力を読み取れなくなった時は、空のメッセージを送り続けないよう退出する
+		// 長すぎる行を読み取った後の Scanner は続きを読み取れないので、入力を閉じた時と同じく退出する
+		if !scanner.Scan() {
+			if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+				fmt.Printf("The message is too long to send (at most %d bytes)\n", protocol.FragmentedMessageBytesMaxLen)
+			} else if err != nil {
+				fmt.Println("Failed to read the message:", err)
+			}
+			leave("")
+		}
 		input := scanner.Text()
 
 		message := protocol.ChatMessage{
@@ -128,35 +273,68 @@ func main() {
 		}
 
 		// "exit"は、ユーザーがチャットルームから退出する意志をサーバーへ伝えたいときに実行される
-		// サーバーへ operation exit を含めたリクエストを送信する
+		// ホストが後任を指名できるチャットルームでは、退出する前に後任のユーザー名を入力させる
 		if strings.ToLower(input) == "exit" {
-			protocol, err := message.CreateChatRequest(protocol.ChatOperationExit)
+			successor := ""
+			if host.Load() && hostDeparture == protocol.HostDepartureNominate {
+				fmt.Println("Enter the user name of the next host (leave blank to hand over to the longest-present member):")
+				if scanner.Scan() {
+					successor = strings.TrimSpace(scanner.Text())
+				}
+			}
+			leave(successor)
+		}
+
+		// "/history [n]" は、表示されているものより前の履歴を n 件サーバーに問い合わせて表示する
+		n, isHistoryCommand, err := cli.ParseHistoryCommand(input)
+		if isHistoryCommand {
 			if err != nil {
-				fmt.Printf("Error creating chat request : %s\n", err)
+				fmt.Println(err)
 				continue
 			}
-			_, err = conn.Write(protocol)
+			history, err := cli.FetchHistory(protocol.HistoryQuery{
+				RoomID:         chatRoomID,
+				UserID:         userID,
+				BeforeSequence: historyCursor,
+				Limit:          n,
+				ResumeToken:    resumeToken,
+			})
 			if err != nil {
-				fmt.Printf("Failed to send exit message to server\nError: %s\n", err)
+				var errorResponse *protocol.ErrorResponse
+				if errors.As(err, &errorResponse) {
+					fmt.Println(cli.DescribeError(errorResponse))
+				} else {
+					fmt.Println("Failed to fetch history of the room:", err)
+				}
+				continue
+			}
+			cli.ShowHistory(history)
+			if len(history.Messages) > 0 {
+				historyCursor = history.Messages[0].Sequence
+			}
+			if !history.HasMore {
+				fmt.Println("*** No more history")
 			}
-			fmt.Println("Exit from Chat room")
-			os.Exit(0)
+			continue
 		}
 
-		// 入力された文字列の長さをチェック
-		if len([]byte(input)) > protocol.ChatMessageBytesMaxLen {
-			fmt.Println("Sorry! This Message is too long to send!")
+		// end-to-end で暗号化するチャットルームでは、サーバーへ送る前に room key で暗号化する
+		// 暗号化すると長くなるので、長さは暗号化した後のメッセージで確認する
+		message, err = cli.SealForRoom(message)
+		if err != nil {
+			fmt.Printf("Failed to encrypt the message: %s\n", err)
 			continue
 		}
 
-		// サーバーへのリクエストメッセージを作成して送信
-		request, err := message.CreateChatRequest(protocol.ChatOperationSendMessage)
-		if err != nil {
-			fmt.Printf("Error creating chat request : %s\n", err)
+		// 入力された文字列の長さをチェック
+		if len(message.Message) > welcome.Limits.MaxMessageSize {
+			fmt.Println("Sorry! This Message is too long to send!")
 			continue
 		}
 
-		_, err = conn.Write(request)
+		// サーバーへのリクエストメッセージを作成して送信
+		messageID++
+		err = cli.SendChatMessage(conn, message, welcome, messageID)
 		if err != nil {
 			fmt.Printf("Failed to send message to server\nError: %s\n", err)
 		}
@@ -1,3 +1,7 @@
 module github.com/okonomipizza/chat-client
 
 go 1.23.1
+
+require github.com/okonomipizza/chat-protocol v0.0.0
+
+replace github.com/okonomipizza/chat-protocol => ../protocol
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+)
+
+// signedConn は udp 接続へ書き込むデータグラムに、SessionKey で認証トレーラーを追加する
+// 暗号化する時は、書き込むデータグラムを暗号化し、読み込んだ配信を復号する
+type signedConn struct {
+	net.Conn
+	signer *protocol.DatagramSigner
+	// broadcastKey は配信を復号する SessionKey で、nil の時は配信を復号しない
+	broadcastKey []byte
+}
+
+// SignDatagrams は conn へ書き込むデータグラムを sessionKey で認証する接続を返す
+// encrypt が true の時は、データグラムを暗号化し、サーバーからの配信を復号する接続を返す
+// sessionKey が空の時はサーバーがデータグラムを認証しないので、conn をそのまま返す
+func SignDatagrams(conn net.Conn, sessionKey string, encrypt bool) (net.Conn, error) {
+	if sessionKey == "" {
+		return conn, nil
+	}
+	key, err := protocol.DecodeSessionKey(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypt {
+		return &signedConn{Conn: conn, signer: protocol.NewDatagramSigner(key)}, nil
+	}
+	sealer, err := protocol.NewDatagramSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	return &signedConn{Conn: conn, signer: sealer, broadcastKey: key}, nil
+}
+
+// Write は認証トレーラーを追加したデータグラムを書き込み、成功した時は datagram の長さを返す
+func (c *signedConn) Write(datagram []byte) (int, error) {
+	signed, err := c.signer.Sign(datagram)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(signed); err != nil {
+		return 0, err
+	}
+	return len(datagram), nil
+}
+
+// Read は配信を読み込み、暗号化する時は復号したバイト列を buffer に入れる
+// 復号できない配信はサーバーからのものではないので、捨てて次の配信を待つ
+func (c *signedConn) Read(buffer []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(buffer)
+		if err != nil || c.broadcastKey == nil {
+			return n, err
+		}
+		opened, err := protocol.OpenBroadcast(c.broadcastKey, buffer[:n])
+		if err != nil {
+			fmt.Println("Dropped a datagram that could not be decrypted: ", err)
+			continue
+		}
+		return copy(buffer, opened), nil
+	}
+}
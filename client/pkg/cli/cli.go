@@ -4,12 +4,16 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/okonomipizza/chat-client/pkg/protocol"
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
 )
 
 // GetUserInputString は、ユーザーに対して target に対応した文字列の入力を求める
@@ -100,12 +104,55 @@ func GetUserActionChoice() int {
 	return choice
 }
 
+// GetHostDepartureChoice はホストが退出した時のチャットルームの扱いをユーザーに選択させる
+func GetHostDepartureChoice() string {
+	reader := bufio.NewReader(os.Stdin)
+	choices := map[string]string{
+		"1": protocol.HostDepartureClose,
+		"2": protocol.HostDeparturePromote,
+		"3": protocol.HostDepartureNominate,
+	}
+
+	for {
+		fmt.Println("What happens to the room when you leave?")
+		fmt.Println("1. Close the room")
+		fmt.Println("2. Hand it over to the longest-present member")
+		fmt.Println("3. Let me nominate the next host when I leave")
+		fmt.Print("Enter 1, 2 or 3: ")
+
+		input, _ := reader.ReadString('\n')
+		choice, ok := choices[strings.TrimSpace(input)]
+		if ok {
+			return choice
+		}
+		fmt.Println("Invalid input. Please enter 1, 2 or 3.")
+	}
+}
+
+// ClientName は Hello でサーバーへ通知するクライアントの名前
+const ClientName = "online-chat-messenger cli"
+
+// ClientFeatures はこのクライアントが対応している機能の一覧
+var ClientFeatures = []string{protocol.FeatureReliableDelivery, protocol.FeatureFragmentation, protocol.FeatureHistory, protocol.FeatureHostHandover, protocol.FeatureHeartbeat, protocol.FeatureSessionResume, protocol.FeatureDatagramAuth, protocol.FeatureEncryption, protocol.FeatureEndToEnd}
+
+// NewHello はサーバーとの接続の最初に送信する Hello を作成する
+func NewHello() protocol.Hello {
+	return protocol.Hello{
+		ProtocolVersion: protocol.ProtocolVersion,
+		ClientName:      ClientName,
+		Features:        ClientFeatures,
+	}
+}
+
 // ユーザーの選択に対応したリクエストプロトコルを生成する
-func GenerateRoomRequest(choice int) ([]byte, error) {
+// 入力を受け付ける文字列の長さや選択できる機能は、サーバーから通知された welcome に従う
+func GenerateRoomRequest(choice int, welcome protocol.Welcome) ([]byte, error) {
+	limits := welcome.Limits
+
 	// 選択に応じたリクエストを作成
 	// 1) 新しいチャットルームの作成
 	if choice == CreateNewChatRoom {
-		request, err := CreateNewRoomRequest()
+		request, err := CreateNewRoomRequest(welcome)
 		if err != nil {
 			return nil, err
 		}
@@ -113,7 +160,7 @@ func GenerateRoomRequest(choice int) ([]byte, error) {
 	}
 	// 2) 既存のチャットルームへの参加
 	if choice == JoinChatRoom {
-		request, err := CreateJoinRoomRequest()
+		request, err := CreateJoinRoomRequest(limits)
 		if err != nil {
 			// CreateJoinRoomRequestの中で、ユーザーが指定した Chatroomが存在しない場合がある
 			return nil, errors.New("room ID you typed does not exists on the server")
@@ -125,9 +172,10 @@ func GenerateRoomRequest(choice int) ([]byte, error) {
 	return nil, errors.New("could not generate request protocol succesfully")
 }
 
-func CreateNewRoomRequest() ([]byte, error) {
-	userName := GetUserInputString("user name", 1, 32)
-	roomName := GetUserInputString("chat room name", 1, 64)
+func CreateNewRoomRequest(welcome protocol.Welcome) ([]byte, error) {
+	limits := welcome.Limits
+	userName := GetUserInputString("user name", 1, limits.MaxUserName)
+	roomName := GetUserInputString("chat room name", 1, limits.MaxRoomName)
 	request := protocol.ChatRoomRequest{
 		RoomName:  roomName,
 		UserName:  userName,
@@ -137,8 +185,29 @@ func CreateNewRoomRequest() ([]byte, error) {
 	// passwordの設定は任意
 	isPasswordNeeded := GetUserChoiceBool("Do you set password to the room?")
 	if isPasswordNeeded {
-		password := GetUserInputString("password", 1, 32)
+		password := GetUserInputString("password", 1, limits.MaxPassword)
 		request.RoomPassword = password
+		// end-to-end の暗号化はパスワードを設定したチャットルームで、サーバーが対応している時だけ選択できる
+		// 選択した時はパスワードをサーバーへ送らず、パスワードから導出した verifier を送る
+		if welcome.Supports(protocol.FeatureEndToEnd) && GetUserChoiceBool("Do you encrypt messages end-to-end so that even the server cannot read them?") {
+			salt, err := protocol.NewEndToEndSalt()
+			if err != nil {
+				return nil, err
+			}
+			request.RoomPassword, err = deriveRoomKey(password, salt)
+			if err != nil {
+				return nil, err
+			}
+			request.EndToEndSalt = salt
+		}
+	}
+	// reliable delivery はサーバーが対応している時だけ選択できる
+	if welcome.Supports(protocol.FeatureReliableDelivery) {
+		request.ReliableDelivery = GetUserChoiceBool("Do you enable reliable delivery in the room?")
+	}
+	// ホストが退出した時の扱いもサーバーが対応している時だけ選択できる
+	if welcome.Supports(protocol.FeatureHostHandover) {
+		request.HostDeparture = GetHostDepartureChoice()
 	}
 
 	requestProtocol, err := request.CreateRequestProtocol()
@@ -151,14 +220,21 @@ func CreateNewRoomRequest() ([]byte, error) {
 
 // GetRoomNameはサーバーにRoomIDを渡して、対応するチャットルームが存在すればその名前を返す
 // また、指定されたチャットルームにログインパスワードが設定されているか否かをbool値で返す
-func GetRoomNameByID(roomID string) (string, bool, error) {
+// end-to-end で暗号化するチャットルームの時は、room key の導出に使う salt も返す (それ以外は空)
+func GetRoomNameByID(roomID string) (string, bool, string, error) {
 	// 問い合わせ用の接続を用意する
-	conn, err := net.Dial("tcp", "server:8080")
+	conn, err := DialServer(0)
 	if err != nil {
-		fmt.Println("Error connecting to server")
+		fmt.Println("Error connecting to server:", err)
 		os.Exit(0)
 	}
 	defer conn.Close()
+	fc := protocol.NewFramedConn(conn)
+
+	_, err = protocol.Handshake(fc, NewHello())
+	if err != nil {
+		return "", false, "", err
+	}
 
 	// 検索したいチャットルームのIDと操作をリクエストに含める
 	request := protocol.ChatRoomRequest{
@@ -170,47 +246,41 @@ func GetRoomNameByID(roomID string) (string, bool, error) {
 	// リクエストを作成して送信
 	requestProtocol, err := request.CreateRequestProtocol()
 	if err != nil {
-		return "", false, err
+		return "", false, "", err
 	}
 
-	_, err = conn.Write(requestProtocol)
+	err = fc.WriteFrame(requestProtocol)
 	if err != nil {
 		fmt.Println("Failed to send request for room searching")
 	}
 
 	// ack responseを受信
-	err = protocol.ReceiveAckResponse(conn)
+	err = protocol.ReceiveAckResponse(fc)
 	if err != nil {
-		return "", false, err
+		return "", false, "", err
 	}
 
 	// サーバーの処理結果を受信
-	response, err := protocol.ReceiveResponse(conn)
+	response, err := protocol.ReceiveResponse(fc)
 	if err != nil {
-		return "", false, err
+		return "", false, "", err
 	}
 
 	// チャットルームが存在しないときはアプリを終了
 	if response.State == protocol.StateInvalid {
-		fmt.Println("Designated Chatroom does not exist")
+		fmt.Println(DescribeError(response.Error))
 		os.Exit(0)
 	}
 
-	roomname := response.RoomName
-	if response.RoomPassword == "" {
-		// パスワードがチャットルームに設定されていない場合
-		return roomname, false, nil
-	} else {
-		// パスワードがチャットルームに設定されている場合
-		return roomname, true, nil
-	}
+	// サーバーはパスワードを返さず、参加にパスワードが必要かどうかだけを返す
+	return response.RoomName, response.PasswordRequired, response.EndToEndSalt, nil
 }
 
 // CreateJoinRoomRequest はユーザーの入力情報に基づいてチャットルームへの参加リクエストを作成する
 // チャットルームが存在しない場合はそこで処理を終了する
-func CreateJoinRoomRequest() ([]byte, error) {
+func CreateJoinRoomRequest(limits protocol.Limits) ([]byte, error) {
 	roomID := GetUserInputString("room id", 1, 64)
-	roomName, isPasswordNeeded, err := GetRoomNameByID(roomID)
+	roomName, isPasswordNeeded, endToEndSalt, err := GetRoomNameByID(roomID)
 	if err != nil {
 		fmt.Println("Some error occured: ", err)
 		os.Exit(0)
@@ -225,7 +295,7 @@ func CreateJoinRoomRequest() ([]byte, error) {
 	}
 
 	// チャットルーム内で使用するハンドルネームを取得
-	userName := GetUserInputString("user name", 1, 32)
+	userName := GetUserInputString("user name", 1, limits.MaxUserName)
 	request := protocol.ChatRoomRequest{
 		RoomID:    roomID,
 		RoomName:  roomName,
@@ -237,8 +307,15 @@ func CreateJoinRoomRequest() ([]byte, error) {
 	// チャットルームにパスワードが設定されている場合
 	// ユーザーにパスワードの入力を求める
 	if isPasswordNeeded {
-		passwordInput := GetUserInputString("password", 1, 32)
+		passwordInput := GetUserInputString("password", 1, limits.MaxPassword)
 		request.RoomPassword = passwordInput
+		// end-to-end で暗号化するチャットルームでは、パスワードの代わりにパスワードから導出した verifier を送る
+		if endToEndSalt != "" {
+			request.RoomPassword, err = deriveRoomKey(passwordInput, endToEndSalt)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// 取得した入力を元にリクエストを作成
@@ -248,3 +325,386 @@ func CreateJoinRoomRequest() ([]byte, error) {
 	}
 	return requestProtocol, nil
 }
+
+// DescribeError はサーバーから返されたエラーをユーザー向けのメッセージに変換する
+func DescribeError(errorResponse *protocol.ErrorResponse) string {
+	if errorResponse == nil {
+		return "Your request refused from the server"
+	}
+
+	switch errorResponse.Code {
+	case protocol.ErrorCodeRoomNotFound:
+		return "Designated Chatroom does not exist"
+	case protocol.ErrorCodeWrongPassword:
+		return "The password you typed is incorrect"
+	case protocol.ErrorCodeNameTaken:
+		return "The user name is already used in the room. Please choose another name"
+	case protocol.ErrorCodeRoomFull:
+		return "The chat room is full. Please try again later"
+	case protocol.ErrorCodeRateLimited:
+		if wait := errorResponse.RetryAfter(); wait > 0 {
+			return fmt.Sprintf("Too many requests. Please try again in %d seconds", max(1, int(math.Ceil(wait.Seconds()))))
+		}
+		return "Too many requests. Please wait a moment and try again"
+	case protocol.ErrorCodeLockedOut:
+		return fmt.Sprintf("Too many failed attempts. Please try again in %d seconds", max(1, int(math.Ceil(errorResponse.RetryAfter().Seconds()))))
+	case protocol.ErrorCodeNotMember:
+		return "You are not a member of the room"
+	case protocol.ErrorCodeUnsupportedVersion:
+		return "This client is not supported by the server. Please update the client"
+	case protocol.ErrorCodeMalformedRequest:
+		return fmt.Sprintf("The server could not read the request: %s", errorResponse.Message)
+	default:
+		return fmt.Sprintf("Server is not available now: %s", errorResponse.Message)
+	}
+}
+
+// FormatBroadcast はサーバーから配信されたデータグラムを、種類に応じて表示用の文字列に変換する
+func FormatBroadcast(broadcast protocol.Broadcast) string {
+	timestamp := broadcast.Timestamp.Local().Format("15:04:05")
+
+	switch broadcast.Kind {
+	case protocol.BroadcastKindUserMessage:
+		// end-to-end で暗号化するチャットルームでは、復号できたメッセージに鍵のマークを付ける
+		if roomKey != nil {
+			message, err := protocol.OpenRoomMessage(roomKey, broadcast.RoomID, broadcast.SenderID, broadcast.Message)
+			if err != nil {
+				return fmt.Sprintf("[%s] %s: (message could not be decrypted with the room key)", timestamp, broadcast.SenderName)
+			}
+			return fmt.Sprintf("[%s] 🔒 %s: %s", timestamp, broadcast.SenderName, message)
+		}
+		return fmt.Sprintf("[%s] %s: %s", timestamp, broadcast.SenderName, broadcast.Message)
+	case protocol.BroadcastKindJoin:
+		return fmt.Sprintf("[%s] *** %s joined the room", timestamp, broadcast.SenderName)
+	case protocol.BroadcastKindLeave:
+		return fmt.Sprintf("[%s] *** %s left the room", timestamp, broadcast.SenderName)
+	case protocol.BroadcastKindRoomClosed:
+		if broadcast.SenderName == "" {
+			return fmt.Sprintf("[%s] *** The chat room was closed", timestamp)
+		}
+		return fmt.Sprintf("[%s] *** The chat room was closed by the host %s", timestamp, broadcast.SenderName)
+	case protocol.BroadcastKindHostChanged:
+		return fmt.Sprintf("[%s] *** %s is now the host", timestamp, broadcast.SenderName)
+	default:
+		return fmt.Sprintf("[%s] [system] %s", timestamp, broadcast.Message)
+	}
+}
+
+// ShowHistory はチャットルームへ参加する前に配信されたメッセージを、ライブの配信と区別できるように区切って表示する
+// 履歴がない時は何も表示しない
+func ShowHistory(history protocol.History) {
+	if len(history.Messages) == 0 {
+		return
+	}
+	fmt.Println("-------- history --------")
+	for _, message := range history.Messages {
+		fmt.Println(FormatBroadcast(message.Broadcast(history.RoomID)))
+	}
+	fmt.Println("-------------------------")
+}
+
+// LeaveChatRoom はサーバーにチャットルームからの退出をリクエストし、完了したことを確認する
+// resumeToken には本人であることを示すため、参加した時に発行された ResumeToken を指定する (発行されていない時は空)
+// successor には、ホストが退出する時に後任として指名するメンバーの名前を指定する (指名しない時は空)
+// サーバーが退出を拒否した時は *protocol.ErrorResponse を、サーバーに届かなかった時はそれ以外のエラーを返す
+func LeaveChatRoom(roomID string, userID string, resumeToken string, successor string) error {
+	conn, err := DialServer(leaveTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(leaveTimeout))
+	fc := protocol.NewFramedConn(conn)
+
+	_, err = protocol.Handshake(fc, NewHello())
+	if err != nil {
+		return err
+	}
+
+	request := protocol.ChatRoomRequest{
+		RoomID:      roomID,
+		UserID:      userID,
+		Successor:   successor,
+		ResumeToken: resumeToken,
+		Operation:   protocol.OperationLeaveChatRoom,
+		State:       protocol.StateRequest,
+	}
+	requestProtocol, err := request.CreateRequestProtocol()
+	if err != nil {
+		return err
+	}
+	err = fc.WriteFrame(requestProtocol)
+	if err != nil {
+		return err
+	}
+
+	// ack responseを受信
+	err = protocol.ReceiveAckResponse(fc)
+	if err != nil {
+		return err
+	}
+
+	// サーバーの処理結果を受信
+	response, err := protocol.ReceiveResponse(fc)
+	if err != nil {
+		return err
+	}
+	if response.State == protocol.StateSuccess {
+		return nil
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return errors.New("unexpected response to leave request")
+}
+
+// leaveTimeout は退出のリクエストがサーバーに届かないと判断するまでの時間
+const leaveTimeout = 3 * time.Second
+
+// HistoryCommand はチャットの入力のうち、履歴を遡って表示するためのコマンド
+const HistoryCommand = "/history"
+
+// ParseHistoryCommand は入力が "/history [n]" であれば、遡って表示する件数と true を返す
+// 件数が省略された時は protocol.DefaultHistoryPageSize 件とする
+func ParseHistoryCommand(input string) (int, bool, error) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 || fields[0] != HistoryCommand {
+		return 0, false, nil
+	}
+	if len(fields) == 1 {
+		return protocol.DefaultHistoryPageSize, true, nil
+	}
+	if len(fields) > 2 {
+		return 0, true, errors.New("usage: /history [n]")
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 || n > protocol.HistoryPageMaxSize {
+		return 0, true, fmt.Errorf("n must be a number between 1 and %d", protocol.HistoryPageMaxSize)
+	}
+	return n, true, nil
+}
+
+// FetchHistory はサーバーに query の範囲の履歴を問い合わせる
+func FetchHistory(query protocol.HistoryQuery) (protocol.History, error) {
+	// 問い合わせ用の接続を用意する
+	conn, err := DialServer(0)
+	if err != nil {
+		return protocol.History{}, err
+	}
+	defer conn.Close()
+	fc := protocol.NewFramedConn(conn)
+
+	_, err = protocol.Handshake(fc, NewHello())
+	if err != nil {
+		return protocol.History{}, err
+	}
+
+	requestProtocol, err := protocol.CreateHistoryRequest(query)
+	if err != nil {
+		return protocol.History{}, err
+	}
+	err = fc.WriteFrame(requestProtocol)
+	if err != nil {
+		return protocol.History{}, err
+	}
+
+	// ack responseを受信
+	err = protocol.ReceiveAckResponse(fc)
+	if err != nil {
+		return protocol.History{}, err
+	}
+
+	// サーバーの処理結果を受信
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		return protocol.History{}, err
+	}
+	return protocol.ParseHistoryResponse(frame)
+}
+
+const (
+	// reliableGapTimeout は reliable delivery で sequence の抜けが埋まるのを待つ時間
+	// サーバーが再送を諦めるまでの時間より長くしておく
+	reliableGapTimeout = 20 * time.Second
+	// bestEffortGapTimeout は best effort の配信で、順番が入れ替わって届く配信を待つ時間
+	bestEffortGapTimeout = 500 * time.Millisecond
+	// gapCheckInterval は配信が届かない間も sequence の抜けを確認する間隔
+	gapCheckInterval = 100 * time.Millisecond
+)
+
+// ReceiveBroadcasts はサーバーから配信されるデータグラムを受信して表示し続ける
+// 配信はサーバーが割り当てた sequence の順に並べ直し、重複を取り除いてから表示する
+// 分割された配信はすべてのフラグメントが揃ってから表示する
+// reliable が true の時は受信するたびに ack を返し、抜けた sequence の再送を待つ
+// ホストの交代が配信されると、このユーザーがホストかどうかを host に反映する
+// チャットルームが閉じられたことが配信されると、それを表示してクライアントを終了する
+func ReceiveBroadcasts(conn net.Conn, chatRoomID string, userID string, reliable bool, host *atomic.Bool) {
+	gapTimeout := bestEffortGapTimeout
+	if reliable {
+		gapTimeout = reliableGapTimeout
+	}
+	reorder := protocol.NewReorderBuffer(gapTimeout)
+	reassembler := protocol.NewReassembler(protocol.DefaultReassemblyConfig)
+	buffer := make([]byte, protocol.BroadcastProtocolMaxLen)
+	// serverUnreachable はサーバーに到達できないことを表示済みかどうか
+	serverUnreachable := false
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(gapCheckInterval))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				delivered, lost := reorder.Expire(time.Now())
+				showBroadcasts(delivered, lost, userID, host)
+				continue
+			}
+			// サーバーが再起動している間は ICMP の到達不能が返ってくるが、再起動したサーバーは
+			// チャットルームとユーザーを復元して同じアドレスへ配信を再開するので、受信を続ける
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				if !serverUnreachable {
+					fmt.Print("\r\033[K")
+					fmt.Println("*** The server is not reachable. Waiting for it to come back...")
+					serverUnreachable = true
+				}
+				continue
+			}
+			fmt.Println("Error receiving data: ", err)
+			return
+		}
+
+		serverUnreachable = false
+
+		broadcast, err := protocol.ParseBroadcast(buffer[:n])
+		if err != nil {
+			fmt.Println("Received invalid data from the server: ", err)
+			continue
+		}
+
+		// 配信の順番に含まれない通知は ack を返さず、そのまま表示する
+		if broadcast.IsDirectNotice() {
+			showBroadcasts([]protocol.Broadcast{broadcast}, 0, userID, host)
+			continue
+		}
+
+		if reliable {
+			// 重複して受信した時もサーバーが再送をやめられるように ack を返す
+			ack, err := protocol.CreateAckRequest(chatRoomID, userID, broadcast.Sequence, broadcast.Fragment.Index)
+			if err == nil {
+				_, err = conn.Write(ack)
+			}
+			if err != nil {
+				fmt.Println("Failed to send ack to the server: ", err)
+			}
+		}
+
+		// 既に表示したメッセージのフラグメントは組み立て直さない
+		if reorder.Delivered(broadcast.Sequence) {
+			continue
+		}
+
+		if broadcast.Fragment.IsFragmented() {
+			message, complete, err := reassembler.Add(broadcast.RoomID, broadcast.Fragment, broadcast.Message, time.Now())
+			if err != nil {
+				fmt.Println("Failed to reassemble a message from the server: ", err)
+				continue
+			}
+			if !complete {
+				continue
+			}
+			broadcast.Message = message
+			broadcast.Fragment = protocol.Fragment{}
+		}
+
+		delivered, _ := reorder.Push(broadcast, time.Now())
+		expired, lost := reorder.Expire(time.Now())
+		showBroadcasts(append(delivered, expired...), lost, userID, host)
+	}
+}
+
+// SendChatMessage はメッセージをサーバーへ送信する
+// サーバーが分割に対応している時は、MTU を超えるメッセージを messageID のフラグメントに分割して送信する
+// データグラムを認証・暗号化する時は、トレーラーを追加しても MTU に収まるように分割する
+func SendChatMessage(conn net.Conn, message protocol.ChatMessage, welcome protocol.Welcome, messageID uint32) error {
+	fragments := []protocol.ChatMessage{message}
+	if welcome.Supports(protocol.FeatureFragmentation) {
+		mtu := welcome.Limits.MTU
+		if welcome.Supports(protocol.FeatureEncryption) {
+			mtu -= protocol.DatagramSealLen
+		} else if welcome.Supports(protocol.FeatureDatagramAuth) {
+			mtu -= protocol.DatagramAuthLen
+		}
+		var err error
+		fragments, err = message.Fragments(messageID, mtu)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fragment := range fragments {
+		request, err := fragment.CreateChatRequest(protocol.ChatOperationSendMessage)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendHeartbeats は interval ごとに heartbeat を送信し、チャットルームに参加し続けていることをサーバーへ知らせ続ける
+// resumeToken から作成した TokenProof を含めるか、データグラムを認証することで、アドレスが変わった時もサーバーが配信先を登録し直せるようにする
+// サーバーが一時的に到達できない間も送信を続ける
+func SendHeartbeats(conn net.Conn, chatRoomID string, userID string, resumeToken string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// 同じ TokenProof は二度受け付けられないので、送信するたびに作成する
+		heartbeat, err := protocol.CreateHeartbeatRequest(chatRoomID, userID, resumeToken, now)
+		if err != nil {
+			fmt.Println("Failed to create heartbeat: ", err)
+			return
+		}
+		// 送信の失敗はサーバーが再起動している間などに起こるので、表示せずに次の heartbeat で再び試みる
+		conn.Write(heartbeat)
+	}
+}
+
+// showBroadcasts は配信を表示する
+// 自分の発言や参加の通知も配信されるが、それらは表示しない
+// チャットルームが閉じられた時は、それを表示してクライアントを終了する
+func showBroadcasts(broadcasts []protocol.Broadcast, lost uint64, userID string, host *atomic.Bool) {
+	if lost > 0 {
+		fmt.Print("\r\033[K")
+		fmt.Printf("*** %d messages could not be delivered\n", lost)
+	}
+	for _, broadcast := range broadcasts {
+		if broadcast.Kind == protocol.BroadcastKindHostChanged {
+			host.Store(broadcast.SenderID == userID)
+			if broadcast.SenderID == userID {
+				fmt.Print("\r\033[K")
+				fmt.Println("*** You are now the host of this room")
+				continue
+			}
+		}
+		if broadcast.SenderID == userID {
+			continue
+		}
+
+		// ユーザー入力行をクリア(入力中の文字を残すと見た目が悪いため)
+		fmt.Print("\r\033[K") // \033[K で行をクリア
+
+		// サーバーから配信されたチャットを表示
+		fmt.Println(FormatBroadcast(broadcast))
+
+		if broadcast.Kind == protocol.BroadcastKindRoomClosed {
+			if err := RemoveSession(); err != nil {
+				fmt.Println("Failed to remove the saved session:", err)
+			}
+			fmt.Println("Run the client again to create or join another room")
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+)
+
+// roomKey は end-to-end で暗号化するチャットルームの room key で、nil の時はメッセージを暗号化しない
+var roomKey []byte
+
+// UseRoomKey は以降に送受信するユーザーのメッセージを key で暗号化・復号する
+func UseRoomKey(key []byte) {
+	roomKey = key
+}
+
+// RoomKey は使用している room key を返し、end-to-end で暗号化しない時は nil を返す
+func RoomKey() []byte {
+	return roomKey
+}
+
+// DecodeRoomKey は Session に hex で保存した room key をバイト列に戻す
+func DecodeRoomKey(key string) ([]byte, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != protocol.RoomKeyLen {
+		return nil, fmt.Errorf("saved room key is corrupted")
+	}
+	return decoded, nil
+}
+
+// SealForRoom は end-to-end で暗号化するチャットルームへ送るメッセージを room key で暗号化する
+// 暗号化しない時はそのまま返す
+func SealForRoom(message protocol.ChatMessage) (protocol.ChatMessage, error) {
+	if roomKey == nil {
+		return message, nil
+	}
+	sealed, err := protocol.SealRoomMessage(roomKey, message.ChatRoomID, message.UserID, message.Message)
+	if err != nil {
+		return protocol.ChatMessage{}, err
+	}
+	message.Message = sealed
+	return message, nil
+}
+
+// ShowRoomKeyFingerprint は end-to-end で暗号化するチャットルームであることと、room key のフィンガープリントを表示する
+// メンバー同士がフィンガープリントを別の手段で比べることで、同じ鍵を使っていることを確かめられる
+func ShowRoomKeyFingerprint() {
+	fmt.Printf("🔒 Messages in this room are end-to-end encrypted (key fingerprint: %s)\n", protocol.RoomKeyFingerprint(roomKey))
+	fmt.Println("   Compare the fingerprint with other members outside this chat to make sure you share the same key")
+}
+
+// deriveRoomKey は end-to-end で暗号化するチャットルームのパスワードから room key を導出して使用し、
+// パスワードの代わりにサーバーへ送る verifier を返す
+func deriveRoomKey(password string, salt string) (string, error) {
+	verifier, key, err := protocol.DeriveRoomKey(password, salt)
+	if err != nil {
+		return "", err
+	}
+	UseRoomKey(key)
+	return verifier, nil
+}
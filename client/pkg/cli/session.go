@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+)
+
+// Session はクライアントを再起動した後もチャットルームへの参加を再開するために、ローカルへ保存する情報
+type Session struct {
+	RoomID      string `json:"room_id"`
+	UserID      string `json:"user_id"`
+	ResumeToken string `json:"resume_token"`
+	// RoomKey は end-to-end で暗号化するチャットルームの room key (hex)
+	// パスワードを入力し直さずに再開したセッションでもメッセージを読めるよう保存する
+	RoomKey string `json:"room_key,omitempty"`
+}
+
+// sessionFileName はユーザーの設定ディレクトリの下に Session を保存するファイル
+const sessionFileName = "online-chat-messenger/session.json"
+
+// SessionPath は Session を保存するファイルのパスを返す
+func SessionPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, sessionFileName), nil
+}
+
+// SaveSession は Session をファイルへ保存する
+// ResumeToken や RoomKey を知っていればそのユーザーとして振る舞えるので、本人だけが読めるように保存する
+func SaveSession(session Session) error {
+	path, err := SessionPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// LoadSession は保存されている Session を読み込む
+func LoadSession() (Session, error) {
+	path, err := SessionPath()
+	if err != nil {
+		return Session{}, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Session{}, errors.New("no session to resume, start without --resume to create or join a room")
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{}
+	if err := json.Unmarshal(data, &session); err != nil {
+		return Session{}, errors.New("saved session is corrupted, start without --resume to create or join a room")
+	}
+	return session, nil
+}
+
+// RemoveSession はチャットルームから退出した後などに、保存されている Session を削除する
+func RemoveSession() error {
+	path, err := SessionPath()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// CreateResumeRequest は保存されていた Session の再開をサーバーへリクエストするバイト列を作成する
+func CreateResumeRequest(session Session) ([]byte, error) {
+	request := protocol.ChatRoomRequest{
+		RoomID:      session.RoomID,
+		UserID:      session.UserID,
+		ResumeToken: session.ResumeToken,
+		Operation:   protocol.OperationResumeSession,
+		State:       protocol.StateRequest,
+	}
+	return request.CreateRequestProtocol()
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ServerAddr は tcp で接続するサーバーのアドレス
+const ServerAddr = "server:8080"
+
+// serverTLS は tcp の接続に使う TLS の設定で、nil の時は TLS を使わない
+var serverTLS *tls.Config
+
+// knownServersFileName はユーザーの設定ディレクトリの下に、初めて接続した時に信頼したサーバーの証明書を保存するファイル
+const knownServersFileName = "online-chat-messenger/known_servers.json"
+
+// knownServersMu は known_servers.json の読み書きが同時に起こらないようにする
+var knownServersMu sync.Mutex
+
+// UseTLS は以降のサーバーとの tcp 接続を TLS で暗号化する
+// caFile を指定した時は、その証明書で署名されたサーバーの証明書だけを信頼する
+// 空の時は初めて接続した時のサーバーの証明書を保存し、以降も同じ証明書であることを確認する (trust on first use)
+func UseTLS(caFile string) error {
+	host, _, err := net.SplitHostPort(ServerAddr)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = roots
+	} else {
+		// 証明書の検証は CA の代わりに、保存してあるフィンガープリントとの比較で行う
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			return trustOnFirstUse(ServerAddr, state.PeerCertificates[0])
+		}
+	}
+
+	serverTLS = config
+	return nil
+}
+
+// DialServer はサーバーとの tcp 接続を確立し、TLS を使う時はハンドシェイクまで済ませる
+// timeout が 0 の時は時間を制限しない
+func DialServer(timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if serverTLS == nil {
+		return dialer.Dial("tcp", ServerAddr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", ServerAddr, serverTLS)
+}
+
+// KnownServersPath は信頼したサーバーの証明書のフィンガープリントを保存するファイルのパスを返す
+func KnownServersPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, knownServersFileName), nil
+}
+
+// trustOnFirstUse はサーバーの証明書のフィンガープリントを、以前に保存したものと比較する
+// 初めて接続したサーバーの時は、フィンガープリントを保存して信頼する
+func trustOnFirstUse(addr string, cert *x509.Certificate) error {
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	knownServersMu.Lock()
+	defer knownServersMu.Unlock()
+
+	path, err := KnownServersPath()
+	if err != nil {
+		return err
+	}
+	known := map[string]string{}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &known); err != nil {
+			return fmt.Errorf("%s is corrupted: %w", path, err)
+		}
+	}
+
+	if saved, exists := known[addr]; exists {
+		if saved != fingerprint {
+			return fmt.Errorf("certificate of %s has changed (SHA-256 %s, trusted %s); remove it from %s if the server was reinstalled", addr, fingerprint, saved, path)
+		}
+		return nil
+	}
+
+	known[addr] = fingerprint
+	data, err = json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Trusting the certificate of %s for the first time (SHA-256 %s)\n", addr, fingerprint)
+	return nil
+}
@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA はテストのサーバー証明書に署名する CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue は ServerAddr のホスト名で接続できるサーバー証明書を作成する
+func (ca testCA) issue(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		DNSNames:     []string{"server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// useTestTLS は caFile を UseTLS に渡し、テストの間だけ TLS の設定と設定ディレクトリを置き換える
+func useTestTLS(t *testing.T, caFile string) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	saved := serverTLS
+	t.Cleanup(func() { serverTLS = saved })
+	if err := UseTLS(caFile); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+// handshake は cert を提示するサーバーと、UseTLS で設定した TLS のハンドシェイクを行う
+// 証明書を拒否したクライアントの alert とサーバーの送信が互いを待たないよう、net.Pipe ではなく tcp で接続する
+func handshake(t *testing.T, cert tls.Certificate) error {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	err = tls.Client(client, serverTLS).Handshake()
+	client.Close()
+	<-done
+	return err
+}
+
+func TestUseTLSWithCA(t *testing.T) {
+	ca := newTestCA(t, "chat-server CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	useTestTLS(t, caFile)
+
+	if err := handshake(t, ca.issue(t)); err != nil {
+		t.Errorf("expected certificate signed by the CA to be accepted, got %v", err)
+	}
+	other := newTestCA(t, "other CA")
+	if err := handshake(t, other.issue(t)); err == nil {
+		t.Error("expected certificate signed by another CA to be rejected")
+	}
+
+	// CA を指定した時は known_servers.json を使わない
+	path, err := KnownServersPath()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no known servers to be saved, got %v", err)
+	}
+}
+
+func TestUseTLSRejectsInvalidCA(t *testing.T) {
+	dir := t.TempDir()
+	if err := UseTLS(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected missing CA file to be rejected")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := UseTLS(empty); err == nil {
+		t.Error("expected file without certificates to be rejected")
+	}
+}
+
+func TestUseTLSTrustOnFirstUse(t *testing.T) {
+	useTestTLS(t, "")
+	ca := newTestCA(t, "chat-server development")
+	cert := ca.issue(t)
+
+	// 初めて接続したサーバーの証明書は、確認できる CA がなくても保存して信頼する
+	if err := handshake(t, cert); err != nil {
+		t.Fatalf("expected first connection to be trusted, got %v", err)
+	}
+	path, err := KnownServersPath()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected known servers to be saved, got %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected mode 0600, got %o", perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	known := map[string]string{}
+	if err := json.Unmarshal(data, &known); err != nil || len(known[ServerAddr]) != 64 {
+		t.Errorf("expected fingerprint of %s, got %s (error %v)", ServerAddr, data, err)
+	}
+
+	// 同じ証明書なら次の接続も信頼し、変わった時は拒否する
+	if err := handshake(t, cert); err != nil {
+		t.Errorf("expected the same certificate to be trusted, got %v", err)
+	}
+	err = handshake(t, ca.issue(t))
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("expected changed certificate to be rejected, got %v", err)
+	}
+	again, _ := os.ReadFile(path)
+	if string(again) != string(data) {
+		t.Errorf("expected trusted fingerprint to be kept, got %s", again)
+	}
+}
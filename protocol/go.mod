@@ -0,0 +1,3 @@
+module github.com/okonomipizza/chat-protocol
+
+go 1.23.1
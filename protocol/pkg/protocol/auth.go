@@ -0,0 +1,256 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// Datagram authentication
+//
+// room_id と user_id を知っていれば、誰でもそのユーザーになりすましたデータグラムを送信できてしまう
+// セッションの Hello / Welcome で FeatureDatagramAuth が合意された場合に限り、次の仕組みでクライアントが送信するデータグラムを認証する
+//
+// - サーバーは作成・参加・再開のレスポンスで、そのセッションだけの SessionKey を発行する
+// - クライアントはすべてのデータグラムの operation に authFlag を立て、末尾に次の認証トレーラーを追加する
+//   | counter: 8byte (uint64, big endian) | mac: 32byte (HMAC-SHA256) |
+//   counter はセッションごとに 1 から始まり、データグラムを送信するたびに増やす
+//   mac は SessionKey を鍵とした、データグラムの先頭から counter までの HMAC-SHA256
+// - サーバーは mac が一致しないデータグラムと、既に受け付けた counter のデータグラム (再送攻撃) を破棄する
+//   udp では順番が入れ替わって届くこともあるので、最大の counter から ReplayWindowSize の範囲では受け付けていない counter も受け付ける
+//
+// サーバーは受け付けた counter を ReplayWindowSize ごとに SessionKey と一緒に保存し、再起動した後は保存した counter に ReplayWindowSize を加えたもの以下の
+// counter のデータグラムを受け付けない (ReplayGuard.Seed を参照)
+// そのため再起動した直後は、まだ受け付けていない counter のデータグラムも最大で ReplayWindowSize 個破棄することがある
+
+const (
+	authFlag byte = 0x40
+
+	datagramCounterLen = 8
+	datagramMACLen     = sha256.Size
+	// DatagramAuthLen は認証トレーラーの長さで、認証するデータグラムはこの分だけ MTU より短く分割する
+	DatagramAuthLen = datagramCounterLen + datagramMACLen
+
+	// SessionKeyLen は SessionKey に使う乱数の長さ (byte)
+	SessionKeyLen = 32
+	// ReplayWindowSize は最大の counter より小さくても受け付ける counter の範囲
+	ReplayWindowSize = 64
+)
+
+var (
+	// ErrDatagramNotAuthenticated は認証が必要なデータグラムに認証トレーラーがないことを示す
+	ErrDatagramNotAuthenticated = errors.New("datagram is not authenticated")
+	// ErrDatagramForged は認証トレーラーの mac が一致しないことを示す
+	ErrDatagramForged = errors.New("datagram authentication failed")
+)
+
+// datagramAuth は受信したデータグラムの認証トレーラー
+type datagramAuth struct {
+	counter uint64
+	mac     []byte
+	// signed は mac の計算に使われたデータグラムの先頭から counter までのバイト列
+	// 暗号化されていた時は counter より前のバイト列で、mac には GCM の tag が入る (encryption.go を参照)
+	signed    []byte
+	encrypted bool
+}
+
+// NewSessionKey はサーバーがセッションごとに発行する SessionKey を作成する
+// レスポンスには hex で表したものを入れる
+func NewSessionKey() ([]byte, error) {
+	key := make([]byte, SessionKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DecodeSessionKey は hex で表された SessionKey をバイト列に戻す
+func DecodeSessionKey(sessionKey string) ([]byte, error) {
+	key, err := hex.DecodeString(sessionKey)
+	if err != nil || len(key) != SessionKeyLen {
+		return nil, errors.New("invalid session key")
+	}
+	return key, nil
+}
+
+// DatagramSigner はクライアントが送信するデータグラムに認証トレーラーを追加する
+// NewDatagramSealer で作成した時は、代わりに message を暗号化してトレーラーを追加する
+// 複数のゴルーチンから同時に使用でき、nil の時はデータグラムをそのまま返す
+type DatagramSigner struct {
+	key     []byte
+	aead    cipher.AEAD
+	mu      sync.Mutex
+	counter uint64
+}
+
+// NewDatagramSigner は SessionKey で認証トレーラーを作成する DatagramSigner を作成する
+func NewDatagramSigner(key []byte) *DatagramSigner {
+	return &DatagramSigner{key: key}
+}
+
+// Sign は CreateChatRequest などで作成したデータグラムに、次の counter の認証トレーラーを追加する
+func (s *DatagramSigner) Sign(datagram []byte) ([]byte, error) {
+	if s == nil {
+		return datagram, nil
+	}
+	if len(datagram) < chatHeaderLen {
+		return nil, &ChatFormatError{Field: "header", Err: ErrChatTruncated}
+	}
+
+	s.mu.Lock()
+	s.counter++
+	counter := s.counter
+	s.mu.Unlock()
+
+	if s.aead != nil {
+		return sealChatDatagram(s.aead, datagram, counter)
+	}
+	signed := make([]byte, 0, len(datagram)+DatagramAuthLen)
+	signed = append(signed, datagram...)
+	signed[1] |= authFlag
+	signed = binary.BigEndian.AppendUint64(signed, counter)
+	return append(signed, datagramMAC(s.key, signed)...), nil
+}
+
+// Authenticated は受信したデータグラムに認証トレーラーがあったかどうかを返す
+func (chat ChatMessage) Authenticated() bool {
+	return chat.auth != nil
+}
+
+// Verify は受信したデータグラムの mac を SessionKey で確認し、一致すれば counter を返す
+// 暗号化されていたデータグラムは復号し、message を平文に戻した ChatMessage を返す
+// counter が既に受け付けたものかどうかは ReplayGuard で確認する
+func (chat ChatMessage) Verify(key []byte) (ChatMessage, uint64, error) {
+	if chat.auth == nil {
+		return ChatMessage{}, 0, ErrDatagramNotAuthenticated
+	}
+	if chat.auth.encrypted {
+		opened, err := chat.open(key)
+		if err != nil {
+			return ChatMessage{}, 0, err
+		}
+		return opened, chat.auth.counter, nil
+	}
+	if !hmac.Equal(chat.auth.mac, datagramMAC(key, chat.auth.signed)) {
+		return ChatMessage{}, 0, ErrDatagramForged
+	}
+	return chat, chat.auth.counter, nil
+}
+
+// splitDatagramAuth は operation に authFlag か encryptFlag が立っている時に末尾のトレーラーを取り出し、
+// flag を取り除いた operation とトレーラーより前のバイト列を返す
+func splitDatagramAuth(datagram []byte) (byte, []byte, *datagramAuth, error) {
+	operation := datagram[1]
+	if operation&authFlag == 0 && operation&encryptFlag != 0 {
+		if len(datagram) < chatHeaderLen+DatagramSealLen {
+			return 0, nil, nil, &ChatFormatError{Field: "auth", Err: ErrChatTruncated}
+		}
+		body := len(datagram) - DatagramSealLen
+		auth := &datagramAuth{
+			counter:   binary.BigEndian.Uint64(datagram[body : body+datagramCounterLen]),
+			mac:       datagram[body+datagramCounterLen:],
+			signed:    datagram[:body],
+			encrypted: true,
+		}
+		return operation &^ encryptFlag, datagram[:body], auth, nil
+	}
+	if operation&authFlag == 0 {
+		return operation, datagram, nil, nil
+	}
+	if len(datagram) < chatHeaderLen+DatagramAuthLen {
+		return 0, nil, nil, &ChatFormatError{Field: "auth", Err: ErrChatTruncated}
+	}
+
+	body := len(datagram) - DatagramAuthLen
+	auth := &datagramAuth{
+		counter: binary.BigEndian.Uint64(datagram[body : body+datagramCounterLen]),
+		mac:     datagram[body+datagramCounterLen:],
+		signed:  datagram[:body+datagramCounterLen],
+	}
+	return operation &^ authFlag, datagram[:body], auth, nil
+}
+
+func datagramMAC(key []byte, signed []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+// replayWindow は 1 つのセッションについて、受け付けた counter のうち最大のものと、
+// そこから ReplayWindowSize の範囲で受け付けた counter を bit で保持する
+type replayWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+// ReplayGuard は送信元ごとに受け付けた counter を記録し、同じ counter のデータグラムを二度受け付けないようにする
+// 複数のゴルーチンから同時に使用できる
+type ReplayGuard struct {
+	mu      sync.Mutex
+	windows map[string]*replayWindow
+}
+
+// NewReplayGuard は空の ReplayGuard を作成する
+func NewReplayGuard() *ReplayGuard {
+	return &ReplayGuard{windows: make(map[string]*replayWindow)}
+}
+
+// Accept は senderID からの counter を初めて受け付ける時に true を返して記録する
+// 既に受け付けた counter や、最大の counter より ReplayWindowSize 以上古い counter には false を返す
+func (g *ReplayGuard) Accept(senderID string, counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	window, exists := g.windows[senderID]
+	if !exists {
+		g.windows[senderID] = &replayWindow{highest: counter, seen: 1}
+		return true
+	}
+
+	if counter > window.highest {
+		shift := counter - window.highest
+		if shift >= ReplayWindowSize {
+			window.seen = 0
+		} else {
+			window.seen <<= shift
+		}
+		window.seen |= 1
+		window.highest = counter
+		return true
+	}
+
+	offset := window.highest - counter
+	if offset >= ReplayWindowSize || window.seen&(1<<offset) != 0 {
+		return false
+	}
+	window.seen |= 1 << offset
+	return true
+}
+
+// Seed は senderID の記録がない時に、highest までの counter をすべて受け付けたものとして記録を始める
+// サーバーが再起動する前に受け付けた counter のデータグラムを、再起動した後に送り直されても受け付けないために使う
+// 既に記録がある時は何もしない
+func (g *ReplayGuard) Seed(senderID string, highest uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, exists := g.windows[senderID]; exists {
+		return
+	}
+	g.windows[senderID] = &replayWindow{highest: highest, seen: ^uint64(0)}
+}
+
+// Forget は senderID の記録を消す
+// セッションを再開して SessionKey が変わった時や、チャットルームから外れた時に呼ぶ
+func (g *ReplayGuard) Forget(senderID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.windows, senderID)
+}
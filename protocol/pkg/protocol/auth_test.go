@@ -0,0 +1,236 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestSigner(t *testing.T) (*DatagramSigner, []byte) {
+	t.Helper()
+	sessionKey, err := NewSessionKey()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	key, err := DecodeSessionKey(hex.EncodeToString(sessionKey))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return NewDatagramSigner(key), key
+}
+
+func TestSignAndVerifyDatagram(t *testing.T) {
+	signer, key := newTestSigner(t)
+	chatMessage := ChatMessage{
+		ChatRoomID: "room-id-123",
+		UserID:     "user-id-123",
+		Message:    "Hello, World!",
+		Fragment:   Fragment{MessageID: 1, Index: 0, Count: 2},
+	}
+	request, err := chatMessage.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for expectedCounter := uint64(1); expectedCounter <= 2; expectedCounter++ {
+		signed, err := signer.Sign(request)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(signed) != len(request)+DatagramAuthLen {
+			t.Fatalf("expected length %d, got %d", len(request)+DatagramAuthLen, len(signed))
+		}
+
+		parsed, err := ParseChatRequest(signed)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !parsed.Authenticated() {
+			t.Fatal("expected datagram to be authenticated")
+		}
+		if parsed.Operation != ChatOperationSendMessage || parsed.Message != chatMessage.Message || parsed.Fragment != chatMessage.Fragment {
+			t.Errorf("unexpected message %+v", parsed)
+		}
+		_, counter, err := parsed.Verify(key)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if counter != expectedCounter {
+			t.Errorf("expected counter %d, got %d", expectedCounter, counter)
+		}
+	}
+
+	// 署名する前のデータグラムは書き換えられていない
+	if request[1]&authFlag != 0 {
+		t.Error("expected Sign not to modify the original datagram")
+	}
+}
+
+func TestVerifyRejectsForgedDatagram(t *testing.T) {
+	signer, key := newTestSigner(t)
+	request, err := ChatMessage{ChatRoomID: "room-id-123", UserID: "user-id-123", Message: "Hello"}.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	signed, err := signer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// メッセージを書き換える
+	tampered := bytes.Clone(signed)
+	tampered[len(request)-1] ^= 0xff
+	parsed, err := ParseChatRequest(tampered)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, _, err := parsed.Verify(key); !errors.Is(err, ErrDatagramForged) {
+		t.Errorf("expected ErrDatagramForged, got %v", err)
+	}
+
+	// 別の鍵で確認する
+	_, otherKey := newTestSigner(t)
+	parsed, err = ParseChatRequest(signed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, _, err := parsed.Verify(otherKey); !errors.Is(err, ErrDatagramForged) {
+		t.Errorf("expected ErrDatagramForged, got %v", err)
+	}
+
+	// 認証トレーラーのないデータグラム
+	parsed, err = ParseChatRequest(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Authenticated() {
+		t.Error("expected datagram not to be authenticated")
+	}
+	if _, _, err := parsed.Verify(key); !errors.Is(err, ErrDatagramNotAuthenticated) {
+		t.Errorf("expected ErrDatagramNotAuthenticated, got %v", err)
+	}
+}
+
+func TestParseChatRequestTruncatedAuth(t *testing.T) {
+	datagram := []byte{ChatProtocolVersion, ChatOperationSendMessage | authFlag, 0, 0, 0, 0, 1, 2, 3}
+	_, err := ParseChatRequest(datagram)
+	var formatErr *ChatFormatError
+	if !errors.As(err, &formatErr) || formatErr.Field != "auth" || !errors.Is(err, ErrChatTruncated) {
+		t.Errorf("expected truncated auth error, got %v", err)
+	}
+}
+
+func TestSignMaxLengthDatagram(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	chatMessage := ChatMessage{
+		ChatRoomID: strings.Repeat("r", ChatIDBytesMaxLen),
+		UserID:     strings.Repeat("u", ChatIDBytesMaxLen),
+		Message:    strings.Repeat("m", ChatMessageBytesMaxLen),
+		Fragment:   Fragment{MessageID: 1, Index: 0, Count: 2},
+	}
+	request, err := chatMessage.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	signed, err := signer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(signed) != ChatProtocolMaxLen {
+		t.Errorf("expected length %d, got %d", ChatProtocolMaxLen, len(signed))
+	}
+	if _, err := ParseChatRequest(signed); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestNilDatagramSigner(t *testing.T) {
+	var signer *DatagramSigner
+	request := []byte{ChatProtocolVersion, ChatOperationHeartbeat, 0, 0, 0, 0}
+	signed, err := signer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(signed, request) {
+		t.Errorf("expected %v, got %v", request, signed)
+	}
+}
+
+func TestDecodeSessionKey(t *testing.T) {
+	for _, sessionKey := range []string{"", "zz", strings.Repeat("ab", SessionKeyLen-1)} {
+		if _, err := DecodeSessionKey(sessionKey); err == nil {
+			t.Errorf("expected error for %q", sessionKey)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	guard := NewReplayGuard()
+	steps := []struct {
+		counter  uint64
+		expected bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{3 + ReplayWindowSize, true},
+		{3, false},
+		{4, true},
+		{4, false},
+		{3 + ReplayWindowSize, false},
+	}
+	for _, step := range steps {
+		if got := guard.Accept("user-id-123", step.counter); got != step.expected {
+			t.Errorf("Accept(%d) = %v, expected %v", step.counter, got, step.expected)
+		}
+	}
+
+	// 送信元ごとに記録する
+	if !guard.Accept("user-id-456", 1) {
+		t.Error("expected another sender to be accepted")
+	}
+
+	guard.Forget("user-id-123")
+	if !guard.Accept("user-id-123", 1) {
+		t.Error("expected counter to be accepted after Forget")
+	}
+}
+
+func TestReplayGuardSeed(t *testing.T) {
+	// 再起動する前に 100 まで受け付けていた送信元は、それ以下の counter を受け付けない
+	guard := NewReplayGuard()
+	guard.Seed("user-id-123", 100)
+	steps := []struct {
+		counter  uint64
+		expected bool
+	}{
+		{100, false},
+		{99, false},
+		{1, false},
+		{102, true},
+		{101, true},
+		{101, false},
+	}
+	for _, step := range steps {
+		if got := guard.Accept("user-id-123", step.counter); got != step.expected {
+			t.Errorf("Accept(%d) = %v, expected %v", step.counter, got, step.expected)
+		}
+	}
+
+	// 既に記録がある時は記録を変えない
+	guard.Seed("user-id-123", 200)
+	if !guard.Accept("user-id-123", 150) {
+		t.Error("expected Seed not to overwrite an existing window")
+	}
+
+	// SessionKey を発行し直した送信元は 0 から始める
+	guard.Seed("user-id-456", 0)
+	if !guard.Accept("user-id-456", 1) {
+		t.Error("expected counter 1 to be accepted after seeding 0")
+	}
+}
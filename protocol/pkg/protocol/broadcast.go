@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Broadcast はサーバーからチャットルームのメンバーへ配信するデータグラム、"Chat Broadcast Protocol"の構造体として定義されている
+// | version: 1byte | kind: 1byte | room_id_size: 1byte | sender_id_size: 1byte | sender_name_size: 1byte |
+// | timestamp: 8byte (int64, unix milli秒, big endian) | sequence: 8byte (uint64, big endian) | message_size: 2byte (uint16, big endian) | (fragment header: 8byte) | payload |
+// payload: room_id(uuid) + sender_id(uuid) + sender_name + message
+// システムからの通知など送信者がいない場合は sender_id と sender_name は空になる
+// データグラム 1 つに収まらないメッセージは分割して配信する (fragment.go を参照)
+// FeatureEncryption が合意されたセッションでは、message を暗号化して末尾にトレーラーを追加する (encryption.go を参照)
+type Broadcast struct {
+	Kind       byte
+	RoomID     string
+	SenderID   string
+	SenderName string
+	// Timestamp はサーバーがメッセージを受け付けた時刻
+	Timestamp time.Time
+	// Sequence はチャットルームごとに 1 から単調増加する番号
+	// 0 の時は、履歴に残さずそのユーザーだけへ送る通知 (DirectNotice) であることを表す
+	Sequence uint64
+	Message  string
+	// Fragment は分割されたメッセージのフラグメントである時に、その位置を表す
+	Fragment Fragment
+}
+
+const (
+	BroadcastProtocolVersion byte = 1
+
+	broadcastHeaderLen      = 23
+	BroadcastProtocolMaxLen = broadcastHeaderLen + fragmentHeaderLen + 2*ChatIDBytesMaxLen + UserNameBytesMaxLen + ChatMessageBytesMaxLen + BroadcastSealLen
+)
+
+const (
+	BroadcastKindUserMessage byte = iota
+	BroadcastKindJoin
+	BroadcastKindLeave
+	BroadcastKindRoomClosed
+	BroadcastKindSystemNotice
+	// BroadcastKindHostChanged は sender がチャットルームの新しいホストになったことを表す
+	BroadcastKindHostChanged
+)
+
+// DirectNotice はチャットルームの配信の順番に含めずに、サーバーが 1 人のユーザーへ送る BroadcastKindSystemNotice を作成する
+// クライアントは ack を返さず、受信した時にそのまま表示する
+func DirectNotice(roomID string, message string, now time.Time) Broadcast {
+	return Broadcast{Kind: BroadcastKindSystemNotice, RoomID: roomID, Timestamp: now, Message: message}
+}
+
+// IsDirectNotice は DirectNotice で作成された通知かどうかを返す
+func (b Broadcast) IsDirectNotice() bool {
+	return b.Sequence == 0
+}
+
+func (b Broadcast) validate() error {
+	if len(b.RoomID) > ChatIDBytesMaxLen {
+		return &ChatFormatError{Field: "room_id", Err: ErrChatTooLong}
+	}
+	if len(b.SenderID) > ChatIDBytesMaxLen {
+		return &ChatFormatError{Field: "sender_id", Err: ErrChatTooLong}
+	}
+	if len(b.SenderName) > UserNameBytesMaxLen {
+		return &ChatFormatError{Field: "sender_name", Err: ErrChatTooLong}
+	}
+	if len(b.Message) > ChatMessageBytesMaxLen {
+		return &ChatFormatError{Field: "message", Err: ErrChatTooLong}
+	}
+	if err := b.Fragment.validate(); err != nil {
+		return &ChatFormatError{Field: "fragment", Err: err}
+	}
+	return nil
+}
+
+// CreateBroadcast は Broadcast をサーバーからクライアントへ送信するためのバイト列に変換する
+func (b Broadcast) CreateBroadcast() ([]byte, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, broadcastHeaderLen+fragmentHeaderLen+len(b.RoomID)+len(b.SenderID)+len(b.SenderName)+len(b.Message))
+
+	kind := b.Kind
+	if b.Fragment.IsFragmented() {
+		kind |= fragmentFlag
+	}
+	buf = append(buf, BroadcastProtocolVersion, kind, byte(len(b.RoomID)), byte(len(b.SenderID)), byte(len(b.SenderName)))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.Timestamp.UnixMilli()))
+	buf = binary.BigEndian.AppendUint64(buf, b.Sequence)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b.Message)))
+	buf = appendFragmentHeader(buf, b.Fragment)
+
+	buf = append(buf, b.RoomID...)
+	buf = append(buf, b.SenderID...)
+	buf = append(buf, b.SenderName...)
+	buf = append(buf, b.Message...)
+
+	return buf, nil
+}
+
+// ParseBroadcast はサーバーから受信したバイト列を解析して Broadcast に変換する
+// 失敗した時は *ChatFormatError を返す
+func ParseBroadcast(datagram []byte) (Broadcast, error) {
+	if len(datagram) < broadcastHeaderLen {
+		return Broadcast{}, &ChatFormatError{Field: "header", Err: ErrChatTruncated}
+	}
+	if len(datagram) > BroadcastProtocolMaxLen {
+		return Broadcast{}, &ChatFormatError{Field: "datagram", Err: ErrChatTooLong}
+	}
+
+	version := datagram[0]
+	if version != BroadcastProtocolVersion {
+		return Broadcast{}, &ChatFormatError{Field: "version", Err: fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)}
+	}
+
+	roomIDSize := int(datagram[2])
+	senderIDSize := int(datagram[3])
+	senderNameSize := int(datagram[4])
+	timestamp := int64(binary.BigEndian.Uint64(datagram[5:13]))
+	sequence := binary.BigEndian.Uint64(datagram[13:21])
+	messageSize := int(binary.BigEndian.Uint16(datagram[21:broadcastHeaderLen]))
+	kind, fragment, payload, err := parseFragmentHeader(datagram[1], datagram[broadcastHeaderLen:])
+	if err != nil {
+		return Broadcast{}, err
+	}
+
+	fields := []struct {
+		name string
+		size int
+		max  int
+	}{
+		{"room_id", roomIDSize, ChatIDBytesMaxLen},
+		{"sender_id", senderIDSize, ChatIDBytesMaxLen},
+		{"sender_name", senderNameSize, UserNameBytesMaxLen},
+		{"message", messageSize, ChatMessageBytesMaxLen},
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		if field.size > field.max {
+			return Broadcast{}, &ChatFormatError{Field: field.name, Err: ErrChatTooLong}
+		}
+		if len(payload) < field.size {
+			return Broadcast{}, &ChatFormatError{Field: field.name, Err: ErrChatTruncated}
+		}
+		values[i] = string(payload[:field.size])
+		payload = payload[field.size:]
+	}
+	if len(payload) > 0 {
+		return Broadcast{}, &ChatFormatError{Field: "datagram", Err: ErrChatTrailingData}
+	}
+
+	return Broadcast{
+		Kind:       kind,
+		RoomID:     values[0],
+		SenderID:   values[1],
+		SenderName: values[2],
+		Timestamp:  time.UnixMilli(timestamp),
+		Sequence:   sequence,
+		Message:    values[3],
+		Fragment:   fragment,
+	}, nil
+}
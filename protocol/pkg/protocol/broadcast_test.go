@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroadcastRoundTrip(t *testing.T) {
+	timestamp := time.UnixMilli(1760000000123)
+
+	broadcasts := []Broadcast{
+		{
+			Kind:       BroadcastKindUserMessage,
+			RoomID:     "123e4567-e89b-12d3-a456-426614174000",
+			SenderID:   "123e4567-e89b-12d3-a456-426614174001",
+			SenderName: "Alice",
+			Timestamp:  timestamp,
+			Sequence:   42,
+			Message:    "こんにちは",
+		},
+		{Kind: BroadcastKindJoin, RoomID: "room", SenderID: "user", SenderName: "Bob", Timestamp: timestamp, Sequence: 1},
+		{Kind: BroadcastKindLeave, RoomID: "room", SenderID: "user", SenderName: "Bob", Timestamp: timestamp, Sequence: 2},
+		{Kind: BroadcastKindRoomClosed, RoomID: "room", Timestamp: timestamp, Sequence: 3},
+		{Kind: BroadcastKindSystemNotice, RoomID: "room", Timestamp: timestamp, Sequence: 1<<64 - 1, Message: "maintenance"},
+		{
+			Kind:       BroadcastKindUserMessage,
+			RoomID:     strings.Repeat("r", ChatIDBytesMaxLen),
+			SenderID:   strings.Repeat("u", ChatIDBytesMaxLen),
+			SenderName: strings.Repeat("n", UserNameBytesMaxLen),
+			Timestamp:  timestamp,
+			Message:    strings.Repeat("m", ChatMessageBytesMaxLen),
+		},
+	}
+
+	for _, original := range broadcasts {
+		data, err := original.CreateBroadcast()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(data) > BroadcastProtocolMaxLen {
+			t.Fatalf("expected length to be <= %d, got %d", BroadcastProtocolMaxLen, len(data))
+		}
+
+		parsed, err := ParseBroadcast(data)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !parsed.Timestamp.Equal(original.Timestamp) {
+			t.Errorf("expected timestamp %v, got %v", original.Timestamp, parsed.Timestamp)
+		}
+		parsed.Timestamp = original.Timestamp
+		if parsed != original {
+			t.Errorf("expected %+v, got %+v", original, parsed)
+		}
+	}
+}
+
+func TestCreateBroadcastTooLong(t *testing.T) {
+	b := Broadcast{RoomID: "room", SenderName: strings.Repeat("n", UserNameBytesMaxLen+1)}
+	_, err := b.CreateBroadcast()
+	var formatErr *ChatFormatError
+	if !errors.As(err, &formatErr) || formatErr.Field != "sender_name" || !errors.Is(err, ErrChatTooLong) {
+		t.Errorf("expected sender_name too long error, got %v", err)
+	}
+}
+
+func TestParseBroadcastErrors(t *testing.T) {
+	valid, err := Broadcast{Kind: BroadcastKindUserMessage, RoomID: "room", SenderID: "user", SenderName: "Alice", Message: "hello"}.CreateBroadcast()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	unknownVersion := bytes.Clone(valid)
+	unknownVersion[0] = BroadcastProtocolVersion + 1
+
+	cases := []struct {
+		name  string
+		data  []byte
+		field string
+		err   error
+	}{
+		{"short header", valid[:broadcastHeaderLen-1], "header", ErrChatTruncated},
+		{"unknown version", unknownVersion, "version", ErrUnsupportedVersion},
+		{"truncated sender name", valid[:broadcastHeaderLen+10], "sender_name", ErrChatTruncated},
+		{"truncated message", valid[:len(valid)-1], "message", ErrChatTruncated},
+		{"trailing data", append(bytes.Clone(valid), 0), "datagram", ErrChatTrailingData},
+	}
+
+	for _, c := range cases {
+		_, err := ParseBroadcast(c.data)
+		var formatErr *ChatFormatError
+		if !errors.As(err, &formatErr) || formatErr.Field != c.field || !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %s %v, got %v", c.name, c.field, c.err, err)
+		}
+	}
+}
+
+func TestDirectNotice(t *testing.T) {
+	notice := DirectNotice("room-id-123", "slow down", time.UnixMilli(1700000000000))
+	datagram, err := notice.CreateBroadcast()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseBroadcast(datagram)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !parsed.IsDirectNotice() || parsed.Kind != BroadcastKindSystemNotice || parsed.Message != "slow down" {
+		t.Errorf("unexpected notice %+v", parsed)
+	}
+	if (Broadcast{Kind: BroadcastKindSystemNotice, Sequence: 1}).IsDirectNotice() {
+		t.Error("expected sequenced broadcast not to be a direct notice")
+	}
+}
@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ChatMessageはクライアント・サーバー間でチャットメッセージをやり取りするためのカスタムプロトコル、"Chat Message Protocol"の構造体として定義されている
+// | version: 1byte | operation: 1byte | chatroom_id_size: 1byte | user_id_size: 1byte | message_size: 2byte (uint16, big endian) | (fragment header: 8byte) | payload | (auth trailer: 40byte) |
+// payload: chatroom_id(uuid) + user_id(uuid) + message
+// idには、uuidを採用しており、その長さは最大 36 bytes
+// messageが取りうる長さは 0 ~ 4020 byte で、プロトコルの長さは最大 4146 byte
+// それより長いメッセージは分割して送信する (fragment.go を参照)
+// FeatureDatagramAuth が合意されたセッションでは、末尾に認証トレーラーを追加する (auth.go を参照)
+// FeatureEncryption が合意されたセッションでは、代わりに message を暗号化して末尾にトレーラーを追加する (encryption.go を参照)
+type ChatMessage struct {
+	Operation  byte
+	ChatRoomID string
+	UserID     string
+	Message    string
+	// Fragment は分割されたメッセージのフラグメントである時に、その位置を表す
+	Fragment Fragment
+
+	// auth は受信したデータグラムに認証トレーラーがあった時に、その内容を保持する
+	auth *datagramAuth
+}
+
+const (
+	ChatProtocolVersion byte = 1
+
+	chatHeaderLen          = 6
+	ChatIDBytesMaxLen      = 36
+	ChatMessageBytesMaxLen = 4020
+	ChatProtocolMaxLen     = chatHeaderLen + fragmentHeaderLen + 2*ChatIDBytesMaxLen + ChatMessageBytesMaxLen + DatagramAuthLen
+)
+
+const (
+	ChatOperationSendMessage byte = iota
+	// ChatOperationSendUDPAddr は送信元のアドレスを配信先として登録する
+	// message には TokenProof が入り、ResumeToken が発行されていない時やデータグラムを認証する時は空 (session.go, auth.go を参照)
+	ChatOperationSendUDPAddr
+	// ChatOperationExit は tcp で退出できなかったクライアントが、代わりにチャットルームからの退出を知らせる
+	// message には SendUDPAddr と同じく TokenProof が入る
+	ChatOperationExit
+	// ChatOperationAck は reliable delivery が有効な時に、配信データグラムを受信したことをサーバーへ知らせる
+	// message には受信した配信の sequence が 8 byte (uint64, big endian)、フラグメントの index が 2 byte (uint16, big endian) で入る
+	ChatOperationAck
+	// ChatOperationHeartbeat はチャットルームに参加し続けていることをサーバーへ知らせる (heartbeat.go を参照)
+	// message には TokenProof が入り、ResumeToken が発行されていない時やデータグラムを認証する時は空 (session.go, auth.go を参照)
+	ChatOperationHeartbeat
+)
+
+const ackMessageLen = 10
+
+var (
+	// ErrChatTruncated はバイト列がヘッダに記載された長さに満たないことを示す
+	ErrChatTruncated = errors.New("truncated")
+	// ErrChatTooLong はフィールドの長さが許容される最大値を超えていることを示す
+	ErrChatTooLong = errors.New("too long")
+	// ErrChatTrailingData はヘッダに記載された長さの後に余分なバイト列が続いていることを示す
+	ErrChatTrailingData = errors.New("unexpected trailing data")
+)
+
+// ChatFormatError は Chat Message Protocol のエンコード・デコードに失敗したフィールドと原因を表す
+// 原因は errors.Is で ErrChatTruncated などと比較できる
+type ChatFormatError struct {
+	Field string
+	Err   error
+}
+
+func (e *ChatFormatError) Error() string {
+	return fmt.Sprintf("invalid chat message %s: %v", e.Field, e.Err)
+}
+
+func (e *ChatFormatError) Unwrap() error {
+	return e.Err
+}
+
+// validate はそれぞれのフィールドが Chat Message Protocol で表現できる長さに収まっているかを確認する
+func (chat ChatMessage) validate() error {
+	if len(chat.ChatRoomID) > ChatIDBytesMaxLen {
+		return &ChatFormatError{Field: "chatroom_id", Err: ErrChatTooLong}
+	}
+	if len(chat.UserID) > ChatIDBytesMaxLen {
+		return &ChatFormatError{Field: "user_id", Err: ErrChatTooLong}
+	}
+	if len(chat.Message) > ChatMessageBytesMaxLen {
+		return &ChatFormatError{Field: "message", Err: ErrChatTooLong}
+	}
+	if err := chat.Fragment.validate(); err != nil {
+		return &ChatFormatError{Field: "fragment", Err: err}
+	}
+	return nil
+}
+
+// CreateChatRequest は ChatMessage をクライアントからサーバーへ送信するためのバイト列に変換する
+func (chat ChatMessage) CreateChatRequest(operation byte) ([]byte, error) {
+	if err := chat.validate(); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, chatHeaderLen+fragmentHeaderLen+len(chat.ChatRoomID)+len(chat.UserID)+len(chat.Message))
+
+	if chat.Fragment.IsFragmented() {
+		operation |= fragmentFlag
+	}
+	buf = append(buf, ChatProtocolVersion, operation, byte(len(chat.ChatRoomID)), byte(len(chat.UserID)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(chat.Message)))
+	buf = appendFragmentHeader(buf, chat.Fragment)
+
+	buf = append(buf, chat.ChatRoomID...)
+	buf = append(buf, chat.UserID...)
+	buf = append(buf, chat.Message...)
+
+	return buf, nil
+}
+
+// ParseChatRequest は udp で受信したバイト列を解析して ChatMessage に変換する
+// 失敗した時は *ChatFormatError を返す
+func ParseChatRequest(message []byte) (ChatMessage, error) {
+	if len(message) < chatHeaderLen {
+		return ChatMessage{}, &ChatFormatError{Field: "header", Err: ErrChatTruncated}
+	}
+	if len(message) > ChatProtocolMaxLen {
+		return ChatMessage{}, &ChatFormatError{Field: "datagram", Err: ErrChatTooLong}
+	}
+
+	version := message[0]
+	if version != ChatProtocolVersion {
+		return ChatMessage{}, &ChatFormatError{Field: "version", Err: fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)}
+	}
+
+	operation, message, auth, err := splitDatagramAuth(message)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+
+	chatRoomIDSize := int(message[2])
+	userIDSize := int(message[3])
+	messageSize := int(binary.BigEndian.Uint16(message[4:chatHeaderLen]))
+	operation, fragment, payload, err := parseFragmentHeader(operation, message[chatHeaderLen:])
+	if err != nil {
+		return ChatMessage{}, err
+	}
+
+	if chatRoomIDSize > ChatIDBytesMaxLen {
+		return ChatMessage{}, &ChatFormatError{Field: "chatroom_id", Err: ErrChatTooLong}
+	}
+	if userIDSize > ChatIDBytesMaxLen {
+		return ChatMessage{}, &ChatFormatError{Field: "user_id", Err: ErrChatTooLong}
+	}
+	if messageSize > ChatMessageBytesMaxLen {
+		return ChatMessage{}, &ChatFormatError{Field: "message", Err: ErrChatTooLong}
+	}
+
+	if len(payload) < chatRoomIDSize {
+		return ChatMessage{}, &ChatFormatError{Field: "chatroom_id", Err: ErrChatTruncated}
+	}
+	chatRoomID := string(payload[:chatRoomIDSize])
+	payload = payload[chatRoomIDSize:]
+
+	if len(payload) < userIDSize {
+		return ChatMessage{}, &ChatFormatError{Field: "user_id", Err: ErrChatTruncated}
+	}
+	userID := string(payload[:userIDSize])
+	payload = payload[userIDSize:]
+
+	if len(payload) < messageSize {
+		return ChatMessage{}, &ChatFormatError{Field: "message", Err: ErrChatTruncated}
+	}
+	if len(payload) > messageSize {
+		return ChatMessage{}, &ChatFormatError{Field: "datagram", Err: ErrChatTrailingData}
+	}
+	chatMessage := string(payload[:messageSize])
+
+	return ChatMessage{
+		Operation:  operation,
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		Message:    chatMessage,
+		Fragment:   fragment,
+		auth:       auth,
+	}, nil
+}
+
+// CreateAckRequest は sequence 番号の配信 (分割されている場合は fragmentIndex 番目のフラグメント) を受信したことを知らせる ack のバイト列を作成する
+// 分割されていない配信の fragmentIndex は 0
+func CreateAckRequest(chatRoomID string, userID string, sequence uint64, fragmentIndex uint16) ([]byte, error) {
+	message := binary.BigEndian.AppendUint64(nil, sequence)
+	message = binary.BigEndian.AppendUint16(message, fragmentIndex)
+	ack := ChatMessage{
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		Message:    string(message),
+	}
+	return ack.CreateChatRequest(ChatOperationAck)
+}
+
+// AckSequence は ack の message から、受信が確認された配信の sequence 番号とフラグメントの index を取り出す
+func (chat ChatMessage) AckSequence() (uint64, uint16, error) {
+	if chat.Operation != ChatOperationAck {
+		return 0, 0, fmt.Errorf("expected ack, got operation %d", chat.Operation)
+	}
+	if len(chat.Message) < ackMessageLen {
+		return 0, 0, &ChatFormatError{Field: "message", Err: ErrChatTruncated}
+	}
+	if len(chat.Message) > ackMessageLen {
+		return 0, 0, &ChatFormatError{Field: "message", Err: ErrChatTrailingData}
+	}
+	message := []byte(chat.Message)
+	return binary.BigEndian.Uint64(message[:8]), binary.BigEndian.Uint16(message[8:ackMessageLen]), nil
+}
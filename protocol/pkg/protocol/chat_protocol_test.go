@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCreateChatRequest(t *testing.T) {
+	chatMessage := ChatMessage{
+		Operation:  ChatOperationSendMessage,
+		ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+		UserID:     "123e4567-e89b-12d3-a456-426614174001",
+		Message:    "Hello, World!",
+	}
+
+	data, err := chatMessage.CreateChatRequest(chatMessage.Operation)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(data) > ChatProtocolMaxLen {
+		t.Fatalf("expected length to be <= %d, got %d", ChatProtocolMaxLen, len(data))
+	}
+
+	if data[0] != ChatProtocolVersion {
+		t.Errorf("expected version %d, got %d", ChatProtocolVersion, data[0])
+	}
+
+	if data[1] != chatMessage.Operation {
+		t.Errorf("expected operation %d, got %d", chatMessage.Operation, data[1])
+	}
+
+	if data[2] != byte(len(chatMessage.ChatRoomID)) {
+		t.Errorf("expected chatRoomID size %d, got %d", len(chatMessage.ChatRoomID), data[2])
+	}
+	if data[3] != byte(len(chatMessage.UserID)) {
+		t.Errorf("expected userID size %d, got %d", len(chatMessage.UserID), data[3])
+	}
+	if size := binary.BigEndian.Uint16(data[4:6]); int(size) != len(chatMessage.Message) {
+		t.Errorf("expected message size %d, got %d", len(chatMessage.Message), size)
+	}
+}
+
+func TestParseChatRequest(t *testing.T) {
+	chatMessage := ChatMessage{
+		Operation:  ChatOperationSendMessage,
+		ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+		UserID:     "123e4567-e89b-12d3-a456-426614174001",
+		Message:    "Hello, World!",
+	}
+
+	data, err := chatMessage.CreateChatRequest(chatMessage.Operation)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	parsedMessage, err := ParseChatRequest(data)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if parsedMessage.Operation != chatMessage.Operation {
+		t.Errorf("expected operation %d, got %d", chatMessage.Operation, parsedMessage.Operation)
+	}
+	if parsedMessage.ChatRoomID != chatMessage.ChatRoomID {
+		t.Errorf("expected chatRoomID %s, got %s", chatMessage.ChatRoomID, parsedMessage.ChatRoomID)
+	}
+	if parsedMessage.UserID != chatMessage.UserID {
+		t.Errorf("expected userID %s, got %s", chatMessage.UserID, parsedMessage.UserID)
+	}
+	if parsedMessage.Message != chatMessage.Message {
+		t.Errorf("expected message %s, got %s", chatMessage.Message, parsedMessage.Message)
+	}
+}
+
+func TestCreateChatRequestBytes(t *testing.T) {
+	chat := ChatMessage{
+		Operation:  ChatOperationSendMessage,
+		ChatRoomID: "12345678-1234-1234-1234-123456789012", // UUID
+		UserID:     "87654321-4321-4321-4321-210987654321", // UUID
+		Message:    "Hello, world!",
+	}
+
+	expected := []byte{
+		ChatProtocolVersion, ChatOperationSendMessage, 36, 36, 0, byte(len([]byte(chat.Message))),
+	}
+
+	expected = append(expected, []byte(chat.ChatRoomID)...)
+	expected = append(expected, []byte(chat.UserID)...)
+	expected = append(expected, []byte(chat.Message)...)
+
+	actual, err := chat.CreateChatRequest(ChatOperationSendMessage)
+
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+// 0 byte から ChatMessageBytesMaxLen byte までの全ての長さのメッセージが往復できることを確認する
+func TestChatRequestRoundTripAllSizes(t *testing.T) {
+	for size := 0; size <= ChatMessageBytesMaxLen; size++ {
+		original := ChatMessage{
+			Operation:  ChatOperationSendMessage,
+			ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+			UserID:     "123e4567-e89b-12d3-a456-426614174001",
+			Message:    strings.Repeat("a", size),
+		}
+
+		data, err := original.CreateChatRequest(original.Operation)
+		if err != nil {
+			t.Fatalf("size %d: expected no error, got %v", size, err)
+		}
+		if len(data) > ChatProtocolMaxLen {
+			t.Fatalf("size %d: expected length to be <= %d, got %d", size, ChatProtocolMaxLen, len(data))
+		}
+
+		parsed, err := ParseChatRequest(data)
+		if err != nil {
+			t.Fatalf("size %d: expected no error, got %v", size, err)
+		}
+		if parsed != original {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestChatRequestMultibyteMessage(t *testing.T) {
+	// "あ" は utf-8 で 3 byte なので、上限ちょうどの長さになる
+	original := ChatMessage{
+		Operation:  ChatOperationSendMessage,
+		ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+		UserID:     "123e4567-e89b-12d3-a456-426614174001",
+		Message:    strings.Repeat("あ", ChatMessageBytesMaxLen/3),
+	}
+
+	data, err := original.CreateChatRequest(original.Operation)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseChatRequest(data)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Message != original.Message {
+		t.Errorf("expected message of %d bytes, got %d bytes", len(original.Message), len(parsed.Message))
+	}
+}
+
+func TestCreateChatRequestTooLong(t *testing.T) {
+	cases := map[string]ChatMessage{
+		"message":     {ChatRoomID: "room", UserID: "user", Message: strings.Repeat("a", ChatMessageBytesMaxLen+1)},
+		"chatroom_id": {ChatRoomID: strings.Repeat("r", ChatIDBytesMaxLen+1), UserID: "user"},
+		"user_id":     {ChatRoomID: "room", UserID: strings.Repeat("u", ChatIDBytesMaxLen+1)},
+	}
+
+	for field, chat := range cases {
+		_, err := chat.CreateChatRequest(ChatOperationSendMessage)
+		var formatErr *ChatFormatError
+		if !errors.As(err, &formatErr) || formatErr.Field != field || !errors.Is(err, ErrChatTooLong) {
+			t.Errorf("%s: expected too long error, got %v", field, err)
+		}
+	}
+}
+
+func TestParseChatRequestErrors(t *testing.T) {
+	valid, err := ChatMessage{ChatRoomID: "room", UserID: "user", Message: "hello"}.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	withMessageSize := func(size uint16) []byte {
+		data := bytes.Clone(valid)
+		binary.BigEndian.PutUint16(data[4:6], size)
+		return data
+	}
+	unknownVersion := bytes.Clone(valid)
+	unknownVersion[0] = ChatProtocolVersion + 1
+	longRoomID := bytes.Clone(valid)
+	longRoomID[2] = ChatIDBytesMaxLen + 1
+
+	cases := []struct {
+		name  string
+		data  []byte
+		field string
+		err   error
+	}{
+		{"empty", nil, "header", ErrChatTruncated},
+		{"short header", valid[:chatHeaderLen-1], "header", ErrChatTruncated},
+		{"unknown version", unknownVersion, "version", ErrUnsupportedVersion},
+		{"chatroom id too long", longRoomID, "chatroom_id", ErrChatTooLong},
+		{"message size too large", withMessageSize(ChatMessageBytesMaxLen + 1), "message", ErrChatTooLong},
+		{"truncated chatroom id", valid[:chatHeaderLen+2], "chatroom_id", ErrChatTruncated},
+		{"truncated user id", valid[:chatHeaderLen+6], "user_id", ErrChatTruncated},
+		{"truncated message", valid[:len(valid)-1], "message", ErrChatTruncated},
+		{"trailing data", append(bytes.Clone(valid), 0), "datagram", ErrChatTrailingData},
+		{"oversize datagram", make([]byte, ChatProtocolMaxLen+1), "datagram", ErrChatTooLong},
+	}
+
+	for _, c := range cases {
+		_, err := ParseChatRequest(c.data)
+		var formatErr *ChatFormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("%s: expected *ChatFormatError, got %v", c.name, err)
+			continue
+		}
+		if formatErr.Field != c.field || !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %s %v, got %v", c.name, c.field, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ChatRoomProtocol: アプリケーション層で動作するカスタムプロトコル
+// ヘッダの形式は header.go を参照
+// Payload: username (32 byte) + roomid (16 byte) + roomname (64 byte) + password(32 byte) をjson形式で表したもの
+
+// ChatRoomRequestはユーザーの入力から作成される
+// サーバーからのレスポンスも同じ構造体に変換して扱う
+// operation = 0: chat roomの作成をリクエストする時に使用
+// operation = 1: chat roomの検索をリクエストする時に使用
+// operation = 2: chat roomへの参加をリクエストする時に使用
+// operation = 3: chat roomからの退出をリクエストする時に使用
+// operation = 4: 接続の最初に Hello / Welcome を交換する時に使用 (handshake.go を参照)
+// operation = 5: チャットルームの履歴を送信する時に使用 (history.go を参照)
+// operation = 6: チャットルームの履歴を遡って取得する時に使用 (history.go を参照)
+// operation = 7: 以前のセッションでのチャットルームへの参加を再開する時に使用 (session.go を参照)
+// state = 0: リクエスト
+// state = 2: 成功レスポンス
+type ChatRoomRequest struct {
+	RoomID       string `json:"room_id"`
+	RoomName     string `json:"room_name"`
+	RoomPassword string `json:"room_password"`
+	// PasswordRequired は検索のレスポンスで、チャットルームへの参加にパスワードが必要かどうかを表す
+	// パスワードそのものはチャットルームのメンバー以外へ返さない
+	PasswordRequired bool   `json:"password_required,omitempty"`
+	UserID           string `json:"user_id"`
+	UserName         string `json:"user_name"`
+	// ReliableDelivery はチャットルームの配信で reliable delivery を使用するかどうか
+	// 作成リクエストではチャットルームの設定を、作成・参加のレスポンスではそのユーザーへの配信で有効かどうかを表す
+	ReliableDelivery bool `json:"reliable_delivery"`
+	// HostDeparture はホストが退出した時のチャットルームの扱い (HostDeparture* のいずれか)
+	// 作成リクエストではチャットルームの設定を、作成・参加のレスポンスではそのチャットルームの設定を表す
+	HostDeparture string `json:"host_departure"`
+	// Successor は退出リクエストで、ホストが後任に指名するメンバーのユーザー名
+	Successor string `json:"successor"`
+	// IsHost は作成・参加のレスポンスで、そのユーザーがチャットルームのホストかどうかを表す
+	// ホストのいない空のチャットルームへ参加したユーザーはホストになる
+	IsHost bool `json:"is_host"`
+	// ResumeToken は作成・参加のレスポンスでサーバーが発行し、再開と退出のリクエストでクライアントが本人であることを示すために提示するトークン
+	ResumeToken string `json:"resume_token"`
+	// SessionKey は作成・参加・再開のレスポンスでサーバーが発行する、データグラムを認証するための鍵 (hex, auth.go を参照)
+	SessionKey string `json:"session_key,omitempty"`
+	// EndToEndSalt は end-to-end で暗号化するチャットルームで、room key の導出に使う salt (hex, e2e.go を参照)
+	// 作成リクエストではクライアントが指定し、検索・作成・参加・再開のレスポンスではサーバーが返す
+	// 空の時は end-to-end で暗号化しないチャットルーム
+	EndToEndSalt string `json:"e2e_salt,omitempty"`
+	Operation    byte
+	State        byte
+	// Version は受信したバイト列のヘッダのバージョン
+	// 送信時は常に ProtocolVersion が使われる
+	Version byte `json:"-"`
+	// Error は StateFail / StateInvalid のレスポンスを受信した時に、その理由が入る
+	Error *ErrorResponse `json:"-"`
+}
+
+const (
+	OperationCreateChatRoom byte = iota
+	OperationSerchChatRoomByID
+	OperationJoinChatRoom
+	OperationLeaveChatRoom
+	OperationHello
+	OperationHistory
+	OperationFetchHistory
+	OperationResumeSession
+)
+
+// ホストが退出した時のチャットルームの扱い
+// 指定されていない時は HostDepartureClose として扱う
+const (
+	// HostDepartureClose はチャットルームを閉じ、残っているメンバーへ BroadcastKindRoomClosed を配信する
+	HostDepartureClose = "close"
+	// HostDeparturePromote は最も長く参加しているメンバーをホストにする
+	HostDeparturePromote = "promote"
+	// HostDepartureNominate は退出するホストが指名したメンバーをホストにする
+	// 指名がない時や指名されたメンバーがいない時は HostDeparturePromote と同じく扱う
+	HostDepartureNominate = "nominate"
+)
+
+// ChatRoomRequest の各フィールドの最大長 (byte)
+const (
+	UserNameBytesMaxLen     = 32
+	RoomNameBytesMaxLen     = 64
+	RoomPasswordBytesMaxLen = 32
+)
+
+const (
+	StateRequest byte = iota
+	StateAckResponse
+	StateSuccess
+	StateFail
+	StateInvalid
+)
+
+// marshalPayload は payload に含めるデータを json に変換する
+func marshalPayload(data map[string]interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, errors.New("failed to generate json data")
+	}
+	return jsonData, nil
+}
+
+func (req ChatRoomRequest) payload() ([]byte, error) {
+	data := map[string]interface{}{
+		"room_id":       req.RoomID,
+		"room_name":     req.RoomName,
+		"room_password": req.RoomPassword,
+		"user_id":       req.UserID,
+		"user_name":     req.UserName,
+	}
+	// reliable delivery や host handover を知らないサーバーへ送るリクエストを変えないよう、指定された時だけ含める
+	if req.ReliableDelivery {
+		data["reliable_delivery"] = true
+	}
+	addOptionalFields(data, req)
+	return marshalPayload(data)
+}
+
+// addOptionalFields は機能の合意によって使われるフィールドを、指定されている時だけ payload に追加する
+func addOptionalFields(data map[string]interface{}, req ChatRoomRequest) {
+	if req.HostDeparture != "" {
+		data["host_departure"] = req.HostDeparture
+	}
+	if req.Successor != "" {
+		data["successor"] = req.Successor
+	}
+	if req.IsHost {
+		data["is_host"] = true
+	}
+	if req.ResumeToken != "" {
+		data["resume_token"] = req.ResumeToken
+	}
+	if req.SessionKey != "" {
+		data["session_key"] = req.SessionKey
+	}
+	if req.EndToEndSalt != "" {
+		data["e2e_salt"] = req.EndToEndSalt
+	}
+}
+
+// CreateRequestProtocol はクライアントからサーバーへ送信するリクエストのバイト列を作成する
+func (req ChatRoomRequest) CreateRequestProtocol() ([]byte, error) {
+	payload, err := req.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, req.Operation, req.State, payload)
+}
+
+// AckResponseはサーバーがリクエストを受信したら受信した事実のみを返すためのもの
+func AckResponse() ([]byte, error) {
+	// state 1はリクエストの受信を示す
+	return encodeChatRoomProtocol(ProtocolVersion, OperationCreateChatRoom, StateAckResponse, nil)
+}
+
+// InvalidRequestResponseはリクエストが無効な際にその旨をクライアントへ伝えるためのもの
+// operation には無効と判断したリクエストの operation を、code にはその理由を指定する
+func InvalidRequestResponse(operation byte, code ErrorCode, message string) ([]byte, error) {
+	// state 4は無効なリクエストが送信されたことを示す
+	return createErrorResponse(StateInvalid, ErrorResponse{
+		Code:      code,
+		Operation: operation,
+		Message:   message,
+	})
+}
+
+// RateLimitedResponse はリクエストが送信元ごとの回数の制限を超えたことと、retryAfter が経つまで受け付けないことをクライアントへ伝えるためのもの
+func RateLimitedResponse(operation byte, retryAfter time.Duration) ([]byte, error) {
+	return retryAfterResponse(operation, ErrorCodeRateLimited, "Too many requests", retryAfter)
+}
+
+// LockedOutResponse はパスワードの試行に失敗し続けたため、retryAfter が経つまで締め出していることをクライアントへ伝えるためのもの
+func LockedOutResponse(operation byte, retryAfter time.Duration) ([]byte, error) {
+	return retryAfterResponse(operation, ErrorCodeLockedOut, "Too many failed attempts", retryAfter)
+}
+
+// retryAfterResponse は再び受け付けられる前に再送しないよう、retryAfter をミリ秒に切り上げて通知する
+func retryAfterResponse(operation byte, code ErrorCode, message string, retryAfter time.Duration) ([]byte, error) {
+	return createErrorResponse(StateInvalid, ErrorResponse{
+		Code:             code,
+		Operation:        operation,
+		Message:          message,
+		RetryAfterMillis: (retryAfter + time.Millisecond - 1).Milliseconds(),
+	})
+}
+
+// InternalServerErrorResponse はサーバー側でエラーが発生したことをクライアントへ伝えるためのもの
+func InternalServerErrorResponse(operation byte) ([]byte, error) {
+	// state 3はサーバー側でエラーが発生したことを示す
+	return createErrorResponse(StateFail, ErrorResponse{
+		Code:      ErrorCodeInternal,
+		Operation: operation,
+		Message:   "Internal Server Error",
+	})
+}
+
+// CreateExistingChatroomResponse はIDで検索されたチャットルームの情報をクライアントへ返す
+// パスワードは返さず、参加にパスワードが必要かどうかだけを返す
+// end-to-end で暗号化するチャットルームでは、参加する前に room key を導出できるよう EndToEndSalt も返す
+func CreateExistingChatroomResponse(chatroom ChatRoomRequest) ([]byte, error) {
+	data := map[string]interface{}{
+		"room_id":           chatroom.RoomID,
+		"room_name":         chatroom.RoomName,
+		"password_required": chatroom.PasswordRequired,
+	}
+	addOptionalFields(data, ChatRoomRequest{EndToEndSalt: chatroom.EndToEndSalt})
+	jsonData, err := marshalPayload(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, OperationSerchChatRoomByID, StateSuccess, jsonData)
+}
+
+// CreateChatRoomJoinResponse はチャットルームへの参加が許可されたことをクライアントへ返す
+func CreateChatRoomJoinResponse(joined ChatRoomRequest) ([]byte, error) {
+	return encodeMembershipResponse(OperationJoinChatRoom, joined)
+}
+
+// encodeMembershipResponse はチャットルームのメンバーになったユーザーへ、チャットルームとそのユーザーの情報を返す
+func encodeMembershipResponse(operation byte, member ChatRoomRequest) ([]byte, error) {
+	data := map[string]interface{}{
+		"room_id":           member.RoomID,
+		"room_name":         member.RoomName,
+		"user_id":           member.UserID,
+		"user_name":         member.UserName,
+		"reliable_delivery": member.ReliableDelivery,
+	}
+	addOptionalFields(data, ChatRoomRequest{HostDeparture: member.HostDeparture, IsHost: member.IsHost, ResumeToken: member.ResumeToken, SessionKey: member.SessionKey, EndToEndSalt: member.EndToEndSalt})
+	jsonData, err := marshalPayload(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, operation, StateSuccess, jsonData)
+}
+
+// CreateNewChatRoomResponse は新しく作成されたチャットルームとホストユーザーの情報をクライアントへ返す
+func CreateNewChatRoomResponse(created ChatRoomRequest) ([]byte, error) {
+	data := map[string]interface{}{
+		"room_id":           created.RoomID,
+		"room_name":         created.RoomName,
+		"room_password":     created.RoomPassword,
+		"user_id":           created.UserID,
+		"user_name":         created.UserName,
+		"reliable_delivery": created.ReliableDelivery,
+	}
+	addOptionalFields(data, ChatRoomRequest{HostDeparture: created.HostDeparture, IsHost: created.IsHost, ResumeToken: created.ResumeToken, SessionKey: created.SessionKey, EndToEndSalt: created.EndToEndSalt})
+	jsonData, err := marshalPayload(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, OperationCreateChatRoom, StateSuccess, jsonData)
+}
+
+// CreateLeaveChatRoomResponse はチャットルームからの退出が完了したことをクライアントへ返す
+func CreateLeaveChatRoomResponse(left ChatRoomRequest) ([]byte, error) {
+	jsonData, err := marshalPayload(map[string]interface{}{
+		"room_id":   left.RoomID,
+		"user_id":   left.UserID,
+		"user_name": left.UserName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, OperationLeaveChatRoom, StateSuccess, jsonData)
+}
+
+// ParseChatRoomRequestはtcp接続により受信したbyte列を解析して構造体ChatRoomRequestに変換する
+func ParseChatRoomRequest(buf []byte) (ChatRoomRequest, error) {
+	header, payload, err := decodeChatRoomProtocol(buf)
+	if err != nil {
+		return ChatRoomRequest{}, err
+	}
+
+	request := ChatRoomRequest{
+		Operation: header.Operation,
+		State:     header.State,
+		Version:   header.Version,
+	}
+
+	err = json.Unmarshal(payload, &request)
+	if err != nil {
+		return ChatRoomRequest{}, errors.New("invalid payload for request")
+	}
+
+	return request, nil
+}
+
+// ParseChatRoomResponseはサーバーから受信したbyte列を解析して構造体ChatRoomRequestに変換する
+func ParseChatRoomResponse(buf []byte) (ChatRoomRequest, error) {
+	header, payload, err := decodeChatRoomProtocol(buf)
+	if err != nil {
+		return ChatRoomRequest{}, err
+	}
+
+	response := ChatRoomRequest{
+		Operation: header.Operation,
+		State:     header.State,
+		Version:   header.Version,
+	}
+
+	// state が成功の時はpayloadをレスポンスとして、失敗の時はエラーとして読み込む
+	switch header.State {
+	case StateSuccess:
+		err := json.Unmarshal(payload, &response)
+		if err != nil {
+			return ChatRoomRequest{}, errors.New("invalid payload for request")
+		}
+	case StateFail, StateInvalid:
+		response.Error = parseErrorPayload(header.Operation, payload)
+	}
+
+	return response, nil
+}
+
+// ReceiveAckResponse はサーバーからの ack response を受信する
+func ReceiveAckResponse(fc *FramedConn) error {
+	// サーバーからのack responseは ChatRoomProtocolのヘッダのみで送信される
+	ack, err := fc.ReadFrame()
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return errors.New("failed to load server response")
+	}
+
+	header, _, err := decodeChatRoomProtocol(ack)
+	if err == nil && header.State == StateAckResponse {
+		return nil
+	}
+
+	return errors.New("internal server error")
+}
+
+// ReceiveResponse はサーバーからのレスポンスを 1 フレーム受信して解析する
+func ReceiveResponse(fc *FramedConn) (ChatRoomRequest, error) {
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return ChatRoomRequest{}, err
+	}
+
+	response, err := ParseChatRoomResponse(frame)
+	if err != nil {
+		return ChatRoomRequest{}, err
+	}
+
+	if response.State == StateSuccess || response.State == StateInvalid {
+		return response, nil
+	} else if response.Error != nil {
+		return ChatRoomRequest{}, response.Error
+	} else {
+		return ChatRoomRequest{}, errors.New("some errors occured")
+	}
+}
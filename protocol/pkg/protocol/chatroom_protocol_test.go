@@ -0,0 +1,489 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAckResponse(t *testing.T) {
+	response, err := AckResponse()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(response) != chatRoomHeaderLen {
+		t.Fatalf("expected length %d, got %d", chatRoomHeaderLen, len(response))
+	}
+
+	if response[2] != 0 {
+		t.Errorf("expected operation 0, got %d", response[2])
+	}
+
+	if response[3] != StateAckResponse {
+		t.Errorf("expected state %d, got %d", StateAckResponse, response[3])
+	}
+
+	// legacy のクライアントには ヘッダのみの 3 byte ([payload size, operation, state]) で送信される
+	legacy, err := EncodeForVersion(response, ProtocolVersionLegacy)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(legacy, []byte{0, 0, 1}) {
+		t.Errorf("expected legacy ack [0 0 1], got %v", legacy)
+	}
+}
+
+func TestInvalidRequestResponse(t *testing.T) {
+	message := "Invalid password"
+	response, err := InvalidRequestResponse(OperationJoinChatRoom, ErrorCodeWrongPassword, message)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(response) < chatRoomHeaderLen {
+		t.Fatal("response length is too short")
+	}
+
+	if response[1] != ProtocolVersion {
+		t.Errorf("expected version %d, got %d", ProtocolVersion, response[1])
+	}
+
+	if response[2] != OperationJoinChatRoom {
+		t.Errorf("expected operation %d, got %d", OperationJoinChatRoom, response[2])
+	}
+
+	if response[3] != StateInvalid {
+		t.Errorf("expected state %d, got %d", StateInvalid, response[3])
+	}
+
+	if size := binary.BigEndian.Uint32(response[4:8]); size != uint32(len(response)-chatRoomHeaderLen) {
+		t.Errorf("expected payload size %d, got %d", len(response)-chatRoomHeaderLen, size)
+	}
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal(response[chatRoomHeaderLen:], &errorResponse); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+	expected := ErrorResponse{Code: ErrorCodeWrongPassword, Operation: OperationJoinChatRoom, Message: message}
+	if errorResponse != expected {
+		t.Errorf("expected %+v, got %+v", expected, errorResponse)
+	}
+}
+
+func TestInternalServerErrorResponse(t *testing.T) {
+	response, err := InternalServerErrorResponse(OperationCreateChatRoom)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(response) < chatRoomHeaderLen {
+		t.Fatal("response length is too short")
+	}
+
+	if response[2] != OperationCreateChatRoom {
+		t.Errorf("expected operation %d, got %d", OperationCreateChatRoom, response[2])
+	}
+
+	if response[3] != StateFail {
+		t.Errorf("expected state %d, got %d", StateFail, response[3])
+	}
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal(response[chatRoomHeaderLen:], &errorResponse); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+	if errorResponse.Code != ErrorCodeInternal {
+		t.Errorf("expected code %s, got %s", ErrorCodeInternal, errorResponse.Code)
+	}
+}
+
+func TestCreateChatRoomJoinResponse(t *testing.T) {
+	joined := ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", UserID: "user-id-123", UserName: "Alice"}
+
+	response, err := CreateChatRoomJoinResponse(joined)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(response) < chatRoomHeaderLen {
+		t.Fatal("response length is too short")
+	}
+
+	var parsedData map[string]interface{}
+	if err := json.Unmarshal(response[chatRoomHeaderLen:], &parsedData); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+
+	if parsedData["room_id"] != joined.RoomID {
+		t.Errorf("expected room_id %s, got %s", joined.RoomID, parsedData["room_id"])
+	}
+	if parsedData["user_id"] != joined.UserID {
+		t.Errorf("expected user_id %s, got %s", joined.UserID, parsedData["user_id"])
+	}
+}
+
+func TestCreateNewChatRoomResponse(t *testing.T) {
+	created := ChatRoomRequest{RoomID: "room-id-456", RoomName: "Tech Room", RoomPassword: "secret", UserID: "user-id-456", UserName: "Bob"}
+
+	response, err := CreateNewChatRoomResponse(created)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(response) < chatRoomHeaderLen {
+		t.Fatal("response length is too short")
+	}
+
+	var parsedData map[string]interface{}
+	if err := json.Unmarshal(response[chatRoomHeaderLen:], &parsedData); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+
+	if parsedData["room_id"] != created.RoomID {
+		t.Errorf("expected room_id %s, got %s", created.RoomID, parsedData["room_id"])
+	}
+	if parsedData["user_id"] != created.UserID {
+		t.Errorf("expected user_id %s, got %s", created.UserID, parsedData["user_id"])
+	}
+}
+
+func TestCreateLeaveChatRoomResponse(t *testing.T) {
+	left := ChatRoomRequest{RoomID: "room-id-789", UserID: "user-id-789", UserName: "Carol"}
+
+	response, err := CreateLeaveChatRoomResponse(left)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	parsed, err := ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Operation != OperationLeaveChatRoom || parsed.State != StateSuccess {
+		t.Errorf("expected leave success, got operation %d state %d", parsed.Operation, parsed.State)
+	}
+	if parsed.RoomID != left.RoomID || parsed.UserID != left.UserID || parsed.UserName != left.UserName {
+		t.Errorf("expected %+v, got %+v", left, parsed)
+	}
+}
+
+func TestHostDepartureInResponses(t *testing.T) {
+	room := ChatRoomRequest{RoomID: "room-id-789", RoomName: "Sports Room", UserID: "user-id-789", UserName: "Carol", HostDeparture: HostDepartureNominate, IsHost: true}
+
+	for _, create := range []func(ChatRoomRequest) ([]byte, error){CreateNewChatRoomResponse, CreateChatRoomJoinResponse} {
+		response, err := create(room)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		parsed, err := ParseChatRoomResponse(response)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if parsed.HostDeparture != HostDepartureNominate {
+			t.Errorf("expected host departure %q, got %q", HostDepartureNominate, parsed.HostDeparture)
+		}
+		if !parsed.IsHost {
+			t.Error("expected is_host to be true")
+		}
+	}
+
+	// 指定されていない時は payload に含めない
+	room.HostDeparture = ""
+	room.IsHost = false
+	response, err := CreateChatRoomJoinResponse(room)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(string(response), "host_departure") || strings.Contains(string(response), "is_host") {
+		t.Errorf("expected no host handover fields in %q", response)
+	}
+}
+
+func TestCreateResumeSessionResponse(t *testing.T) {
+	resumed := ChatRoomRequest{RoomID: "room-id-789", RoomName: "Sports Room", UserID: "user-id-789", UserName: "Carol", ReliableDelivery: true, ResumeToken: "token-789", SessionKey: "0123abcd"}
+
+	response, err := CreateResumeSessionResponse(resumed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	parsed, err := ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Operation != OperationResumeSession || parsed.State != StateSuccess {
+		t.Errorf("expected resume success, got operation %d state %d", parsed.Operation, parsed.State)
+	}
+	if parsed.RoomID != resumed.RoomID || parsed.UserID != resumed.UserID || parsed.UserName != resumed.UserName || !parsed.ReliableDelivery {
+		t.Errorf("expected %+v, got %+v", resumed, parsed)
+	}
+	if parsed.ResumeToken != resumed.ResumeToken {
+		t.Errorf("expected resume token %q, got %q", resumed.ResumeToken, parsed.ResumeToken)
+	}
+	if parsed.SessionKey != resumed.SessionKey {
+		t.Errorf("expected session key %q, got %q", resumed.SessionKey, parsed.SessionKey)
+	}
+}
+
+func TestParseChatRoomRequest(t *testing.T) {
+	// Prepare a valid request
+	originalRequest := ChatRoomRequest{
+		RoomID:       "room-id-789",
+		RoomName:     "Sports Room",
+		RoomPassword: "password",
+		UserID:       "user-id-789",
+		UserName:     "Charlie",
+		Operation:    OperationJoinChatRoom,
+		State:        StateRequest,
+	}
+
+	// Create the byte representation
+	payload, err := json.Marshal(originalRequest)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	buf := []byte{byte(len(payload)), originalRequest.Operation, originalRequest.State}
+	buf = append(buf, payload...)
+
+	// Parse the request
+	parsedRequest, err := ParseChatRoomRequest(buf)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Validate the parsed values
+	if parsedRequest.Operation != originalRequest.Operation {
+		t.Errorf("expected operation %d, got %d", originalRequest.Operation, parsedRequest.Operation)
+	}
+	if parsedRequest.RoomID != originalRequest.RoomID {
+		t.Errorf("expected room_id %s, got %s", originalRequest.RoomID, parsedRequest.RoomID)
+	}
+	if parsedRequest.UserID != originalRequest.UserID {
+		t.Errorf("expected user_id %s, got %s", originalRequest.UserID, parsedRequest.UserID)
+	}
+	if parsedRequest.Version != ProtocolVersionLegacy {
+		t.Errorf("expected version %d, got %d", ProtocolVersionLegacy, parsedRequest.Version)
+	}
+}
+
+func TestCreateRequestProtocol(t *testing.T) {
+	req := ChatRoomRequest{
+		RoomID:       "123456",
+		RoomName:     "TestRoom",
+		RoomPassword: "password123",
+		UserID:       "user123",
+		UserName:     "Alice",
+		Operation:    OperationCreateChatRoom,
+		State:        StateRequest,
+	}
+
+	expectedPayload := []byte(`{"room_id":"123456","room_name":"TestRoom","room_password":"password123","user_id":"user123","user_name":"Alice"}`)
+
+	protocol, err := req.CreateRequestProtocol()
+	if err != nil {
+		t.Fatalf("CreateRequestProtocol returned an error: %v", err)
+	}
+
+	// バイト列の長さを確認 (ヘッダー + ペイロード)
+	expectedLength := chatRoomHeaderLen + len(expectedPayload) // Marker(1 byte) + Version(1 byte) + Operation(1 byte) + State(1 byte) + PayloadSize(4 byte) + Payload
+	if len(protocol) != expectedLength {
+		t.Errorf("expected protocol length %d, but got %d", expectedLength, len(protocol))
+	}
+
+	// Versionの確認
+	if protocol[0] != 0 || protocol[1] != ProtocolVersion {
+		t.Errorf("expected marker 0 and version %d, but got %d and %d", ProtocolVersion, protocol[0], protocol[1])
+	}
+
+	// Operationの確認
+	if protocol[2] != req.Operation {
+		t.Errorf("expected operation %d, but got %d", req.Operation, protocol[2])
+	}
+
+	// Stateの確認
+	if protocol[3] != req.State {
+		t.Errorf("expected state %d, but got %d", req.State, protocol[3])
+	}
+
+	// PayloadSizeの確認
+	payloadSize := binary.BigEndian.Uint32(protocol[4:8])
+	if int(payloadSize) != len(expectedPayload) {
+		t.Errorf("expected payload size %d, but got %d", len(expectedPayload), payloadSize)
+	}
+
+	// Payloadの確認
+	payload := protocol[chatRoomHeaderLen:]
+	if !bytes.Equal(payload, expectedPayload) {
+		t.Errorf("expected payload %s, but got %s", expectedPayload, payload)
+	}
+}
+
+// 255 byte を超える payload が切り詰められずに送受信できることを確認する
+func TestLargePayloadRoundTrip(t *testing.T) {
+	original := ChatRoomRequest{
+		RoomName:     strings.Repeat("r", 64),
+		RoomPassword: strings.Repeat("p", 32),
+		UserName:     strings.Repeat("あ", 100),
+		Operation:    OperationCreateChatRoom,
+		State:        StateRequest,
+	}
+
+	encoded, err := original.CreateRequestProtocol()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(encoded)-chatRoomHeaderLen <= 255 {
+		t.Fatalf("expected payload larger than 255 bytes, got %d", len(encoded)-chatRoomHeaderLen)
+	}
+
+	parsed, err := ParseChatRoomRequest(encoded)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.UserName != original.UserName || parsed.RoomName != original.RoomName {
+		t.Errorf("expected %+v, got %+v", original, parsed)
+	}
+}
+
+func TestParseUnsupportedVersion(t *testing.T) {
+	buf := []byte{0, ProtocolVersion + 1, OperationCreateChatRoom, StateRequest, 0, 0, 0, 2, '{', '}'}
+
+	_, err := ParseChatRoomRequest(buf)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestParseOversizePayload(t *testing.T) {
+	buf := []byte{0, ProtocolVersion, OperationCreateChatRoom, StateRequest}
+	buf = binary.BigEndian.AppendUint32(buf, ChatRoomPayloadMaxLen+1)
+
+	_, err := ParseChatRoomRequest(buf)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("expected %v, got %v", ErrPayloadTooLarge, err)
+	}
+}
+
+func TestEncodeForLegacyVersion(t *testing.T) {
+	joined := ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", UserID: "user-id-123", UserName: "Alice"}
+	response, err := CreateChatRoomJoinResponse(joined)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	legacy, err := EncodeForVersion(response, ProtocolVersionLegacy)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if int(legacy[0]) != len(response)-chatRoomHeaderLen {
+		t.Errorf("expected payload size %d, got %d", len(response)-chatRoomHeaderLen, legacy[0])
+	}
+
+	parsed, err := ParseChatRoomResponse(legacy)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Version != ProtocolVersionLegacy || parsed.RoomID != joined.RoomID || parsed.UserID != joined.UserID {
+		t.Errorf("unexpected legacy response %+v", parsed)
+	}
+
+	tooLarge, err := InvalidRequestResponse(OperationCreateChatRoom, ErrorCodeMalformedRequest, strings.Repeat("x", 256))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := EncodeForVersion(tooLarge, ProtocolVersionLegacy); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("expected %v, got %v", ErrPayloadTooLarge, err)
+	}
+}
+
+// 古いサーバーが送る自由文のエラーも読み取れることを確認する
+func TestParseLegacyErrorPayload(t *testing.T) {
+	message := "No room exist"
+	buf := []byte{byte(len(message)), OperationCreateChatRoom, StateInvalid}
+	buf = append(buf, message...)
+
+	response, err := ParseChatRoomResponse(buf)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if response.Error == nil || response.Error.Message != message {
+		t.Errorf("expected error message %q, got %+v", message, response.Error)
+	}
+}
+
+func TestCreateExistingChatroomResponseHidesPassword(t *testing.T) {
+	found := ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", RoomPassword: "secret", PasswordRequired: true}
+
+	response, err := CreateExistingChatroomResponse(found)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(string(response), "secret") || strings.Contains(string(response), "room_password") {
+		t.Errorf("expected no password in %q", response)
+	}
+
+	parsed, err := ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !parsed.PasswordRequired || parsed.RoomPassword != "" {
+		t.Errorf("expected password_required without password, got %+v", parsed)
+	}
+
+	found.PasswordRequired = false
+	response, err = CreateExistingChatroomResponse(found)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err = ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.PasswordRequired {
+		t.Errorf("expected password not to be required, got %+v", parsed)
+	}
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	response, err := RateLimitedResponse(OperationCreateChatRoom, 1500*time.Microsecond)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Error == nil || parsed.Error.Code != ErrorCodeRateLimited {
+		t.Fatalf("expected rate limited error, got %+v", parsed.Error)
+	}
+	// 再び受け付けられる前に再送しないよう、切り上げて通知する
+	if parsed.Error.RetryAfter() != 2*time.Millisecond {
+		t.Errorf("expected retry after 2ms, got %s", parsed.Error.RetryAfter())
+	}
+}
+
+func TestLockedOutResponse(t *testing.T) {
+	response, err := LockedOutResponse(OperationJoinChatRoom, 4*time.Second)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseChatRoomResponse(response)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Error == nil || parsed.Error.Code != ErrorCodeLockedOut || parsed.Error.Operation != OperationJoinChatRoom {
+		t.Fatalf("expected locked out error, got %+v", parsed.Error)
+	}
+	if parsed.Error.RetryAfter() != 4*time.Second {
+		t.Errorf("expected retry after 4s, got %s", parsed.Error.RetryAfter())
+	}
+	if parsed.Error.Code.String() != "locked_out" {
+		t.Errorf("unexpected code name %s", parsed.Error.Code)
+	}
+}
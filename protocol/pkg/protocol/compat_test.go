@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+)
+
+// クライアントが作成したリクエストをサーバーが解析できることを確認する
+func TestClientRequestDecodedByServer(t *testing.T) {
+	requests := []ChatRoomRequest{
+		{RoomName: "General Room", RoomPassword: "secret", UserName: "Alice", Operation: OperationCreateChatRoom, State: StateRequest},
+		{RoomID: "room-id-123", Operation: OperationSerchChatRoomByID, State: StateRequest},
+		{RoomID: "room-id-123", RoomName: "General Room", RoomPassword: "secret", UserName: "Bob", Operation: OperationJoinChatRoom, State: StateRequest},
+		{RoomID: "room-id-123", UserID: "user-id-123", Operation: OperationLeaveChatRoom, State: StateRequest},
+		{RoomName: "General Room", UserName: "Alice", HostDeparture: HostDepartureNominate, Operation: OperationCreateChatRoom, State: StateRequest},
+		{RoomID: "room-id-123", UserID: "user-id-123", Successor: "Bob", Operation: OperationLeaveChatRoom, State: StateRequest},
+		{RoomID: "room-id-123", UserID: "user-id-123", ResumeToken: "token-123", Operation: OperationResumeSession, State: StateRequest},
+	}
+
+	for _, original := range requests {
+		original.Version = ProtocolVersion
+		encoded, err := original.CreateRequestProtocol()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		parsed, err := ParseChatRoomRequest(encoded)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if parsed != original {
+			t.Errorf("expected %+v, got %+v", original, parsed)
+		}
+	}
+}
+
+// サーバーが作成したレスポンスをクライアントが解析できることを確認する
+func TestServerResponseDecodedByClient(t *testing.T) {
+	room := ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", RoomPassword: "secret", UserID: "user-id-123", UserName: "Alice"}
+
+	created, err := CreateNewChatRoomResponse(room)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err := ParseChatRoomResponse(created)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := room
+	expected.Operation = OperationCreateChatRoom
+	expected.State = StateSuccess
+	expected.Version = ProtocolVersion
+	if response != expected {
+		t.Errorf("expected %+v, got %+v", expected, response)
+	}
+
+	found, err := CreateExistingChatroomResponse(room)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err = ParseChatRoomResponse(found)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected = ChatRoomRequest{RoomID: room.RoomID, RoomName: room.RoomName, Operation: OperationSerchChatRoomByID, State: StateSuccess, Version: ProtocolVersion}
+	if response != expected {
+		t.Errorf("expected %+v, got %+v", expected, response)
+	}
+
+	joined, err := CreateChatRoomJoinResponse(room)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err = ParseChatRoomResponse(joined)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected = ChatRoomRequest{RoomID: room.RoomID, RoomName: room.RoomName, UserID: room.UserID, UserName: room.UserName, Operation: OperationJoinChatRoom, State: StateSuccess, Version: ProtocolVersion}
+	if response != expected {
+		t.Errorf("expected %+v, got %+v", expected, response)
+	}
+
+	invalid, err := InvalidRequestResponse(OperationSerchChatRoomByID, ErrorCodeRoomNotFound, "No room exist")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err = ParseChatRoomResponse(invalid)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if response.State != StateInvalid {
+		t.Errorf("expected state %d, got %d", StateInvalid, response.State)
+	}
+	expectedError := ErrorResponse{Code: ErrorCodeRoomNotFound, Operation: OperationSerchChatRoomByID, Message: "No room exist"}
+	if response.Error == nil || *response.Error != expectedError {
+		t.Errorf("expected error %+v, got %+v", expectedError, response.Error)
+	}
+
+	internal, err := InternalServerErrorResponse(OperationJoinChatRoom)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err = ParseChatRoomResponse(internal)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if response.State != StateFail {
+		t.Errorf("expected state %d, got %d", StateFail, response.State)
+	}
+	if response.Error == nil || response.Error.Code != ErrorCodeInternal || response.Error.Operation != OperationJoinChatRoom {
+		t.Errorf("unexpected error %+v", response.Error)
+	}
+}
+
+// クライアントが作成したチャットメッセージをサーバーが解析できることを確認する
+func TestClientChatMessageDecodedByServer(t *testing.T) {
+	operations := []byte{ChatOperationSendMessage, ChatOperationSendUDPAddr, ChatOperationExit}
+
+	for _, operation := range operations {
+		original := ChatMessage{
+			Operation:  operation,
+			ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+			UserID:     "123e4567-e89b-12d3-a456-426614174001",
+			Message:    "こんにちは",
+		}
+
+		encoded, err := original.CreateChatRequest(operation)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		parsed, err := ParseChatRequest(encoded)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if parsed != original {
+			t.Errorf("expected %+v, got %+v", original, parsed)
+		}
+	}
+}
+
+// サーバーが送信したack responseとレスポンスをクライアントが受信できることを確認する
+func TestReceiveResponseOverConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	room := ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", UserID: "user-id-123", UserName: "Alice"}
+
+	go func() {
+		ack, _ := AckResponse()
+		server.Write(ack)
+		joined, _ := CreateChatRoomJoinResponse(room)
+		server.Write(joined)
+	}()
+
+	fc := NewFramedConn(client)
+	if err := ReceiveAckResponse(fc); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	response, err := ReceiveResponse(fc)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if response.RoomID != room.RoomID || response.UserID != room.UserID {
+		t.Errorf("expected %+v, got %+v", room, response)
+	}
+}
+
+func TestParseTruncatedPackets(t *testing.T) {
+	request := ChatRoomRequest{RoomID: "room-id-123", Operation: OperationSerchChatRoomByID}
+	encoded, err := request.CreateRequestProtocol()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := ParseChatRoomRequest(encoded[:len(encoded)-1]); err == nil {
+		t.Error("expected error for truncated chat room request")
+	}
+
+	message := ChatMessage{ChatRoomID: "room", UserID: "user", Message: "hello"}
+	encoded, err = message.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, n := range []int{0, 2, 3, len(encoded) - 1} {
+		if _, err := ParseChatRequest(encoded[:n]); err == nil {
+			t.Errorf("expected error for chat message truncated to %d bytes", n)
+		}
+	}
+}
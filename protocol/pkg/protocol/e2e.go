@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// End-to-end encrypted rooms
+//
+// FeatureEncryption で暗号化されるのはクライアントとサーバーの間だけで、サーバーはチャットの内容を読むことができる
+// end-to-end で暗号化するチャットルームでは、メンバーがチャットルームのパスワードから鍵を導出し、サーバーが読めない暗号文をやり取りする
+//
+// - チャットルームを作成するクライアントが乱数の EndToEndSalt を決め、サーバーはチャットルームと一緒に保存して検索・作成・参加・再開のレスポンスで返す
+// - メンバーはパスワードと EndToEndSalt から PBKDF2-HMAC-SHA256 で 48 byte を導出する
+//   先頭の 16 byte を hex にしたもの (verifier) をパスワードの代わりにサーバーへ送り、残りの 32 byte (room key) はサーバーへ送らない
+// - ユーザーのメッセージは room key の AES-256-GCM で暗号化し、"e2e1:" に続けて nonce (12byte) + 暗号文 + tag (16byte) を base64 で表した文字列を message として送る
+//   チャットルームの id と送信者の user_id を追加の認証データにするので、サーバーが別のチャットルームや別の送信者の発言として配信し直しても復号できない
+// - サーバーは message を暗号文のまま配信し、履歴にも暗号文のまま保存する
+//
+// サーバーは verifier のハッシュと EndToEndSalt を保存しているので、room key の強さはパスワードの強さで決まる
+
+const (
+	// EndToEndSaltLen は EndToEndSalt に使う乱数の長さ (byte)
+	EndToEndSaltLen = 16
+	// RoomKeyLen は room key の長さ (byte)
+	RoomKeyLen = 32
+
+	roomVerifierLen   = 16
+	roomKeyIterations = 600000
+	roomMessagePrefix = "e2e1:"
+)
+
+// ErrRoomMessageUnreadable は message が room key で暗号化されていないか、復号できないことを示す
+var ErrRoomMessageUnreadable = errors.New("message cannot be decrypted with the room key")
+
+// NewEndToEndSalt はチャットルームを作成するクライアントが、hex で表した EndToEndSalt を作成する
+func NewEndToEndSalt() (string, error) {
+	salt := make([]byte, EndToEndSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// ValidEndToEndSalt は salt が NewEndToEndSalt で作成できる形式かどうかを返す
+func ValidEndToEndSalt(salt string) bool {
+	decoded, err := hex.DecodeString(salt)
+	return err == nil && len(decoded) == EndToEndSaltLen
+}
+
+// DeriveRoomKey はパスワードと EndToEndSalt から、サーバーへパスワードの代わりに送る verifier と room key を導出する
+// verifier は RoomPasswordBytesMaxLen に収まる長さになる
+func DeriveRoomKey(password string, salt string) (string, []byte, error) {
+	if !ValidEndToEndSalt(salt) {
+		return "", nil, errors.New("invalid end-to-end salt")
+	}
+	decoded, _ := hex.DecodeString(salt)
+	derived := PBKDF2SHA256([]byte(password), decoded, roomKeyIterations, roomVerifierLen+RoomKeyLen)
+	return hex.EncodeToString(derived[:roomVerifierLen]), derived[roomVerifierLen:], nil
+}
+
+// RoomKeyFingerprint はメンバーが同じ room key を使っていることを互いに確かめるための、room key の sha256 の先頭 10 byte を 4 桁ずつ区切って返す
+func RoomKeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	encoded := hex.EncodeToString(sum[:10])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SealedRoomMessageLen は length byte のメッセージを SealRoomMessage で暗号化した時の長さを返す
+func SealedRoomMessageLen(length int) int {
+	return len(roomMessagePrefix) + base64.StdEncoding.EncodedLen(sealNonceLen+length+sealTagLen)
+}
+
+// SealRoomMessage は senderID のユーザーが roomID のチャットルームへ送るメッセージを room key で暗号化する
+func SealRoomMessage(key []byte, roomID string, senderID string, message string) (string, error) {
+	aead, err := newRoomCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, sealNonceLen, sealNonceLen+len(message)+sealTagLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(message), roomMessageAdditional(roomID, senderID))
+	return roomMessagePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenRoomMessage は roomID のチャットルームで senderID のユーザーから配信されたメッセージを room key で復号する
+func OpenRoomMessage(key []byte, roomID string, senderID string, message string) (string, error) {
+	encoded, found := strings.CutPrefix(message, roomMessagePrefix)
+	if !found {
+		return "", ErrRoomMessageUnreadable
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < sealNonceLen+sealTagLen {
+		return "", ErrRoomMessageUnreadable
+	}
+	aead, err := newRoomCipher(key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aead.Open(nil, sealed[:sealNonceLen], sealed[sealNonceLen:], roomMessageAdditional(roomID, senderID))
+	if err != nil {
+		return "", ErrRoomMessageUnreadable
+	}
+	return string(plaintext), nil
+}
+
+func newRoomCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != RoomKeyLen {
+		return nil, errors.New("invalid room key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// roomMessageAdditional は id に含まれない 0 で区切った、チャットルームの id と送信者の user_id
+func roomMessageAdditional(roomID string, senderID string) []byte {
+	additional := make([]byte, 0, len(roomID)+1+len(senderID))
+	additional = append(additional, roomID...)
+	additional = append(additional, 0)
+	return append(additional, senderID...)
+}
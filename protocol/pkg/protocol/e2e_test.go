@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDeriveRoomKey(t *testing.T) {
+	salt, err := NewEndToEndSalt()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !ValidEndToEndSalt(salt) {
+		t.Fatalf("expected %q to be a valid salt", salt)
+	}
+
+	verifier, key, err := DeriveRoomKey("secret", salt)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(verifier) > RoomPasswordBytesMaxLen || len(key) != RoomKeyLen {
+		t.Fatalf("unexpected lengths: verifier %d, key %d", len(verifier), len(key))
+	}
+	// サーバーへ送る verifier から room key は分からない
+	if strings.Contains(hex.EncodeToString(key), verifier) {
+		t.Error("expected verifier not to reveal the room key")
+	}
+
+	sameVerifier, sameKey, _ := DeriveRoomKey("secret", salt)
+	if sameVerifier != verifier || !bytes.Equal(sameKey, key) {
+		t.Error("expected the same password and salt to derive the same key")
+	}
+	otherVerifier, otherKey, _ := DeriveRoomKey("other", salt)
+	if otherVerifier == verifier || bytes.Equal(otherKey, key) {
+		t.Error("expected another password to derive another key")
+	}
+	if RoomKeyFingerprint(key) == RoomKeyFingerprint(otherKey) {
+		t.Error("expected fingerprints of different keys to differ")
+	}
+
+	if _, _, err := DeriveRoomKey("secret", "not-hex"); err == nil {
+		t.Error("expected invalid salt to be rejected")
+	}
+}
+
+func TestRoomKeyFingerprint(t *testing.T) {
+	fingerprint := RoomKeyFingerprint(bytes.Repeat([]byte{1}, RoomKeyLen))
+	groups := strings.Split(fingerprint, " ")
+	if len(groups) != 5 {
+		t.Fatalf("expected 5 groups, got %q", fingerprint)
+	}
+	for _, group := range groups {
+		if len(group) != 4 {
+			t.Errorf("expected groups of 4 digits, got %q", fingerprint)
+		}
+	}
+}
+
+func TestSealAndOpenRoomMessage(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, RoomKeyLen)
+	message := "Hello, World! こんにちは"
+
+	sealed, err := SealRoomMessage(key, "room-id-123", "user-id-123", message)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(sealed, "Hello") {
+		t.Fatalf("expected message not to be readable, got %q", sealed)
+	}
+	if len(sealed) != SealedRoomMessageLen(len(message)) {
+		t.Errorf("expected length %d, got %d", SealedRoomMessageLen(len(message)), len(sealed))
+	}
+
+	opened, err := OpenRoomMessage(key, "room-id-123", "user-id-123", sealed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if opened != message {
+		t.Errorf("expected %q, got %q", message, opened)
+	}
+
+	// 別の送信者、別のチャットルーム、別の鍵、平文のメッセージはどれも復号できない
+	otherKey := bytes.Repeat([]byte{8}, RoomKeyLen)
+	cases := []struct {
+		name     string
+		key      []byte
+		roomID   string
+		senderID string
+		message  string
+	}{
+		{"other sender", key, "room-id-123", "user-id-456", sealed},
+		{"other room", key, "room-id-456", "user-id-123", sealed},
+		{"other key", otherKey, "room-id-123", "user-id-123", sealed},
+		{"plaintext", key, "room-id-123", "user-id-123", message},
+		{"truncated", key, "room-id-123", "user-id-123", sealed[:len(sealed)-8]},
+	}
+	for _, c := range cases {
+		if _, err := OpenRoomMessage(c.key, c.roomID, c.senderID, c.message); !errors.Is(err, ErrRoomMessageUnreadable) {
+			t.Errorf("%s: expected ErrRoomMessageUnreadable, got %v", c.name, err)
+		}
+	}
+}
+
+func TestSealedRoomMessageFitsFragmentedMessage(t *testing.T) {
+	// 暗号文は json の履歴にもそのまま保存できる文字だけで表す
+	key := bytes.Repeat([]byte{7}, RoomKeyLen)
+	sealed, err := SealRoomMessage(key, "room-id-123", "user-id-123", string([]byte{0xff, 0x00, 0x80}))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, r := range sealed {
+		if r > 0x7e || r < 0x20 {
+			t.Fatalf("expected printable ascii, got %q", sealed)
+		}
+	}
+}
+
+func TestEndToEndSaltInResponses(t *testing.T) {
+	salt := strings.Repeat("ab", EndToEndSaltLen)
+	found, err := CreateExistingChatroomResponse(ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room", PasswordRequired: true, EndToEndSalt: salt})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseChatRoomResponse(found)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.EndToEndSalt != salt {
+		t.Errorf("expected salt %q, got %q", salt, parsed.EndToEndSalt)
+	}
+
+	joined, err := CreateChatRoomJoinResponse(ChatRoomRequest{RoomID: "room-id-123", UserID: "user-id-123", EndToEndSalt: salt})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err = ParseChatRoomResponse(joined)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.EndToEndSalt != salt {
+		t.Errorf("expected salt %q, got %q", salt, parsed.EndToEndSalt)
+	}
+
+	// end-to-end で暗号化しないチャットルームのレスポンスには含めない
+	plain, err := CreateExistingChatroomResponse(ChatRoomRequest{RoomID: "room-id-123", RoomName: "General Room"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(string(plain), "e2e_salt") {
+		t.Errorf("expected no salt in %q", plain)
+	}
+}
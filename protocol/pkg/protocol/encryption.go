@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Datagram encryption
+//
+// 認証しただけのデータグラムは、チャットの内容が平文のままネットワークを流れる
+// セッションの Hello / Welcome で FeatureEncryption が合意された場合は、データグラムの message を AES-256-GCM で暗号化する
+//
+// - 鍵は作成・参加・再開のレスポンスで受け取る SessionKey から HKDF-SHA256 で導出し、送信する方向ごとに別の鍵を使う
+// - 暗号化したデータグラムは operation / kind に encryptFlag を立て、message を同じ長さの暗号文に置き換えて、末尾に次のトレーラーを追加する
+//   クライアントからサーバー: | counter: 8byte (uint64, big endian) | tag: 16byte |
+//     nonce は 4 byte の 0 と counter で、counter は認証トレーラーと同じくセッションごとに 1 から増やす
+//     SessionKey は作成・参加・再開のたびに発行し直すので、同じ鍵で nonce が重複することはない
+//   サーバーからクライアント: | nonce: 12byte | tag: 16byte |
+//     サーバーは再起動しても同じ SessionKey で配信を続けるので、nonce には乱数を使う
+// - message より前のバイト列 (flag を立てたヘッダ、フラグメントヘッダ、id など) は暗号化せずに、追加の認証データとして改ざんを検出する
+//   サーバーは復号できないデータグラムを、認証できないデータグラムと同じく破棄する
+
+const (
+	encryptFlag byte = 0x20
+
+	sealNonceLen = 12
+	sealTagLen   = 16
+	// DatagramSealLen はクライアントが暗号化したデータグラムに追加するトレーラーの長さ (DatagramAuthLen より短い)
+	DatagramSealLen = datagramCounterLen + sealTagLen
+	// BroadcastSealLen は暗号化した配信に追加するトレーラーの長さで、暗号化する配信はこの分だけ MTU より短く分割する
+	BroadcastSealLen = sealNonceLen + sealTagLen
+)
+
+// 一方の方向の暗号文を反対の方向へ送り返されても復号できないよう、方向ごとに別の鍵を導出する
+const (
+	clientSealLabel = "chat-protocol datagram client to server"
+	serverSealLabel = "chat-protocol datagram server to client"
+)
+
+// ErrDatagramNotEncrypted は暗号化が必要なデータグラムが暗号化されていないことを示す
+var ErrDatagramNotEncrypted = errors.New("datagram is not encrypted")
+
+// NewDatagramSealer は SessionKey から導出した鍵で、データグラムの message を暗号化する DatagramSigner を作成する
+func NewDatagramSealer(key []byte) (*DatagramSigner, error) {
+	aead, err := newSealCipher(key, clientSealLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &DatagramSigner{key: key, aead: aead}, nil
+}
+
+// Encrypted は受信したデータグラムが暗号化されていたかどうかを返す
+func (chat ChatMessage) Encrypted() bool {
+	return chat.auth != nil && chat.auth.encrypted
+}
+
+// sealChatDatagram は CreateChatRequest で作成したデータグラムの message を counter の nonce で暗号化する
+func sealChatDatagram(aead cipher.AEAD, datagram []byte, counter uint64) ([]byte, error) {
+	messageSize := int(binary.BigEndian.Uint16(datagram[4:chatHeaderLen]))
+	if len(datagram) < chatHeaderLen+messageSize {
+		return nil, &ChatFormatError{Field: "message", Err: ErrChatTruncated}
+	}
+	body := len(datagram) - messageSize
+
+	sealed := make([]byte, 0, len(datagram)+DatagramSealLen)
+	sealed = append(sealed, datagram[:body]...)
+	sealed[1] |= encryptFlag
+	ciphertext := aead.Seal(nil, counterNonce(counter), datagram[body:], sealed)
+
+	sealed = append(sealed, ciphertext[:messageSize]...)
+	sealed = binary.BigEndian.AppendUint64(sealed, counter)
+	return append(sealed, ciphertext[messageSize:]...), nil
+}
+
+// open は暗号化されていた message を復号した ChatMessage を返す
+func (chat ChatMessage) open(key []byte) (ChatMessage, error) {
+	aead, err := newSealCipher(key, clientSealLabel)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	// ParseChatRequest で message がトレーラーの直前まで続いていることは確認している
+	body := chat.auth.signed
+	additional := body[:len(body)-len(chat.Message)]
+	ciphertext := make([]byte, 0, len(chat.Message)+sealTagLen)
+	ciphertext = append(ciphertext, chat.Message...)
+	ciphertext = append(ciphertext, chat.auth.mac...)
+
+	plaintext, err := aead.Open(nil, counterNonce(chat.auth.counter), ciphertext, additional)
+	if err != nil {
+		return ChatMessage{}, ErrDatagramForged
+	}
+	chat.Message = string(plaintext)
+	return chat, nil
+}
+
+// SealBroadcast は CreateBroadcast で作成した配信の message を、配信先のユーザーの SessionKey から導出した鍵で暗号化する
+// 再送する時は同じバイト列をそのまま送信する
+func SealBroadcast(key []byte, datagram []byte) ([]byte, error) {
+	if len(datagram) < broadcastHeaderLen {
+		return nil, &ChatFormatError{Field: "header", Err: ErrChatTruncated}
+	}
+	messageSize := int(binary.BigEndian.Uint16(datagram[21:broadcastHeaderLen]))
+	if len(datagram) < broadcastHeaderLen+messageSize {
+		return nil, &ChatFormatError{Field: "message", Err: ErrChatTruncated}
+	}
+	aead, err := newSealCipher(key, serverSealLabel)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, sealNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	body := len(datagram) - messageSize
+
+	sealed := make([]byte, 0, len(datagram)+BroadcastSealLen)
+	sealed = append(sealed, datagram[:body]...)
+	sealed[1] |= encryptFlag
+	ciphertext := aead.Seal(nil, nonce, datagram[body:], sealed)
+
+	sealed = append(sealed, ciphertext[:messageSize]...)
+	sealed = append(sealed, nonce...)
+	return append(sealed, ciphertext[messageSize:]...), nil
+}
+
+// OpenBroadcast は SealBroadcast で暗号化された配信を復号し、ParseBroadcast で解析できるバイト列に戻す
+// 暗号化されていない配信には ErrDatagramNotEncrypted を、復号できない配信には ErrDatagramForged を返す
+func OpenBroadcast(key []byte, datagram []byte) ([]byte, error) {
+	if len(datagram) < broadcastHeaderLen {
+		return nil, &ChatFormatError{Field: "header", Err: ErrChatTruncated}
+	}
+	if datagram[1]&encryptFlag == 0 {
+		return nil, ErrDatagramNotEncrypted
+	}
+	if len(datagram) < broadcastHeaderLen+BroadcastSealLen {
+		return nil, &ChatFormatError{Field: "seal", Err: ErrChatTruncated}
+	}
+	trailer := len(datagram) - BroadcastSealLen
+	body := datagram[:trailer]
+	messageSize := int(binary.BigEndian.Uint16(body[21:broadcastHeaderLen]))
+	if len(body) < broadcastHeaderLen+messageSize {
+		return nil, &ChatFormatError{Field: "message", Err: ErrChatTruncated}
+	}
+	additional := body[:len(body)-messageSize]
+	ciphertext := make([]byte, 0, messageSize+sealTagLen)
+	ciphertext = append(ciphertext, body[len(additional):]...)
+	ciphertext = append(ciphertext, datagram[trailer+sealNonceLen:]...)
+
+	aead, err := newSealCipher(key, serverSealLabel)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, datagram[trailer:trailer+sealNonceLen], ciphertext, additional)
+	if err != nil {
+		return nil, ErrDatagramForged
+	}
+
+	opened := make([]byte, 0, len(additional)+len(plaintext))
+	opened = append(opened, additional...)
+	opened[1] &^= encryptFlag
+	return append(opened, plaintext...), nil
+}
+
+func newSealCipher(key []byte, label string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveSealKey(key, label))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveSealKey は RFC 5869 の HKDF-SHA256 (salt なし) で、SessionKey から label の用途の 32 byte の鍵を導出する
+func deriveSealKey(key []byte, label string) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(key)
+	prk := extract.Sum(nil)
+
+	// 必要な長さはハッシュ 1 つ分なので、T(1) = HMAC(PRK, info || 0x01) だけを計算する
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(label))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, sealNonceLen-datagramCounterLen, sealNonceLen)
+	return binary.BigEndian.AppendUint64(nonce, counter)
+}
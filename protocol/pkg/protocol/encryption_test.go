@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSealer(t *testing.T) (*DatagramSigner, []byte) {
+	t.Helper()
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	sealer, err := NewDatagramSealer(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return sealer, key
+}
+
+func TestSealAndOpenChatDatagram(t *testing.T) {
+	sealer, key := newTestSealer(t)
+	chatMessage := ChatMessage{
+		ChatRoomID: "room-id-123",
+		UserID:     "user-id-123",
+		Message:    "Hello, World!",
+		Fragment:   Fragment{MessageID: 1, Index: 0, Count: 2},
+	}
+	request, err := chatMessage.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var previous []byte
+	for expectedCounter := uint64(1); expectedCounter <= 2; expectedCounter++ {
+		sealed, err := sealer.Sign(request)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(sealed) != len(request)+DatagramSealLen {
+			t.Fatalf("expected length %d, got %d", len(request)+DatagramSealLen, len(sealed))
+		}
+		if bytes.Contains(sealed, []byte(chatMessage.Message)) {
+			t.Fatal("expected message not to be sent as plaintext")
+		}
+		// counter が変わるので、同じメッセージでも暗号文は変わる
+		if bytes.Equal(sealed, previous) {
+			t.Fatal("expected ciphertext to differ for each datagram")
+		}
+		previous = sealed
+
+		parsed, err := ParseChatRequest(sealed)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !parsed.Encrypted() {
+			t.Fatal("expected datagram to be encrypted")
+		}
+		if parsed.ChatRoomID != chatMessage.ChatRoomID || parsed.UserID != chatMessage.UserID || parsed.Fragment != chatMessage.Fragment {
+			t.Errorf("unexpected message %+v", parsed)
+		}
+
+		opened, counter, err := parsed.Verify(key)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if counter != expectedCounter {
+			t.Errorf("expected counter %d, got %d", expectedCounter, counter)
+		}
+		if opened.Operation != ChatOperationSendMessage || opened.Message != chatMessage.Message {
+			t.Errorf("unexpected message %+v", opened)
+		}
+	}
+}
+
+func TestOpenRejectsTamperedChatDatagram(t *testing.T) {
+	sealer, key := newTestSealer(t)
+	request, err := ChatMessage{ChatRoomID: "room-id-123", UserID: "user-id-123", Message: "Hello"}.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	sealed, err := sealer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// 暗号文、平文のままの id、counter のどれを書き換えても復号できない
+	for _, index := range []int{len(sealed) - DatagramSealLen - 1, chatHeaderLen, len(sealed) - sealTagLen - 1} {
+		tampered := bytes.Clone(sealed)
+		tampered[index] ^= 0x01
+		parsed, err := ParseChatRequest(tampered)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, _, err := parsed.Verify(key); !errors.Is(err, ErrDatagramForged) {
+			t.Errorf("byte %d: expected ErrDatagramForged, got %v", index, err)
+		}
+	}
+
+	otherKey, _ := NewSessionKey()
+	parsed, err := ParseChatRequest(sealed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, _, err := parsed.Verify(otherKey); !errors.Is(err, ErrDatagramForged) {
+		t.Errorf("expected ErrDatagramForged, got %v", err)
+	}
+
+	// 署名しただけのデータグラムは暗号化されていない
+	signed, err := NewDatagramSigner(key).Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err = ParseChatRequest(signed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Encrypted() {
+		t.Error("expected signed datagram not to be encrypted")
+	}
+}
+
+func TestParseChatRequestTruncatedSeal(t *testing.T) {
+	datagram := []byte{ChatProtocolVersion, ChatOperationHeartbeat | encryptFlag, 0, 0, 0, 0, 1, 2, 3}
+
+	_, err := ParseChatRequest(datagram)
+	var formatErr *ChatFormatError
+	if !errors.As(err, &formatErr) || formatErr.Field != "auth" || !errors.Is(err, ErrChatTruncated) {
+		t.Errorf("expected truncated auth error, got %v", err)
+	}
+}
+
+func TestSealMaxLengthChatDatagram(t *testing.T) {
+	sealer, key := newTestSealer(t)
+	chatMessage := ChatMessage{
+		ChatRoomID: strings.Repeat("r", ChatIDBytesMaxLen),
+		UserID:     strings.Repeat("u", ChatIDBytesMaxLen),
+		Message:    strings.Repeat("m", ChatMessageBytesMaxLen),
+		Fragment:   Fragment{MessageID: 1, Index: 0, Count: 2},
+	}
+	request, err := chatMessage.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	sealed, err := sealer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseChatRequest(sealed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	opened, _, err := parsed.Verify(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if opened.Message != chatMessage.Message {
+		t.Error("expected message to be restored")
+	}
+}
+
+func TestSealAndOpenBroadcast(t *testing.T) {
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	broadcast := Broadcast{
+		Kind:       BroadcastKindUserMessage,
+		RoomID:     "room-id-123",
+		SenderID:   "user-id-123",
+		SenderName: "alice",
+		Timestamp:  time.UnixMilli(1700000000000),
+		Sequence:   42,
+		Message:    "Hello, World!",
+		Fragment:   Fragment{MessageID: 42, Index: 1, Count: 2},
+	}
+	datagram, err := broadcast.CreateBroadcast()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	sealed, err := SealBroadcast(key, datagram)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(sealed) != len(datagram)+BroadcastSealLen {
+		t.Fatalf("expected length %d, got %d", len(datagram)+BroadcastSealLen, len(sealed))
+	}
+	if bytes.Contains(sealed, []byte(broadcast.Message)) {
+		t.Fatal("expected message not to be sent as plaintext")
+	}
+	// nonce は乱数なので、同じ配信を暗号化し直しても暗号文は変わる
+	again, err := SealBroadcast(key, datagram)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Fatal("expected ciphertext to differ for each seal")
+	}
+
+	opened, err := OpenBroadcast(key, sealed)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(opened, datagram) {
+		t.Fatalf("expected opened datagram to match the original")
+	}
+	parsed, err := ParseBroadcast(opened)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Message != broadcast.Message || parsed.Sequence != broadcast.Sequence || parsed.Fragment != broadcast.Fragment {
+		t.Errorf("unexpected broadcast %+v", parsed)
+	}
+}
+
+func TestOpenBroadcastRejectsInvalidDatagram(t *testing.T) {
+	key, _ := NewSessionKey()
+	datagram, err := Broadcast{Kind: BroadcastKindJoin, RoomID: "room-id-123", Sequence: 7, Message: "bob is logged in"}.CreateBroadcast()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, err := OpenBroadcast(key, datagram); !errors.Is(err, ErrDatagramNotEncrypted) {
+		t.Errorf("expected ErrDatagramNotEncrypted, got %v", err)
+	}
+
+	sealed, err := SealBroadcast(key, datagram)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// sequence を書き換えた配信は復号できない
+	tampered := bytes.Clone(sealed)
+	tampered[20] ^= 0x01
+	if _, err := OpenBroadcast(key, tampered); !errors.Is(err, ErrDatagramForged) {
+		t.Errorf("expected ErrDatagramForged, got %v", err)
+	}
+
+	otherKey, _ := NewSessionKey()
+	if _, err := OpenBroadcast(otherKey, sealed); !errors.Is(err, ErrDatagramForged) {
+		t.Errorf("expected ErrDatagramForged, got %v", err)
+	}
+
+	// クライアントが暗号化したデータグラムを配信として送り返されても復号できない
+	sealer, err := NewDatagramSealer(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	request, err := ChatMessage{ChatRoomID: "room-id-123", UserID: "user-id-123", Message: "bob is logged in"}.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	reflected, err := sealer.Sign(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := OpenBroadcast(key, reflected); err == nil {
+		t.Error("expected reflected datagram to be rejected")
+	}
+}
+
+func TestDeriveSealKey(t *testing.T) {
+	// RFC 5869 A.3 (salt, info なし) の IKM と OKM の先頭 32 byte
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	expected := []byte{
+		0x8d, 0xa4, 0xe7, 0x75, 0xa5, 0x63, 0xc1, 0x8f, 0x71, 0x5f, 0x80, 0x2a, 0x06, 0x3c, 0x5a, 0x31,
+		0xb8, 0xa1, 0x1f, 0x5c, 0x5e, 0xe1, 0x87, 0x9e, 0xc3, 0x45, 0x4e, 0x5f, 0x3c, 0x73, 0x8d, 0x2d,
+	}
+	if key := deriveSealKey(ikm, ""); !bytes.Equal(key, expected) {
+		t.Errorf("expected %x, got %x", expected, key)
+	}
+	if bytes.Equal(deriveSealKey(ikm, clientSealLabel), deriveSealKey(ikm, serverSealLabel)) {
+		t.Error("expected keys for each direction to differ")
+	}
+}
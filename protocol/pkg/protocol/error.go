@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ErrorCode は StateFail / StateInvalid のレスポンスで、リクエストが処理されなかった理由を表す
+type ErrorCode byte
+
+const (
+	ErrorCodeInternal ErrorCode = iota
+	ErrorCodeMalformedRequest
+	ErrorCodeUnsupportedVersion
+	ErrorCodeRoomNotFound
+	ErrorCodeWrongPassword
+	ErrorCodeNameTaken
+	ErrorCodeRoomFull
+	ErrorCodeRateLimited
+	ErrorCodeNotMember
+	// ErrorCodeLockedOut はパスワードの試行に失敗し続けたため、送信元やチャットルームへの参加を一時的に締め出していることを表す
+	ErrorCodeLockedOut
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrorCodeInternal:
+		return "internal"
+	case ErrorCodeMalformedRequest:
+		return "malformed_request"
+	case ErrorCodeUnsupportedVersion:
+		return "unsupported_version"
+	case ErrorCodeRoomNotFound:
+		return "room_not_found"
+	case ErrorCodeWrongPassword:
+		return "wrong_password"
+	case ErrorCodeNameTaken:
+		return "name_taken"
+	case ErrorCodeRoomFull:
+		return "room_full"
+	case ErrorCodeRateLimited:
+		return "rate_limited"
+	case ErrorCodeNotMember:
+		return "not_member"
+	case ErrorCodeLockedOut:
+		return "locked_out"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(code))
+	}
+}
+
+// ErrorResponse は StateFail / StateInvalid のレスポンスの payload
+// Operation にはエラーの原因となったリクエストの operation が入る
+type ErrorResponse struct {
+	Code      ErrorCode `json:"code"`
+	Operation byte      `json:"operation"`
+	Message   string    `json:"message"`
+	// RetryAfterMillis は ErrorCodeRateLimited と ErrorCodeLockedOut の時に、リクエストを再び受け付けられるようになるまでの時間 (ミリ秒)
+	RetryAfterMillis int64 `json:"retry_after_ms,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// RetryAfter はリクエストを再び受け付けられるようになるまでの時間を返し、サーバーが通知していない時は 0 を返す
+func (e *ErrorResponse) RetryAfter() time.Duration {
+	return time.Duration(e.RetryAfterMillis) * time.Millisecond
+}
+
+// createErrorResponse はエラーの payload を持つレスポンスのバイト列を作成する
+func createErrorResponse(state byte, errorResponse ErrorResponse) ([]byte, error) {
+	jsonData, err := json.Marshal(errorResponse)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, err
+	}
+
+	return encodeChatRoomProtocol(ProtocolVersion, errorResponse.Operation, state, jsonData)
+}
+
+// parseErrorPayload は StateFail / StateInvalid のレスポンスの payload を解析する
+// json として読めない payload は古いサーバーが送る自由文とみなし、そのまま Message に入れる
+func parseErrorPayload(operation byte, payload []byte) *ErrorResponse {
+	errorResponse := ErrorResponse{}
+	if err := json.Unmarshal(payload, &errorResponse); err != nil {
+		return &ErrorResponse{
+			Code:      ErrorCodeInternal,
+			Operation: operation,
+			Message:   string(payload),
+		}
+	}
+	return &errorResponse
+}
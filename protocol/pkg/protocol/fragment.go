@@ -0,0 +1,301 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Fragment header
+//
+// 1 つのデータグラムに収まらない長さのメッセージは、送信側で MTU 以下のデータグラムに分割して送信し、受信側で組み立て直す
+// 分割されたデータグラムは operation (Chat Message Protocol) / kind (Chat Broadcast Protocol) の最上位 bit に
+// fragmentFlag を立て、固定長のヘッダの直後に次のフラグメントヘッダを置く
+// | message_id: 4byte (uint32, big endian) | fragment_index: 2byte (uint16, big endian) | fragment_count: 2byte (uint16, big endian) |
+//
+// message_id は送信元ごとに分割したメッセージを区別するための番号
+// クライアントは自身で番号を振り、サーバーからの配信では sequence の下位 32 bit を使う
+// 1 つのメッセージのフラグメントはすべて同じ sequence で配信される
+type Fragment struct {
+	MessageID uint32
+	Index     uint16
+	Count     uint16
+}
+
+const (
+	fragmentFlag      byte = 0x80
+	fragmentHeaderLen      = 8
+
+	// DefaultMTU は分割せずに送信するデータグラムの最大長 (byte)
+	DefaultMTU = 1200
+	// MinMTU は MTU として指定できる最小値で、ヘッダと id を含めても 1 byte 以上のメッセージを運べる長さ
+	MinMTU = 256
+	// FragmentedMessageBytesMaxLen は分割して送信できるメッセージの最大長 (byte)
+	FragmentedMessageBytesMaxLen = 64 * 1024
+)
+
+var (
+	// ErrFragmentInvalid はフラグメントヘッダの内容が矛盾していることを示す
+	ErrFragmentInvalid = errors.New("invalid fragment")
+	// ErrFragmentedMessageTooLarge は組み立てたメッセージが許容される長さを超えることを示す
+	ErrFragmentedMessageTooLarge = errors.New("fragmented message is too large")
+	// ErrReassemblyBufferFull は組み立て途中のメッセージが保持できる上限に達していることを示す
+	ErrReassemblyBufferFull = errors.New("reassembly buffer is full")
+)
+
+// IsFragmented は分割されたメッセージのフラグメントであるかどうかを返す
+func (f Fragment) IsFragmented() bool {
+	return f.Count > 0
+}
+
+func (f Fragment) validate() error {
+	if f.IsFragmented() && f.Index >= f.Count {
+		return ErrFragmentInvalid
+	}
+	return nil
+}
+
+// appendFragmentHeader は分割されたメッセージの場合にフラグメントヘッダを追加する
+func appendFragmentHeader(buf []byte, f Fragment) []byte {
+	if !f.IsFragmented() {
+		return buf
+	}
+	buf = binary.BigEndian.AppendUint32(buf, f.MessageID)
+	buf = binary.BigEndian.AppendUint16(buf, f.Index)
+	return binary.BigEndian.AppendUint16(buf, f.Count)
+}
+
+// parseFragmentHeader は operation / kind に fragmentFlag が立っている時にフラグメントヘッダを読み取り、
+// fragmentFlag を取り除いた operation / kind と残りのバイト列を返す
+func parseFragmentHeader(operation byte, payload []byte) (byte, Fragment, []byte, error) {
+	if operation&fragmentFlag == 0 {
+		return operation, Fragment{}, payload, nil
+	}
+	if len(payload) < fragmentHeaderLen {
+		return 0, Fragment{}, nil, &ChatFormatError{Field: "fragment", Err: ErrChatTruncated}
+	}
+
+	f := Fragment{
+		MessageID: binary.BigEndian.Uint32(payload[0:4]),
+		Index:     binary.BigEndian.Uint16(payload[4:6]),
+		Count:     binary.BigEndian.Uint16(payload[6:fragmentHeaderLen]),
+	}
+	if f.Count == 0 || f.validate() != nil {
+		return 0, Fragment{}, nil, &ChatFormatError{Field: "fragment", Err: ErrFragmentInvalid}
+	}
+	return operation &^ fragmentFlag, f, payload[fragmentHeaderLen:], nil
+}
+
+// splitMessage は message を chunkSize byte ずつに分割する
+// マルチバイト文字の途中で分割されることもあるが、受信側で連結すれば元に戻る
+func splitMessage(message string, chunkSize int) []string {
+	chunks := []string{}
+	for len(message) > chunkSize {
+		chunks = append(chunks, message[:chunkSize])
+		message = message[chunkSize:]
+	}
+	return append(chunks, message)
+}
+
+// fragmentCount は message を chunkSize byte ずつに分割した時のフラグメントの数を返す
+func fragmentCount(message string, chunkSize int) (int, error) {
+	if chunkSize <= 0 || len(message) > FragmentedMessageBytesMaxLen {
+		return 0, ErrFragmentedMessageTooLarge
+	}
+	return max(1, (len(message)+chunkSize-1)/chunkSize), nil
+}
+
+// Fragments は Message がデータグラム 1 つで mtu を超える場合に、mtu 以下のデータグラムに収まる ChatMessage に分割する
+// 分割する必要がない場合は ChatMessage をそのまま 1 つだけ返す
+func (chat ChatMessage) Fragments(messageID uint32, mtu int) ([]ChatMessage, error) {
+	if chatHeaderLen+len(chat.ChatRoomID)+len(chat.UserID)+len(chat.Message) <= mtu && len(chat.Message) <= ChatMessageBytesMaxLen {
+		return []ChatMessage{chat}, nil
+	}
+
+	chunkSize := min(mtu-chatHeaderLen-fragmentHeaderLen-len(chat.ChatRoomID)-len(chat.UserID), ChatMessageBytesMaxLen)
+	count, err := fragmentCount(chat.Message, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	fragments := make([]ChatMessage, 0, count)
+	for i, chunk := range splitMessage(chat.Message, chunkSize) {
+		fragment := chat
+		fragment.Message = chunk
+		fragment.Fragment = Fragment{MessageID: messageID, Index: uint16(i), Count: uint16(count)}
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// Fragments は Message がデータグラム 1 つで mtu を超える場合に、mtu 以下のデータグラムに収まる Broadcast に分割する
+// message_id には sequence の下位 32 bit を使う
+// 分割する必要がない場合は Broadcast をそのまま 1 つだけ返す
+func (b Broadcast) Fragments(mtu int) ([]Broadcast, error) {
+	overhead := broadcastHeaderLen + len(b.RoomID) + len(b.SenderID) + len(b.SenderName)
+	if overhead+len(b.Message) <= mtu && len(b.Message) <= ChatMessageBytesMaxLen {
+		return []Broadcast{b}, nil
+	}
+
+	chunkSize := min(mtu-overhead-fragmentHeaderLen, ChatMessageBytesMaxLen)
+	count, err := fragmentCount(b.Message, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	fragments := make([]Broadcast, 0, count)
+	for i, chunk := range splitMessage(b.Message, chunkSize) {
+		fragment := b
+		fragment.Message = chunk
+		fragment.Fragment = Fragment{MessageID: uint32(b.Sequence), Index: uint16(i), Count: uint16(count)}
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// ReassemblyConfig は Reassembler が組み立て途中のメッセージを保持する期間と量の上限
+type ReassemblyConfig struct {
+	// Timeout を過ぎても揃わないメッセージは破棄する
+	Timeout time.Duration
+	// MaxMessageSize は組み立てたメッセージの最大長 (byte)
+	MaxMessageSize int
+	// MaxPendingBytes は組み立て途中のメッセージ全体で保持する最大のバイト数
+	MaxPendingBytes int
+	// MaxPendingPerSource は送信元ごとに保持する組み立て途中のメッセージの最大数
+	MaxPendingPerSource int
+}
+
+// DefaultReassemblyConfig はサーバーとクライアントが使用する組み立ての設定
+var DefaultReassemblyConfig = ReassemblyConfig{
+	Timeout:             10 * time.Second,
+	MaxMessageSize:      FragmentedMessageBytesMaxLen,
+	MaxPendingBytes:     4 * 1024 * 1024,
+	MaxPendingPerSource: 4,
+}
+
+type reassemblyKey struct {
+	source    string
+	messageID uint32
+}
+
+// partialMessage は組み立て途中のメッセージ
+type partialMessage struct {
+	chunks   []string
+	received []bool
+	count    int
+	size     int
+	started  time.Time
+}
+
+// Reassembler は分割されたメッセージのフラグメントを送信元と message_id ごとに集めて組み立てる
+type Reassembler struct {
+	config       ReassemblyConfig
+	mu           sync.Mutex
+	partials     map[reassemblyKey]*partialMessage
+	pendingBytes int
+}
+
+// NewReassembler は config の上限に従ってメッセージを組み立てる Reassembler を作成する
+func NewReassembler(config ReassemblyConfig) *Reassembler {
+	return &Reassembler{
+		config:   config,
+		partials: make(map[reassemblyKey]*partialMessage),
+	}
+}
+
+// Add は source から受信したフラグメントを追加し、すべてのフラグメントが揃った時に組み立てたメッセージと true を返す
+// 既に受信したフラグメントが重複して届いた時は無視する
+// 上限を超える場合はエラーを返し、そのメッセージの組み立てをやめる
+func (r *Reassembler) Add(source string, fragment Fragment, chunk string, now time.Time) (string, bool, error) {
+	if !fragment.IsFragmented() {
+		return chunk, true, nil
+	}
+	if err := fragment.validate(); err != nil {
+		return "", false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	key := reassemblyKey{source, fragment.MessageID}
+	partial, exists := r.partials[key]
+	if !exists {
+		if r.countBySource(source) >= r.config.MaxPendingPerSource {
+			return "", false, ErrReassemblyBufferFull
+		}
+		partial = &partialMessage{
+			chunks:   make([]string, fragment.Count),
+			received: make([]bool, fragment.Count),
+			started:  now,
+		}
+		r.partials[key] = partial
+	}
+
+	if int(fragment.Count) != len(partial.chunks) {
+		r.drop(key)
+		return "", false, ErrFragmentInvalid
+	}
+	if partial.received[fragment.Index] {
+		return "", false, nil
+	}
+	if partial.size+len(chunk) > r.config.MaxMessageSize {
+		r.drop(key)
+		return "", false, ErrFragmentedMessageTooLarge
+	}
+	if r.pendingBytes+len(chunk) > r.config.MaxPendingBytes {
+		r.drop(key)
+		return "", false, ErrReassemblyBufferFull
+	}
+
+	partial.chunks[fragment.Index] = chunk
+	partial.received[fragment.Index] = true
+	partial.count++
+	partial.size += len(chunk)
+	r.pendingBytes += len(chunk)
+	if partial.count < len(partial.chunks) {
+		return "", false, nil
+	}
+
+	r.drop(key)
+	message := make([]byte, 0, partial.size)
+	for _, c := range partial.chunks {
+		message = append(message, c...)
+	}
+	return string(message), true, nil
+}
+
+// Pending は組み立て途中のメッセージの数を返す
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.partials)
+}
+
+// expire は Timeout を過ぎても揃わないメッセージを破棄する
+func (r *Reassembler) expire(now time.Time) {
+	for key, partial := range r.partials {
+		if now.Sub(partial.started) >= r.config.Timeout {
+			r.drop(key)
+		}
+	}
+}
+
+func (r *Reassembler) drop(key reassemblyKey) {
+	if partial, exists := r.partials[key]; exists {
+		r.pendingBytes -= partial.size
+		delete(r.partials, key)
+	}
+}
+
+func (r *Reassembler) countBySource(source string) int {
+	count := 0
+	for key := range r.partials {
+		if key.source == source {
+			count++
+		}
+	}
+	return count
+}
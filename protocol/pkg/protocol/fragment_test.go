@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// MTU を超えるメッセージが MTU 以下のデータグラムに分割され、順番が入れ替わったり重複したりしても組み立て直せることを確認する
+func TestChatMessageFragmentsRoundTrip(t *testing.T) {
+	original := ChatMessage{
+		ChatRoomID: "123e4567-e89b-12d3-a456-426614174000",
+		UserID:     "123e4567-e89b-12d3-a456-426614174001",
+		Message:    strings.Repeat("スタックトレース\n", 2000),
+	}
+	const mtu = 512
+
+	fragments, err := original.Fragments(42, mtu)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(fragments) < 2 {
+		t.Fatalf("expected message to be fragmented, got %d fragments", len(fragments))
+	}
+
+	datagrams := [][]byte{}
+	for _, fragment := range fragments {
+		datagram, err := fragment.CreateChatRequest(ChatOperationSendMessage)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(datagram) > mtu {
+			t.Fatalf("expected datagram to be <= %d bytes, got %d", mtu, len(datagram))
+		}
+		datagrams = append(datagrams, datagram)
+	}
+
+	// 順番を入れ替え、一部を重複させる
+	shuffled := append(datagrams, datagrams[0], datagrams[len(datagrams)-1])
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	reassembler := NewReassembler(DefaultReassemblyConfig)
+	completed := 0
+	var message string
+	for _, datagram := range shuffled {
+		chat, err := ParseChatRequest(datagram)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if chat.Operation != ChatOperationSendMessage || chat.Fragment.MessageID != 42 {
+			t.Fatalf("unexpected fragment %+v", chat.Fragment)
+		}
+		assembled, complete, err := reassembler.Add(chat.UserID, chat.Fragment, chat.Message, time.Now())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if complete {
+			completed++
+			message = assembled
+		}
+	}
+
+	if completed != 1 {
+		t.Fatalf("expected message to be completed once, got %d", completed)
+	}
+	if message != original.Message {
+		t.Errorf("expected reassembled message to equal the original (%d bytes), got %d bytes", len(original.Message), len(message))
+	}
+}
+
+func TestBroadcastFragmentsRoundTrip(t *testing.T) {
+	original := Broadcast{
+		Kind:       BroadcastKindUserMessage,
+		RoomID:     "room",
+		SenderID:   "user",
+		SenderName: "Alice",
+		Timestamp:  time.UnixMilli(1760000000123),
+		Sequence:   1<<32 + 9,
+		Message:    strings.Repeat("x", FragmentedMessageBytesMaxLen),
+	}
+
+	fragments, err := original.Fragments(DefaultMTU)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	reassembler := NewReassembler(DefaultReassemblyConfig)
+	for i, fragment := range fragments {
+		datagram, err := fragment.CreateBroadcast()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(datagram) > DefaultMTU {
+			t.Fatalf("expected datagram to be <= %d bytes, got %d", DefaultMTU, len(datagram))
+		}
+
+		parsed, err := ParseBroadcast(datagram)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if parsed.Kind != original.Kind || parsed.Sequence != original.Sequence || parsed.Fragment.MessageID != 9 {
+			t.Fatalf("unexpected fragment %+v", parsed)
+		}
+
+		message, complete, err := reassembler.Add(parsed.RoomID, parsed.Fragment, parsed.Message, time.Now())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if complete != (i == len(fragments)-1) {
+			t.Fatalf("fragment %d: unexpected completion %v", i, complete)
+		}
+		if complete && message != original.Message {
+			t.Errorf("expected reassembled message to equal the original")
+		}
+	}
+}
+
+// MTU に収まるメッセージは分割しない
+func TestFragmentsNotNeeded(t *testing.T) {
+	chat := ChatMessage{ChatRoomID: "room", UserID: "user", Message: "hello"}
+	fragments, err := chat.Fragments(1, DefaultMTU)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(fragments) != 1 || fragments[0].Fragment.IsFragmented() {
+		t.Fatalf("expected 1 unfragmented message, got %+v", fragments)
+	}
+
+	datagram, _ := fragments[0].CreateChatRequest(ChatOperationSendMessage)
+	if datagram[1] != ChatOperationSendMessage {
+		t.Errorf("expected operation %d, got %d", ChatOperationSendMessage, datagram[1])
+	}
+
+	if _, err := (ChatMessage{Message: strings.Repeat("x", FragmentedMessageBytesMaxLen+1)}).Fragments(1, DefaultMTU); !errors.Is(err, ErrFragmentedMessageTooLarge) {
+		t.Errorf("expected %v, got %v", ErrFragmentedMessageTooLarge, err)
+	}
+}
+
+func TestParseFragmentErrors(t *testing.T) {
+	valid, err := ChatMessage{ChatRoomID: "room", UserID: "user", Message: "hello", Fragment: Fragment{MessageID: 1, Index: 0, Count: 2}}.CreateChatRequest(ChatOperationSendMessage)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	invalidIndex := bytes.Clone(valid)
+	invalidIndex[chatHeaderLen+5] = 2
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"truncated fragment header", valid[:chatHeaderLen+fragmentHeaderLen-1], ErrChatTruncated},
+		{"index out of range", invalidIndex, ErrFragmentInvalid},
+	}
+	for _, c := range cases {
+		_, err := ParseChatRequest(c.data)
+		var formatErr *ChatFormatError
+		if !errors.As(err, &formatErr) || formatErr.Field != "fragment" || !errors.Is(err, c.err) {
+			t.Errorf("%s: expected fragment %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	_, err = ChatMessage{Fragment: Fragment{Index: 3, Count: 3}}.CreateChatRequest(ChatOperationSendMessage)
+	if !errors.Is(err, ErrFragmentInvalid) {
+		t.Errorf("expected %v, got %v", ErrFragmentInvalid, err)
+	}
+}
+
+// 組み立て途中のメッセージは期限と量の上限を超えて保持しない
+func TestReassemblerLimits(t *testing.T) {
+	now := time.Now()
+	config := ReassemblyConfig{
+		Timeout:             time.Second,
+		MaxMessageSize:      10,
+		MaxPendingBytes:     16,
+		MaxPendingPerSource: 2,
+	}
+	reassembler := NewReassembler(config)
+
+	// メッセージ全体が MaxMessageSize を超える
+	reassembler.Add("alice", Fragment{MessageID: 1, Index: 0, Count: 3}, "123456", now)
+	if _, _, err := reassembler.Add("alice", Fragment{MessageID: 1, Index: 1, Count: 3}, "123456", now); !errors.Is(err, ErrFragmentedMessageTooLarge) {
+		t.Errorf("expected %v, got %v", ErrFragmentedMessageTooLarge, err)
+	}
+	if pending := reassembler.Pending(); pending != 0 {
+		t.Errorf("expected oversized message to be dropped, got %d pending", pending)
+	}
+
+	// 送信元ごとの上限
+	reassembler.Add("alice", Fragment{MessageID: 2, Index: 0, Count: 2}, "a", now)
+	reassembler.Add("alice", Fragment{MessageID: 3, Index: 0, Count: 2}, "a", now)
+	if _, _, err := reassembler.Add("alice", Fragment{MessageID: 4, Index: 0, Count: 2}, "a", now); !errors.Is(err, ErrReassemblyBufferFull) {
+		t.Errorf("expected %v, got %v", ErrReassemblyBufferFull, err)
+	}
+
+	// 全体で保持するバイト数の上限
+	reassembler.Add("bob", Fragment{MessageID: 1, Index: 0, Count: 2}, "1234567890", now)
+	if _, _, err := reassembler.Add("carol", Fragment{MessageID: 1, Index: 0, Count: 2}, "12345", now); !errors.Is(err, ErrReassemblyBufferFull) {
+		t.Errorf("expected %v, got %v", ErrReassemblyBufferFull, err)
+	}
+
+	// フラグメントの数が食い違う
+	if _, _, err := reassembler.Add("alice", Fragment{MessageID: 2, Index: 2, Count: 3}, "a", now); !errors.Is(err, ErrFragmentInvalid) {
+		t.Errorf("expected %v, got %v", ErrFragmentInvalid, err)
+	}
+
+	// 期限を過ぎたものは破棄される
+	if _, complete, _ := reassembler.Add("alice", Fragment{MessageID: 3, Index: 1, Count: 2}, "b", now.Add(time.Second)); complete {
+		t.Errorf("expected expired message not to be completed")
+	}
+	if pending := reassembler.Pending(); pending != 1 {
+		t.Errorf("expected only the new partial message to be pending, got %d", pending)
+	}
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+)
+
+// FramedConn は tcp 接続の上で ChatRoomProtocol をフレーム (ヘッダ + payload) 単位で読み書きする
+// tcp では 1 回の Read が 1 つのメッセージに対応するとは限らないため、
+// ヘッダに記載された長さの分だけ読み取りを繰り返してフレームを組み立てる
+type FramedConn struct {
+	rw io.ReadWriter
+	// MaxPayloadSize を超える payload を持つフレームは読み取らずに ErrPayloadTooLarge を返す
+	MaxPayloadSize int
+}
+
+// NewFramedConn は rw を FramedConn で包む
+func NewFramedConn(rw io.ReadWriter) *FramedConn {
+	return &FramedConn{
+		rw:             rw,
+		MaxPayloadSize: ChatRoomPayloadMaxLen,
+	}
+}
+
+// ReadFrame はフレームを 1 つ読み取り、ヘッダを含むバイト列として返す
+// フレームの途中で接続が閉じられた時は io.ErrUnexpectedEOF を、
+// フレームの境界で閉じられた時は io.EOF を返す
+func (fc *FramedConn) ReadFrame() ([]byte, error) {
+	header := make([]byte, chatRoomHeaderLen)
+
+	// 先頭の 1 byte で legacy のヘッダかどうかを判断する
+	if _, err := io.ReadFull(fc.rw, header[:1]); err != nil {
+		return nil, err
+	}
+
+	read := 1
+	headerLen := legacyHeaderLen
+	if header[0] == versionMarker {
+		// バージョンを読み取り、未知のバージョンなら残りを読まずに返す
+		if _, err := fc.readFull(header[1:2]); err != nil {
+			return nil, err
+		}
+		if header[1] != ProtocolVersion {
+			return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[1])
+		}
+		read = 2
+		headerLen = chatRoomHeaderLen
+	}
+
+	if _, err := fc.readFull(header[read:headerLen]); err != nil {
+		return nil, err
+	}
+	header = header[:headerLen]
+
+	decoded, _, err := decodeChatRoomHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if decoded.PayloadSize > fc.MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	frame := make([]byte, headerLen+decoded.PayloadSize)
+	copy(frame, header)
+	if _, err := fc.readFull(frame[headerLen:]); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// WriteFrame はフレームを 1 つ書き込む
+func (fc *FramedConn) WriteFrame(frame []byte) error {
+	n, err := fc.rw.Write(frame)
+	if err != nil {
+		return err
+	}
+	if n != len(frame) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// readFull はフレームの途中で読み取る時に使用し、EOF を io.ErrUnexpectedEOF として返す
+func (fc *FramedConn) readFull(buf []byte) (int, error) {
+	n, err := io.ReadFull(fc.rw, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
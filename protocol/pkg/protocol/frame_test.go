@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// readWriter は読み込みと書き込みを別々の io.Reader / io.Writer で行う
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func newTestFramedConn(r io.Reader) *FramedConn {
+	return NewFramedConn(readWriter{Reader: r, Writer: io.Discard})
+}
+
+// 1 byte ずつしか読み取れない場合でもフレームを組み立てられることを確認する
+func TestReadFramePartialReads(t *testing.T) {
+	request := ChatRoomRequest{RoomName: strings.Repeat("r", 300), UserName: "Alice", Operation: OperationCreateChatRoom}
+	frame, err := request.CreateRequestProtocol()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	fc := newTestFramedConn(iotest.OneByteReader(bytes.NewReader(frame)))
+	received, err := fc.ReadFrame()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(received, frame) {
+		t.Errorf("expected %v, got %v", frame, received)
+	}
+}
+
+// 複数のフレームが 1 度に届いた場合でも 1 つずつ読み取れることを確認する
+func TestReadFrameCoalesced(t *testing.T) {
+	first, _ := ChatRoomRequest{RoomID: "room-1", Operation: OperationSerchChatRoomByID}.CreateRequestProtocol()
+	second, _ := InvalidRequestResponse(OperationSerchChatRoomByID, ErrorCodeRoomNotFound, "No room exist")
+	legacy := []byte{2, OperationJoinChatRoom, StateRequest, '{', '}'}
+
+	fc := newTestFramedConn(bytes.NewReader(bytes.Join([][]byte{first, second, legacy}, nil)))
+	for _, expected := range [][]byte{first, second, legacy} {
+		received, err := fc.ReadFrame()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(received, expected) {
+			t.Errorf("expected %v, got %v", expected, received)
+		}
+	}
+
+	if _, err := fc.ReadFrame(); err != io.EOF {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestReadFrameUnexpectedEOF(t *testing.T) {
+	frame, _ := ChatRoomRequest{RoomID: "room-1", Operation: OperationSerchChatRoomByID}.CreateRequestProtocol()
+
+	for _, n := range []int{1, 2, chatRoomHeaderLen - 1, chatRoomHeaderLen, len(frame) - 1} {
+		fc := newTestFramedConn(bytes.NewReader(frame[:n]))
+		if _, err := fc.ReadFrame(); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated to %d bytes: expected %v, got %v", n, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestReadFrameOversize(t *testing.T) {
+	header := []byte{0, ProtocolVersion, OperationCreateChatRoom, StateRequest}
+	header = binary.BigEndian.AppendUint32(header, 1024)
+
+	fc := newTestFramedConn(bytes.NewReader(header))
+	fc.MaxPayloadSize = 512
+	if _, err := fc.ReadFrame(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("expected %v, got %v", ErrPayloadTooLarge, err)
+	}
+}
+
+func TestReadFrameUnsupportedVersion(t *testing.T) {
+	fc := newTestFramedConn(bytes.NewReader([]byte{0, ProtocolVersion + 1}))
+	if _, err := fc.ReadFrame(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestReadAckFollowedByFrame(t *testing.T) {
+	ack, _ := AckResponse()
+	response, _ := CreateChatRoomJoinResponse(ChatRoomRequest{RoomID: "room-1", UserID: "user-1"})
+
+	fc := newTestFramedConn(iotest.OneByteReader(bytes.NewReader(append(ack, response...))))
+	if err := ReceiveAckResponse(fc); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	received, err := ReceiveResponse(fc)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if received.RoomID != "room-1" || received.UserID != "user-1" {
+		t.Errorf("unexpected response %+v", received)
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	frame, _ := ChatRoomRequest{RoomID: "room-1"}.CreateRequestProtocol()
+
+	var written bytes.Buffer
+	fc := NewFramedConn(readWriter{Reader: bytes.NewReader(nil), Writer: &written})
+	if err := fc.WriteFrame(frame); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(written.Bytes(), frame) {
+		t.Errorf("expected %v, got %v", frame, written.Bytes())
+	}
+}
@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// クライアントとサーバーが対応している機能
+const (
+	FeatureCompression      = "compression"
+	FeatureEncryption       = "encryption"
+	FeatureReliableDelivery = "reliable_delivery"
+	FeatureHistory          = "history"
+	FeatureFragmentation    = "fragmentation"
+	FeatureHostHandover     = "host_handover"
+	FeatureHeartbeat        = "heartbeat"
+	FeatureSessionResume    = "session_resume"
+	FeatureDatagramAuth     = "datagram_auth"
+	// FeatureEndToEnd はサーバーが EndToEndSalt を保存し、end-to-end で暗号化するチャットルームを作成できることを表す (e2e.go を参照)
+	FeatureEndToEnd = "end_to_end"
+)
+
+// Hello は tcp 接続の最初にクライアントが送信する、自身のバージョンと対応している機能の一覧
+type Hello struct {
+	ProtocolVersion byte     `json:"protocol_version"`
+	ClientName      string   `json:"client_name"`
+	Features        []string `json:"features"`
+}
+
+// Limits はサーバーが受け付ける各フィールドの最大長 (byte)
+// FeatureFragmentation が合意された時の MaxMessageSize は、分割して送信するメッセージ全体の最大長になる
+type Limits struct {
+	MaxMessageSize int `json:"max_message_size"`
+	// MTU はこれを超える長さのデータグラムを分割して送信する長さ
+	MTU         int `json:"mtu"`
+	MaxRoomName int `json:"max_room_name"`
+	MaxUserName int `json:"max_user_name"`
+	MaxPassword int `json:"max_password"`
+	// HeartbeatInterval は FeatureHeartbeat が合意された時に、クライアントが heartbeat を送信する間隔 (ミリ秒)
+	HeartbeatInterval int `json:"heartbeat_interval"`
+}
+
+// Welcome は Hello に対してサーバーが返す、サーバーの情報と双方が対応している機能の一覧
+type Welcome struct {
+	ProtocolVersion byte     `json:"protocol_version"`
+	ServerIdentity  string   `json:"server_identity"`
+	Features        []string `json:"features"`
+	Limits          Limits   `json:"limits"`
+}
+
+// DefaultLimits は Welcome を受け取る前にクライアントが使用する制限
+var DefaultLimits = Limits{
+	MaxMessageSize:    ChatMessageBytesMaxLen,
+	MTU:               DefaultMTU,
+	MaxRoomName:       RoomNameBytesMaxLen,
+	MaxUserName:       UserNameBytesMaxLen,
+	MaxPassword:       RoomPasswordBytesMaxLen,
+	HeartbeatInterval: int(DefaultHeartbeatInterval / time.Millisecond),
+}
+
+// Supports は feature が双方で利用できる機能かどうかを返す
+func (welcome Welcome) Supports(feature string) bool {
+	return slices.Contains(welcome.Features, feature)
+}
+
+// NegotiateFeatures はクライアントとサーバーの双方が対応している機能の一覧を返す
+func NegotiateFeatures(clientFeatures []string, serverFeatures []string) []string {
+	features := []string{}
+	for _, feature := range clientFeatures {
+		if slices.Contains(serverFeatures, feature) && !slices.Contains(features, feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// CreateHelloRequest は Hello をサーバーへ送信するためのバイト列に変換する
+func CreateHelloRequest(hello Hello) ([]byte, error) {
+	jsonData, err := json.Marshal(hello)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, errors.New("failed to generate json data")
+	}
+	return encodeChatRoomProtocol(ProtocolVersion, OperationHello, StateRequest, jsonData)
+}
+
+// ParseHelloRequest はクライアントから受信したフレームを Hello に変換する
+func ParseHelloRequest(frame []byte) (Hello, error) {
+	header, payload, err := decodeChatRoomProtocol(frame)
+	if err != nil {
+		return Hello{}, err
+	}
+	if header.Operation != OperationHello {
+		return Hello{}, fmt.Errorf("expected hello, got operation %d", header.Operation)
+	}
+
+	hello := Hello{}
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return Hello{}, errors.New("invalid payload for hello")
+	}
+	return hello, nil
+}
+
+// IsHelloRequest はフレームが Hello であるかどうかを返す
+// Hello を送信しない古いクライアントのリクエストと区別するために使用する
+func IsHelloRequest(frame []byte) bool {
+	header, _, err := decodeChatRoomProtocol(frame)
+	return err == nil && header.Operation == OperationHello && header.State == StateRequest
+}
+
+// CreateWelcomeResponse は Welcome をクライアントへ送信するためのバイト列に変換する
+func CreateWelcomeResponse(welcome Welcome) ([]byte, error) {
+	jsonData, err := json.Marshal(welcome)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, errors.New("failed to generate json data")
+	}
+	return encodeChatRoomProtocol(ProtocolVersion, OperationHello, StateSuccess, jsonData)
+}
+
+// Handshake はクライアント側で Hello を送信し、サーバーからの Welcome を受信する
+func Handshake(fc *FramedConn, hello Hello) (Welcome, error) {
+	request, err := CreateHelloRequest(hello)
+	if err != nil {
+		return Welcome{}, err
+	}
+	if err := fc.WriteFrame(request); err != nil {
+		return Welcome{}, err
+	}
+
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		return Welcome{}, err
+	}
+	header, payload, err := decodeChatRoomProtocol(frame)
+	if err != nil {
+		return Welcome{}, err
+	}
+	if header.State != StateSuccess {
+		return Welcome{}, parseErrorPayload(header.Operation, payload)
+	}
+	if header.Operation != OperationHello {
+		return Welcome{}, fmt.Errorf("expected welcome, got operation %d", header.Operation)
+	}
+
+	welcome := Welcome{}
+	if err := json.Unmarshal(payload, &welcome); err != nil {
+		return Welcome{}, errors.New("invalid payload for welcome")
+	}
+	return welcome, nil
+}
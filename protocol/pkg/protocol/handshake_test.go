@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestNegotiateFeatures(t *testing.T) {
+	client := []string{FeatureCompression, FeatureHistory, FeatureReliableDelivery, FeatureHistory}
+	server := []string{FeatureHistory, FeatureEncryption, FeatureReliableDelivery}
+
+	negotiated := NegotiateFeatures(client, server)
+	expected := []string{FeatureHistory, FeatureReliableDelivery}
+	if !slices.Equal(negotiated, expected) {
+		t.Errorf("expected %v, got %v", expected, negotiated)
+	}
+
+	if negotiated := NegotiateFeatures(client, nil); negotiated == nil || len(negotiated) != 0 {
+		t.Errorf("expected empty feature list, got %v", negotiated)
+	}
+}
+
+// クライアントの Handshake とサーバー側の Hello の解析・Welcome の送信が噛み合うことを確認する
+func TestHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	hello := Hello{
+		ProtocolVersion: ProtocolVersion,
+		ClientName:      "chat-client",
+		Features:        []string{FeatureHistory, FeatureCompression},
+	}
+	serverFeatures := []string{FeatureHistory}
+
+	received := make(chan Hello, 1)
+	go func() {
+		fc := NewFramedConn(server)
+		frame, err := fc.ReadFrame()
+		if err != nil || !IsHelloRequest(frame) {
+			close(received)
+			return
+		}
+		clientHello, err := ParseHelloRequest(frame)
+		if err != nil {
+			close(received)
+			return
+		}
+		received <- clientHello
+
+		welcome, _ := CreateWelcomeResponse(Welcome{
+			ProtocolVersion: ProtocolVersion,
+			ServerIdentity:  "test-server",
+			Features:        NegotiateFeatures(clientHello.Features, serverFeatures),
+			Limits:          DefaultLimits,
+		})
+		fc.WriteFrame(welcome)
+	}()
+
+	welcome, err := Handshake(NewFramedConn(client), hello)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	clientHello, ok := <-received
+	if !ok {
+		t.Fatal("server failed to read hello")
+	}
+	if clientHello.ClientName != hello.ClientName || !slices.Equal(clientHello.Features, hello.Features) {
+		t.Errorf("expected %+v, got %+v", hello, clientHello)
+	}
+
+	if welcome.ServerIdentity != "test-server" || welcome.Limits != DefaultLimits {
+		t.Errorf("unexpected welcome %+v", welcome)
+	}
+	if !welcome.Supports(FeatureHistory) || welcome.Supports(FeatureCompression) {
+		t.Errorf("expected only %s to be negotiated, got %v", FeatureHistory, welcome.Features)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		fc := NewFramedConn(server)
+		fc.ReadFrame()
+		response, _ := InvalidRequestResponse(OperationHello, ErrorCodeUnsupportedVersion, "unsupported")
+		fc.WriteFrame(response)
+	}()
+
+	_, err := Handshake(NewFramedConn(client), Hello{ProtocolVersion: ProtocolVersion})
+	var errorResponse *ErrorResponse
+	if !errors.As(err, &errorResponse) || errorResponse.Code != ErrorCodeUnsupportedVersion {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
+
+func TestIsHelloRequest(t *testing.T) {
+	hello, _ := CreateHelloRequest(Hello{ProtocolVersion: ProtocolVersion})
+	if !IsHelloRequest(hello) {
+		t.Error("expected hello to be detected")
+	}
+
+	request, _ := ChatRoomRequest{RoomID: "room-1", Operation: OperationSerchChatRoomByID}.CreateRequestProtocol()
+	if IsHelloRequest(request) {
+		t.Error("expected chat room request not to be detected as hello")
+	}
+}
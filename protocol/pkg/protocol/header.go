@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ChatRoomProtocol のヘッダ
+//
+// version 1 (現行):
+// | marker: 1 byte (0x00) | version: 1 byte | operation: 1 byte | state: 1 byte | payload_size: 4 byte (uint32, big endian) | payload |
+//
+// legacy (version 0):
+// | payload_size: 1 byte | operation: 1 byte | state: 1 byte | payload |
+//
+// legacy のリクエストは必ず json の payload を含むため、先頭の 1 byte が 0 になることはない
+// したがって先頭が 0 であればバージョン付きのヘッダ、それ以外は legacy のヘッダとして扱う
+// payload を持たない legacy の ack response ([0, 0, 1]) はサーバーが legacy のクライアントへ送信するだけで、
+// このパッケージが解析することはない
+const (
+	ProtocolVersionLegacy byte = 0
+	ProtocolVersion       byte = 1
+)
+
+const (
+	versionMarker         byte = 0x00
+	legacyHeaderLen            = 3
+	chatRoomHeaderLen          = 8
+	legacyPayloadMaxLen        = 255
+	ChatRoomPayloadMaxLen      = 1 << 20
+)
+
+var (
+	// ErrUnsupportedVersion はヘッダのバージョンがこの実装で扱えないものであることを示す
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrIncompletePacket は受信したバイト列がヘッダに記載された長さに満たないことを示す
+	ErrIncompletePacket = errors.New("recieved packet is not complete")
+	// ErrPayloadTooLarge は payload がヘッダで表現できる長さ、または許容される長さを超えていることを示す
+	ErrPayloadTooLarge = errors.New("payload is too large")
+)
+
+// chatRoomHeader は ChatRoomProtocol のヘッダを表す
+type chatRoomHeader struct {
+	Version     byte
+	Operation   byte
+	State       byte
+	PayloadSize int
+}
+
+// encodeChatRoomProtocol はヘッダとpayloadを連結して、指定されたバージョンの ChatRoomProtocol のバイト列を作成する
+func encodeChatRoomProtocol(version byte, operation byte, state byte, payload []byte) ([]byte, error) {
+	switch version {
+	case ProtocolVersionLegacy:
+		if len(payload) > legacyPayloadMaxLen {
+			return nil, ErrPayloadTooLarge
+		}
+		buf := make([]byte, 0, legacyHeaderLen+len(payload))
+		buf = append(buf, byte(len(payload)), operation, state)
+		return append(buf, payload...), nil
+	case ProtocolVersion:
+		if len(payload) > ChatRoomPayloadMaxLen {
+			return nil, ErrPayloadTooLarge
+		}
+		buf := make([]byte, 0, chatRoomHeaderLen+len(payload))
+		buf = append(buf, versionMarker, version, operation, state)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+		return append(buf, payload...), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+// decodeChatRoomHeader はバイト列の先頭からヘッダを読み取り、ヘッダの長さとともに返す
+// バイト列がヘッダを読み取るのに足りない場合は ErrIncompletePacket を返す
+func decodeChatRoomHeader(buf []byte) (chatRoomHeader, int, error) {
+	if len(buf) < 1 {
+		return chatRoomHeader{}, 0, ErrIncompletePacket
+	}
+
+	// legacy のヘッダ
+	if buf[0] != versionMarker {
+		if len(buf) < legacyHeaderLen {
+			return chatRoomHeader{}, 0, ErrIncompletePacket
+		}
+		return chatRoomHeader{
+			Version:     ProtocolVersionLegacy,
+			PayloadSize: int(buf[0]),
+			Operation:   buf[1],
+			State:       buf[2],
+		}, legacyHeaderLen, nil
+	}
+
+	if len(buf) < 2 {
+		return chatRoomHeader{}, 0, ErrIncompletePacket
+	}
+	if buf[1] != ProtocolVersion {
+		return chatRoomHeader{}, 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, buf[1])
+	}
+	if len(buf) < chatRoomHeaderLen {
+		return chatRoomHeader{}, 0, ErrIncompletePacket
+	}
+
+	payloadSize := binary.BigEndian.Uint32(buf[4:chatRoomHeaderLen])
+	if payloadSize > ChatRoomPayloadMaxLen {
+		return chatRoomHeader{}, 0, ErrPayloadTooLarge
+	}
+
+	return chatRoomHeader{
+		Version:     buf[1],
+		Operation:   buf[2],
+		State:       buf[3],
+		PayloadSize: int(payloadSize),
+	}, chatRoomHeaderLen, nil
+}
+
+// decodeChatRoomProtocol は ChatRoomProtocol のバイト列をヘッダとpayloadに分解する
+func decodeChatRoomProtocol(buf []byte) (chatRoomHeader, []byte, error) {
+	header, headerLen, err := decodeChatRoomHeader(buf)
+	if err != nil {
+		return chatRoomHeader{}, nil, err
+	}
+
+	if len(buf) < headerLen+header.PayloadSize {
+		return chatRoomHeader{}, nil, ErrIncompletePacket
+	}
+	payload := buf[headerLen : headerLen+header.PayloadSize]
+
+	return header, payload, nil
+}
+
+// EncodeForVersion は現行バージョンで作成されたバイト列を、指定されたバージョンのヘッダで作り直す
+// legacy のクライアントへレスポンスを返す移行期間中に使用する
+func EncodeForVersion(frame []byte, version byte) ([]byte, error) {
+	header, payload, err := decodeChatRoomProtocol(frame)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version == version {
+		return frame, nil
+	}
+	return encodeChatRoomProtocol(version, header.Operation, header.State, payload)
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import "time"
+
+// Heartbeat
+//
+// クライアントが exit を送信せずに終了したり通信できなくなったりしても、サーバーからはそれがわからない
+// セッションの Hello / Welcome で FeatureHeartbeat が合意された場合に限り、次の仕組みで応答しなくなったメンバーを取り除く
+//
+// - クライアントはチャットルームに参加している間、Limits.HeartbeatInterval ごとに ChatOperationHeartbeat を送信する
+// - サーバーは heartbeat を含むデータグラムを最後に受信してから一定時間が経ったメンバーをチャットルームから外し、
+//   タイムアウトしたことを残りのメンバーへ配信する
+
+// DefaultHeartbeatInterval は Welcome で間隔が通知されなかった時に heartbeat を送信する間隔
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// CreateHeartbeatRequest はチャットルームに参加し続けていることをサーバーへ知らせる heartbeat のバイト列を作成する
+// resumeToken には FeatureSessionResume が合意された時に発行されたトークンを指定する (ない時や、データグラムを認証する時は空)
+// トークンそのものは含めず、now の時刻で作成した TokenProof を含めるので、heartbeat は送信するたびに作成する
+func CreateHeartbeatRequest(chatRoomID string, userID string, resumeToken string, now time.Time) ([]byte, error) {
+	heartbeat := ChatMessage{
+		ChatRoomID: chatRoomID,
+		UserID:     userID,
+		Message:    CreateTokenProof(ChatOperationHeartbeat, chatRoomID, userID, resumeToken, now),
+	}
+	return heartbeat.CreateChatRequest(ChatOperationHeartbeat)
+}
+
+// HeartbeatPeriod はクライアントが heartbeat を送信する間隔を返す
+// サーバーが間隔を通知しなかった時は DefaultHeartbeatInterval を返す
+func (limits Limits) HeartbeatPeriod() time.Duration {
+	if limits.HeartbeatInterval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return time.Duration(limits.HeartbeatInterval) * time.Millisecond
+}
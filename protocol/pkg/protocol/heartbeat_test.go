@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateHeartbeatRequest(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	request, err := CreateHeartbeatRequest("room-id-123", "user-id-123", "token", now)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	parsed, err := ParseChatRequest(request)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.Operation != ChatOperationHeartbeat {
+		t.Errorf("expected operation %d, got %d", ChatOperationHeartbeat, parsed.Operation)
+	}
+	if parsed.ChatRoomID != "room-id-123" || parsed.UserID != "user-id-123" {
+		t.Errorf("unexpected heartbeat %+v", parsed)
+	}
+
+	// トークンそのものは送信せず、トークンから作成した TokenProof を送信する
+	if strings.Contains(string(request), "token") {
+		t.Error("expected heartbeat not to contain the resume token")
+	}
+	hash := sha256.Sum256([]byte("token"))
+	issued, err := VerifyTokenProof(parsed.Message, ChatOperationHeartbeat, "room-id-123", "user-id-123", hex.EncodeToString(hash[:]))
+	if err != nil || !issued.Equal(now) {
+		t.Errorf("expected proof issued at %v, got %v (error %v)", now, issued, err)
+	}
+
+	// トークンが発行されていない時は何も含めない
+	request, err = CreateHeartbeatRequest("room-id-123", "user-id-123", "", now)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err = ParseChatRequest(request)
+	if err != nil || parsed.Message != "" {
+		t.Errorf("expected empty heartbeat, got %+v (error %v)", parsed, err)
+	}
+}
+
+func TestHeartbeatPeriod(t *testing.T) {
+	tests := []struct {
+		interval int
+		expected time.Duration
+	}{
+		{0, DefaultHeartbeatInterval},
+		{-1, DefaultHeartbeatInterval},
+		{2500, 2500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		limits := Limits{HeartbeatInterval: tt.interval}
+		if got := limits.HeartbeatPeriod(); got != tt.expected {
+			t.Errorf("HeartbeatPeriod() with %d = %v, expected %v", tt.interval, got, tt.expected)
+		}
+	}
+	if got := DefaultLimits.HeartbeatPeriod(); got != DefaultHeartbeatInterval {
+		t.Errorf("expected default limits to use %v, got %v", DefaultHeartbeatInterval, got)
+	}
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// チャットルームの履歴
+//
+// operation = 5 (OperationHistory): チャットルームへの参加が成功した直後に、サーバーがそれまでの配信を送信する
+// operation = 6 (OperationFetchHistory): メンバーが cursor より前の配信を遡って取得する
+// どちらのレスポンスも payload は History を json で表したもの
+
+// HistoryMessage はチャットルームの履歴に記録された 1 件の配信
+type HistoryMessage struct {
+	Kind       byte      `json:"kind"`
+	SenderID   string    `json:"sender_id"`
+	SenderName string    `json:"sender_name"`
+	Timestamp  time.Time `json:"timestamp"`
+	Sequence   uint64    `json:"sequence"`
+	Message    string    `json:"message"`
+}
+
+// History はチャットルームの履歴のうち、クライアントへ送信する範囲
+// Messages は sequence の古い順に並ぶ
+type History struct {
+	RoomID   string           `json:"room_id"`
+	Messages []HistoryMessage `json:"messages"`
+	// HasMore は Messages より前にもサーバーが保持している配信があるかどうか
+	HasMore bool `json:"has_more"`
+}
+
+// HistoryQuery は履歴を遡って取得するためのリクエスト
+// BeforeSequence / Before を指定した時は、それより前に配信されたものだけを新しい方から Limit 件返す
+// 両方とも指定しない時は最新の配信から返す
+type HistoryQuery struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// BeforeSequence が 0 でない時は、sequence がこれより小さい配信だけを返す
+	BeforeSequence uint64 `json:"before_sequence"`
+	// Before がゼロ値でない時は、これより前の時刻に配信されたものだけを返す
+	Before time.Time `json:"before"`
+	Limit  int       `json:"limit"`
+	// ResumeToken は本人であることを示すため、参加した時に発行された ResumeToken を入れる (発行されていない時は空)
+	// user_id は配信や履歴で他のメンバーにも知られているので、サーバーはそれだけでは履歴を返さない
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+const (
+	// DefaultHistoryPageSize は Limit が指定されていない時に返す履歴の数
+	DefaultHistoryPageSize = 20
+	// HistoryPageMaxSize は 1 回のリクエストで返す履歴の最大数
+	HistoryPageMaxSize = 100
+)
+
+// historyEnvelopeLen は History の json のうち Messages 以外の部分に使う長さの見積もり
+const historyEnvelopeLen = 128
+
+// Broadcast は履歴の配信を、配信データグラムと同じ形式で扱えるように変換する
+func (m HistoryMessage) Broadcast(roomID string) Broadcast {
+	return Broadcast{
+		Kind:       m.Kind,
+		RoomID:     roomID,
+		SenderID:   m.SenderID,
+		SenderName: m.SenderName,
+		Timestamp:  m.Timestamp,
+		Sequence:   m.Sequence,
+		Message:    m.Message,
+	}
+}
+
+// PageSize は Limit を 1 から HistoryPageMaxSize の範囲に収めた、実際に返す履歴の数
+func (query HistoryQuery) PageSize() int {
+	if query.Limit <= 0 {
+		return DefaultHistoryPageSize
+	}
+	return min(query.Limit, HistoryPageMaxSize)
+}
+
+// CreateHistoryRequest は HistoryQuery をサーバーへ送信するためのバイト列に変換する
+func CreateHistoryRequest(query HistoryQuery) ([]byte, error) {
+	jsonData, err := json.Marshal(query)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, errors.New("failed to generate json data")
+	}
+	return encodeChatRoomProtocol(ProtocolVersion, OperationFetchHistory, StateRequest, jsonData)
+}
+
+// ParseHistoryRequest はクライアントから受信したフレームを HistoryQuery に変換する
+func ParseHistoryRequest(frame []byte) (HistoryQuery, error) {
+	header, payload, err := decodeChatRoomProtocol(frame)
+	if err != nil {
+		return HistoryQuery{}, err
+	}
+	if header.Operation != OperationFetchHistory {
+		return HistoryQuery{}, fmt.Errorf("expected history request, got operation %d", header.Operation)
+	}
+
+	query := HistoryQuery{}
+	if err := json.Unmarshal(payload, &query); err != nil {
+		return HistoryQuery{}, errors.New("invalid payload for history request")
+	}
+	return query, nil
+}
+
+// CreateHistoryResponse はチャットルームへの参加時に送信する History をバイト列に変換する
+func CreateHistoryResponse(history History) ([]byte, error) {
+	return encodeHistory(OperationHistory, history)
+}
+
+// CreateHistoryPageResponse は HistoryQuery に対する History をバイト列に変換する
+func CreateHistoryPageResponse(history History) ([]byte, error) {
+	return encodeHistory(OperationFetchHistory, history)
+}
+
+// encodeHistory は History をバイト列に変換する
+// すべての配信が payload に収まらない時は、古い配信から省いて新しいものを優先し、HasMore を立てる
+func encodeHistory(operation byte, history History) ([]byte, error) {
+	// 新しい配信から順に、payload に収まる範囲を求める
+	size := historyEnvelopeLen + len(history.RoomID)
+	first := len(history.Messages)
+	for first > 0 {
+		encoded, err := json.Marshal(history.Messages[first-1])
+		if err != nil {
+			fmt.Println("JSON変換エラー", err)
+			return nil, errors.New("failed to generate json data")
+		}
+		if size+len(encoded)+1 > ChatRoomPayloadMaxLen {
+			break
+		}
+		size += len(encoded) + 1
+		first--
+	}
+	if first > 0 {
+		history.Messages = history.Messages[first:]
+		history.HasMore = true
+	}
+
+	jsonData, err := json.Marshal(history)
+	if err != nil {
+		fmt.Println("JSON変換エラー", err)
+		return nil, errors.New("failed to generate json data")
+	}
+	return encodeChatRoomProtocol(ProtocolVersion, operation, StateSuccess, jsonData)
+}
+
+// ParseHistoryResponse はサーバーから受信したフレームを History に変換する
+// エラーのレスポンスを受信した時は *ErrorResponse を返す
+func ParseHistoryResponse(frame []byte) (History, error) {
+	header, payload, err := decodeChatRoomProtocol(frame)
+	if err != nil {
+		return History{}, err
+	}
+	if header.State != StateSuccess {
+		return History{}, parseErrorPayload(header.Operation, payload)
+	}
+	if header.Operation != OperationHistory && header.Operation != OperationFetchHistory {
+		return History{}, fmt.Errorf("expected history, got operation %d", header.Operation)
+	}
+
+	history := History{}
+	if err := json.Unmarshal(payload, &history); err != nil {
+		return History{}, errors.New("invalid payload for history")
+	}
+	return history, nil
+}
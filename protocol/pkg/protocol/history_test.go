@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	timestamp := time.UnixMilli(1760000000123)
+	original := History{
+		RoomID: "room",
+		Messages: []HistoryMessage{
+			{Kind: BroadcastKindJoin, SenderID: "bob", SenderName: "Bob", Timestamp: timestamp, Sequence: 1},
+			{Kind: BroadcastKindUserMessage, SenderID: "bob", SenderName: "Bob", Timestamp: timestamp, Sequence: 2, Message: "こんにちは"},
+		},
+	}
+
+	data, err := CreateHistoryResponse(original)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseHistoryResponse(data)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if parsed.RoomID != original.RoomID || len(parsed.Messages) != len(original.Messages) {
+		t.Fatalf("expected %+v, got %+v", original, parsed)
+	}
+	for i, message := range parsed.Messages {
+		if !message.Timestamp.Equal(timestamp) {
+			t.Errorf("expected timestamp %v, got %v", timestamp, message.Timestamp)
+		}
+		message.Timestamp = timestamp
+		if message != original.Messages[i] {
+			t.Errorf("expected %+v, got %+v", original.Messages[i], message)
+		}
+	}
+
+	b := parsed.Messages[1].Broadcast(parsed.RoomID)
+	if b.RoomID != "room" || b.Sequence != 2 || b.Message != "こんにちは" {
+		t.Errorf("unexpected broadcast %+v", b)
+	}
+}
+
+// payload に収まらない時は古い配信から省く
+func TestHistoryResponseDropsOldest(t *testing.T) {
+	history := History{RoomID: "room"}
+	message := strings.Repeat("x", FragmentedMessageBytesMaxLen)
+	for i := range 20 {
+		history.Messages = append(history.Messages, HistoryMessage{Kind: BroadcastKindUserMessage, Sequence: uint64(i + 1), Message: message})
+	}
+
+	data, err := CreateHistoryResponse(history)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	parsed, err := ParseHistoryResponse(data)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(parsed.Messages) == 0 || len(parsed.Messages) >= len(history.Messages) {
+		t.Fatalf("expected some messages to be dropped, got %d", len(parsed.Messages))
+	}
+	if last := parsed.Messages[len(parsed.Messages)-1].Sequence; last != 20 {
+		t.Errorf("expected newest message to be kept, got sequence %d", last)
+	}
+	if !parsed.HasMore {
+		t.Errorf("expected has_more to be set when messages are dropped")
+	}
+}
+
+func TestParseHistoryResponseError(t *testing.T) {
+	data, _ := InvalidRequestResponse(OperationHistory, ErrorCodeRoomNotFound, "room not found")
+	if _, err := ParseHistoryResponse(data); err == nil {
+		t.Errorf("expected error response to be returned as an error")
+	}
+}
+
+func TestHistoryRequestRoundTrip(t *testing.T) {
+	original := HistoryQuery{RoomID: "room", UserID: "user", BeforeSequence: 42, Before: time.UnixMilli(1760000000123), Limit: 10, ResumeToken: "token"}
+
+	data, err := CreateHistoryRequest(original)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if data[2] != OperationFetchHistory {
+		t.Errorf("expected operation %d, got %d", OperationFetchHistory, data[2])
+	}
+	parsed, err := ParseHistoryRequest(data)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !parsed.Before.Equal(original.Before) {
+		t.Errorf("expected before %v, got %v", original.Before, parsed.Before)
+	}
+	parsed.Before = original.Before
+	if parsed != original {
+		t.Errorf("expected %+v, got %+v", original, parsed)
+	}
+
+	// 他の operation のフレームは履歴のリクエストとして扱わない
+	join, _ := ChatRoomRequest{RoomID: "room", Operation: OperationJoinChatRoom}.CreateRequestProtocol()
+	if _, err := ParseHistoryRequest(join); err == nil {
+		t.Errorf("expected error for join request")
+	}
+}
+
+func TestHistoryQueryPageSize(t *testing.T) {
+	cases := map[int]int{0: DefaultHistoryPageSize, -1: DefaultHistoryPageSize, 5: 5, HistoryPageMaxSize + 1: HistoryPageMaxSize}
+	for limit, expected := range cases {
+		if size := (HistoryQuery{Limit: limit}).PageSize(); size != expected {
+			t.Errorf("limit %d: expected %d, got %d", limit, expected, size)
+		}
+	}
+}
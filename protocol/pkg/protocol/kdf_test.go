@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		salt       string
+		iterations int
+		keyLen     int
+		expected   string
+	}{
+		// RFC 6070 のテストケースを HMAC-SHA256 で計算した既知の値
+		{"one iteration", "password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"two iterations", "password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"many iterations", "password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		// RFC 7914 11. のテストベクタ (鍵の長さがハッシュの長さを超えるので 2 ブロック目も計算する)
+		{"two blocks", "passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		// 鍵の長さがハッシュの長さで割り切れない時は、最後のブロックを途中で切る
+		{"truncated block", "password", "salt", 1, 20, "120fb6cffcf8b32c43e7225256c4f837a86548c9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, _ := hex.DecodeString(tt.expected)
+			key := PBKDF2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, tt.keyLen)
+			if !bytes.Equal(key, expected) {
+				t.Errorf("expected %x, got %x", expected, key)
+			}
+		})
+	}
+}
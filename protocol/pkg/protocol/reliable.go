@@ -0,0 +1,276 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Reliable delivery
+//
+// udp の配信は届かなくても誰も気づかないため、セッションの Hello / Welcome で FeatureReliableDelivery が
+// 合意され、かつチャットルームが reliable delivery を有効にして作成された場合に限り、次の仕組みで配信を確実にする
+//
+// - サーバーは配信データグラムをメンバーごとに RetransmitQueue へ登録し、ack が返るまで間隔を伸ばしながら再送する
+// - クライアントは受信した配信の sequence とフラグメントの index を ChatOperationAck で返す (重複して受信した時も ack を返す)
+// - クライアントは ReorderBuffer で重複を取り除き、sequence の順に並べ直してから表示する
+// - sequence の抜けが一定時間埋まらない時は、その分の配信を失われたものとして読み飛ばす
+//
+// サーバーは配信のきっかけとなったメンバー自身にも配信するため、受信側で sequence に抜けがあれば配信が失われたことがわかる
+// ReorderBuffer は best effort の配信でも、順番を揃えて欠落を検出するために使う
+
+// RetransmitConfig は RetransmitQueue の再送間隔と回数
+type RetransmitConfig struct {
+	// InitialTimeout は最初の再送までの待ち時間で、再送するたびに 2 倍になる
+	InitialTimeout time.Duration
+	// MaxTimeout は再送の間隔の上限
+	MaxTimeout time.Duration
+	// MaxAttempts はこの回数まで再送しても ack が返らなければ諦める
+	MaxAttempts int
+	// OnGiveUp は配信を諦めた時に呼ばれる (nil でも良い)
+	OnGiveUp func(recipientID string, sequence uint64, fragmentIndex uint16)
+}
+
+// DefaultRetransmitConfig はサーバーが使用する再送の設定
+var DefaultRetransmitConfig = RetransmitConfig{
+	InitialTimeout: 200 * time.Millisecond,
+	MaxTimeout:     3 * time.Second,
+	MaxAttempts:    8,
+}
+
+type retransmitKey struct {
+	recipientID   string
+	sequence      uint64
+	fragmentIndex uint16
+}
+
+// pendingDatagram は ack を待っている配信データグラム
+type pendingDatagram struct {
+	addr     net.Addr
+	datagram []byte
+	attempts int
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// RetransmitQueue は ack が返ってきていない配信データグラムを保持し、期限が来たものを再送する
+type RetransmitQueue struct {
+	conn    net.PacketConn
+	config  RetransmitConfig
+	mu      sync.Mutex
+	pending map[retransmitKey]*pendingDatagram
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewRetransmitQueue は conn を使って再送を行う RetransmitQueue を作成し、再送のゴルーチンを開始する
+// 使い終わったら Close を呼ぶ
+func NewRetransmitQueue(conn net.PacketConn, config RetransmitConfig) *RetransmitQueue {
+	q := &RetransmitQueue{
+		conn:    conn,
+		config:  config,
+		pending: make(map[retransmitKey]*pendingDatagram),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Send は datagram を addr へ送信し、recipientID から sequence (分割されている場合は fragmentIndex 番目のフラグメント) の
+// ack が返るまで再送の対象にする
+func (q *RetransmitQueue) Send(recipientID string, addr net.Addr, sequence uint64, fragmentIndex uint16, datagram []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending[retransmitKey{recipientID, sequence, fragmentIndex}] = &pendingDatagram{
+		addr:     addr,
+		datagram: datagram,
+		timeout:  q.config.InitialTimeout,
+		deadline: time.Now().Add(q.config.InitialTimeout),
+	}
+	_, err := q.conn.WriteTo(datagram, addr)
+	return err
+}
+
+// Ack は recipientID が sequence の配信 (の fragmentIndex 番目のフラグメント) を受信したことを記録し、再送の対象から外す
+// 再送待ちの配信であった場合は true を返す
+func (q *RetransmitQueue) Ack(recipientID string, sequence uint64, fragmentIndex uint16) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := retransmitKey{recipientID, sequence, fragmentIndex}
+	_, exists := q.pending[key]
+	delete(q.pending, key)
+	return exists
+}
+
+// Forget はチャットルームから退出したユーザー宛ての配信をすべて再送の対象から外す
+func (q *RetransmitQueue) Forget(recipientID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for key := range q.pending {
+		if key.recipientID == recipientID {
+			delete(q.pending, key)
+		}
+	}
+}
+
+// Pending は recipientID 宛てで ack を待っている配信の数を返す
+func (q *RetransmitQueue) Pending(recipientID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for key := range q.pending {
+		if key.recipientID == recipientID {
+			count++
+		}
+	}
+	return count
+}
+
+// Close は再送のゴルーチンを停止する
+func (q *RetransmitQueue) Close() {
+	q.once.Do(func() { close(q.done) })
+}
+
+func (q *RetransmitQueue) run() {
+	ticker := time.NewTicker(q.config.InitialTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case now := <-ticker.C:
+			q.retransmit(now)
+		}
+	}
+}
+
+// retransmit は期限が来た配信を再送し、再送の回数を使い切ったものは諦める
+func (q *RetransmitQueue) retransmit(now time.Time) {
+	var givenUp []retransmitKey
+
+	q.mu.Lock()
+	for key, p := range q.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+		if p.attempts >= q.config.MaxAttempts {
+			delete(q.pending, key)
+			givenUp = append(givenUp, key)
+			continue
+		}
+
+		// 送信に失敗した時も次の期限まで待ってから再送する
+		q.conn.WriteTo(p.datagram, p.addr)
+		p.attempts++
+		p.timeout = min(p.timeout*2, q.config.MaxTimeout)
+		p.deadline = now.Add(p.timeout)
+	}
+	q.mu.Unlock()
+
+	if q.config.OnGiveUp != nil {
+		for _, key := range givenUp {
+			q.config.OnGiveUp(key.recipientID, key.sequence, key.fragmentIndex)
+		}
+	}
+}
+
+// reorderBufferMaxPending は ReorderBuffer が並べ直しのために保持する配信の上限
+const reorderBufferMaxPending = 256
+
+// ReorderBuffer はクライアント側で配信の重複を取り除き、sequence の順に並べ直す
+// 最初に受信した配信の sequence から順に受け渡す
+// 分割された配信は組み立ててから追加する
+type ReorderBuffer struct {
+	next       uint64
+	pending    map[uint64]Broadcast
+	gapTimeout time.Duration
+	gapSince   time.Time
+}
+
+// NewReorderBuffer は sequence の抜けを gapTimeout まで待つ ReorderBuffer を作成する
+func NewReorderBuffer(gapTimeout time.Duration) *ReorderBuffer {
+	return &ReorderBuffer{
+		pending:    make(map[uint64]Broadcast),
+		gapTimeout: gapTimeout,
+	}
+}
+
+// Delivered は sequence の配信を既に受け渡した、または読み飛ばしたかどうかを返す
+// 分割された配信のフラグメントが重複して届いた時に、組み立てる前に取り除くために使う
+func (r *ReorderBuffer) Delivered(sequence uint64) bool {
+	return r.next != 0 && sequence < r.next
+}
+
+// Push は受信した配信を追加し、順番通りに受け渡せるようになった配信を返す
+// 既に受け渡した、または保持している配信を受信した時は duplicate に true を返す
+func (r *ReorderBuffer) Push(broadcast Broadcast, now time.Time) (delivered []Broadcast, duplicate bool) {
+	if r.next == 0 {
+		r.next = broadcast.Sequence
+	}
+	if broadcast.Sequence < r.next {
+		return nil, true
+	}
+	if _, exists := r.pending[broadcast.Sequence]; exists {
+		return nil, true
+	}
+
+	r.pending[broadcast.Sequence] = broadcast
+	delivered = r.flush()
+
+	// 抜けが生じた時刻から gapTimeout を数える
+	if len(r.pending) == 0 {
+		r.gapSince = time.Time{}
+	} else if r.gapSince.IsZero() {
+		r.gapSince = now
+	}
+	return delivered, false
+}
+
+// Expire は gapTimeout を過ぎても埋まらない sequence の抜けを読み飛ばし、
+// その後ろで受け渡せるようになった配信と、失われた配信の数を返す
+// 保持している配信が上限に達した時は gapTimeout を待たずに読み飛ばす
+func (r *ReorderBuffer) Expire(now time.Time) (delivered []Broadcast, lost uint64) {
+	if len(r.pending) == 0 {
+		return nil, 0
+	}
+	if now.Sub(r.gapSince) < r.gapTimeout && len(r.pending) < reorderBufferMaxPending {
+		return nil, 0
+	}
+
+	// 保持している中で最も小さい sequence まで読み飛ばす
+	lowest := uint64(0)
+	for sequence := range r.pending {
+		if lowest == 0 || sequence < lowest {
+			lowest = sequence
+		}
+	}
+	lost = lowest - r.next
+	r.next = lowest
+	delivered = r.flush()
+
+	if len(r.pending) > 0 {
+		r.gapSince = now
+	} else {
+		r.gapSince = time.Time{}
+	}
+	return delivered, lost
+}
+
+// flush は next から連続している配信を取り出す
+func (r *ReorderBuffer) flush() []Broadcast {
+	var delivered []Broadcast
+	for {
+		broadcast, exists := r.pending[r.next]
+		if !exists {
+			return delivered
+		}
+		delete(r.pending, r.next)
+		delivered = append(delivered, broadcast)
+		r.next++
+	}
+}
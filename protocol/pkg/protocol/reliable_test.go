@@ -0,0 +1,315 @@
+package protocol
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn は送信するデータグラムの一部を捨て、一部を重複して送信する net.PacketConn
+type lossyPacketConn struct {
+	net.PacketConn
+	mu        sync.Mutex
+	rand      *rand.Rand
+	dropRate  float64
+	dupRate   float64
+	dropAll   bool
+	writeSeen int
+}
+
+func newLossyPacketConn(t *testing.T, seed int64, dropRate float64, dupRate float64) *lossyPacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &lossyPacketConn{
+		PacketConn: conn,
+		rand:       rand.New(rand.NewSource(seed)),
+		dropRate:   dropRate,
+		dupRate:    dupRate,
+	}
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.writeSeen++
+	drop := c.dropAll || c.rand.Float64() < c.dropRate
+	dup := c.rand.Float64() < c.dupRate
+	c.mu.Unlock()
+
+	if drop {
+		return len(p), nil
+	}
+	if dup {
+		c.PacketConn.WriteTo(p, addr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *lossyPacketConn) writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeSeen
+}
+
+var testRetransmitConfig = RetransmitConfig{
+	InitialTimeout: 10 * time.Millisecond,
+	MaxTimeout:     40 * time.Millisecond,
+	MaxAttempts:    20,
+}
+
+// 送信・ack の双方でデータグラムが失われたり重複したりしても、すべての配信が順番通りに 1 度だけ届くことを確認する
+func TestReliableDeliveryOverLossyConn(t *testing.T) {
+	const roomID = "room"
+	const userID = "user"
+	const count = 100
+
+	server := newLossyPacketConn(t, 1, 0.3, 0.1)
+	client := newLossyPacketConn(t, 2, 0.3, 0.1)
+
+	queue := NewRetransmitQueue(server, testRetransmitConfig)
+	defer queue.Close()
+
+	// サーバー側: ack を受信して再送の対象から外す
+	go func() {
+		buffer := make([]byte, ChatProtocolMaxLen)
+		for {
+			n, _, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			ack, err := ParseChatRequest(buffer[:n])
+			if err != nil {
+				continue
+			}
+			sequence, fragmentIndex, err := ack.AckSequence()
+			if err == nil {
+				queue.Ack(ack.UserID, sequence, fragmentIndex)
+			}
+		}
+	}()
+
+	for sequence := uint64(1); sequence <= count; sequence++ {
+		datagram, err := Broadcast{Kind: BroadcastKindUserMessage, RoomID: roomID, Sequence: sequence, Message: "hello"}.CreateBroadcast()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := queue.Send(userID, client.LocalAddr(), sequence, 0, datagram); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// クライアント側: 受信するたびに ack を返し、並べ直して受け渡す
+	buffer := NewReorderBuffer(time.Minute)
+	var delivered []Broadcast
+	datagram := make([]byte, BroadcastProtocolMaxLen)
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for len(delivered) < count {
+		n, _, err := client.ReadFrom(datagram)
+		if err != nil {
+			t.Fatalf("expected no error, got %v (delivered %d)", err, len(delivered))
+		}
+		broadcast, err := ParseBroadcast(datagram[:n])
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ack, _ := CreateAckRequest(roomID, userID, broadcast.Sequence, broadcast.Fragment.Index)
+		client.WriteTo(ack, server.LocalAddr())
+
+		received, _ := buffer.Push(broadcast, time.Now())
+		delivered = append(delivered, received...)
+	}
+
+	for i, broadcast := range delivered {
+		if broadcast.Sequence != uint64(i+1) {
+			t.Fatalf("expected sequence %d, got %d", i+1, broadcast.Sequence)
+		}
+	}
+
+	// 最後の ack が失われた場合でも、再送された配信に ack を返し続ければ再送待ちは無くなる
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Pending(userID) > 0 && time.Now().Before(deadline) {
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := client.ReadFrom(datagram)
+		if err != nil {
+			continue
+		}
+		broadcast, _ := ParseBroadcast(datagram[:n])
+		ack, _ := CreateAckRequest(roomID, userID, broadcast.Sequence, broadcast.Fragment.Index)
+		client.WriteTo(ack, server.LocalAddr())
+		if _, duplicate := buffer.Push(broadcast, time.Now()); !duplicate {
+			t.Errorf("expected retransmitted sequence %d to be a duplicate", broadcast.Sequence)
+		}
+	}
+	if pending := queue.Pending(userID); pending != 0 {
+		t.Errorf("expected no pending datagrams, got %d", pending)
+	}
+}
+
+// ack が返らない配信は再送の回数を使い切ったら諦めることを確認する
+func TestRetransmitQueueGivesUp(t *testing.T) {
+	server := newLossyPacketConn(t, 1, 0, 0)
+	server.dropAll = true
+	client := newLossyPacketConn(t, 2, 0, 0)
+
+	givenUp := make(chan uint64, 1)
+	config := testRetransmitConfig
+	config.MaxAttempts = 3
+	config.OnGiveUp = func(recipientID string, sequence uint64, fragmentIndex uint16) {
+		givenUp <- sequence
+	}
+
+	queue := NewRetransmitQueue(server, config)
+	defer queue.Close()
+
+	if err := queue.Send("user", client.LocalAddr(), 7, 0, []byte("datagram")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	select {
+	case sequence := <-givenUp:
+		if sequence != 7 {
+			t.Errorf("expected %d, got %d", 7, sequence)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected retransmission to give up")
+	}
+
+	// 最初の送信と再送 3 回
+	if writes := server.writes(); writes != 1+config.MaxAttempts {
+		t.Errorf("expected %d writes, got %d", 1+config.MaxAttempts, writes)
+	}
+	if pending := queue.Pending("user"); pending != 0 {
+		t.Errorf("expected no pending datagrams, got %d", pending)
+	}
+}
+
+func TestRetransmitQueueForget(t *testing.T) {
+	server := newLossyPacketConn(t, 1, 0, 0)
+	queue := NewRetransmitQueue(server, testRetransmitConfig)
+	defer queue.Close()
+
+	queue.Send("alice", server.LocalAddr(), 1, 0, []byte("1"))
+	queue.Send("alice", server.LocalAddr(), 2, 0, []byte("2-0"))
+	queue.Send("alice", server.LocalAddr(), 2, 1, []byte("2-1"))
+	queue.Send("bob", server.LocalAddr(), 1, 0, []byte("1"))
+
+	if !queue.Ack("alice", 1, 0) {
+		t.Errorf("expected ack of pending datagram to return true")
+	}
+	if queue.Ack("alice", 1, 0) {
+		t.Errorf("expected duplicate ack to return false")
+	}
+	// フラグメントごとに ack を待つ
+	if !queue.Ack("alice", 2, 1) || queue.Pending("alice") != 1 {
+		t.Errorf("expected only fragment 1 of sequence 2 to be acknowledged")
+	}
+
+	queue.Forget("alice")
+	if pending := queue.Pending("alice"); pending != 0 {
+		t.Errorf("expected no pending datagrams, got %d", pending)
+	}
+	if pending := queue.Pending("bob"); pending != 1 {
+		t.Errorf("expected 1 pending datagram, got %d", pending)
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	now := time.Now()
+	buffer := NewReorderBuffer(time.Second)
+
+	sequences := func(broadcasts []Broadcast) []uint64 {
+		result := []uint64{}
+		for _, b := range broadcasts {
+			result = append(result, b.Sequence)
+		}
+		return result
+	}
+
+	steps := []struct {
+		sequence  uint64
+		delivered []uint64
+		duplicate bool
+	}{
+		{5, []uint64{5}, false},
+		{7, []uint64{}, false},
+		{7, []uint64{}, true},
+		{6, []uint64{6, 7}, false},
+		{6, []uint64{}, true},
+		{4, []uint64{}, true},
+		{9, []uint64{}, false},
+	}
+	for _, step := range steps {
+		delivered, duplicate := buffer.Push(Broadcast{Sequence: step.sequence}, now)
+		if duplicate != step.duplicate {
+			t.Errorf("sequence %d: expected duplicate %v, got %v", step.sequence, step.duplicate, duplicate)
+		}
+		if got := sequences(delivered); !slices.Equal(got, step.delivered) {
+			t.Errorf("sequence %d: expected %v, got %v", step.sequence, step.delivered, got)
+		}
+	}
+
+	// gapTimeout が過ぎるまでは抜けを待つ
+	if delivered, lost := buffer.Expire(now.Add(500 * time.Millisecond)); len(delivered) != 0 || lost != 0 {
+		t.Errorf("expected to wait for the gap, got %v lost %d", sequences(delivered), lost)
+	}
+
+	delivered, lost := buffer.Expire(now.Add(time.Second))
+	if lost != 1 || !slices.Equal(sequences(delivered), []uint64{9}) {
+		t.Errorf("expected [9] with 1 lost, got %v with %d lost", sequences(delivered), lost)
+	}
+
+	// 読み飛ばした sequence が後から届いても受け渡さない
+	if _, duplicate := buffer.Push(Broadcast{Sequence: 8}, now); !duplicate {
+		t.Errorf("expected skipped sequence to be a duplicate")
+	}
+}
+
+func TestAckRequestRoundTrip(t *testing.T) {
+	datagram, err := CreateAckRequest("room", "user", 1<<40+3, 5)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ack, err := ParseChatRequest(datagram)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	sequence, fragmentIndex, err := ack.AckSequence()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if sequence != 1<<40+3 || fragmentIndex != 5 {
+		t.Errorf("expected %d/%d, got %d/%d", uint64(1<<40+3), 5, sequence, fragmentIndex)
+	}
+
+	ack.Message = "short"
+	if _, _, err := ack.AckSequence(); !errors.Is(err, ErrChatTruncated) {
+		t.Errorf("expected %v, got %v", ErrChatTruncated, err)
+	}
+}
+
+// reliable delivery の設定がリクエストとレスポンスで受け渡されることを確認する
+func TestReliableDeliveryFlag(t *testing.T) {
+	frame, _ := ChatRoomRequest{RoomName: "room", UserName: "Alice", ReliableDelivery: true, Operation: OperationCreateChatRoom}.CreateRequestProtocol()
+	request, err := ParseChatRoomRequest(frame)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !request.ReliableDelivery {
+		t.Errorf("expected reliable delivery to be requested")
+	}
+
+	frame, _ = CreateChatRoomJoinResponse(ChatRoomRequest{RoomID: "room-1", UserID: "user-1", ReliableDelivery: true})
+	response, err := ParseChatRoomResponse(frame)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !response.ReliableDelivery {
+		t.Errorf("expected reliable delivery to be enabled in the response")
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session resume
+//
+// クライアントの再起動や、NAT の再割り当て・ネットワークの切り替えで udp のアドレスが変わっても、同じユーザーとして会話を続けるための仕組み
+// セッションの Hello / Welcome で FeatureSessionResume が合意された場合に限り使われる
+//
+// - サーバーは作成・参加のレスポンスで、そのユーザーだけが知っている ResumeToken を発行する
+// - ResumeToken は再開のリクエストで使うので、経路上で盗み見られうる udp では送信しない
+//   クライアントは ChatOperationSendUDPAddr, ChatOperationHeartbeat, ChatOperationExit の message に、
+//   ResumeToken を持っていることを示す TokenProof を入れて送信する (CreateTokenProof を参照)
+//   サーバーは TokenProof を確認できた時だけ、送信元のアドレスをそのユーザーの配信先として登録し直す
+// - 再起動したクライアントは operation = 7 (OperationResumeSession) で room_id, user_id, resume_token を送信し、
+//   参加のレスポンスと同じ内容を受け取ってから新しいアドレスを登録する
+// - user_id は配信や履歴で他のメンバーにも知られているので、退出のリクエスト (OperationLeaveChatRoom) にも resume_token を入れる
+//   サーバーは ResumeToken を発行したユーザーの退出を、トークンが一致した時だけ受け付ける
+
+// TokenProofMaxSkew はサーバーが受け付ける TokenProof の時刻と、サーバーの時刻とのずれの最大値
+const TokenProofMaxSkew = 2 * time.Minute
+
+// ErrTokenProofInvalid は TokenProof の形式が正しくないか、mac が一致しないことを示す
+var ErrTokenProofInvalid = errors.New("invalid token proof")
+
+// CreateResumeSessionResponse はセッションの再開が許可されたことを、参加のレスポンスと同じ内容でクライアントへ返す
+func CreateResumeSessionResponse(resumed ChatRoomRequest) ([]byte, error) {
+	return encodeMembershipResponse(OperationResumeSession, resumed)
+}
+
+// CreateTokenProof は ResumeToken そのものを送らずに、それを持っていることをデータグラムで示すための TokenProof を作成する
+// "<unix 時刻 (ミリ秒)>.<mac (hex)>" の形式で、mac は sha256(resumeToken) を鍵とした operation, room_id, user_id, 時刻の HMAC-SHA256
+// サーバーは保存している ResumeToken のハッシュで確認でき、同じ時刻の TokenProof は二度受け付けない
+// resumeToken が空の時は空を返す
+func CreateTokenProof(operation byte, chatRoomID string, userID string, resumeToken string, now time.Time) string {
+	if resumeToken == "" {
+		return ""
+	}
+	key := sha256.Sum256([]byte(resumeToken))
+	millis := now.UnixMilli()
+	return strconv.FormatInt(millis, 10) + "." + hex.EncodeToString(tokenProofMAC(key[:], operation, chatRoomID, userID, millis))
+}
+
+// VerifyTokenProof は TokenProof を tokenHash (sha256(ResumeToken) の hex) で確認し、作成された時刻を返す
+// 時刻が古すぎないか、既に受け付けたものでないかは呼び出し側で確認する
+func VerifyTokenProof(proof string, operation byte, chatRoomID string, userID string, tokenHash string) (time.Time, error) {
+	millisText, macText, found := strings.Cut(proof, ".")
+	if !found {
+		return time.Time{}, ErrTokenProofInvalid
+	}
+	millis, err := strconv.ParseInt(millisText, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrTokenProofInvalid
+	}
+	mac, err := hex.DecodeString(macText)
+	if err != nil {
+		return time.Time{}, ErrTokenProofInvalid
+	}
+	key, err := hex.DecodeString(tokenHash)
+	if err != nil || len(key) != sha256.Size {
+		return time.Time{}, ErrTokenProofInvalid
+	}
+	if !hmac.Equal(mac, tokenProofMAC(key, operation, chatRoomID, userID, millis)) {
+		return time.Time{}, ErrTokenProofInvalid
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// tokenProofMAC は TokenProof の mac を計算する
+// 別のチャットルームやユーザー、operation の TokenProof として使い回せないよう、長さを付けてそれぞれを含める
+func tokenProofMAC(key []byte, operation byte, chatRoomID string, userID string, millis int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	signed := []byte{operation}
+	for _, field := range []string{chatRoomID, userID} {
+		signed = binary.BigEndian.AppendUint16(signed, uint16(len(field)))
+		signed = append(signed, field...)
+	}
+	signed = binary.BigEndian.AppendUint64(signed, uint64(millis))
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenProof(t *testing.T) {
+	token := "0123456789abcdef"
+	hash := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(hash[:])
+	now := time.UnixMilli(1700000000123)
+
+	proof := CreateTokenProof(ChatOperationSendUDPAddr, "room-1", "user-1", token, now)
+	if strings.Contains(proof, token) {
+		t.Fatal("expected proof not to contain the token")
+	}
+	issued, err := VerifyTokenProof(proof, ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash)
+	if err != nil || !issued.Equal(now) {
+		t.Fatalf("expected proof issued at %v, got %v (error %v)", now, issued, err)
+	}
+
+	otherHash := sha256.Sum256([]byte("another token"))
+	millis, mac, _ := strings.Cut(proof, ".")
+	cases := []struct {
+		name      string
+		proof     string
+		operation byte
+		roomID    string
+		userID    string
+		tokenHash string
+	}{
+		{"another token", proof, ChatOperationSendUDPAddr, "room-1", "user-1", hex.EncodeToString(otherHash[:])},
+		{"another operation", proof, ChatOperationExit, "room-1", "user-1", tokenHash},
+		{"another room", proof, ChatOperationSendUDPAddr, "room-2", "user-1", tokenHash},
+		{"another user", proof, ChatOperationSendUDPAddr, "room-1", "user-2", tokenHash},
+		{"fields shifted", proof, ChatOperationSendUDPAddr, "room-1u", "ser-1", tokenHash},
+		{"changed time", "1700000000124." + mac, ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash},
+		{"raw token", token, ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash},
+		{"invalid time", "time." + mac, ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash},
+		{"invalid mac", millis + ".zz", ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash},
+		{"empty", "", ChatOperationSendUDPAddr, "room-1", "user-1", tokenHash},
+		{"no token issued", proof, ChatOperationSendUDPAddr, "room-1", "user-1", ""},
+	}
+	for _, c := range cases {
+		if _, err := VerifyTokenProof(c.proof, c.operation, c.roomID, c.userID, c.tokenHash); !errors.Is(err, ErrTokenProofInvalid) {
+			t.Errorf("%s: expected ErrTokenProofInvalid, got %v", c.name, err)
+		}
+	}
+
+	if proof := CreateTokenProof(ChatOperationSendUDPAddr, "room-1", "user-1", "", now); proof != "" {
+		t.Errorf("expected no proof without a token, got %q", proof)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+	"github.com/okonomipizza/chat-server/pkg/chat"
+	"github.com/okonomipizza/chat-server/pkg/data"
+)
+
+// addrLockout は間違ったパスワードや存在しないチャットルームの id を試し続ける送信元の IP アドレスを、検索と参加から締め出す
+var addrLockout *chat.Lockout
+
+// roomLockout は同じチャットルームに間違ったパスワードを試し続ける送信元の IP アドレスを、そのチャットルームへの参加から締め出す
+// チャットルームごとに締め出すと、少ない送信元からわざと間違えるだけでパスワードを知っている人も参加できなくなるので、
+// チャットルームと IP アドレスの組ごとに数える
+// その代わり多くの IP アドレスから試す相手には、それぞれの IP アドレスから試せる回数の合計だけ試されることになる
+// すでに参加しているメンバーやセッションの再開には影響しない
+var roomLockout *chat.Lockout
+
+// roomAttempts はチャットルームごとに間違ったパスワードを試された回数を、ホストへの通知のためだけに数え、締め出しはしない
+var roomAttempts *chat.Lockout
+
+// roomNotifyAttempts はそれぞれの送信元が締め出されない回数に抑えていても、チャットルームへの失敗の合計がこの回数に達したらホストへ通知する (0 の時は合計では通知しない)
+var roomNotifyAttempts int
+
+// hostNotices は多くの送信元から試され続けてもホストへの通知が溢れないよう、チャットルームごとに通知する回数を制限する
+var hostNotices *chat.RateLimiter
+
+// audit はパスワードの試行の失敗と、締め出して拒否したリクエストを記録する
+var audit *chat.AuditLog
+
+// pruneLockouts は interval ごとに、締め出しが終わってしばらく失敗していない記録を消す
+func pruneLockouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		addrLockout.Prune(now)
+		roomLockout.Prune(now)
+		roomAttempts.Prune(now)
+		hostNotices.Prune(now)
+	}
+}
+
+// roomLockoutKey は roomLockout で chatRoomID のチャットルームへの addr からの試行を数える key
+func roomLockoutKey(chatRoomID string, addr net.Addr) string {
+	return chatRoomID + " " + remoteIP(addr)
+}
+
+// rejectLockedOut は送信元の IP アドレスが締め出されているか、roomID が空でなければそのチャットルームへの参加から締め出されている時に、
+// 監査ログに記録してから締め出されている残りの時間をクライアントへ返し、true を返す
+func rejectLockedOut(fc *protocol.FramedConn, request protocol.ChatRoomRequest, addr net.Addr, roomID string) bool {
+	now := time.Now()
+	wait := addrLockout.Locked(remoteIP(addr), now)
+	if roomID != "" {
+		wait = max(wait, roomLockout.Locked(roomLockoutKey(roomID, addr), now))
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	fmt.Printf("Rejected locked out request from %s for %s\n", addr, wait)
+	recordAudit(chat.AuditEvent{
+		Event:           chat.AuditLockedOut,
+		Addr:            addr.String(),
+		Operation:       request.Operation,
+		RoomID:          request.RoomID,
+		UserName:        request.UserName,
+		LockedForMillis: wait.Milliseconds(),
+	})
+	response, _ := protocol.LockedOutResponse(request.Operation, wait)
+	if err := writeResponse(fc, request.Version, response); err != nil {
+		fmt.Println("Failed to send locked out response to client")
+	}
+	return true
+}
+
+// recordUnknownRoom は存在しないチャットルームの id を試した送信元の失敗を数え、監査ログに記録する
+func recordUnknownRoom(request protocol.ChatRoomRequest, addr net.Addr) {
+	failures, lockedFor := addrLockout.Fail(remoteIP(addr), time.Now())
+	recordAudit(chat.AuditEvent{
+		Event:           chat.AuditUnknownRoom,
+		Addr:            addr.String(),
+		Operation:       request.Operation,
+		RoomID:          request.RoomID,
+		UserName:        request.UserName,
+		Failures:        failures,
+		LockedForMillis: lockedFor.Milliseconds(),
+	})
+}
+
+// recordWrongPassword は間違ったパスワードを試した送信元の失敗を、すべてのチャットルームについてと、このチャットルームについて数え、監査ログに記録する
+// 送信元を締め出した時と、チャットルームへの失敗の合計が roomNotifyAttempts に達した後は、hostNotices の制限の範囲でチャットルームのホストへ通知する
+func recordWrongPassword(request protocol.ChatRoomRequest, addr net.Addr, chatRoom data.ChatRoom, udpConn *net.UDPConn, datastore data.Store) {
+	now := time.Now()
+	failures, addrLockedFor := addrLockout.Fail(remoteIP(addr), now)
+	_, roomLockedFor := roomLockout.Fail(roomLockoutKey(chatRoom.Id, addr), now)
+	roomFailures, _ := roomAttempts.Fail(chatRoom.Id, now)
+	lockedFor := max(addrLockedFor, roomLockedFor)
+	recordAudit(chat.AuditEvent{
+		Event:           chat.AuditWrongPassword,
+		Addr:            addr.String(),
+		Operation:       request.Operation,
+		RoomID:          chatRoom.Id,
+		UserName:        request.UserName,
+		Failures:        failures,
+		LockedForMillis: lockedFor.Milliseconds(),
+	})
+	// 多くの送信元に分けて締め出されないように試されている時も、合計が増え続けていればホストへ知らせる
+	spread := roomNotifyAttempts > 0 && roomFailures >= roomNotifyAttempts
+	if lockedFor <= 0 && !spread {
+		return
+	}
+	if hostNotices.Allow(chatRoom.Id, now) != nil {
+		return
+	}
+
+	// 誰が試しているかはホストにも伝えず、失敗が続いていることだけを通知する
+	notice := fmt.Sprintf("There have been %d failed password attempts to join this room", roomFailures)
+	if lockedFor > 0 {
+		notice += fmt.Sprintf(". The sender is blocked for %s", describeRetryAfter(lockedFor))
+	}
+	for _, user := range chatRoom.Users {
+		if !user.IsHost {
+			continue
+		}
+		if err := sendDirectNotice(udpConn, chatRoom.Id, user.Id, notice, datastore); err != nil {
+			fmt.Println("Failed to notify host of failed password attempts:", err)
+		}
+	}
+}
+
+// recordAudit は監査ログへ記録し、記録できなかった時もリクエストの処理は続ける
+func recordAudit(event chat.AuditEvent) {
+	event.Time = time.Now()
+	if err := audit.Record(event); err != nil {
+		fmt.Println("Failed to write audit log:", err)
+	}
+}
@@ -1,56 +1,156 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
 	"github.com/okonomipizza/chat-server/pkg/chat"
 	"github.com/okonomipizza/chat-server/pkg/data"
-	"github.com/okonomipizza/chat-server/pkg/protocol"
 )
 
 // client から新しい chatRoom の作成か、既存の chatRomm への接続を求められるのでそれに対応する
-func handleChatRoomRequest(conn net.Conn, dataStore *data.DataStore) {
+func handleChatRoomRequest(conn net.Conn, udpConn *net.UDPConn, dataStore data.Store) {
 	defer conn.Close()
 
-	// メッセージを受信したことをクライアントへ知らせる
+	// tcp 接続上のデータはフレーム単位で読み書きする
+	fc := protocol.NewFramedConn(conn)
+
+	// 接続したまま何も送らないクライアントにゴルーチンと接続を占有させないよう、Hello とリクエストを読み取る期限を設ける
+	if requestTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	}
+
+	// クライアントからのリクエストを 1 フレーム読み取る
+	frame, err := fc.ReadFrame()
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Println("Connection closed by client before sending a request")
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		fmt.Printf("Timed out waiting for a request from %s\n", conn.RemoteAddr())
+		return
+	}
+
+	// 接続の最初に Hello が送られてきた場合は Welcome を返してから、続くリクエストを読み取る
+	// Hello を送信しない古いクライアントは、最初のフレームがそのままリクエストとなり、追加の機能は何も使えない
+	var welcome protocol.Welcome
+	if err == nil && protocol.IsHelloRequest(frame) {
+		welcome, err = handleHello(fc, frame)
+		if err != nil {
+			fmt.Println("Failed to complete handshake with client:", err)
+			return
+		}
+
+		frame, err = fc.ReadFrame()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Println("Connection closed by client before sending a request")
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Printf("Timed out waiting for a request from %s\n", conn.RemoteAddr())
+			return
+		}
+	}
+	fmt.Printf("%d bytes data received through tcp connection\n", len(frame))
+
+	var request protocol.ChatRoomRequest
+	if err == nil {
+		request, err = protocol.ParseChatRoomRequest(frame)
+	}
+	if err != nil {
+		// 無効なリクエストの時
+		// 未知のバージョンのヘッダや長すぎるフレームが送られてきた時もここで拒否する
+		code := protocol.ErrorCodeMalformedRequest
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			code = protocol.ErrorCodeUnsupportedVersion
+		}
+		response, _ := protocol.InvalidRequestResponse(request.Operation, code, err.Error())
+		err = fc.WriteFrame(response)
+		if err != nil {
+			fmt.Println("Failed to send respose to invalid request")
+		}
+		return
+	}
+	// パスワードや ResumeToken がログに残らないよう、伏せてから表示する
+	logged := request
+	if logged.RoomPassword != "" {
+		logged.RoomPassword = "***"
+	}
+	if logged.ResumeToken != "" {
+		logged.ResumeToken = "***"
+	}
+	fmt.Printf("request: %+v\n", logged)
+
+	// リクエストを受信したことをクライアントへ知らせる
 	ackResponse, err := protocol.AckResponse()
 	if err != nil {
 		fmt.Println("Failed to create response to client")
 	}
 
-	_, err = conn.Write(ackResponse)
+	err = writeResponse(fc, request.Version, ackResponse)
 	if err != nil {
 		fmt.Println("Failed to send ack response to client")
 		return
 	}
 
-	// クライアントからのデータを読み取るためのバッファ
-	bufferSize := 1024
-	readBuf := make([]byte, bufferSize)
-	count, _ := conn.Read(readBuf)
-	fmt.Printf("%d bytes data received through tcp connection\n", count)
+	// 移行期間が終わった後は legacy のヘッダを使うクライアントを拒否する
+	if request.Version == protocol.ProtocolVersionLegacy && !acceptLegacyProtocol {
+		err = sendErrorResponse(fc, request, protocol.ErrorCodeUnsupportedVersion, "legacy protocol header is no longer supported, please update the client")
+		if err != nil {
+			fmt.Println("Failed to send respose to legacy request")
+		}
+		return
+	}
 
-	request, err := protocol.ParseChatRoomRequest(readBuf)
+	// 制限を超える長さのフィールドを含むリクエストは拒否する
+	err = validateRequest(request)
 	if err != nil {
-		// TODO 無効なリクエストの時
-		response, err := protocol.InvalidRequestResponse(string(err.Error()))
-		println(err)
-		_, err = conn.Write(response)
+		err = sendErrorResponse(fc, request, protocol.ErrorCodeMalformedRequest, err.Error())
 		if err != nil {
-			fmt.Println("Failed to send respose to invalid request")
+			fmt.Println("Failed to send invalid response to client")
 		}
+		return
 	}
-	fmt.Printf("request: %+v\n", request)
+
+	// 短い間に繰り返されるチャットルームの作成・参加・検索は、送信元の IP アドレスごとに制限する
+	// user_id は誰でも名乗れるので、ユーザーごとの制限は本人と確認できた後にだけ数える (resumeSession を参照)
+	err = allowAddr(limits.forRequest(request.Operation), conn.RemoteAddr(), time.Now())
+	if err != nil {
+		fmt.Printf("Rate limited request from %s: %s\n", conn.RemoteAddr(), err)
+		response, _ := protocol.RateLimitedResponse(request.Operation, retryAfter(err))
+		err = writeResponse(fc, request.Version, response)
+		if err != nil {
+			fmt.Println("Failed to send rate limited response to client")
+		}
+		return
+	}
+
+	// パスワードや存在しないチャットルームの id を試し続けている送信元には、検索と参加をさせない
+	searchesRoom := request.Operation == protocol.OperationSerchChatRoomByID || request.Operation == protocol.OperationJoinChatRoom
+	if searchesRoom && rejectLockedOut(fc, request, conn.RemoteAddr(), "") {
+		return
+	}
+
+	// reliable delivery はセッションで合意された時だけ使用する
+	sessionReliable := welcome.Supports(protocol.FeatureReliableDelivery)
+	request.ReliableDelivery = request.ReliableDelivery && sessionReliable
 
 	// 新しいチャットルームの作成がリクエストされた場合
 	if request.Operation == protocol.OperationCreateChatRoom {
-		err = SendNewRoomResponse(conn, request, dataStore)
+		err = SendNewRoomResponse(fc, request, welcome, dataStore)
 		if err != nil {
-			response, _ := protocol.InternalServerErrorResponse()
-			_, err = conn.Write(response)
+			response, _ := protocol.InternalServerErrorResponse(request.Operation)
+			err = writeResponse(fc, request.Version, response)
 			if err != nil {
 				fmt.Println("Failed to send creating chatroom response to client")
 				return
@@ -63,19 +163,19 @@ func handleChatRoomRequest(conn net.Conn, dataStore *data.DataStore) {
 		// ChatRoomのIDによるChatRoom検索がリクエストされた場合
 	} else if request.Operation == protocol.OperationSerchChatRoomByID {
 		// リクエストに含まれるidに該当するチャットルームがあるか検索
-		chatroom, exists := dataStore.ChatRooms[request.RoomID]
-		if exists {
-			response, _ := protocol.CreateExistingChatroomResponse(chatroom)
-			_, err = conn.Write(response)
+		chatroom, err := dataStore.GetChatRoomByID(request.RoomID)
+		if err == nil {
+			response, _ := protocol.CreateExistingChatroomResponse(chat.ToResponse(data.User{}, chatroom))
+			err = writeResponse(fc, request.Version, response)
 			if err != nil {
 				fmt.Println("Failed to send chatroom name response to client")
 				return
 			}
 			return
 		} else {
-			response, _ := protocol.InvalidRequestResponse("No room exist")
-
-			_, err = conn.Write(response)
+			// id を総当たりで試して存在するチャットルームを探せないよう、見つからなかった検索も失敗として数える
+			recordUnknownRoom(request, conn.RemoteAddr())
+			err = sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
 			if err != nil {
 				fmt.Println("Failed to send invalid response to client")
 				return
@@ -90,17 +190,26 @@ func handleChatRoomRequest(conn net.Conn, dataStore *data.DataStore) {
 		// チャットルームがあるかを確認
 		chatRoom, err := dataStore.GetChatRoomByID(request.RoomID)
 		if err != nil {
-			println(err)
+			recordUnknownRoom(request, conn.RemoteAddr())
+			err = sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+			if err != nil {
+				fmt.Println("Failed to send invalid response to client")
+			}
+			return
+		}
+
+		// 間違ったパスワードを試され続けているチャットルームには、締め出している間はパスワードを確認しない
+		if chatRoom.PasswordHash != "" && rejectLockedOut(fc, request, conn.RemoteAddr(), chatRoom.Id) {
 			return
 		}
 
 		// チャットルームのパスワードを確認
-		if chatRoom.Password != "" && chatRoom.Password != request.RoomPassword {
+		if !data.VerifyPassword(chatRoom.PasswordHash, request.RoomPassword) {
 			// リクエストされたパスワードが間違っていた時
 			println("Invalid password requested")
+			recordWrongPassword(request, conn.RemoteAddr(), chatRoom, udpConn, dataStore)
 			// 応答
-			response, _ := protocol.InvalidRequestResponse("Invalid password")
-			_, err = conn.Write(response)
+			err = sendErrorResponse(fc, request, protocol.ErrorCodeWrongPassword, "Invalid password")
 			if err != nil {
 				fmt.Println("Failed to send invalid response to client")
 			}
@@ -109,108 +218,510 @@ func handleChatRoomRequest(conn net.Conn, dataStore *data.DataStore) {
 
 		// 受信されたパスワードが正しければ、
 		// リクエストに含まれる情報からユーザーインスタンスを作成し、所定のチャットルームへ登録する
+		// reliable delivery はチャットルームで有効にされていて、セッションでも合意されている時だけ使用する
+		token, tokenHash, err := chat.IssueResumeToken(welcome)
+		var sessionKey []byte
+		if err == nil {
+			sessionKey, err = chat.IssueSessionKey(welcome)
+		}
+		if err != nil {
+			response, _ := protocol.InternalServerErrorResponse(request.Operation)
+			err = writeResponse(fc, request.Version, response)
+			if err != nil {
+				fmt.Println("Failed to send invalid response to client")
+			}
+			return
+		}
 		user := data.User{
-			Id:     uuid.NewString(),
-			Name:   request.UserName,
-			IsHost: false,
+			Id:              uuid.NewString(),
+			Name:            request.UserName,
+			IsHost:          false,
+			Reliable:        chatRoom.Reliable && sessionReliable,
+			Fragmentation:   welcome.Supports(protocol.FeatureFragmentation),
+			Heartbeat:       welcome.Supports(protocol.FeatureHeartbeat),
+			JoinedAt:        time.Now(),
+			ResumeTokenHash: tokenHash,
+			SessionKey:      sessionKey,
+			Encryption:      welcome.Supports(protocol.FeatureEncryption),
 		}
 
-		err = dataStore.AddUsers(request.RoomID, user)
+		user, err = dataStore.AddUsers(request.RoomID, user)
 		if err != nil {
-			println(err)
+			fmt.Println("Failed to add user to chat room:", err)
+			switch {
+			case errors.Is(err, data.ErrChatRoomNotFound):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+			case errors.Is(err, data.ErrUserNameTaken):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeNameTaken, "User name is already used in the room")
+			case errors.Is(err, data.ErrChatRoomFull):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeRoomFull, "Chat room is full")
+			default:
+				response, _ := protocol.InternalServerErrorResponse(request.Operation)
+				err = writeResponse(fc, request.Version, response)
+			}
+			if err != nil {
+				fmt.Println("Failed to send invalid response to client")
+			}
 			return
 		}
 
 		// リクエストが許可されたことを応答する
 		println("Request creating ...")
-		response, _ := protocol.CreateChatRoomJoinResponse(user, chatRoom)
+		joined := chat.ToResponse(user, chatRoom)
+		joined.ResumeToken = token
+		response, _ := protocol.CreateChatRoomJoinResponse(joined)
 		println("Created request")
 
-		_, err = conn.Write(response)
+		err = writeResponse(fc, request.Version, response)
 		if err != nil {
 			fmt.Printf("failed to send response to join request %s\n", err)
 			return
 		}
+
+		// 履歴に対応しているクライアントには、参加する前に配信されたメッセージを続けて送信する
+		if welcome.Supports(protocol.FeatureHistory) {
+			err = sendHistory(fc, request.RoomID, dataStore)
+			if err != nil {
+				fmt.Printf("failed to send history to joined user %s\n", err)
+			}
+		}
+		return
+
+		// チャットルームからの退出がリクエストされた場合
+	} else if request.Operation == protocol.OperationLeaveChatRoom {
+		// user_id は他のメンバーにも知られているので、本人と確認できた退出だけを受け付ける
+		_, err := authorizeMember(request.RoomID, request.UserID, request.ResumeToken, conn.RemoteAddr(), dataStore)
+		var departure data.Departure
+		if err == nil {
+			departure, err = leaveChatRoom(request.RoomID, request.UserID, request.Successor, logoutNotice, udpConn, dataStore)
+		}
+		if err != nil {
+			fmt.Println("Failed to remove user from chat room:", err)
+			switch {
+			case errors.Is(err, data.ErrChatRoomNotFound):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+			case errors.Is(err, data.ErrUserNotFound):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeNotMember, "User is not a member of the room")
+			case errors.Is(err, errNotUser):
+				err = sendErrorResponse(fc, request, protocol.ErrorCodeNotMember, "Leave request is not from the user")
+			default:
+				response, _ := protocol.InternalServerErrorResponse(request.Operation)
+				err = writeResponse(fc, request.Version, response)
+			}
+			if err != nil {
+				fmt.Println("Failed to send invalid response to client")
+			}
+			return
+		}
+
+		// 退出が完了したことを応答する
+		request.UserName = departure.User.Name
+		response, _ := protocol.CreateLeaveChatRoomResponse(request)
+		err = writeResponse(fc, request.Version, response)
+		if err != nil {
+			fmt.Printf("failed to send response to leave request %s\n", err)
+		}
 		return
 
+		// 以前のセッションの再開がリクエストされた場合
+	} else if request.Operation == protocol.OperationResumeSession {
+		err = resumeSession(fc, request, welcome, dataStore)
+		if err != nil {
+			fmt.Println("Failed to send resume response to client:", err)
+		}
+		return
+
+		// チャットルームの履歴がリクエストされた場合
+	} else if request.Operation == protocol.OperationFetchHistory {
+		err = sendHistoryPage(fc, request, frame, conn.RemoteAddr(), dataStore)
+		if err != nil {
+			fmt.Println("Failed to send history response to client:", err)
+		}
+		return
 	}
 
+	// 未知の operation がリクエストされた場合
+	err = sendErrorResponse(fc, request, protocol.ErrorCodeMalformedRequest, fmt.Sprintf("unsupported operation %d", request.Operation))
+	if err != nil {
+		fmt.Println("Failed to send invalid response to client")
+	}
 }
 
 // SendNewRoomResponseはクライアントの要望に沿った新しいチャットルームの作成を試みる。
 // 成功した時は、作成されたチャットルームに関するデータをjson形式で表してpayloadに含める
 // 失敗した時は、失敗した旨を送信 (state=1)
-func SendNewRoomResponse(conn net.Conn, request protocol.ChatRoomRequest, dataStore *data.DataStore) error {
-	user, chatRoom := chat.CreateNewChatRoom(request, dataStore)
+func SendNewRoomResponse(fc *protocol.FramedConn, request protocol.ChatRoomRequest, session protocol.Welcome, dataStore data.Store) error {
+	user, chatRoom, token, err := chat.CreateNewChatRoom(request, session, dataStore)
+	if err != nil {
+		return err
+	}
 
 	// レスポンスを作成
-	response, err := protocol.CreateNewChatRoomResponse(user, chatRoom)
+	created := chat.ToResponse(user, chatRoom)
+	created.ResumeToken = token
+	// 作成したユーザーには、設定したパスワードをそのまま返す
+	created.RoomPassword = request.RoomPassword
+	response, err := protocol.CreateNewChatRoomResponse(created)
 	if err != nil {
 		return err
 	}
 
 	// レスポンスを送信
-	_, err = conn.Write(response)
+	err = writeResponse(fc, request.Version, response)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// resumeSession は ResumeToken を確認し、以前のセッションでのチャットルームへの参加を再開させる
+// 参加のレスポンスと同じ内容を返し、履歴に対応しているクライアントには続けて履歴を送信する
+// 配信先のアドレスはクライアントが再開した後に udp で登録し直す
+func resumeSession(fc *protocol.FramedConn, request protocol.ChatRoomRequest, session protocol.Welcome, dataStore data.Store) error {
+	isMember, user, err := dataStore.IsUserMemberOfChatRoom(request.RoomID, request.UserID)
+	if err != nil {
+		return sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+	}
+	// トークンを発行していないユーザーや、タイムアウトなどで既にチャットルームから外れたユーザーは再開できない
+	if !isMember || user.ResumeTokenHash == "" || !chat.VerifyResumeToken(user, request.ResumeToken) {
+		fmt.Printf("Rejected to resume session of user %s in chat room %s\n", request.UserID, request.RoomID)
+		return sendErrorResponse(fc, request, protocol.ErrorCodeNotMember, "Session cannot be resumed")
+	}
+	// 確認できたユーザーの再開は、送信元の IP アドレスが変わっても続けて繰り返せないよう、ユーザーごとにも制限する
+	if err := allowUser(limits.joins, user.Id, time.Now()); err != nil {
+		fmt.Printf("Rate limited resume of user %s: %s\n", user.Id, err)
+		response, _ := protocol.RateLimitedResponse(request.Operation, retryAfter(err))
+		return writeResponse(fc, request.Version, response)
+	}
+	chatRoom, err := dataStore.GetChatRoomByID(request.RoomID)
+	if err != nil {
+		return sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+	}
+	// 暗号化するかどうかは参加した時に決まるので、異なる設定のクライアントでは再開させない
+	if user.Encryption != session.Supports(protocol.FeatureEncryption) {
+		fmt.Printf("Rejected to resume session of user %s with a different encryption setting\n", user.Id)
+		return sendErrorResponse(fc, request, protocol.ErrorCodeNotMember, "Session cannot be resumed with a different encryption setting")
+	}
+
+	// 再開したセッションのデータグラムは発行し直した SessionKey で認証し、counter も 1 から数え直す
+	user.SessionKey, err = chat.IssueSessionKey(session)
+	if err == nil {
+		err = dataStore.SaveSessionKey(chatRoom.Id, user.Id, user.SessionKey)
+	}
+	if err != nil {
+		response, _ := protocol.InternalServerErrorResponse(request.Operation)
+		return errors.Join(err, writeResponse(fc, request.Version, response))
+	}
+	replays.Forget(user.Id)
+
+	resumed := chat.ToResponse(user, chatRoom)
+	resumed.ResumeToken = request.ResumeToken
+	response, err := protocol.CreateResumeSessionResponse(resumed)
+	if err != nil {
+		return err
+	}
+	err = writeResponse(fc, request.Version, response)
 	if err != nil {
 		return err
 	}
+	fmt.Printf("'id: %s, name: %s' resumed the session in Chat room 'id: %s, name: %s'\n", user.Id, user.Name, chatRoom.Id, chatRoom.Name)
+	presence.Touch(chatRoom.Id, user.Id, time.Now())
 
+	if session.Supports(protocol.FeatureHistory) {
+		return sendHistory(fc, chatRoom.Id, dataStore)
+	}
 	return nil
 }
 
-func hostingChatServer(port string, datastore *data.DataStore) {
+// errNotUser はリクエストが名乗っているユーザー本人から送られてきたものと確認できなかったこと
+var errNotUser = errors.New("request is not from the user")
+
+// authorizeMember はリクエストが user_id のユーザー本人から送られてきたものかを確認し、そのユーザーを返す
+// user_id はブロードキャストや履歴で他のメンバーにも知られているので、それだけでは本人と判断しない
+// ResumeToken を発行したユーザーにはトークンの一致を、発行していない古いクライアントのユーザーには
+// 登録されている配信先と同じ IP アドレスから接続していることを求める
+func authorizeMember(chatRoomID string, userID string, token string, remote net.Addr, dataStore data.Store) (data.User, error) {
+	isMember, user, err := dataStore.IsUserMemberOfChatRoom(chatRoomID, userID)
+	if err != nil {
+		return data.User{}, err
+	}
+	if !isMember {
+		return data.User{}, data.ErrUserNotFound
+	}
+	if user.ResumeTokenHash != "" {
+		if !chat.VerifyResumeToken(user, token) {
+			return data.User{}, fmt.Errorf("%w: invalid resume token for user %s from %s", errNotUser, userID, remote)
+		}
+		return user, nil
+	}
+	if user.Addr == nil || user.Addr.IP.String() != remoteIP(remote) {
+		return data.User{}, fmt.Errorf("%w: user %s is not connecting from the registered address (%s)", errNotUser, userID, remote)
+	}
+	return user, nil
+}
+
+// sendHistory はチャットルームの履歴のうち新しいものから historyReplaySize 件をクライアントへ送信する
+// 履歴がない時も空の History を送信し、クライアントが受信を待ち続けないようにする
+func sendHistory(fc *protocol.FramedConn, chatRoomID string, dataStore data.Store) error {
+	messages, hasMore, err := dataStore.History(chatRoomID, 0, time.Time{}, historyReplaySize)
+	if err != nil {
+		return err
+	}
+
+	response, err := protocol.CreateHistoryResponse(toHistory(chatRoomID, messages, hasMore))
+	if err != nil {
+		return err
+	}
+	return fc.WriteFrame(response)
+}
+
+// sendHistoryPage はメンバーから求められた範囲の履歴を送信する
+// メンバーでないユーザーや、本人と確認できないリクエストには履歴を返さない (authorizeMember を参照)
+func sendHistoryPage(fc *protocol.FramedConn, request protocol.ChatRoomRequest, frame []byte, remote net.Addr, dataStore data.Store) error {
+	query, err := protocol.ParseHistoryRequest(frame)
+	if err != nil {
+		return sendErrorResponse(fc, request, protocol.ErrorCodeMalformedRequest, err.Error())
+	}
+
+	_, err = authorizeMember(query.RoomID, query.UserID, query.ResumeToken, remote, dataStore)
+	if errors.Is(err, data.ErrChatRoomNotFound) {
+		return sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+	}
+	if err != nil {
+		fmt.Println("Rejected history request:", err)
+		return sendErrorResponse(fc, request, protocol.ErrorCodeNotMember, "Only members of the room can read its history")
+	}
+
+	messages, hasMore, err := dataStore.History(query.RoomID, query.BeforeSequence, query.Before, query.PageSize())
+	if err != nil {
+		return sendErrorResponse(fc, request, protocol.ErrorCodeRoomNotFound, "No room exist")
+	}
+
+	response, err := protocol.CreateHistoryPageResponse(toHistory(query.RoomID, messages, hasMore))
+	if err != nil {
+		return err
+	}
+	return writeResponse(fc, request.Version, response)
+}
+
+// toHistory はチャットルームに記録されたメッセージをクライアントへ送信する History に変換する
+func toHistory(chatRoomID string, messages []data.Message, hasMore bool) protocol.History {
+	history := protocol.History{RoomID: chatRoomID, Messages: []protocol.HistoryMessage{}, HasMore: hasMore}
+	for _, message := range messages {
+		history.Messages = append(history.Messages, protocol.HistoryMessage{
+			Kind:       message.Kind,
+			SenderID:   message.Sender.Id,
+			SenderName: message.Sender.Name,
+			Timestamp:  message.Timestamp,
+			Sequence:   message.Sequence,
+			Message:    message.Content,
+		})
+	}
+	return history
+}
+
+// handleHello はクライアントから送られてきた Hello に対して、サーバーが対応している機能と制限を Welcome として返す
+// 返した Welcome はそのセッションで使用できる機能の判断に使う
+func handleHello(fc *protocol.FramedConn, frame []byte) (protocol.Welcome, error) {
+	hello, err := protocol.ParseHelloRequest(frame)
+	if err != nil {
+		response, _ := protocol.InvalidRequestResponse(protocol.OperationHello, protocol.ErrorCodeMalformedRequest, err.Error())
+		fc.WriteFrame(response)
+		return protocol.Welcome{}, err
+	}
+	fmt.Printf("hello from %s (protocol version %d, features %v)\n", hello.ClientName, hello.ProtocolVersion, hello.Features)
+
+	welcome := protocol.Welcome{
+		ProtocolVersion: protocol.ProtocolVersion,
+		ServerIdentity:  serverIdentity,
+		Features:        protocol.NegotiateFeatures(hello.Features, serverFeatures),
+		Limits:          protocol.DefaultLimits,
+	}
+	// 分割して送信できるクライアントには、データグラム 1 つに収まらない長さのメッセージも許可する
+	welcome.Limits.MTU = chatMTU
+	if welcome.Supports(protocol.FeatureFragmentation) {
+		welcome.Limits.MaxMessageSize = protocol.FragmentedMessageBytesMaxLen
+	}
+	// heartbeat が数回失われてもタイムアウトしないよう、idleTimeout より十分短い間隔で送信させる
+	if welcome.Supports(protocol.FeatureHeartbeat) {
+		welcome.Limits.HeartbeatInterval = int(idleTimeout / heartbeatsPerIdleTimeout / time.Millisecond)
+	}
+	response, err := protocol.CreateWelcomeResponse(welcome)
+	if err != nil {
+		return protocol.Welcome{}, err
+	}
+	return welcome, fc.WriteFrame(response)
+}
+
+// validateRequest はリクエストに含まれる各フィールドが Welcome で通知した制限に収まっているかを確認する
+func validateRequest(request protocol.ChatRoomRequest) error {
+	limits := protocol.DefaultLimits
+	if len(request.UserName) > limits.MaxUserName {
+		return fmt.Errorf("user name must be at most %d bytes", limits.MaxUserName)
+	}
+	if len(request.RoomName) > limits.MaxRoomName {
+		return fmt.Errorf("room name must be at most %d bytes", limits.MaxRoomName)
+	}
+	if len(request.RoomPassword) > limits.MaxPassword {
+		return fmt.Errorf("password must be at most %d bytes", limits.MaxPassword)
+	}
+	if len(request.Successor) > limits.MaxUserName {
+		return fmt.Errorf("successor must be at most %d bytes", limits.MaxUserName)
+	}
+	switch request.HostDeparture {
+	case "", protocol.HostDepartureClose, protocol.HostDeparturePromote, protocol.HostDepartureNominate:
+	default:
+		return fmt.Errorf("unknown host departure policy %q", request.HostDeparture)
+	}
+	// end-to-end で暗号化するチャットルームの room key はパスワードから導出するので、パスワードを必須にする
+	if request.EndToEndSalt != "" {
+		if !protocol.ValidEndToEndSalt(request.EndToEndSalt) {
+			return errors.New("invalid end-to-end salt")
+		}
+		if request.RoomPassword == "" {
+			return errors.New("end-to-end encrypted rooms require a password")
+		}
+	}
+	return nil
+}
+
+// sendErrorResponse はリクエストが無効であった理由をエラーコードとともにクライアントへ送信する
+func sendErrorResponse(fc *protocol.FramedConn, request protocol.ChatRoomRequest, code protocol.ErrorCode, message string) error {
+	response, err := protocol.InvalidRequestResponse(request.Operation, code, message)
+	if err != nil {
+		return err
+	}
+	return writeResponse(fc, request.Version, response)
+}
+
+// writeResponse はリクエストと同じバージョンのヘッダでレスポンスを送信する
+// legacy のクライアントには legacy のヘッダに作り直してから送信する
+func writeResponse(fc *protocol.FramedConn, version byte, response []byte) error {
+	response, err := protocol.EncodeForVersion(response, version)
+	if err != nil {
+		return err
+	}
+	return fc.WriteFrame(response)
+}
+
+// listenChat はチャットのメッセージを受信する UDP のポートを開き、配信に使う再送キューと組み立てを準備する
+func listenChat(port string) (*net.UDPConn, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", ":"+port)
 	if err != nil {
-		fmt.Println("Error resolving UDP address:", err)
-		return
+		return nil, err
 	}
 
 	// UDP サーバーを開始
 	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		fmt.Println("Error starting UDP server:", err)
-		return
+		return nil, err
+	}
+
+	// reliable delivery のユーザーへの配信は ack が返るまで再送する
+	config := protocol.DefaultRetransmitConfig
+	config.OnGiveUp = func(recipientID string, sequence uint64, fragmentIndex uint16) {
+		fmt.Printf("Gave up delivering message %d (fragment %d) to user %s\n", sequence, fragmentIndex, recipientID)
 	}
+	retransmits = protocol.NewRetransmitQueue(udpConn, config)
+
+	// 分割されて送られてきたメッセージはすべて揃ってから配信する
+	reassembler = protocol.NewReassembler(protocol.DefaultReassemblyConfig)
+
+	return udpConn, nil
+}
+
+func hostingChatServer(udpConn *net.UDPConn, datastore data.Store) {
 	defer udpConn.Close()
+	defer retransmits.Close()
 
-	fmt.Println("UDP server listening on port", port)
+	fmt.Println("UDP server listening on", udpConn.LocalAddr().String())
 
 	for {
 		// クライアントからのメッセージを受信するバッファ
-		buffer := make([]byte, protocol.ChatProtocolMaxLen)
+		// 最大長を超えるデータグラムを切り詰めずに不正なものとして検出できるよう、1 byte 余分に確保する
+		buffer := make([]byte, protocol.ChatProtocolMaxLen+1)
 		n, addr, err := udpConn.ReadFromUDP(buffer)
 		if err != nil {
 			fmt.Println("Error receiving UDP packet:", err)
 			continue
 		}
 
-		go handleChatMessages(udpConn, addr, buffer, n, datastore)
+		// 大量のデータグラムを送り付ける送信元のために、ゴルーチンを起動しないよう先に捨てる
+		// 捨てるたびにログを出すとそれ自体が負荷になるので、ここでは何も出力しない
+		if limits.datagrams.Allow("ip:"+addr.IP.String(), time.Now()) != nil {
+			continue
+		}
+
+		go handleChatMessages(udpConn, addr, buffer[:n], n, datastore)
 
 	}
 }
 
-func handleChatMessages(udpConn *net.UDPConn, addr *net.UDPAddr, data []byte, length int, datastore *data.DataStore) {
-	fmt.Printf("Received %d bytes from %s: %s\n", length, addr.String(), string(data[:length]))
-	req, err := protocol.ParseChatRequest(data)
+func handleChatMessages(udpConn *net.UDPConn, addr *net.UDPAddr, datagram []byte, length int, datastore data.Store) {
+	fmt.Printf("Received %d bytes from %s: %s\n", length, addr.String(), string(datagram[:length]))
+	req, err := protocol.ParseChatRequest(datagram)
+	if err != nil {
+		fmt.Printf("Received data invalid to read from %s: %s\n", addr.String(), err)
+		return
+	}
+
+	// SessionKey を発行したユーザーを名乗るデータグラムは、認証できたものだけを受け付ける
+	// 暗号化されていたデータグラムは、ここで message を復号する
+	req, authenticated, err := authenticateDatagram(req, addr, datastore)
 	if err != nil {
-		fmt.Print("Received data invalid to read")
+		fmt.Printf("Rejected datagram from %s: %s\n", addr.String(), err)
+		return
+	}
+
+	// heartbeat に限らず、メンバーからデータグラムが届いている間は応答があるものとみなす
+	presence.Touch(req.ChatRoomID, req.UserID, time.Now())
+
+	// heartbeat は NAT の再割り当てなどでアドレスが変わったことを検出するためにも使う
+	if req.Operation == protocol.ChatOperationHeartbeat {
+		isMember, user, err := datastore.IsUserMemberOfChatRoom(req.ChatRoomID, req.UserID)
+		if err != nil || !isMember || (user.ResumeTokenHash == "" && !authenticated) {
+			return
+		}
+		if err := saveUDPAddr(req.ChatRoomID, user, req.Operation, req.Message, authenticated, addr, datastore); err != nil {
+			fmt.Println("Failed to update udp address:", err)
+		}
+		return
+	}
+
+	// 配信の ack が送られてきたとき
+	if req.Operation == protocol.ChatOperationAck {
+		sequence, fragmentIndex, err := req.AckSequence()
+		if err != nil {
+			fmt.Printf("Received invalid ack from %s: %s\n", addr.String(), err)
+			return
+		}
+		retransmits.Ack(req.UserID, sequence, fragmentIndex)
 		return
 	}
 
 	// exitがリクエストされたとき
+	// tcp で退出できなかったクライアントが代わりに送信する
+	// 他のユーザーを退出させられないよう、認証されたデータグラムか TokenProof を確認できたものだけを受け付ける
+	// ResumeToken を発行していない古いクライアントのユーザーは、登録されている配信先から届いたものだけを受け付ける
 	if req.Operation == protocol.ChatOperationExit {
-		// ユーザーをチャットルームから外す
-		// ユーザーがチャットルームのホストならチャットルームごとdatastoreから削除
-		logoutUserName, err := datastore.DeleteUsers(req.ChatRoomID, req.UserID)
-		if err != nil {
-			fmt.Println(err)
+		isMember, user, err := datastore.IsUserMemberOfChatRoom(req.ChatRoomID, req.UserID)
+		if err != nil || !isMember {
+			return
+		}
+		verified := authenticated
+		if !verified && user.ResumeTokenHash != "" {
+			verified = tokenProofs.Verify(user, req.ChatRoomID, req.Operation, req.Message, time.Now())
+		} else if !verified {
+			verified = user.Addr != nil && user.Addr.String() == addr.String()
+		}
+		if !verified {
+			fmt.Printf("Rejected exit of user %s from %s\n", req.UserID, addr.String())
 			return
 		}
-		// ユーザーが退出した場合は、それをサーバーから全員へ配信
-		message := fmt.Sprintf("%s is logged out", logoutUserName)
-		err = broadcastToClients(req.ChatRoomID, "", udpConn, message, datastore)
+		_, err = leaveChatRoom(req.ChatRoomID, req.UserID, "", logoutNotice, udpConn, datastore)
 		if err != nil {
-			fmt.Println("Error occured while broadcasting")
+			fmt.Println(err)
 		}
 		return
 	}
@@ -230,13 +741,18 @@ func handleChatMessages(udpConn *net.UDPConn, addr *net.UDPAddr, data []byte, le
 		}
 		if isUserMember {
 			fmt.Printf("Saving UDP address\n")
-			err = datastore.SaveUserUDPAddr(chatroom.Id, req.UserID, addr)
+			firstAddr := user.Addr == nil
+			err = saveUDPAddr(chatroom.Id, user, req.Operation, req.Message, authenticated, addr, datastore)
 			if err != nil {
-				fmt.Printf("Failed to save udp address of the user")
+				fmt.Println("Failed to save udp address of the user:", err)
+				return
+			}
+			// セッションを再開したユーザーのアドレスが変わった時は、改めて参加を配信しない
+			if !firstAddr {
 				return
 			}
 			message := fmt.Sprintf("%s is logged in", user.Name)
-			err = broadcastToClients(chatroom.Id, user.Id, udpConn, message, datastore)
+			err = broadcastToClients(chatroom.Id, protocol.BroadcastKindJoin, user, udpConn, message, datastore)
 			if err != nil {
 				fmt.Println("Error occured while broadcasting: ", err)
 			}
@@ -246,9 +762,35 @@ func handleChatMessages(udpConn *net.UDPConn, addr *net.UDPAddr, data []byte, le
 
 	// メッセージの配信リクエストが送られてきた時
 	if req.Operation == protocol.ChatOperationSendMessage {
+		// 分割されたメッセージは、すべてのフラグメントが揃うまで配信しない
+		message, complete, err := reassembler.Add(req.UserID, req.Fragment, req.Message, time.Now())
+		if err != nil {
+			fmt.Printf("Failed to reassemble message from %s: %s\n", addr.String(), err)
+			return
+		}
+		if !complete {
+			return
+		}
+		req.Message = message
+
+		// 短い間に送られすぎたメッセージは配信せず、送信者にだけいつから送れるかを通知する
+		// 他のユーザーを名乗ったデータグラムでそのユーザーの回数を使い切らせないよう、ユーザーごとの制限は本人と確認できた時だけ数える
+		err = allowAddr(limits.messages, addr, time.Now())
+		if err == nil && verifiedSender(req, authenticated, addr, datastore) {
+			err = allowUser(limits.messages, req.UserID, time.Now())
+		}
+		if err != nil {
+			fmt.Printf("Rate limited message from %s: %s\n", addr.String(), err)
+			notice := fmt.Sprintf("You are sending messages too fast and your message was not delivered. Please wait %s before sending again", describeRetryAfter(retryAfter(err)))
+			if err := sendDirectNotice(udpConn, chatroom.Id, req.UserID, notice, datastore); err != nil {
+				fmt.Println("Failed to send rate limit notice:", err)
+			}
+			return
+		}
+
 		// client全員へメッセージをブロードキャスト
 
-		err = broadcastToClients(chatroom.Id, req.UserID, udpConn, req.Message, datastore)
+		err = broadcastToClients(chatroom.Id, protocol.BroadcastKindUserMessage, data.User{Id: req.UserID}, udpConn, req.Message, datastore)
 		if err != nil {
 			fmt.Printf("Failed to bradcast: %s\n", err)
 			return
@@ -256,34 +798,269 @@ func handleChatMessages(udpConn *net.UDPConn, addr *net.UDPAddr, data []byte, le
 	}
 }
 
-// broadcastToClients はチャットルーム内の全員へチャットメッセージを配信する
-func broadcastToClients(chatRoomID string, sender_id string, udpConn *net.UDPConn, message string, datastore *data.DataStore) error {
-	datastore.Mu.Lock()
-	defer datastore.Mu.Unlock()
+// authenticateDatagram は SessionKey を発行したユーザーを名乗るデータグラムについて、mac と送信元のアドレス、counter を確認する
+// 確認できたデータグラムには復号した ChatMessage と true を返し、SessionKey を発行していないユーザーやメンバーでない送信元のデータグラムは確認せずにそのまま返す
+// 暗号化を合意したユーザーからのデータグラムは、暗号化されていなければ受け付けない
+// 配信先のアドレスを登録する operation 以外は、登録されているアドレスから届いたものだけを受け付ける
+// 受け付けた counter は counterSaveStep ごとに Store に保存し、サーバーが再起動した後に送り直されたデータグラムも受け付けない
+func authenticateDatagram(req protocol.ChatMessage, addr *net.UDPAddr, datastore data.Store) (protocol.ChatMessage, bool, error) {
+	isMember, user, err := datastore.IsUserMemberOfChatRoom(req.ChatRoomID, req.UserID)
+	if err != nil || !isMember || len(user.SessionKey) == 0 {
+		return req, false, nil
+	}
+	if user.Encryption && !req.Encrypted() {
+		return req, false, fmt.Errorf("%w for user %s", protocol.ErrDatagramNotEncrypted, user.Id)
+	}
+	req, counter, err := req.Verify(user.SessionKey)
+	if err != nil {
+		return req, false, fmt.Errorf("%w for user %s", err, user.Id)
+	}
+	// 別のアドレスから送り直されたデータグラムで counter を使わせないよう、アドレスを先に確認する
+	registersAddr := req.Operation == protocol.ChatOperationSendUDPAddr || req.Operation == protocol.ChatOperationHeartbeat
+	if !registersAddr && (user.Addr == nil || user.Addr.String() != addr.String()) {
+		return req, false, fmt.Errorf("datagram for user %s is not from the registered address", user.Id)
+	}
+	// メモリ上の記録がない時は、再起動する前に受け付けた counter を超えている、保存した counter に counterSaveStep を加えたものまでを受け付けたものとして数え始める
+	if user.Counter > 0 {
+		replays.Seed(user.Id, user.Counter+counterSaveStep)
+	}
+	if !replays.Accept(user.Id, counter) {
+		return req, false, fmt.Errorf("datagram for user %s is replayed (counter %d)", user.Id, counter)
+	}
+	// データグラムごとに journal へ書き込まないよう、最初の counter と、保存した counter から counterSaveStep 以上進んだ時だけ保存する
+	if user.Counter == 0 || counter >= user.Counter+counterSaveStep {
+		if err := datastore.SaveCounter(req.ChatRoomID, user.Id, counter); err != nil {
+			return req, false, fmt.Errorf("failed to save counter for user %s: %w", user.Id, err)
+		}
+	}
+	return req, true, nil
+}
+
+// counterSaveStep は受け付けた counter を保存する間隔
+// 再起動した直後は、保存した counter からこの間隔までのデータグラムをまだ受け付けていなくても破棄する
+const counterSaveStep = protocol.ReplayWindowSize
+
+// verifiedSender はデータグラムが user_id のユーザー本人から送られてきたと確認できるかを返す
+// SessionKey で認証されたデータグラムか、SessionKey を発行していないユーザーの登録されている配信先から届いたものを本人からとみなす
+func verifiedSender(req protocol.ChatMessage, authenticated bool, addr *net.UDPAddr, datastore data.Store) bool {
+	if authenticated {
+		return true
+	}
+	isMember, user, err := datastore.IsUserMemberOfChatRoom(req.ChatRoomID, req.UserID)
+	if err != nil || !isMember || len(user.SessionKey) != 0 {
+		return false
+	}
+	return user.Addr != nil && user.Addr.String() == addr.String()
+}
+
+// saveUDPAddr はデータグラムが認証されているか、proof がユーザーに発行した ResumeToken から operation のために作成された TokenProof であれば、
+// addr をユーザーの配信先として登録する
+// 既に同じアドレスが登録されている時は何もしない
+func saveUDPAddr(chatRoomID string, user data.User, operation byte, proof string, authenticated bool, addr *net.UDPAddr, datastore data.Store) error {
+	if !authenticated && !tokenProofs.Verify(user, chatRoomID, operation, proof, time.Now()) {
+		return fmt.Errorf("invalid token proof for user %s from %s", user.Id, addr)
+	}
+	if user.Addr != nil && user.Addr.String() == addr.String() {
+		return nil
+	}
+	err := datastore.SaveUserUDPAddr(chatRoomID, user.Id, addr)
+	if err != nil {
+		return err
+	}
+	if user.Addr != nil {
+		fmt.Printf("Address of '%s' changed from %s to %s\n", user.Name, user.Addr, addr)
+	}
+	return nil
+}
+
+// leaveChatRoom はユーザーをチャットルームから外し、退出したことを残りのメンバーへ配信する
+// ユーザーがチャットルームのホストなら、チャットルームの設定に従って後任のホストを配信するか、
+// チャットルームを閉じたことを配信してからチャットルームごと削除する
+// successor には退出するホストが後任に指名したメンバーの名前を、notice には退出したユーザーの名前を埋め込む配信の書式を指定する
+// 退出の結果を返し、Closed の時はチャットルームが既に削除されている
+func leaveChatRoom(chatRoomID string, userID string, successor string, notice string, udpConn *net.UDPConn, datastore data.Store) (data.Departure, error) {
+	departure, err := datastore.DeleteUsers(chatRoomID, userID, successor)
+	if err != nil {
+		return data.Departure{}, err
+	}
+	// 退出したユーザーへの再送はもう必要ない
+	retransmits.Forget(userID)
+	presence.Forget(chatRoomID, userID)
+	replays.Forget(userID)
+	tokenProofs.Forget(userID)
+
+	if departure.Closed {
+		message := fmt.Sprintf("%s closed the room", departure.User.Name)
+		err = broadcastToClients(chatRoomID, protocol.BroadcastKindRoomClosed, departure.User, udpConn, message, datastore)
+		if err != nil {
+			fmt.Println("Error occured while broadcasting:", err)
+		}
+		deleteChatRoom(chatRoomID, datastore)
+		return departure, nil
+	}
+
+	// ユーザーが退出した場合は、それをサーバーから全員へ配信
+	message := fmt.Sprintf(notice, departure.User.Name)
+	err = broadcastToClients(chatRoomID, protocol.BroadcastKindLeave, departure.User, udpConn, message, datastore)
+	if err != nil {
+		fmt.Println("Error occured while broadcasting:", err)
+	}
+
+	// ホストが交代した場合は、新しいホストを全員へ配信
+	if departure.NewHost.Id != "" {
+		message := fmt.Sprintf("%s is now the host", departure.NewHost.Name)
+		err = broadcastToClients(chatRoomID, protocol.BroadcastKindHostChanged, departure.NewHost, udpConn, message, datastore)
+		if err != nil {
+			fmt.Println("Error occured while broadcasting:", err)
+		}
+	}
+	return departure, nil
+}
+
+// 退出を配信する時の書式
+const (
+	logoutNotice  = "%s is logged out"
+	timeoutNotice = "%s timed out"
+)
+
+// deleteChatRoom はチャットルームを削除し、残っていたメンバーへの再送と、応答やデータグラムの counter の記録を打ち切る
+func deleteChatRoom(chatRoomID string, datastore data.Store) {
+	chatRoom, err := datastore.GetChatRoomByID(chatRoomID)
+	if err == nil {
+		for memberID := range chatRoom.Users {
+			retransmits.Forget(memberID)
+			replays.Forget(memberID)
+			tokenProofs.Forget(memberID)
+		}
+	}
+	presence.ForgetChatRoom(chatRoomID)
+	err = datastore.DeleteChatRooms(chatRoomID)
+	if err != nil {
+		fmt.Println("Failed to delete chat room:", err)
+	}
+}
+
+// reapIdleSessions は interval ごとに reapChatRooms ですべてのチャットルームを確認する
+func reapIdleSessions(udpConn *net.UDPConn, datastore data.Store, interval time.Duration, emptyRoomTTL time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		reapChatRooms(udpConn, datastore, now, emptyRoomTTL)
+	}
+}
+
+// reapChatRooms は heartbeat を送信するメンバーのうち idleTimeout の間データグラムが届いていないものをチャットルームから外す
+// また、メンバーがいない状態が emptyRoomTTL 続いたチャットルームを削除する
+// idleTimeout や emptyRoomTTL が 0 の時は、それぞれの確認を行わない
+func reapChatRooms(udpConn *net.UDPConn, datastore data.Store, now time.Time, emptyRoomTTL time.Duration) {
+	for _, chatRoomID := range datastore.ChatRoomIDs() {
+		chatRoom, err := datastore.GetChatRoomByID(chatRoomID)
+		if err != nil {
+			continue
+		}
+
+		if len(chatRoom.Users) == 0 {
+			if emptyRoomTTL > 0 && presence.Empty(chatRoomID, now) >= emptyRoomTTL {
+				fmt.Printf("Chat room 'id: %s, name: %s' has been empty for %s, deleting it\n", chatRoomID, chatRoom.Name, emptyRoomTTL)
+				deleteChatRoom(chatRoomID, datastore)
+			}
+			continue
+		}
+		presence.Occupied(chatRoomID)
+
+		if idleTimeout <= 0 {
+			continue
+		}
+		for _, user := range chatRoom.Users {
+			if !user.Heartbeat || presence.Idle(chatRoomID, user.Id, now) < idleTimeout {
+				continue
+			}
+			fmt.Printf("'id: %s, name: %s' has been silent for %s\n", user.Id, user.Name, idleTimeout)
+			departure, err := leaveChatRoom(chatRoomID, user.Id, "", timeoutNotice, udpConn, datastore)
+			if err != nil {
+				fmt.Println("Failed to remove idle user from chat room:", err)
+				continue
+			}
+			// タイムアウトしたホストがチャットルームを閉じた時は、削除したチャットルームの残りのメンバーを確認しない
+			if departure.Closed {
+				break
+			}
+		}
+	}
+}
+
+// broadcastToClients はチャットルーム内の全員へ kind に応じた配信データグラムを送信する
+// sender には配信のきっかけとなったユーザーを指定する
+// クライアントが sequence の抜けから配信の欠落を検出できるよう、sender 自身にも配信する
+// reliable delivery のユーザーへは ack が返るまで再送する
+// システムからの通知など送信者がいない場合は sender に空の User を指定する
+//
+// サーバーの時刻と通し番号の割り当てから送信までを Store のロックを保持したまま行うため、
+// 複数のゴルーチンから同時に呼ばれても、各ユーザーへは通し番号の順に送信される
+func broadcastToClients(chatRoomID string, kind byte, sender data.User, udpConn *net.UDPConn, message string, datastore data.Store) error {
+	// 配信ごとにサーバーの時刻とチャットルームの通し番号を割り当て、後から参加したユーザーのために履歴へ残す
+	// ユーザーのメッセージはメンバーからのものしか配信しない
+	request := data.Message{Kind: kind, Content: message, Sender: sender.Sender(), Timestamp: time.Now()}
+	memberOnly := kind == protocol.BroadcastKindUserMessage
+	_, err := datastore.AppendMessage(chatRoomID, request, memberOnly, func(chatRoom data.ChatRoom, accepted data.Message) error {
+		return sendBroadcast(udpConn, chatRoom, accepted)
+	})
+	if errors.Is(err, data.ErrUserNotFound) {
+		return errors.New("invalid User message")
+	}
+	return err
+}
 
-	chatRoom, exists := datastore.ChatRooms[chatRoomID]
-	if !exists {
-		// チャットルームが存在しないときはその旨をユーザーへ配信する
-		return errors.New("the chatroom does not exist")
+// sendBroadcast は Store に受け付けられたメッセージをチャットルームのメンバーへ送信する
+func sendBroadcast(udpConn *net.UDPConn, chatRoom data.ChatRoom, accepted data.Message) error {
+	broadcast := protocol.Broadcast{
+		Kind:       accepted.Kind,
+		RoomID:     chatRoom.Id,
+		SenderID:   accepted.Sender.Id,
+		SenderName: accepted.Sender.Name,
+		Timestamp:  accepted.Timestamp,
+		Sequence:   accepted.Sequence,
+		Message:    accepted.Content,
 	}
 
-	// メンバーの退出を配信するときには、sender_idの引数が与えられない
-	// それ以外の時にはidが送られるのでそれをメッセージに含める
-	if sender_id != "" {
-		sender, exists := chatRoom.Users[sender_id]
-		if !exists {
-			return errors.New("invalid User message")
+	// 分割された配信を組み立てられるユーザーには MTU 以下に分割して送信する
+	// 暗号化するユーザーには、トレーラーを追加しても MTU に収まるように分割する
+	// 組み立てられないユーザーには分割せずに送信し、データグラム 1 つに収まらない時は代わりにその旨を通知する
+	fragmented, err := encodeFragments(broadcast, chatMTU)
+	if err != nil {
+		return err
+	}
+	sealedFragmented, err := encodeFragments(broadcast, chatMTU-protocol.BroadcastSealLen)
+	if err != nil {
+		return err
+	}
+	whole, err := encodeBroadcasts([]protocol.Broadcast{broadcast})
+	if err != nil {
+		notice := broadcast
+		notice.Kind = protocol.BroadcastKindSystemNotice
+		notice.SenderID = ""
+		notice.SenderName = ""
+		notice.Message = fmt.Sprintf("%s sent a message that is too long for this client", accepted.Sender.Name)
+		whole, err = encodeBroadcasts([]protocol.Broadcast{notice})
+		if err != nil {
+			return err
 		}
-		message = fmt.Sprintf("%s: %s", sender.Name, message)
 	}
 
 	for _, user := range chatRoom.Users {
 		// ユーザーのアドレスにメッセージを送信
-		// 配信メッセージの送り主には配信しない
-		if user.Id == sender_id {
+		// まだ udp address を登録していないユーザーには配信しない
+		if user.Addr == nil {
 			continue
 		}
-		_, err := udpConn.WriteToUDP([]byte(message), user.Addr)
+		datagrams := whole
+		if user.Fragmentation && user.Encryption {
+			datagrams = sealedFragmented
+		} else if user.Fragmentation {
+			datagrams = fragmented
+		}
+		err = sendDatagrams(udpConn, user, broadcast.Sequence, datagrams)
 		if err != nil {
 			fmt.Printf("Error sending message to user %s: %v\n", user.Name, err)
 			continue
@@ -293,14 +1070,270 @@ func broadcastToClients(chatRoomID string, sender_id string, udpConn *net.UDPCon
 	return nil
 }
 
+// encodeFragments は配信を mtu 以下に分割し、それぞれ送信するためのバイト列に変換する
+func encodeFragments(broadcast protocol.Broadcast, mtu int) ([][]byte, error) {
+	fragments, err := broadcast.Fragments(mtu)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBroadcasts(fragments)
+}
+
+// encodeBroadcasts は配信をそれぞれ送信するためのバイト列に変換する
+func encodeBroadcasts(broadcasts []protocol.Broadcast) ([][]byte, error) {
+	datagrams := make([][]byte, 0, len(broadcasts))
+	for _, broadcast := range broadcasts {
+		datagram, err := broadcast.CreateBroadcast()
+		if err != nil {
+			return nil, err
+		}
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams, nil
+}
+
+// sendDatagrams は 1 つの配信を構成するデータグラムをユーザーへ送信する
+// 暗号化するユーザーへはユーザーの SessionKey で暗号化してから送信する
+// reliable delivery のユーザーへはフラグメントごとに ack が返るまで再送する
+func sendDatagrams(udpConn *net.UDPConn, user data.User, sequence uint64, datagrams [][]byte) error {
+	for i, datagram := range datagrams {
+		var err error
+		if user.Encryption {
+			datagram, err = protocol.SealBroadcast(user.SessionKey, datagram)
+			if err != nil {
+				return err
+			}
+		}
+		if user.Reliable {
+			err = retransmits.Send(user.Id, user.Addr, sequence, uint16(i), datagram)
+		} else {
+			_, err = udpConn.WriteToUDP(datagram, user.Addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDirectNotice はチャットルームの配信の順番に含めず、履歴にも残さない通知をメンバー 1 人へ送信する
+// 登録されているアドレスへだけ送信し、届かなくても再送しない
+func sendDirectNotice(udpConn *net.UDPConn, chatRoomID string, userID string, message string, datastore data.Store) error {
+	isMember, user, err := datastore.IsUserMemberOfChatRoom(chatRoomID, userID)
+	if err != nil || !isMember || user.Addr == nil {
+		return err
+	}
+	datagram, err := protocol.DirectNotice(chatRoomID, message, time.Now()).CreateBroadcast()
+	if err != nil {
+		return err
+	}
+	if user.Encryption {
+		datagram, err = protocol.SealBroadcast(user.SessionKey, datagram)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = udpConn.WriteToUDP(datagram, user.Addr)
+	return err
+}
+
+// serverIdentity は Welcome でクライアントへ通知するサーバーの名前
+const serverIdentity = "online-chat-messenger server"
+
+// serverFeatures はこのサーバーが対応している機能の一覧
+var serverFeatures = []string{protocol.FeatureReliableDelivery, protocol.FeatureFragmentation, protocol.FeatureHistory, protocol.FeatureHostHandover, protocol.FeatureSessionResume, protocol.FeatureDatagramAuth, protocol.FeatureEncryption, protocol.FeatureEndToEnd}
+
+// retransmits は reliable delivery のユーザーへ送信した配信のうち、ack が返ってきていないものを保持する
+var retransmits *protocol.RetransmitQueue
+
+// reassembler はクライアントから分割されて送られてきたメッセージを組み立てる
+var reassembler *protocol.Reassembler
+
+// replays は SessionKey を発行したユーザーごとに、認証したデータグラムの counter を記録する
+var replays = protocol.NewReplayGuard()
+
+// tokenProofs は ResumeToken を発行したユーザーごとに、受け付けた TokenProof の時刻を記録する
+var tokenProofs = chat.NewTokenProofs(time.Now())
+
+// chatMTU はこれを超える長さの配信を分割する長さ
+var chatMTU int
+
+// historyReplaySize はチャットルームへ参加したユーザーへ送信する履歴の最大数
+var historyReplaySize int
+
+// presence はメンバーから最後にデータグラムが届いた時刻と、チャットルームが空になった時刻を保持する
+var presence = chat.NewPresence()
+
+// idleTimeout はこの間 heartbeat を含むデータグラムが届かないメンバーをチャットルームから外す時間 (0 の時は外さない)
+var idleTimeout time.Duration
+
+// heartbeatsPerIdleTimeout は idleTimeout の間にクライアントが送信する heartbeat の数
+const heartbeatsPerIdleTimeout = 4
+
+// acceptLegacyProtocol が true の間は legacy のヘッダを使うクライアントからのリクエストも受け付ける
+var acceptLegacyProtocol bool
+
+// requestTimeout は tcp で接続したクライアントが Hello とリクエストを送信し終えるまで待つ時間 (0 の時は待ち続ける)
+var requestTimeout time.Duration
+
+// reapInterval はメンバーとチャットルームを確認する間隔で、短い方の期限の 1/4 とする
+// どちらの確認も行わない時は 0 を返す
+func reapInterval(idleTimeout time.Duration, emptyRoomTTL time.Duration) time.Duration {
+	shortest := idleTimeout
+	if shortest <= 0 || (emptyRoomTTL > 0 && emptyRoomTTL < shortest) {
+		shortest = emptyRoomTTL
+	}
+	if shortest <= 0 {
+		return 0
+	}
+	return max(shortest/4, 100*time.Millisecond)
+}
+
+// openStore は -storage で指定された Store を作成する
+func openStore(storage string, dataDir string, config data.Config, snapshotInterval time.Duration) (data.Store, error) {
+	switch storage {
+	case "memory":
+		return data.NewMemoryStore(config), nil
+	case "file":
+		if snapshotInterval <= 0 {
+			return nil, errors.New("snapshot-interval must be positive")
+		}
+		return data.OpenFileStore(dataDir, config, snapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", storage)
+	}
+}
+
 func main() {
+	flag.BoolVar(&acceptLegacyProtocol, "accept-legacy-protocol", true, "accept requests from clients using the legacy ChatRoomProtocol header")
+	flag.DurationVar(&requestTimeout, "request-timeout", 10*time.Second, "close tcp connections that do not send a request within this time (0 disables)")
+	maxUsersPerRoom := flag.Int("max-room-members", 0, "maximum number of members in a chat room (0 means unlimited)")
+	flag.IntVar(&chatMTU, "mtu", protocol.DefaultMTU, "maximum size of a chat datagram before it is split into fragments")
+	historySize := flag.Int("history-size", 100, "number of messages kept as history in each chat room (0 disables history)")
+	flag.IntVar(&historyReplaySize, "history-replay", 20, "number of history messages sent to a user who joins a chat room")
+	storage := flag.String("storage", "file", "storage backend for chat rooms: file (restored on restart) or memory")
+	dataDir := flag.String("data-dir", "data", "directory where the file storage keeps its journal and snapshots")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "interval between snapshots of the file storage")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Minute, "remove members whose heartbeats stop for this long (0 disables)")
+	emptyRoomTTL := flag.Duration("empty-room-ttl", 10*time.Minute, "delete chat rooms that stay empty for this long (0 disables)")
+	tlsMode := flag.String("tls", tlsModeOff, "encrypt the tcp control channel: off, cert (use -tls-cert and -tls-key) or dev (create a self-signed certificate at those paths)")
+	tlsCert := flag.String("tls-cert", "tls/cert.pem", "certificate file for the tcp control channel")
+	tlsKey := flag.String("tls-key", "tls/key.pem", "private key file for the tcp control channel")
+	datagramRate := rateLimitValue{Count: 200, Per: time.Second}
+	flag.Var(&datagramRate, "rate-datagrams", "maximum udp datagrams accepted from each IP address, as COUNT/DURATION (0 disables)")
+	connectionRate := rateLimitValue{Count: 60, Per: time.Minute}
+	flag.Var(&connectionRate, "rate-connections", "maximum tcp connections accepted from each IP address, as COUNT/DURATION (0 disables)")
+	messageRate := rateLimitValue{Count: 20, Per: 10 * time.Second}
+	flag.Var(&messageRate, "rate-messages", "maximum chat messages accepted from each IP address and verified user, as COUNT/DURATION (0 disables)")
+	createRate := rateLimitValue{Count: 10, Per: time.Minute}
+	flag.Var(&createRate, "rate-creates", "maximum chat room creations accepted from each IP address, as COUNT/DURATION (0 disables)")
+	joinRate := rateLimitValue{Count: 20, Per: time.Minute}
+	flag.Var(&joinRate, "rate-joins", "maximum join and resume attempts accepted from each IP address, and resumes of each verified user, as COUNT/DURATION (0 disables)")
+	searchRate := rateLimitValue{Count: 30, Per: time.Minute}
+	flag.Var(&searchRate, "rate-searches", "maximum chat room searches accepted from each IP address, as COUNT/DURATION (0 disables)")
+	lockoutAttempts := flag.Int("lockout-attempts", 5, "failed password attempts or unknown room ids from an IP address before it is locked out of searching and joining (0 disables)")
+	roomLockoutAttempts := flag.Int("lockout-room-attempts", 3, "failed password attempts to a chat room from an IP address before it is locked out of joining that room (0 disables)")
+	flag.IntVar(&roomNotifyAttempts, "notify-room-attempts", 10, "failed password attempts to a chat room from all IP addresses before its hosts are notified (0 disables)")
+	notifyInterval := flag.Duration("notify-interval", time.Minute, "shortest interval between notices of failed password attempts sent to the hosts of a chat room (0 sends every notice)")
+	lockoutBase := flag.Duration("lockout-base", 5*time.Second, "first lockout after too many failed attempts, doubled on each further failure")
+	lockoutMax := flag.Duration("lockout-max", 15*time.Minute, "longest lockout, and how long failed attempts are remembered")
+	auditLog := flag.String("audit-log", "audit.log", "file where failed password attempts and lockouts are recorded (empty disables)")
+	flag.Parse()
+
+	if chatMTU < protocol.MinMTU || chatMTU > protocol.ChatProtocolMaxLen {
+		fmt.Printf("mtu must be between %d and %d\n", protocol.MinMTU, protocol.ChatProtocolMaxLen)
+		return
+	}
+	if *historySize < 0 || historyReplaySize < 0 {
+		fmt.Println("history-size and history-replay must not be negative")
+		return
+	}
+	if idleTimeout < 0 || *emptyRoomTTL < 0 {
+		fmt.Println("idle-timeout and empty-room-ttl must not be negative")
+		return
+	}
+	// パスワードなどを平文で送受信しないよう、tcp の接続を TLS で暗号化する
+	tlsConfig, err := loadTLSConfig(*tlsMode, *tlsCert, *tlsKey)
+	if err != nil {
+		fmt.Println("Error loading TLS certificate:", err)
+		return
+	}
+
+	// 1 つの送信元からのリクエストでサーバーが埋め尽くされないよう、送信元ごとに回数を制限する
+	limits = rateLimits{
+		datagrams:   chat.NewRateLimiter(chat.RateLimit(datagramRate)),
+		connections: chat.NewRateLimiter(chat.RateLimit(connectionRate)),
+		messages:    chat.NewRateLimiter(chat.RateLimit(messageRate)),
+		creates:     chat.NewRateLimiter(chat.RateLimit(createRate)),
+		joins:       chat.NewRateLimiter(chat.RateLimit(joinRate)),
+		searches:    chat.NewRateLimiter(chat.RateLimit(searchRate)),
+	}
+	go limits.prune(time.Minute)
+
+	// パスワードを総当たりで試されないよう、失敗し続けた送信元を締め出し、失敗を監査ログに残す
+	if *lockoutBase <= 0 || *lockoutMax < *lockoutBase {
+		fmt.Println("lockout-base must be positive and lockout-max must not be shorter than lockout-base")
+		return
+	}
+	if roomNotifyAttempts < 0 || *notifyInterval < 0 {
+		fmt.Println("notify-room-attempts and notify-interval must not be negative")
+		return
+	}
+	addrLockout = chat.NewLockout(chat.LockoutConfig{Attempts: *lockoutAttempts, Base: *lockoutBase, Max: *lockoutMax})
+	roomLockout = chat.NewLockout(chat.LockoutConfig{Attempts: *roomLockoutAttempts, Base: *lockoutBase, Max: *lockoutMax})
+	roomAttempts = chat.NewLockout(chat.LockoutConfig{Max: *lockoutMax})
+	hostNotices = chat.NewRateLimiter(chat.RateLimit{Count: 1, Per: *notifyInterval})
+	go pruneLockouts(time.Minute)
+	if *auditLog != "" {
+		audit, err = chat.OpenAuditLog(*auditLog)
+		if err != nil {
+			fmt.Println("Error opening audit log:", err)
+			return
+		}
+		defer audit.Close()
+	}
+
+	// タイムアウトしないサーバーでは、クライアントに heartbeat を送信させない
+	if idleTimeout > 0 {
+		serverFeatures = append(serverFeatures, protocol.FeatureHeartbeat)
+	}
+
 	// 稼働しているチャットルームに関する情報はここに保存
-	dataStore := &data.DataStore{
-		ChatRooms: make(map[string]data.ChatRoom),
+	config := data.Config{
+		MaxUsersPerRoom:    *maxUsersPerRoom,
+		MaxMessagesPerRoom: *historySize,
+	}
+	dataStore, err := openStore(*storage, *dataDir, config, *snapshotInterval)
+	if err != nil {
+		fmt.Println("Error opening storage:", err)
+		return
 	}
+	defer dataStore.Close()
+
+	// 終了する時は保存されていないデータを書き出してから終了する
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := dataStore.Close(); err != nil {
+			fmt.Println("Error closing storage:", err)
+		}
+		os.Exit(0)
+	}()
 
 	// UDP サーバーを起動
-	go hostingChatServer("9090", dataStore)
+	// tcp で受け付けた退出なども配信できるよう、tcp の接続を受け付ける前にポートを開いておく
+	udpConn, err := listenChat("9090")
+	if err != nil {
+		fmt.Println("Error starting UDP server:", err)
+		return
+	}
+	go hostingChatServer(udpConn, dataStore)
+
+	// 応答しなくなったメンバーと、空のまま残っているチャットルームを取り除く
+	if interval := reapInterval(idleTimeout, *emptyRoomTTL); interval > 0 {
+		go reapIdleSessions(udpConn, dataStore, interval, *emptyRoomTTL)
+	}
 
 	// TCPサーバーをポート8080でリッスン開始
 	listener, err := net.Listen("tcp", ":8080")
@@ -309,8 +1342,12 @@ func main() {
 		return
 	}
 	defer listener.Close()
-
-	fmt.Println("Server is listening on port 8080...")
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		fmt.Println("Server is listening on port 8080 with TLS...")
+	} else {
+		fmt.Println("Server is listening on port 8080...")
+	}
 
 	for {
 		// クライアントからの接続を待機
@@ -320,7 +1357,14 @@ func main() {
 			continue
 		}
 
+		// 接続を繰り返す送信元からの接続は、ゴルーチンを起動せずにすぐ閉じる
+		if err := limits.connections.Allow("ip:"+remoteIP(tcpConn.RemoteAddr()), time.Now()); err != nil {
+			fmt.Printf("Rate limited connection from %s: %s\n", tcpConn.RemoteAddr(), err)
+			tcpConn.Close()
+			continue
+		}
+
 		// 接続を新しいゴルーチンで処理
-		go handleChatRoomRequest(tcpConn, dataStore)
+		go handleChatRoomRequest(tcpConn, udpConn, dataStore)
 	}
 }
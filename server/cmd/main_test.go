@@ -0,0 +1,661 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+	"github.com/okonomipizza/chat-server/pkg/chat"
+	"github.com/okonomipizza/chat-server/pkg/data"
+)
+
+// newTestServer は配信に使う udp のポートを開き、テストの終了時に閉じる
+func newTestServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	chatMTU = protocol.DefaultMTU
+	udpConn, err := listenChat("0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() {
+		retransmits.Close()
+		udpConn.Close()
+	})
+	return udpConn
+}
+
+// testMember はテストのチャットルームに参加させるユーザーと、そのユーザーに発行した ResumeToken
+type testMember struct {
+	user  data.User
+	token string
+}
+
+// newTestMember は ResumeToken を発行したユーザーを作成する
+func newTestMember(t *testing.T, id string, name string, joinedAt time.Time) testMember {
+	t.Helper()
+	token, tokenHash, err := chat.IssueResumeToken(protocol.Welcome{Features: []string{protocol.FeatureSessionResume}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return testMember{user: data.User{Id: id, Name: name, JoinedAt: joinedAt, ResumeTokenHash: tokenHash}, token: token}
+}
+
+// newTestChatRoom はホストが退出すると閉じるチャットルームに members を参加させる
+// 最初のメンバーがホストになる
+func newTestChatRoom(t *testing.T, dataStore data.Store, members ...testMember) {
+	t.Helper()
+	room := data.ChatRoom{Id: "room-1", Name: "General", Users: map[string]data.User{}, HostDeparture: protocol.HostDepartureClose}
+	if err := dataStore.AddChatRooms(room.Id, room); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, member := range members {
+		if _, err := dataStore.AddUsers(room.Id, member.user); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+}
+
+// sendTestRequest は handleChatRoomRequest に request を送り、ack に続くレスポンスを返す
+func sendTestRequest(t *testing.T, udpConn *net.UDPConn, dataStore data.Store, request protocol.ChatRoomRequest) protocol.ChatRoomRequest {
+	t.Helper()
+	return sendTestRequestFrom(t, udpConn, dataStore, request, nil)
+}
+
+// sendTestRequestFrom は remote から接続したものとして handleChatRoomRequest に request を送り、ack に続くレスポンスを返す
+func sendTestRequestFrom(t *testing.T, udpConn *net.UDPConn, dataStore data.Store, request protocol.ChatRoomRequest, remote net.Addr) protocol.ChatRoomRequest {
+	t.Helper()
+	frame, err := request.CreateRequestProtocol()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	response, err := protocol.ParseChatRoomResponse(sendTestFrame(t, udpConn, dataStore, frame, remote))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return response
+}
+
+// remoteConn は RemoteAddr が remote を返す net.Conn
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// sendTestFrame は handleChatRoomRequest にリクエストのフレームを送り、ack に続くレスポンスのフレームを返す
+// remote を指定した時は、そのアドレスから接続したものとして扱わせる
+func sendTestFrame(t *testing.T, udpConn *net.UDPConn, dataStore data.Store, frame []byte, remote net.Addr) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	var conn net.Conn = server
+	if remote != nil {
+		conn = remoteConn{Conn: server, remote: remote}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleChatRoomRequest(conn, udpConn, dataStore)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	fc := protocol.NewFramedConn(client)
+	err := fc.WriteFrame(frame)
+	if err == nil {
+		err = protocol.ReceiveAckResponse(fc)
+	}
+	var response []byte
+	if err == nil {
+		response, err = fc.ReadFrame()
+	}
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	<-done
+	return response
+}
+
+func TestLeaveRequiresResumeToken(t *testing.T) {
+	udpConn := newTestServer(t)
+	alice := newTestMember(t, "user-alice", "alice", time.Now())
+	bob := newTestMember(t, "user-bob", "bob", time.Now())
+
+	cases := []struct {
+		name    string
+		userID  string
+		token   string
+		success bool
+	}{
+		{"without token", "user-bob", "", false},
+		{"with token of another member", "user-bob", alice.token, false},
+		{"host with token of another member", "user-alice", bob.token, false},
+		{"with own token", "user-bob", bob.token, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dataStore := data.NewMemoryStore(data.Config{})
+			newTestChatRoom(t, dataStore, alice, bob)
+
+			response := sendTestRequest(t, udpConn, dataStore, protocol.ChatRoomRequest{
+				RoomID:      "room-1",
+				UserID:      c.userID,
+				ResumeToken: c.token,
+				Operation:   protocol.OperationLeaveChatRoom,
+				State:       protocol.StateRequest,
+			})
+
+			isMember, _, err := dataStore.IsUserMemberOfChatRoom("room-1", c.userID)
+			if c.success {
+				if response.State != protocol.StateSuccess || isMember {
+					t.Errorf("expected user to leave, got state %d (error %v)", response.State, response.Error)
+				}
+				return
+			}
+			if response.Error == nil || response.Error.Code != protocol.ErrorCodeNotMember {
+				t.Errorf("expected not_member error, got state %d (error %v)", response.State, response.Error)
+			}
+			// 拒否した退出では、メンバーもチャットルームもそのまま残る
+			if err != nil || !isMember {
+				t.Errorf("expected user %s to stay in the room (error %v)", c.userID, err)
+			}
+		})
+	}
+}
+
+func TestLeaveOfLegacyUserRequiresRegisteredAddress(t *testing.T) {
+	udpConn := newTestServer(t)
+	dataStore := data.NewMemoryStore(data.Config{})
+	// ResumeToken を発行していない古いクライアントのユーザーは、配信先と同じ IP アドレスからの退出だけを受け付ける
+	newTestChatRoom(t, dataStore, testMember{user: data.User{Id: "user-alice", Name: "alice"}})
+	if err := dataStore.SaveUserUDPAddr("room-1", "user-alice", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	response := sendTestRequest(t, udpConn, dataStore, protocol.ChatRoomRequest{
+		RoomID:    "room-1",
+		UserID:    "user-alice",
+		Operation: protocol.OperationLeaveChatRoom,
+		State:     protocol.StateRequest,
+	})
+	if response.Error == nil || response.Error.Code != protocol.ErrorCodeNotMember {
+		t.Errorf("expected not_member error, got state %d (error %v)", response.State, response.Error)
+	}
+	if _, err := dataStore.GetChatRoomByID("room-1"); err != nil {
+		t.Errorf("expected the room to stay open, got %v", err)
+	}
+}
+
+// departureStore は DeleteUsers の結果を記録する Store
+type departureStore struct {
+	data.Store
+	departures []data.Departure
+	errors     []error
+}
+
+func (s *departureStore) DeleteUsers(chatRoomID string, userID string, successorName string) (data.Departure, error) {
+	departure, err := s.Store.DeleteUsers(chatRoomID, userID, successorName)
+	if err != nil {
+		s.errors = append(s.errors, err)
+	} else {
+		s.departures = append(s.departures, departure)
+	}
+	return departure, err
+}
+
+// useReaperConfig はテストの間だけ idleTimeout と presence を置き換える
+func useReaperConfig(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	savedTimeout, savedPresence := idleTimeout, presence
+	idleTimeout, presence = timeout, chat.NewPresence()
+	t.Cleanup(func() {
+		idleTimeout, presence = savedTimeout, savedPresence
+	})
+}
+
+func TestReaperStopsAtClosedRoom(t *testing.T) {
+	udpConn := newTestServer(t)
+	useReaperConfig(t, time.Minute)
+	dataStore := &departureStore{Store: data.NewMemoryStore(data.Config{})}
+	start := time.Now()
+	members := []testMember{}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		member := newTestMember(t, "user-"+name, name, start)
+		member.user.Heartbeat = true
+		members = append(members, member)
+	}
+	newTestChatRoom(t, dataStore, members...)
+
+	// 最初の確認で記録を始め、その後 heartbeat が届かないまま idleTimeout が過ぎる
+	reapChatRooms(udpConn, dataStore, start, 0)
+	if len(dataStore.departures) != 0 {
+		t.Fatalf("expected nobody to time out yet, got %+v", dataStore.departures)
+	}
+	reapChatRooms(udpConn, dataStore, start.Add(time.Minute), 0)
+
+	if _, err := dataStore.GetChatRoomByID("room-1"); !errors.Is(err, data.ErrChatRoomNotFound) {
+		t.Fatalf("expected the room to be closed with the host, got %v", err)
+	}
+	// ホストが閉じたチャットルームの残りのメンバーは、外そうとも応答を記録し直そうともしない
+	if len(dataStore.errors) != 0 {
+		t.Errorf("expected no departures from the deleted room, got %v", dataStore.errors)
+	}
+	for _, member := range members {
+		if idle := presence.Idle("room-1", member.user.Id, start.Add(2*time.Minute)); idle != 0 {
+			t.Errorf("expected %s of the deleted room not to be tracked, got %s", member.user.Id, idle)
+		}
+	}
+	last := dataStore.departures[len(dataStore.departures)-1]
+	if !last.Closed || last.User.Id != "user-alice" {
+		t.Errorf("expected the host to close the room last, got %+v", last)
+	}
+}
+
+func TestReaperKeepsActiveMembers(t *testing.T) {
+	udpConn := newTestServer(t)
+	useReaperConfig(t, time.Minute)
+	dataStore := &departureStore{Store: data.NewMemoryStore(data.Config{})}
+	start := time.Now()
+	alice := newTestMember(t, "user-alice", "alice", start)
+	alice.user.Heartbeat = true
+	bob := newTestMember(t, "user-bob", "bob", start)
+	bob.user.Heartbeat = true
+	// heartbeat を送信しない古いクライアントのユーザーはタイムアウトさせない
+	carol := newTestMember(t, "user-carol", "carol", start)
+	newTestChatRoom(t, dataStore, alice, bob, carol)
+
+	reapChatRooms(udpConn, dataStore, start, 0)
+	presence.Touch("room-1", "user-alice", start.Add(30*time.Second))
+	reapChatRooms(udpConn, dataStore, start.Add(time.Minute), 0)
+
+	if len(dataStore.departures) != 1 || dataStore.departures[0].User.Id != "user-bob" {
+		t.Fatalf("expected only bob to time out, got %+v", dataStore.departures)
+	}
+	room, err := dataStore.GetChatRoomByID("room-1")
+	if err != nil || len(room.Users) != 2 {
+		t.Errorf("expected alice and carol to stay, got %+v (error %v)", room.Users, err)
+	}
+}
+
+func TestReaperDeletesEmptyRoom(t *testing.T) {
+	udpConn := newTestServer(t)
+	useReaperConfig(t, 0)
+	dataStore := data.NewMemoryStore(data.Config{})
+	newTestChatRoom(t, dataStore)
+	start := time.Now()
+
+	reapChatRooms(udpConn, dataStore, start, 10*time.Minute)
+	reapChatRooms(udpConn, dataStore, start.Add(5*time.Minute), 10*time.Minute)
+	if _, err := dataStore.GetChatRoomByID("room-1"); err != nil {
+		t.Fatalf("expected the room to be kept before the ttl, got %v", err)
+	}
+	reapChatRooms(udpConn, dataStore, start.Add(10*time.Minute), 10*time.Minute)
+	if _, err := dataStore.GetChatRoomByID("room-1"); !errors.Is(err, data.ErrChatRoomNotFound) {
+		t.Errorf("expected the empty room to be deleted, got %v", err)
+	}
+}
+
+func TestFetchHistoryRequiresResumeToken(t *testing.T) {
+	udpConn := newTestServer(t)
+	dataStore := data.NewMemoryStore(data.Config{MaxMessagesPerRoom: 10})
+	alice := newTestMember(t, "user-alice", "alice", time.Now())
+	bob := newTestMember(t, "user-bob", "bob", time.Now())
+	newTestChatRoom(t, dataStore, alice, bob)
+	if err := broadcastToClients("room-1", protocol.BroadcastKindUserMessage, alice.user, udpConn, "secret", dataStore); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		token   string
+		success bool
+	}{
+		{"without token", "", false},
+		{"with token of another member", alice.token, false},
+		{"with own token", bob.token, true},
+	}
+	for _, c := range cases {
+		frame, err := protocol.CreateHistoryRequest(protocol.HistoryQuery{RoomID: "room-1", UserID: "user-bob", ResumeToken: c.token})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		history, err := protocol.ParseHistoryResponse(sendTestFrame(t, udpConn, dataStore, frame, nil))
+		if c.success {
+			if err != nil || len(history.Messages) != 1 {
+				t.Errorf("%s: expected the history, got %+v (error %v)", c.name, history, err)
+			}
+			continue
+		}
+		var errorResponse *protocol.ErrorResponse
+		if !errors.As(err, &errorResponse) || errorResponse.Code != protocol.ErrorCodeNotMember {
+			t.Errorf("%s: expected not_member error, got %+v (error %v)", c.name, history, err)
+		}
+	}
+}
+
+// counterStore は SaveCounter が呼ばれた回数を数える Store
+type counterStore struct {
+	data.Store
+	saves int
+}
+
+func (s *counterStore) SaveCounter(chatRoomID string, userID string, counter uint64) error {
+	s.saves++
+	return s.Store.SaveCounter(chatRoomID, userID, counter)
+}
+
+func TestReplayedDatagramIsRejectedAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, err := data.OpenFileStore(dir, data.Config{}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	dataStore := &counterStore{Store: fileStore}
+	alice := newTestMember(t, "user-alice", "alice", time.Now())
+	alice.user.SessionKey, err = protocol.NewSessionKey()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	newTestChatRoom(t, dataStore, alice)
+
+	// counter が 1 から 2*counterSaveStep+2 までの heartbeat
+	signer := protocol.NewDatagramSigner(alice.user.SessionKey)
+	heartbeats := [][]byte{}
+	for i := 0; i < 2*counterSaveStep+2; i++ {
+		heartbeat, err := protocol.CreateHeartbeatRequest("room-1", "user-alice", "", time.Now())
+		if err == nil {
+			heartbeat, err = signer.Sign(heartbeat)
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		heartbeats = append(heartbeats, heartbeat)
+	}
+	victim := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	attacker := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000}
+	authenticate := func(store data.Store, counter int, addr *net.UDPAddr) error {
+		req, err := protocol.ParseChatRequest(heartbeats[counter-1])
+		if err != nil {
+			return err
+		}
+		_, authenticated, err := authenticateDatagram(req, addr, store)
+		if err == nil && !authenticated {
+			err = errors.New("datagram was not authenticated")
+		}
+		return err
+	}
+
+	savedReplays := replays
+	replays = protocol.NewReplayGuard()
+	t.Cleanup(func() { replays = savedReplays })
+	accepted := counterSaveStep + 36
+	for counter := 1; counter <= accepted; counter++ {
+		if err := authenticate(dataStore, counter, victim); err != nil {
+			t.Fatalf("expected heartbeat %d to be accepted, got %v", counter, err)
+		}
+	}
+	// データグラムごとには保存せず、最初の counter と counterSaveStep 進んだ counter だけを保存する
+	_, user, _ := dataStore.IsUserMemberOfChatRoom("room-1", "user-alice")
+	if dataStore.saves != 2 || user.Counter != counterSaveStep+1 {
+		t.Errorf("expected counter %d after 2 saves, got %d after %d saves", counterSaveStep+1, user.Counter, dataStore.saves)
+	}
+	if err := fileStore.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// 再起動してメモリ上の記録が消えても、受け付けた counter のデータグラムは受け付けない
+	replays = protocol.NewReplayGuard()
+	restarted, err := data.OpenFileStore(dir, data.Config{}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer restarted.Close()
+	for _, counter := range []int{1, counterSaveStep + 1, accepted} {
+		if err := authenticate(restarted, counter, attacker); err == nil {
+			t.Errorf("expected replayed heartbeat %d to be rejected after restart", counter)
+		}
+	}
+	// 保存した counter から counterSaveStep までは、受け付けたかどうか分からないので受け付けない
+	if err := authenticate(restarted, 2*counterSaveStep+1, victim); err == nil {
+		t.Errorf("expected heartbeat %d to be rejected after restart", 2*counterSaveStep+1)
+	}
+	if err := authenticate(restarted, 2*counterSaveStep+2, victim); err != nil {
+		t.Errorf("expected the next heartbeat to be accepted, got %v", err)
+	}
+}
+
+// useRateLimits はテストの間だけ limits を置き換える
+func useRateLimits(t *testing.T, replaced rateLimits) {
+	t.Helper()
+	saved := limits
+	limits = replaced
+	t.Cleanup(func() { limits = saved })
+}
+
+func TestResumeRateLimitCountsOnlyVerifiedUser(t *testing.T) {
+	udpConn := newTestServer(t)
+	useRateLimits(t, rateLimits{joins: chat.NewRateLimiter(chat.RateLimit{Count: 1, Per: time.Hour})})
+	dataStore := data.NewMemoryStore(data.Config{})
+	alice := newTestMember(t, "user-alice", "alice", time.Now())
+	newTestChatRoom(t, dataStore, alice)
+
+	resume := func(token string, ip string) protocol.ChatRoomRequest {
+		return sendTestRequestFrom(t, udpConn, dataStore, protocol.ChatRoomRequest{
+			RoomID:      "room-1",
+			UserID:      "user-alice",
+			ResumeToken: token,
+			Operation:   protocol.OperationResumeSession,
+			State:       protocol.StateRequest,
+		}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 9001})
+	}
+
+	// 他のユーザーを名乗った再開は、送信元の IP アドレスの回数だけを使う
+	if response := resume("wrong-token", "198.51.100.1"); response.Error == nil || response.Error.Code != protocol.ErrorCodeNotMember {
+		t.Fatalf("expected not_member error, got state %d (error %v)", response.State, response.Error)
+	}
+	if response := resume(alice.token, "192.0.2.1"); response.Error != nil {
+		t.Fatalf("expected alice to resume, got %v", response.Error)
+	}
+	// 本人と確認できた再開は、IP アドレスが変わってもユーザーごとに数える
+	if response := resume(alice.token, "192.0.2.2"); response.Error == nil || response.Error.Code != protocol.ErrorCodeRateLimited {
+		t.Errorf("expected rate limited error, got state %d (error %v)", response.State, response.Error)
+	}
+}
+
+func TestSpoofedMessagesDoNotUseUpRateLimitOfUser(t *testing.T) {
+	udpConn := newTestServer(t)
+	useRateLimits(t, rateLimits{messages: chat.NewRateLimiter(chat.RateLimit{Count: 1, Per: time.Hour})})
+	dataStore := data.NewMemoryStore(data.Config{MaxMessagesPerRoom: 10})
+	newTestChatRoom(t, dataStore, newTestMember(t, "user-alice", "alice", time.Now()))
+	victim := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	if err := dataStore.SaveUserUDPAddr("room-1", "user-alice", victim); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	send := func(content string, addr *net.UDPAddr) {
+		datagram, err := protocol.ChatMessage{ChatRoomID: "room-1", UserID: "user-alice", Message: content}.CreateChatRequest(protocol.ChatOperationSendMessage)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		handleChatMessages(udpConn, addr, datagram, len(datagram), dataStore)
+	}
+	delivered := func(content string) bool {
+		room, err := dataStore.GetChatRoomByID("room-1")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, message := range room.Messages {
+			if message.Content == content {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 登録されている配信先以外から alice を名乗ったメッセージでは、alice の回数を使わない
+	for i := 0; i < 3; i++ {
+		send("spoofed", &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000 + i})
+	}
+	send("first", victim)
+	if !delivered("first") {
+		t.Error("expected alice's message to be delivered")
+	}
+	send("second", victim)
+	if delivered("second") {
+		t.Error("expected alice's second message to be rate limited")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	udpConn := newTestServer(t)
+	saved := requestTimeout
+	requestTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { requestTimeout = saved })
+
+	// 接続したまま何も送信しないクライアントの接続は、期限が過ぎると閉じる
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleChatRoomRequest(server, udpConn, data.NewMemoryStore(data.Config{}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be closed after the request timeout")
+	}
+}
+
+// useLockouts はテストの間だけ締め出しの記録とホストへの通知の制限を置き換え、監査ログを記録しないようにする
+// チャットルームへの失敗の合計ではホストへ通知しない
+func useLockouts(t *testing.T, attempts int, roomAttemptsBeforeLockout int) {
+	t.Helper()
+	savedAddr, savedRoom, savedAttempts, savedAudit := addrLockout, roomLockout, roomAttempts, audit
+	savedNotifyAttempts, savedNotices := roomNotifyAttempts, hostNotices
+	addrLockout = chat.NewLockout(chat.LockoutConfig{Attempts: attempts, Base: time.Minute, Max: time.Hour})
+	roomLockout = chat.NewLockout(chat.LockoutConfig{Attempts: roomAttemptsBeforeLockout, Base: time.Minute, Max: time.Hour})
+	roomAttempts = chat.NewLockout(chat.LockoutConfig{Max: time.Hour})
+	roomNotifyAttempts = 0
+	hostNotices = chat.NewRateLimiter(chat.RateLimit{Count: 1, Per: time.Hour})
+	audit = nil
+	t.Cleanup(func() {
+		addrLockout, roomLockout, roomAttempts, audit = savedAddr, savedRoom, savedAttempts, savedAudit
+		roomNotifyAttempts, hostNotices = savedNotifyAttempts, savedNotices
+	})
+}
+
+// newTestPasswordRoom はパスワードが "secret" のチャットルームに members を参加させる
+func newTestPasswordRoom(t *testing.T, dataStore data.Store, members ...testMember) {
+	t.Helper()
+	passwordHash, err := data.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	room := data.ChatRoom{Id: "room-1", Name: "General", PasswordHash: passwordHash, Users: map[string]data.User{}, HostDeparture: protocol.HostDepartureClose}
+	if err := dataStore.AddChatRooms(room.Id, room); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, member := range members {
+		if _, err := dataStore.AddUsers(room.Id, member.user); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+}
+
+// sendTestJoin は ip から name として password でチャットルームへの参加をリクエストする
+func sendTestJoin(t *testing.T, udpConn *net.UDPConn, dataStore data.Store, name string, password string, ip string) protocol.ChatRoomRequest {
+	t.Helper()
+	return sendTestRequestFrom(t, udpConn, dataStore, protocol.ChatRoomRequest{
+		RoomID:       "room-1",
+		UserName:     name,
+		RoomPassword: password,
+		Operation:    protocol.OperationJoinChatRoom,
+		State:        protocol.StateRequest,
+	}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 9001})
+}
+
+func TestWrongPasswordsLockOutOnlyTheSender(t *testing.T) {
+	udpConn := newTestServer(t)
+	useLockouts(t, 5, 2)
+	dataStore := data.NewMemoryStore(data.Config{})
+	newTestPasswordRoom(t, dataStore)
+	join := func(name string, password string, ip string) protocol.ChatRoomRequest {
+		return sendTestJoin(t, udpConn, dataStore, name, password, ip)
+	}
+
+	// 間違ったパスワードを試し続けた送信元は、それぞれこのチャットルームへの参加から締め出す
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2"} {
+		for i := 0; i < 2; i++ {
+			if response := join("mallory", "guess", ip); response.Error == nil || response.Error.Code != protocol.ErrorCodeWrongPassword {
+				t.Fatalf("expected wrong_password error, got state %d (error %v)", response.State, response.Error)
+			}
+		}
+		if response := join("mallory", "secret", ip); response.Error == nil || response.Error.Code != protocol.ErrorCodeLockedOut {
+			t.Errorf("expected %s to be locked out, got state %d (error %v)", ip, response.State, response.Error)
+		}
+	}
+
+	// 締め出した送信元が何度間違えても、パスワードを知っている他の送信元は参加できる
+	if response := join("alice", "secret", "192.0.2.1"); response.Error != nil {
+		t.Errorf("expected alice to join, got %v", response.Error)
+	}
+	joined, err := dataStore.GetChatRoomByID("room-1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(joined.Users) != 1 {
+		t.Errorf("expected only alice to be a member, got %+v", joined.Users)
+	}
+}
+
+func TestHostIsNotifiedOfFailuresFromManyAddresses(t *testing.T) {
+	udpConn := newTestServer(t)
+	useLockouts(t, 5, 2)
+	roomNotifyAttempts = 3
+	dataStore := data.NewMemoryStore(data.Config{})
+
+	// ホストへの通知はホストの配信先に届く
+	hostConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer hostConn.Close()
+	host := newTestMember(t, "user-alice", "alice", time.Now())
+	host.user.Addr = hostConn.LocalAddr().(*net.UDPAddr)
+	newTestPasswordRoom(t, dataStore, host)
+	notice := func() (protocol.Broadcast, bool) {
+		buffer := make([]byte, protocol.ChatProtocolMaxLen)
+		hostConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := hostConn.ReadFromUDP(buffer)
+		if err != nil {
+			return protocol.Broadcast{}, false
+		}
+		broadcast, err := protocol.ParseBroadcast(buffer[:n])
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return broadcast, true
+	}
+
+	// それぞれの送信元が締め出されない回数に抑えていても、合計が増え続けていればホストへ通知する
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4"} {
+		if response := sendTestJoin(t, udpConn, dataStore, "mallory", "guess", ip); response.Error == nil || response.Error.Code != protocol.ErrorCodeWrongPassword {
+			t.Fatalf("expected wrong_password error, got state %d (error %v)", response.State, response.Error)
+		}
+		broadcast, received := notice()
+		switch {
+		case i < 2 && received:
+			t.Errorf("expected no notice after %d failures, got %q", i+1, broadcast.Message)
+		case i == 2 && (!received || broadcast.Message != "There have been 3 failed password attempts to join this room"):
+			t.Errorf("expected notice after 3 failures, got %q (received %v)", broadcast.Message, received)
+		// 続けて失敗しても、通知は -notify-interval に 1 回までにする
+		case i == 3 && received:
+			t.Errorf("expected notices to be rate limited, got %q", broadcast.Message)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+	"github.com/okonomipizza/chat-server/pkg/chat"
+)
+
+// rateLimitValue は -rate-* のフラグで RateLimit を "COUNT/DURATION" の形式で指定するための flag.Value
+type rateLimitValue chat.RateLimit
+
+func (v *rateLimitValue) String() string {
+	return chat.RateLimit(*v).String()
+}
+
+func (v *rateLimitValue) Set(value string) error {
+	limit, err := chat.ParseRateLimit(value)
+	if err != nil {
+		return err
+	}
+	*v = rateLimitValue(limit)
+	return nil
+}
+
+// rateLimits は送信元の IP アドレスと user_id ごとに、リクエストの種類ごとの回数を制限する
+type rateLimits struct {
+	// datagrams は udp で受信するすべてのデータグラムを、処理するゴルーチンを起動する前に IP アドレスごとに制限する
+	datagrams *chat.RateLimiter
+	// connections は tcp の接続を、処理するゴルーチンを起動する前に IP アドレスごとに制限する
+	connections *chat.RateLimiter
+	messages    *chat.RateLimiter
+	creates     *chat.RateLimiter
+	joins       *chat.RateLimiter
+	searches    *chat.RateLimiter
+}
+
+// limits は main でフラグから作成する
+var limits rateLimits
+
+// forRequest は tcp で受け付けた operation を制限する RateLimiter を返し、制限しない operation には nil を返す
+// セッションの再開は ResumeToken を総当たりで試せないよう、参加と同じく制限する
+func (l rateLimits) forRequest(operation byte) *chat.RateLimiter {
+	switch operation {
+	case protocol.OperationCreateChatRoom:
+		return l.creates
+	case protocol.OperationJoinChatRoom, protocol.OperationResumeSession:
+		return l.joins
+	case protocol.OperationSerchChatRoomByID:
+		return l.searches
+	default:
+		return nil
+	}
+}
+
+// prune は interval ごとに、回数を使い切っていない送信元の記録を消す
+func (l rateLimits) prune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, limiter := range []*chat.RateLimiter{l.datagrams, l.connections, l.messages, l.creates, l.joins, l.searches} {
+			limiter.Prune(now)
+		}
+	}
+}
+
+// allowAddr は addr の IP アドレスが limiter の制限を超えていない時に nil を返す
+// 超えている時は再び受け付けられるまでの時間を持つ *chat.RateLimitError を返す
+func allowAddr(limiter *chat.RateLimiter, addr net.Addr, now time.Time) error {
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Allow("ip:"+remoteIP(addr), now)
+}
+
+// allowUser は userID のユーザーが limiter の制限を超えていない時に nil を返す
+// リクエストがユーザー本人から送られてきたと確認できた後にだけ呼び出す
+func allowUser(limiter *chat.RateLimiter, userID string, now time.Time) error {
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Allow("user:"+userID, now)
+}
+
+// remoteIP は送信元のアドレスからポートを除いた IP アドレスを返す
+func remoteIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// retryAfter は制限を超えたリクエストを再び受け付けられるまでの時間を返す
+func retryAfter(err error) time.Duration {
+	var limited *chat.RateLimitError
+	if errors.As(err, &limited) {
+		return limited.RetryAfter
+	}
+	return 0
+}
+
+// describeRetryAfter はユーザーへの通知に使う、秒に切り上げた待ち時間を返す
+func describeRetryAfter(wait time.Duration) string {
+	seconds := max(1, int(math.Ceil(wait.Seconds())))
+	if seconds == 1 {
+		return "1 second"
+	}
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tcp の接続を TLS で暗号化するかどうか
+const (
+	// tlsModeOff は TLS を使わない
+	tlsModeOff = "off"
+	// tlsModeCert は -tls-cert と -tls-key で指定された証明書と秘密鍵を使う
+	tlsModeCert = "cert"
+	// tlsModeDev は開発用に自己署名証明書を使う
+	// 指定されたパスに証明書がなければ作成して保存し、次に起動した時も同じ証明書を使う
+	tlsModeDev = "dev"
+)
+
+// devCertValidity は開発用に作成する自己署名証明書の有効期間
+const devCertValidity = 365 * 24 * time.Hour
+
+// devCertHosts は開発用の自己署名証明書に含める名前
+// クライアントはコンテナの名前 "server" で接続する
+var devCertHosts = []string{"server", "localhost", "127.0.0.1", "::1"}
+
+// loadTLSConfig は mode に従って tcp の接続に使う TLS の設定を作成する
+// TLS を使わない時は nil を返す
+func loadTLSConfig(mode string, certFile string, keyFile string) (*tls.Config, error) {
+	switch mode {
+	case tlsModeOff:
+		return nil, nil
+	case tlsModeCert:
+	case tlsModeDev:
+		if err := ensureDevCert(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("failed to prepare self-signed certificate: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tls mode %q", mode)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// クライアントが証明書を確認できるよう、フィンガープリントを表示する
+	sum := sha256.Sum256(cert.Certificate[0])
+	fmt.Printf("TLS certificate %s (SHA-256 %s)\n", certFile, hex.EncodeToString(sum[:]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ensureDevCert は certFile と keyFile がなければ、自己署名証明書と秘密鍵を作成して保存する
+// 作成した証明書は CA としても使えるので、クライアントはそのまま -tls-ca に指定して確認できる
+func ensureDevCert(certFile string, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return certErr
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return keyErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "chat-server development"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(devCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range devCertHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// 秘密鍵は本人だけが読めるように保存する
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Created self-signed certificate %s for development\n", certFile)
+	return nil
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadTLSConfigDev(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls", "cert.pem")
+	keyFile := filepath.Join(dir, "tls", "key.pem")
+
+	config, err := loadTLSConfig(tlsModeDev, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// クライアントがコンテナの名前やループバックアドレスで接続しても確認できる
+	for _, name := range []string{"server", "localhost"} {
+		if !slices.Contains(cert.DNSNames, name) {
+			t.Errorf("expected %s in %v", name, cert.DNSNames)
+		}
+	}
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		if !slices.ContainsFunc(cert.IPAddresses, func(addr net.IP) bool { return addr.Equal(net.ParseIP(ip)) }) {
+			t.Errorf("expected %s in %v", ip, cert.IPAddresses)
+		}
+	}
+	if err := cert.VerifyHostname("server"); err != nil {
+		t.Errorf("expected certificate to be valid for server, got %v", err)
+	}
+	// クライアントが -tls-ca に指定できるよう、CA として自分自身を署名している
+	if !cert.IsCA || cert.CheckSignatureFrom(cert) != nil {
+		t.Error("expected a self-signed CA certificate")
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected private key mode 0600, got %o", perm)
+	}
+
+	// 次に起動した時は作成済みの証明書を読み込み直す
+	reloaded, err := loadTLSConfig(tlsModeDev, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(reloaded.Certificates[0].Certificate[0], cert.Raw) {
+		t.Error("expected the saved certificate to be reused")
+	}
+}
+
+func TestLoadTLSConfigCertRequiresFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if _, err := loadTLSConfig(tlsModeCert, certFile, keyFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected missing certificate to be rejected, got %v", err)
+	}
+	// cert の時は開発用の証明書を作成しない
+	if _, err := os.Stat(certFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no certificate to be created, got %v", err)
+	}
+
+	// dev で作成した証明書は cert でも読み込める
+	if _, err := loadTLSConfig(tlsModeDev, certFile, keyFile); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if config, err := loadTLSConfig(tlsModeCert, certFile, keyFile); err != nil || len(config.Certificates) != 1 {
+		t.Errorf("expected certificate to be loaded, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigMode(t *testing.T) {
+	if config, err := loadTLSConfig(tlsModeOff, "", ""); config != nil || err != nil {
+		t.Errorf("expected no TLS, got %v (error %v)", config, err)
+	}
+	if _, err := loadTLSConfig("on", "", ""); err == nil {
+		t.Error("expected unknown mode to be rejected")
+	}
+}
@@ -2,4 +2,9 @@ module github.com/okonomipizza/chat-server
 
 go 1.23.1
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/google/uuid v1.6.0
+	github.com/okonomipizza/chat-protocol v0.0.0
+)
+
+replace github.com/okonomipizza/chat-protocol => ../protocol
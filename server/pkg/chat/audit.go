@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// AuditWrongPassword はチャットルームへの参加で間違ったパスワードが送られてきたこと
+	AuditWrongPassword = "wrong_password"
+	// AuditUnknownRoom は存在しないチャットルームの id で検索・参加がリクエストされたこと
+	AuditUnknownRoom = "unknown_room"
+	// AuditLockedOut は締め出している間に送信元やチャットルームへのリクエストを拒否したこと
+	AuditLockedOut = "locked_out"
+)
+
+// AuditEvent は監査ログに 1 行の json として記録する、パスワードの試行の失敗などの出来事
+// パスワードそのものは記録しない
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Addr      string    `json:"addr"`
+	Operation byte      `json:"operation"`
+	RoomID    string    `json:"room_id,omitempty"`
+	UserName  string    `json:"user_name,omitempty"`
+	// Failures は記録が消えるまでに送信元が失敗した回数
+	Failures int `json:"failures,omitempty"`
+	// LockedForMillis はこの出来事で締め出した、または締め出されている残りの時間 (ミリ秒)
+	LockedForMillis int64 `json:"locked_for_ms,omitempty"`
+}
+
+// AuditLog は AuditEvent をファイルへ追記する
+// 複数のゴルーチンから同時に使用でき、nil の AuditLog は何も記録しない
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenAuditLog は path のファイルへ追記する AuditLog を開く
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record は event を追記し、サーバーが強制終了されても残るよう fsync してから返る
+func (a *AuditLog) Record(event AuditEvent) error {
+	if a == nil {
+		return nil
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close はファイルを閉じる
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
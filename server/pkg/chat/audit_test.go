@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer file.Close()
+
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected one json object per line, got %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []AuditEvent{
+		{Time: now, Event: AuditWrongPassword, Addr: "192.0.2.1:4000", Operation: 2, RoomID: "room-1", UserName: "mallory", Failures: 3, LockedForMillis: 5000},
+		{Time: now.Add(time.Second), Event: AuditLockedOut, Addr: "192.0.2.1:4001", Operation: 2, RoomID: "room-1", LockedForMillis: 4000},
+	}
+
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := audit.Record(events[0]); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// 開き直しても以前の記録に追記する
+	audit, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer audit.Close()
+	if err := audit.Record(events[1]); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got := readAuditLog(t, path); !reflect.DeepEqual(got, events) {
+		t.Errorf("expected %+v, got %+v", events, got)
+	}
+	// 送信元の IP アドレスを含むので、他のユーザーからは読めないようにする
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected mode 0600, got %o", perm)
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	// 監査ログを無効にした時の nil の AuditLog は何も記録しない
+	var audit *AuditLog
+	if err := audit.Record(AuditEvent{Event: AuditUnknownRoom}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if err := audit.Close(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
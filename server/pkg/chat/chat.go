@@ -1,34 +1,92 @@
 package chat
 
 import (
+	"encoding/hex"
+	"time"
+
 	"github.com/google/uuid"
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
 	"github.com/okonomipizza/chat-server/pkg/data"
-	"github.com/okonomipizza/chat-server/pkg/protocol"
 )
 
-func CreateNewChatRoom(request protocol.ChatRoomRequest, dataStore *data.DataStore) (data.User, data.ChatRoom) {
+// CreateNewChatRoom はリクエストされたチャットルームを作成し、リクエストしたユーザーをホストとして登録する
+// session にはそのユーザーとの Hello / Welcome で合意された内容を指定する
+// ホストに発行した ResumeToken も返す (発行しなかった時は空)
+func CreateNewChatRoom(request protocol.ChatRoomRequest, session protocol.Welcome, dataStore data.Store) (data.User, data.ChatRoom, string, error) {
+	token, tokenHash, err := IssueResumeToken(session)
+	if err != nil {
+		return data.User{}, data.ChatRoom{}, "", err
+	}
+	sessionKey, err := IssueSessionKey(session)
+	if err != nil {
+		return data.User{}, data.ChatRoom{}, "", err
+	}
+	// パスワードは平文のまま保存せず、ソルト付きのハッシュにする
+	passwordHash, err := data.HashPassword(request.RoomPassword)
+	if err != nil {
+		return data.User{}, data.ChatRoom{}, "", err
+	}
+
 	// リクエストに含まれていた情報からサーバー側でユーザーインスタンスを作成する
 	// チャットルームの作成者がそのルームのホストユーザーとなる
 	user := data.User{
-		Id:     uuid.NewString(),
-		Name:   request.UserName,
-		IsHost: true,
+		Id:              uuid.NewString(),
+		Name:            request.UserName,
+		IsHost:          true,
+		Reliable:        request.ReliableDelivery,
+		Fragmentation:   session.Supports(protocol.FeatureFragmentation),
+		Heartbeat:       session.Supports(protocol.FeatureHeartbeat),
+		JoinedAt:        time.Now(),
+		ResumeTokenHash: tokenHash,
+		SessionKey:      sessionKey,
+		Encryption:      session.Supports(protocol.FeatureEncryption),
+	}
+
+	// host handover に対応していないクライアントのチャットルームは、ホストが退出した時に閉じる
+	hostDeparture := data.HostDepartureClose
+	if session.Supports(protocol.FeatureHostHandover) && request.HostDeparture != "" {
+		hostDeparture = request.HostDeparture
 	}
 
 	// リクエストからチャットルームインスタンスを作成する
 	chatRoom := data.ChatRoom{
-		Id:       uuid.NewString(),
-		Name:     request.RoomName,
-		Password: request.RoomPassword,
-		Users:    make(map[string]data.User),
-		Messages: []data.Message{},
+		Id:            uuid.NewString(),
+		Name:          request.RoomName,
+		PasswordHash:  passwordHash,
+		Users:         make(map[string]data.User),
+		Messages:      []data.Message{},
+		Reliable:      request.ReliableDelivery,
+		HostDeparture: hostDeparture,
+		EndToEndSalt:  request.EndToEndSalt,
 	}
 
 	// 作成したチャットルームにリクエストユーザーを追加
 	chatRoom.Users[user.Id] = user
 
 	// アプリケーション全体へ反映
-	dataStore.AddChatRooms(chatRoom.Id, chatRoom)
+	err = dataStore.AddChatRooms(chatRoom.Id, chatRoom)
+	if err != nil {
+		return data.User{}, data.ChatRoom{}, "", err
+	}
 
-	return user, chatRoom
+	return user, chatRoom, token, nil
+}
+
+// ToResponse はサーバー側で保持しているユーザーとチャットルームの情報を、クライアントへ返すレスポンスの形式に変換する
+// SessionKey を発行したユーザーには、その鍵も hex で返す
+// パスワードは返さず、参加にパスワードが必要かどうかだけを返す
+func ToResponse(user data.User, chatRoom data.ChatRoom) protocol.ChatRoomRequest {
+	return protocol.ChatRoomRequest{
+		RoomID:           chatRoom.Id,
+		RoomName:         chatRoom.Name,
+		PasswordRequired: chatRoom.PasswordHash != "",
+		UserID:           user.Id,
+		UserName:         user.Name,
+		// reliable delivery はチャットルームの設定ではなく、そのユーザーへの配信で有効かどうかを返す
+		ReliableDelivery: user.Reliable,
+		HostDeparture:    chatRoom.HostDeparture,
+		IsHost:           user.IsHost,
+		SessionKey:       hex.EncodeToString(user.SessionKey),
+		EndToEndSalt:     chatRoom.EndToEndSalt,
+	}
 }
@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutConfig はパスワードの試行に失敗し続けた送信元を締め出す条件
+type LockoutConfig struct {
+	// Attempts は締め出すまでに失敗できる回数 (0 の時は締め出さない)
+	Attempts int
+	// Base は最初に締め出す時間で、その後は失敗するたびに倍にする
+	Base time.Duration
+	// Max は締め出す時間の上限で、この間失敗しなかった記録は消す
+	Max time.Duration
+}
+
+// Lockout は送信元の IP アドレスや、チャットルームと IP アドレスの組などの key ごとにパスワードの試行の失敗を数え、
+// Attempts 回失敗した key を、失敗するたびに指数的に長くなる時間の間締め出す
+// 自分で作成したチャットルームへの参加などで数え直させないよう、失敗の記録は成功しても消さず、Max の間失敗しなかった時に消す
+// 複数のゴルーチンから同時に使用できる
+type Lockout struct {
+	mu      sync.Mutex
+	config  LockoutConfig
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout は config で締め出す Lockout を作成する
+func NewLockout(config LockoutConfig) *Lockout {
+	return &Lockout{config: config, entries: make(map[string]*lockoutEntry)}
+}
+
+// Locked は key が締め出されている残りの時間を返し、締め出されていない時は 0 を返す
+func (l *Lockout) Locked(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, exists := l.entries[key]
+	if !exists || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+	return entry.lockedUntil.Sub(now)
+}
+
+// Fail は key の試行の失敗を記録し、記録が消えるまでに失敗した回数と、今回の失敗で締め出した時間を返す
+// 締め出さなかった時の時間は 0 になる
+func (l *Lockout) Fail(key string, now time.Time) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, exists := l.entries[key]
+	if !exists || l.expired(entry, now) {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if l.config.Attempts <= 0 || entry.failures < l.config.Attempts {
+		return entry.failures, 0
+	}
+
+	// Attempts 回目の失敗で Base の間締め出し、それ以降は失敗するたびに倍にする
+	lockedFor := l.config.Base
+	for i := l.config.Attempts; i < entry.failures && lockedFor < l.config.Max; i++ {
+		lockedFor *= 2
+	}
+	lockedFor = min(lockedFor, l.config.Max)
+	entry.lockedUntil = now.Add(lockedFor)
+	return entry.failures, lockedFor
+}
+
+// Prune は締め出しが終わっていて、Max の間失敗していない key の記録を消す
+func (l *Lockout) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, entry := range l.entries {
+		if l.expired(entry, now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+func (l *Lockout) expired(entry *lockoutEntry, now time.Time) bool {
+	return !now.Before(entry.lockedUntil) && now.Sub(entry.lastFailure) >= l.config.Max
+}
@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	l := NewLockout(LockoutConfig{Attempts: 3, Base: 5 * time.Second, Max: time.Minute})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Attempts 回目の失敗で Base の間締め出し、それ以降は失敗するたびに倍にして Max で止める
+	cases := []struct {
+		after     time.Duration
+		failures  int
+		lockedFor time.Duration
+	}{
+		{0, 1, 0},
+		{time.Second, 2, 0},
+		{2 * time.Second, 3, 5 * time.Second},
+		{10 * time.Second, 4, 10 * time.Second},
+		{30 * time.Second, 5, 20 * time.Second},
+		{time.Minute, 6, 40 * time.Second},
+		{110 * time.Second, 7, time.Minute},
+		{160 * time.Second, 8, time.Minute},
+	}
+	for _, c := range cases {
+		failures, lockedFor := l.Fail("192.0.2.1", start.Add(c.after))
+		if failures != c.failures || lockedFor != c.lockedFor {
+			t.Errorf("at %s: expected %d failures locked for %s, got %d locked for %s", c.after, c.failures, c.lockedFor, failures, lockedFor)
+		}
+	}
+
+	// 締め出している間は残りの時間を返し、別の key は締め出さない
+	last := start.Add(160 * time.Second)
+	if wait := l.Locked("192.0.2.1", last.Add(15*time.Second)); wait != 45*time.Second {
+		t.Errorf("expected 45s left, got %s", wait)
+	}
+	if wait := l.Locked("192.0.2.1", last.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected lockout to end after 1m, got %s", wait)
+	}
+	if wait := l.Locked("192.0.2.2", last); wait != 0 {
+		t.Errorf("expected another key not to be locked, got %s", wait)
+	}
+}
+
+func TestLockoutExpiry(t *testing.T) {
+	l := NewLockout(LockoutConfig{Attempts: 2, Base: 5 * time.Second, Max: time.Minute})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l.Fail("192.0.2.1", start)
+	// Max が経つ前の失敗は続けて数える
+	if failures, lockedFor := l.Fail("192.0.2.1", start.Add(59*time.Second)); failures != 2 || lockedFor != 5*time.Second {
+		t.Errorf("expected second failure to lock for 5s, got %d locked for %s", failures, lockedFor)
+	}
+	// 成功しても記録は消さないので、締め出しが終わった直後の失敗でまた締め出す
+	if failures, lockedFor := l.Fail("192.0.2.1", start.Add(70*time.Second)); failures != 3 || lockedFor != 10*time.Second {
+		t.Errorf("expected third failure to lock for 10s, got %d locked for %s", failures, lockedFor)
+	}
+	// 最後の失敗から Max の間失敗しなかった key は、1 回目から数え直す
+	if failures, lockedFor := l.Fail("192.0.2.1", start.Add(130*time.Second)); failures != 1 || lockedFor != 0 {
+		t.Errorf("expected failures to be forgotten, got %d locked for %s", failures, lockedFor)
+	}
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	l := NewLockout(LockoutConfig{Max: time.Minute})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Attempts が 0 の時は失敗を数えるだけで締め出さない
+	for i := 1; i <= 10; i++ {
+		if failures, lockedFor := l.Fail("room-1", start); failures != i || lockedFor != 0 {
+			t.Fatalf("expected %d failures without lockout, got %d locked for %s", i, failures, lockedFor)
+		}
+	}
+	if wait := l.Locked("room-1", start); wait != 0 {
+		t.Errorf("expected no lockout, got %s", wait)
+	}
+}
+
+func TestLockoutPrune(t *testing.T) {
+	l := NewLockout(LockoutConfig{Attempts: 1, Base: 2 * time.Minute, Max: 5 * time.Minute})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l.Fail("old", start)
+	l.Fail("recent", start.Add(4*time.Minute))
+	// 締め出している key は記録を残す
+	for i := 0; i < 3; i++ {
+		l.Fail("locked", start.Add(7*time.Minute))
+	}
+
+	l.Prune(start.Add(8 * time.Minute))
+	if _, exists := l.entries["old"]; exists {
+		t.Error("expected expired key to be pruned")
+	}
+	if _, exists := l.entries["recent"]; !exists {
+		t.Error("expected recently failed key to be kept")
+	}
+	if wait := l.Locked("locked", start.Add(8*time.Minute)); wait != 4*time.Minute {
+		t.Errorf("expected locked key to be kept with 4m left, got %s", wait)
+	}
+
+	l.Prune(start.Add(time.Hour))
+	if len(l.entries) != 0 {
+		t.Errorf("expected all keys to be pruned, got %d", len(l.entries))
+	}
+}
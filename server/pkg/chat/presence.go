@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// Presence はメンバーからデータグラムを最後に受信した時刻と、チャットルームが空になった時刻を保持する
+// 再起動すると失われるので、記録のないメンバーやチャットルームは初めて確認した時刻から数える
+type Presence struct {
+	mu       sync.Mutex
+	lastSeen map[presenceKey]time.Time
+	// emptySince はメンバーがいないチャットルームについて、空であることを最初に確認した時刻
+	emptySince map[string]time.Time
+}
+
+type presenceKey struct {
+	chatRoomID string
+	userID     string
+}
+
+// NewPresence は空の Presence を作成する
+func NewPresence() *Presence {
+	return &Presence{
+		lastSeen:   make(map[presenceKey]time.Time),
+		emptySince: make(map[string]time.Time),
+	}
+}
+
+// Touch はメンバーからデータグラムを受信したことを記録する
+// 存在しないメンバーを記録し続けないよう、Idle で確認済みのメンバーだけを更新する
+func (p *Presence) Touch(chatRoomID string, userID string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := presenceKey{chatRoomID, userID}
+	if _, exists := p.lastSeen[key]; exists {
+		p.lastSeen[key] = now
+	}
+}
+
+// Idle はメンバーからデータグラムを最後に受信してからの時間を返す
+// 記録のないメンバーは now に受信したものとして記録を始める
+func (p *Presence) Idle(chatRoomID string, userID string, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := presenceKey{chatRoomID, userID}
+	lastSeen, exists := p.lastSeen[key]
+	if !exists {
+		p.lastSeen[key] = now
+		return 0
+	}
+	return now.Sub(lastSeen)
+}
+
+// Forget はチャットルームから外れたメンバーの記録を消す
+func (p *Presence) Forget(chatRoomID string, userID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.lastSeen, presenceKey{chatRoomID, userID})
+}
+
+// Empty はチャットルームにメンバーがいない状態が続いている時間を返す
+// 空であることを初めて確認した時は now から数え始める
+func (p *Presence) Empty(chatRoomID string, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	since, exists := p.emptySince[chatRoomID]
+	if !exists {
+		p.emptySince[chatRoomID] = now
+		return 0
+	}
+	return now.Sub(since)
+}
+
+// Occupied はチャットルームにメンバーがいることを記録し、空になってからの時間を数え直す
+func (p *Presence) Occupied(chatRoomID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.emptySince, chatRoomID)
+}
+
+// ForgetChatRoom は削除されたチャットルームとそのメンバーの記録を消す
+func (p *Presence) ForgetChatRoom(chatRoomID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.emptySince, chatRoomID)
+	for key := range p.lastSeen {
+		if key.chatRoomID == chatRoomID {
+			delete(p.lastSeen, key)
+		}
+	}
+}
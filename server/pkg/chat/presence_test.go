@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceIdle(t *testing.T) {
+	p := NewPresence()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Idle で確認する前のメンバーは記録しない
+	p.Touch("room-1", "user-alice", start)
+	if idle := p.Idle("room-1", "user-alice", start.Add(time.Minute)); idle != 0 {
+		t.Errorf("expected counting to start at the first check, got %s", idle)
+	}
+	if idle := p.Idle("room-1", "user-alice", start.Add(2*time.Minute)); idle != time.Minute {
+		t.Errorf("expected 1m, got %s", idle)
+	}
+
+	p.Touch("room-1", "user-alice", start.Add(150*time.Second))
+	if idle := p.Idle("room-1", "user-alice", start.Add(3*time.Minute)); idle != 30*time.Second {
+		t.Errorf("expected 30s after touch, got %s", idle)
+	}
+
+	// 別のチャットルームの同じユーザーは別に数える
+	if idle := p.Idle("room-2", "user-alice", start.Add(3*time.Minute)); idle != 0 {
+		t.Errorf("expected another room to be counted separately, got %s", idle)
+	}
+
+	p.Forget("room-1", "user-alice")
+	if idle := p.Idle("room-1", "user-alice", start.Add(10*time.Minute)); idle != 0 {
+		t.Errorf("expected forgotten member to start again, got %s", idle)
+	}
+}
+
+func TestPresenceEmpty(t *testing.T) {
+	p := NewPresence()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if empty := p.Empty("room-1", start); empty != 0 {
+		t.Errorf("expected counting to start at the first check, got %s", empty)
+	}
+	if empty := p.Empty("room-1", start.Add(time.Minute)); empty != time.Minute {
+		t.Errorf("expected 1m, got %s", empty)
+	}
+
+	// メンバーが戻ってきたら数え直す
+	p.Occupied("room-1")
+	if empty := p.Empty("room-1", start.Add(2*time.Minute)); empty != 0 {
+		t.Errorf("expected counting to restart, got %s", empty)
+	}
+}
+
+func TestPresenceForgetChatRoom(t *testing.T) {
+	p := NewPresence()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.Idle("room-1", "user-alice", start)
+	p.Idle("room-2", "user-bob", start)
+	p.Empty("room-1", start)
+
+	p.ForgetChatRoom("room-1")
+	if idle := p.Idle("room-1", "user-alice", start.Add(time.Minute)); idle != 0 {
+		t.Errorf("expected members of the deleted room to be forgotten, got %s", idle)
+	}
+	if empty := p.Empty("room-1", start.Add(time.Minute)); empty != 0 {
+		t.Errorf("expected the deleted room to be forgotten, got %s", empty)
+	}
+	if idle := p.Idle("room-2", "user-bob", start.Add(time.Minute)); idle != time.Minute {
+		t.Errorf("expected other rooms to be kept, got %s", idle)
+	}
+}
@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit は Per の間に Count 回までのリクエストを受け付ける制限を表す
+// 一度に Count 回まで続けて受け付け、その後は Per / Count ごとに 1 回ずつ受け付けられるようになる
+// Count が 0 の時は制限しない
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRateLimit は "30/1m" のように回数と時間を / で区切った文字列を RateLimit に変換する
+// "0" は制限しないことを表す
+func ParseRateLimit(value string) (RateLimit, error) {
+	if value == "0" {
+		return RateLimit{}, nil
+	}
+	count, per, found := strings.Cut(value, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("rate limit %q must be in the form COUNT/DURATION", value)
+	}
+	limit := RateLimit{}
+	var err error
+	limit.Count, err = strconv.Atoi(count)
+	if err != nil || limit.Count < 0 {
+		return RateLimit{}, fmt.Errorf("invalid count in rate limit %q", value)
+	}
+	limit.Per, err = time.ParseDuration(per)
+	if err != nil || limit.Per <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid duration in rate limit %q", value)
+	}
+	return limit, nil
+}
+
+// String は ParseRateLimit で読み込める形式で RateLimit を表す
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Count, l.Per)
+}
+
+// Enabled は制限するかどうかを返す
+func (l RateLimit) Enabled() bool {
+	return l.Count > 0 && l.Per > 0
+}
+
+// ErrRateLimited はリクエストが RateLimit を超えたことを示す
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitError は RateLimit を超えたリクエストについて、再び受け付けられるまでの時間を表す
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// RateLimiter は送信元の IP アドレスや user_id などの key ごとに、トークンバケットでリクエストの回数を制限する
+// 複数のゴルーチンから同時に使用できる
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   RateLimit
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter は limit で制限する RateLimiter を作成する
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: make(map[string]*rateBucket)}
+}
+
+// Allow は key からのリクエストを受け付けられる時に nil を返して 1 回分を消費する
+// 受け付けられない時は、再び受け付けられるまでの時間を持つ *RateLimitError を返す
+func (r *RateLimiter) Allow(key string, now time.Time) error {
+	if !r.limit.Enabled() {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket, exists := r.buckets[key]
+	if !exists {
+		bucket = &rateBucket{tokens: float64(r.limit.Count), updated: now}
+		r.buckets[key] = bucket
+	}
+	bucket.refill(r.limit, now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return nil
+	}
+	wait := time.Duration(math.Ceil((1 - bucket.tokens) * float64(r.interval())))
+	return &RateLimitError{RetryAfter: wait}
+}
+
+// Prune は回数を使い切っていない key の記録を消し、送信元が増え続けても記録が溜まらないようにする
+// 消した key は次のリクエストで Count 回分を持った状態から数え直すので、制限は変わらない
+func (r *RateLimiter) Prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, bucket := range r.buckets {
+		bucket.refill(r.limit, now)
+		if bucket.tokens >= float64(r.limit.Count) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// interval は 1 回分が回復するまでの時間
+func (r *RateLimiter) interval() time.Duration {
+	return r.limit.Per / time.Duration(r.limit.Count)
+}
+
+func (b *rateBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.updated)
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(limit.Count), b.tokens+float64(limit.Count)*elapsed.Seconds()/limit.Per.Seconds())
+	b.updated = now
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("30/1m")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if limit.Count != 30 || limit.Per != time.Minute || !limit.Enabled() {
+		t.Errorf("unexpected limit %+v", limit)
+	}
+	if parsed, err := ParseRateLimit(limit.String()); err != nil || parsed != limit {
+		t.Errorf("expected %q to round trip, got %+v, %v", limit.String(), parsed, err)
+	}
+
+	disabled, err := ParseRateLimit("0")
+	if err != nil || disabled.Enabled() || disabled.String() != "0" {
+		t.Errorf("expected disabled limit, got %+v, %v", disabled, err)
+	}
+
+	for _, value := range []string{"", "30", "x/1m", "-1/1m", "30/x", "30/0s", "30/-1s"} {
+		if _, err := ParseRateLimit(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRateLimiterAllowsBurstThenRefills(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Count: 3, Per: 3 * time.Second})
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow("10.0.0.1", now); err != nil {
+			t.Fatalf("request %d: expected no error, got %v", i, err)
+		}
+	}
+	err := limiter.Allow("10.0.0.1", now)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected RateLimitError, got %v", err)
+	}
+	if limited.RetryAfter != time.Second {
+		t.Errorf("expected retry after 1s, got %s", limited.RetryAfter)
+	}
+
+	// 別の key は別に数える
+	if err := limiter.Allow("10.0.0.2", now); err != nil {
+		t.Errorf("expected another key to be allowed, got %v", err)
+	}
+
+	// 待つべき時間の途中では受け付けず、残りの時間を返す
+	err = limiter.Allow("10.0.0.1", now.Add(400*time.Millisecond))
+	if !errors.As(err, &limited) || limited.RetryAfter != 600*time.Millisecond {
+		t.Errorf("expected retry after 600ms, got %v", err)
+	}
+	if err := limiter.Allow("10.0.0.1", now.Add(time.Second)); err != nil {
+		t.Errorf("expected request to be allowed after refill, got %v", err)
+	}
+	if err := limiter.Allow("10.0.0.1", now.Add(time.Second)); err == nil {
+		t.Error("expected only one request to be refilled")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{})
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 1000; i++ {
+		if err := limiter.Allow("10.0.0.1", now); err != nil {
+			t.Fatalf("expected disabled limiter to allow, got %v", err)
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Count: 2, Per: time.Minute})
+	now := time.Unix(1700000000, 0)
+	limiter.Allow("10.0.0.1", now)
+	limiter.Allow("10.0.0.1", now)
+	limiter.Allow("10.0.0.2", now)
+
+	// 回数を使い切ったままの key は消さない
+	limiter.Prune(now.Add(time.Second))
+	if len(limiter.buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(limiter.buckets))
+	}
+	if err := limiter.Allow("10.0.0.1", now.Add(time.Second)); err == nil {
+		t.Error("expected pruning not to reset the limit")
+	}
+
+	limiter.Prune(now.Add(2 * time.Minute))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("expected refilled buckets to be pruned, got %d", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+	"github.com/okonomipizza/chat-server/pkg/data"
+)
+
+// resumeTokenLen は ResumeToken に使う乱数の長さ (byte)
+const resumeTokenLen = 32
+
+// IssueResumeToken は FeatureSessionResume が合意されたセッションのユーザーに ResumeToken を発行する
+// クライアントへ返すトークンと、サーバーが保存するそのハッシュを返す
+// 合意されていない時はどちらも空を返す
+func IssueResumeToken(session protocol.Welcome) (string, string, error) {
+	if !session.Supports(protocol.FeatureSessionResume) {
+		return "", "", nil
+	}
+	buf := make([]byte, resumeTokenLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashResumeToken(token), nil
+}
+
+// VerifyResumeToken はクライアントが提示したトークンがユーザーに発行したものと一致するかを返す
+// トークンを発行していないユーザーは、トークンに関係なく true を返す
+func VerifyResumeToken(user data.User, token string) bool {
+	if user.ResumeTokenHash == "" {
+		return true
+	}
+	// 一致するまでの時間からトークンを推測されないよう、長さの揃ったハッシュを定数時間で比較する
+	return subtle.ConstantTimeCompare([]byte(hashResumeToken(token)), []byte(user.ResumeTokenHash)) == 1
+}
+
+func hashResumeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenProofs はユーザーごとに最後に受け付けた TokenProof の時刻を記録し、盗み見られた TokenProof を送り直されても受け付けないようにする
+// 記録はメモリ上にだけ保持するので、サーバーが起動する前の時刻の TokenProof は受け付けない
+// 複数のゴルーチンから同時に使用できる
+type TokenProofs struct {
+	mu       sync.Mutex
+	started  time.Time
+	accepted map[string]time.Time
+}
+
+// NewTokenProofs は started より後に作成された TokenProof だけを受け付ける TokenProofs を作成する
+func NewTokenProofs(started time.Time) *TokenProofs {
+	return &TokenProofs{started: started, accepted: make(map[string]time.Time)}
+}
+
+// Verify は proof がユーザーに発行した ResumeToken から operation のために作成されたもので、
+// 前に受け付けたものより新しく、now との時刻のずれが protocol.TokenProofMaxSkew 以内であれば true を返して記録する
+// トークンを発行していないユーザーは、proof に関係なく true を返す
+func (p *TokenProofs) Verify(user data.User, chatRoomID string, operation byte, proof string, now time.Time) bool {
+	if user.ResumeTokenHash == "" {
+		return true
+	}
+	issued, err := protocol.VerifyTokenProof(proof, operation, chatRoomID, user.Id, user.ResumeTokenHash)
+	if err != nil {
+		return false
+	}
+	if issued.Before(now.Add(-protocol.TokenProofMaxSkew)) || issued.After(now.Add(protocol.TokenProofMaxSkew)) {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, exists := p.accepted[user.Id]
+	if !exists {
+		last = p.started
+	}
+	if !issued.After(last) {
+		return false
+	}
+	p.accepted[user.Id] = issued
+	return true
+}
+
+// Forget はチャットルームから外れたユーザーの記録を消す
+func (p *TokenProofs) Forget(userID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.accepted, userID)
+}
+
+// IssueSessionKey は FeatureDatagramAuth か FeatureEncryption が合意されたセッションのユーザーに、データグラムを認証・暗号化するための SessionKey を発行する
+// どちらも合意されていない時は nil を返す
+func IssueSessionKey(session protocol.Welcome) ([]byte, error) {
+	if !session.Supports(protocol.FeatureDatagramAuth) && !session.Supports(protocol.FeatureEncryption) {
+		return nil, nil
+	}
+	return protocol.NewSessionKey()
+}
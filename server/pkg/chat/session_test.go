@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+	"github.com/okonomipizza/chat-server/pkg/data"
+)
+
+func TestTokenProofs(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	token, tokenHash, err := IssueResumeToken(protocol.Welcome{Features: []string{protocol.FeatureSessionResume}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	user := data.User{Id: "user-alice", Name: "alice", ResumeTokenHash: tokenHash}
+	proof := func(issued time.Time) string {
+		return protocol.CreateTokenProof(protocol.ChatOperationHeartbeat, "room-1", user.Id, token, issued)
+	}
+
+	proofs := NewTokenProofs(started)
+	now := started.Add(time.Minute)
+	cases := []struct {
+		name     string
+		proof    string
+		expected bool
+	}{
+		{"created before the server started", proof(started.Add(-time.Second)), false},
+		{"fresh", proof(now), true},
+		// 盗み見られた TokenProof を送り直されても受け付けない
+		{"replayed", proof(now), false},
+		{"older than accepted", proof(now.Add(-time.Second)), false},
+		{"newer", proof(now.Add(time.Millisecond)), true},
+		{"too far in the future", proof(now.Add(protocol.TokenProofMaxSkew + time.Second)), false},
+		{"raw token", token, false},
+		{"empty", "", false},
+	}
+	for _, c := range cases {
+		if got := proofs.Verify(user, "room-1", protocol.ChatOperationHeartbeat, c.proof, now); got != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+
+	// 古すぎる TokenProof は、まだ受け付けていない時刻でも受け付けない
+	later := now.Add(time.Hour)
+	if proofs.Verify(user, "room-1", protocol.ChatOperationHeartbeat, proof(later.Add(-protocol.TokenProofMaxSkew-time.Second)), later) {
+		t.Error("expected stale proof to be rejected")
+	}
+
+	// 別の operation のための TokenProof では登録できない
+	exit := protocol.CreateTokenProof(protocol.ChatOperationExit, "room-1", user.Id, token, later)
+	if proofs.Verify(user, "room-1", protocol.ChatOperationHeartbeat, exit, later) {
+		t.Error("expected proof for another operation to be rejected")
+	}
+
+	// トークンを発行していないユーザーは確認しない
+	if !proofs.Verify(data.User{Id: "user-bob"}, "room-1", protocol.ChatOperationHeartbeat, "", later) {
+		t.Error("expected user without a token to be accepted")
+	}
+}
@@ -2,10 +2,10 @@ package data
 
 import (
 	"errors"
-	"fmt"
+	"maps"
 	"net"
-	"strings"
-	"sync"
+	"slices"
+	"time"
 )
 
 type User struct {
@@ -13,139 +13,222 @@ type User struct {
 	Name   string
 	Addr   *net.UDPAddr
 	IsHost bool
+	// Reliable はこのユーザーへの配信で reliable delivery を使用するかどうか
+	Reliable bool
+	// Fragmentation はこのユーザーのクライアントが分割された配信を組み立てられるかどうか
+	Fragmentation bool
+	// Heartbeat はこのユーザーのクライアントが heartbeat を送信するかどうか
+	// true のユーザーは heartbeat が途絶えるとチャットルームから外される
+	Heartbeat bool
+	// ResumeTokenHash はこのユーザーに発行した ResumeToken の sha256 (hex)
+	// 空の時はトークンを発行しておらず、udp のアドレスはトークンなしで登録できる
+	ResumeTokenHash string
+	// SessionKey はこのユーザーに発行した、データグラムを認証するための鍵
+	// 空の時は鍵を発行しておらず、このユーザーからのデータグラムは認証しない
+	SessionKey []byte
+	// Counter は SessionKey で認証したデータグラムのうち、最後に保存した counter で、受け付けた最大の counter との差は一定の間隔より小さい
+	// サーバーが再起動した後も、受け付けた counter のデータグラムを送り直されても受け付けないために保存する
+	// SessionKey を発行し直すと 0 に戻る
+	Counter uint64
+	// Encryption はこのユーザーとのデータグラムの message を SessionKey で暗号化するかどうか
+	// true のユーザーからの暗号化されていないデータグラムは破棄する
+	Encryption bool
+	// JoinedAt はユーザーがチャットルームに参加した時刻
+	JoinedAt time.Time
 }
 
 type ChatRoom struct {
-	Id       string
-	Name     string
-	Password string
-	Users    map[string]User
-	Messages []Message
+	Id   string
+	Name string
+	// PasswordHash はチャットルームのパスワードをソルト付きでハッシュにしたもの (password.go を参照)
+	// 空の時はパスワードが設定されていない
+	PasswordHash string
+	// LegacyPassword は以前の形式で平文のまま保存されていたパスワードで、読み込んだ時に PasswordHash へ置き換える
+	LegacyPassword string `json:"Password,omitempty"`
+	Users          map[string]User
+	Messages       []Message
+	// LastSequence はチャットルームで最後に配信したメッセージの通し番号
+	LastSequence uint64
+	// Reliable は作成時に reliable delivery が有効にされたかどうか
+	// false のチャットルームではすべてのメンバーへの配信が best effort になる
+	Reliable bool
+	// HostDeparture はホストが退出した時のチャットルームの扱い (HostDeparture* のいずれか)
+	HostDeparture string
+	// EndToEndSalt は end-to-end で暗号化するチャットルームで、メンバーが room key の導出に使う salt (hex)
+	// 空の時は end-to-end で暗号化しないチャットルームで、空でない時はユーザーのメッセージを暗号文のまま配信・保存する
+	EndToEndSalt string
+}
+
+// ホストが退出した時のチャットルームの扱い
+// 空の時は HostDepartureClose として扱う
+const (
+	HostDepartureClose    = "close"
+	HostDeparturePromote  = "promote"
+	HostDepartureNominate = "nominate"
+)
+
+// Departure はユーザーがチャットルームから退出した結果
+type Departure struct {
+	User User
+	// NewHost は退出したホストの後任になったメンバーで、ホストが交代しなかった時は Id が空になる
+	NewHost User
+	// Closed はホストが退出してチャットルームを閉じる必要があることを表す
+	// 残っているメンバーへ通知してから DeleteChatRooms で削除する
+	Closed bool
 }
 
 type Message struct {
+	// Kind は配信の種類 (protocol.BroadcastKind*)
+	Kind    byte
 	Content string
-	User    User
+	// Sender は送信者で、以前の形式で記録された送信者もそのまま読み込めるよう "User" として保存する
+	Sender Sender `json:"User"`
+	// Timestamp はサーバーがメッセージを受け付けた時刻
+	Timestamp time.Time
+	// Sequence はチャットルームごとに単調増加する通し番号
+	Sequence uint64
 }
 
-type DataStore struct {
-	ChatRooms map[string]ChatRoom
-	Mu        sync.Mutex
+// Sender はメッセージの送信者
+// 履歴は journal.log や snapshot.json に残り続けるので、SessionKey などを含む User ではなく id と名前だけを持たせる
+type Sender struct {
+	Id   string
+	Name string
 }
 
-func (ds *DataStore) AddChatRooms(id string, room ChatRoom) {
-	ds.Mu.Lock()
-	ds.ChatRooms[id] = room
-	ds.Mu.Unlock()
+// Sender はユーザーをメッセージの送信者として返す
+func (user User) Sender() Sender {
+	return Sender{Id: user.Id, Name: user.Name}
 }
 
-func (ds *DataStore) DeleteChatRooms(id string) {
-	ds.Mu.Lock()
-	delete(ds.ChatRooms, id)
-	ds.Mu.Unlock()
+// Config はチャットルームごとに保持するデータの上限
+type Config struct {
+	// MaxUsersPerRoom はチャットルームに参加できるユーザー数の上限 (0 のときは上限なし)
+	MaxUsersPerRoom int
+	// MaxMessagesPerRoom はチャットルームごとに履歴として保持する配信の数 (0 のときは保持しない)
+	MaxMessagesPerRoom int
 }
 
-// IsUserMemberOfChatRoom はそのユーザーが与えられた指定されたチャットルームに存在するかと、存在する場合はユーザ名を返す
-func (ds *DataStore) IsUserMemberOfChatRoom(chatRoomID string, userID string) (bool, User, error) {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRoomID]
-	if !exists {
-		return false, User{}, errors.New("designated ChatRoom does not exist")
-	}
-
-	user, exists := chatRoom.Users[userID]
-	if !exists {
-		return false, User{}, nil
-	}
-	return true, user, nil
+// Store はチャットルーム、ユーザー、メッセージを保存する
+// 実装はそれぞれ内部でロックを持ち、複数のゴルーチンから同時に呼び出せる
+// 取得したチャットルームは複製なので、変更しても Store には反映されない
+type Store interface {
+	AddChatRooms(id string, room ChatRoom) error
+	DeleteChatRooms(id string) error
+	GetChatRoomByID(chatRoomID string) (ChatRoom, error)
+	// ChatRoomIDs は存在するすべてのチャットルームの id を返す
+	ChatRoomIDs() []string
+	ConfirmPassword(chatRoomID string, password_input string) (bool, error)
+
+	// AddUsers はユーザーをチャットルームに追加し、追加したユーザーを返す
+	// ホストがいないチャットルームでは、追加したユーザーがホストになる
+	AddUsers(chatRoomID string, user User) (User, error)
+	// DeleteUsers はユーザーをチャットルームから外す
+	// ユーザーがホストの時はチャットルームの HostDeparture に従って後任を選ぶか、チャットルームを閉じる必要があることを返す
+	// 後任に選べるメンバーがいない時は、ホストのいない空のチャットルームとして残す
+	// successorName は HostDepartureNominate のチャットルームで、ホストが後任に指名したメンバーの名前
+	DeleteUsers(chatRoomID string, userID string, successorName string) (Departure, error)
+	IsUserMemberOfChatRoom(chatRoomID string, userID string) (bool, User, error)
+	SaveUserUDPAddr(chatRoomID string, userID string, addr *net.UDPAddr) error
+	// SaveSessionKey はセッションを再開したユーザーに発行し直した SessionKey を保存し、Counter を 0 に戻す
+	SaveSessionKey(chatRoomID string, userID string, key []byte) error
+	// SaveCounter は認証したデータグラムの counter が保存されている Counter より大きい時に、Counter として保存する
+	SaveCounter(chatRoomID string, userID string, counter uint64) error
+
+	// AppendMessage はチャットルームの次の通し番号を割り当てたメッセージを履歴に残してから deliver に渡す
+	// message.Sender がメンバーであれば Store が保持しているユーザーの名前に置き換え、memberOnly の時はメンバー以外からのメッセージを受け付けない
+	// deliver はロックを保持したまま呼ばれるため、複数のゴルーチンから同時に呼ばれても各メンバーへは通し番号の順に配信される
+	AppendMessage(chatRoomID string, message Message, memberOnly bool, deliver func(ChatRoom, Message) error) (Message, error)
+	// History はチャットルームの履歴のうち、beforeSequence と before より前に配信されたものを新しい方から最大 limit 件、古い順に返す
+	// beforeSequence が 0 の時、before がゼロ値の時はそれぞれの条件を使わない
+	// 返したものより前にも履歴が残っている時は true を返す
+	History(chatRoomID string, beforeSequence uint64, before time.Time, limit int) ([]Message, bool, error)
+
+	// Close は保存されていないデータを書き出して Store を閉じる
+	Close() error
 }
 
-func (ds *DataStore) SaveUserUDPAddr(chatRoomID string, userID string, addr *net.UDPAddr) error {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRoomID]
-	if !exists {
-		return errors.New("designated ChatRoom does not exist")
-	}
-	user, exists := chatRoom.Users[userID]
-	if !exists {
-		return errors.New("User is not a member of the room")
-	}
-	user.Addr = addr
-	chatRoom.Users[userID] = user
-	ds.ChatRooms[chatRoomID] = chatRoom
+var (
+	ErrChatRoomNotFound = errors.New("designated ChatRoom does not exist")
+	ErrUserNotFound     = errors.New("designated user does not exist")
+	ErrUserNameTaken    = errors.New("user name is already used in the ChatRoom")
+	ErrChatRoomFull     = errors.New("designated ChatRoom is full")
+	ErrInvalidPassword  = errors.New("invalid password")
+)
 
-	return nil
+// NewMessage はチャットルームで配信するメッセージに、受け付けた時刻と次の通し番号を割り当てる
+// 通し番号の順に配信されるよう、Store のロックを保持したまま呼び出す
+func (chatRoom *ChatRoom) NewMessage(kind byte, sender Sender, content string, now time.Time) Message {
+	chatRoom.LastSequence++
+	return Message{
+		Kind:      kind,
+		Content:   content,
+		Sender:    sender,
+		Timestamp: now,
+		Sequence:  chatRoom.LastSequence,
+	}
 }
 
-func (ds *DataStore) AddUsers(chatRoomID string, user User) error {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRoomID]
-	if exists {
-		chatRoom.Users[user.Id] = user
-	} else {
-		return errors.New("designated ChatRoom does not exist")
+// Record は配信したメッセージを履歴に追加し、limit を超えた分は古いものから捨てる
+// NewMessage と同じく Store のロックを保持したまま呼び出す
+func (chatRoom *ChatRoom) Record(message Message, limit int) {
+	if limit <= 0 {
+		return
 	}
-	ds.ChatRooms[chatRoomID] = chatRoom
-
-	// chatroomにおける現在のメンバーを一覧にして表示
-	currentUsers := ds.ChatRooms[chatRoomID].Users
-	userList := []string{}
-	for _, currentUser := range currentUsers {
-		userList = append(userList, currentUser.Name) // ユーザー名を取得して追加
+	chatRoom.Messages = append(chatRoom.Messages, message)
+	if len(chatRoom.Messages) > limit {
+		// 捨てたメッセージを参照し続けないよう、残す分だけを新しいスライスへ移す
+		chatRoom.Messages = slices.Clone(chatRoom.Messages[len(chatRoom.Messages)-limit:])
 	}
-	fmt.Println("Current users in chat room:", strings.Join(userList, ", "))
+}
 
-	return nil
+// closesOnHostDeparture はホストが退出した時にチャットルームを閉じるかどうかを返す
+func (chatRoom ChatRoom) closesOnHostDeparture() bool {
+	return chatRoom.HostDeparture != HostDeparturePromote && chatRoom.HostDeparture != HostDepartureNominate
 }
 
-func (ds *DataStore) DeleteUsers(chatRommID string, user_id string) (string, error) {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRommID]
-	if !exists {
-		return "", errors.New("designated ChatRoom does not exist")
-	}
-	user, exists := chatRoom.Users[user_id]
-	if !exists {
-		return "", errors.New("designated user does not exist")
-	}
-	// userがhostユーザーか確認する
-	if user.IsHost {
-		delete(ds.ChatRooms, chatRommID)
-		fmt.Printf("Chat room 'id: %s, name: %s' removed", chatRommID, chatRoom.Name)
-	} else {
-		delete(chatRoom.Users, user_id)
-		ds.ChatRooms[chatRommID] = chatRoom
-		fmt.Printf("'id: %s, name: %s' is logged out from Chat room 'id: %s, name: %s'", user.Id, user.Name, chatRommID, chatRoom.Name)
+// successor はホストが退出する時に後任となるメンバーを選ぶ
+// HostDepartureNominate の時は指名されたメンバーを、それ以外の時や指名されたメンバーがいない時は最も長く参加しているメンバーを選ぶ
+// 後任に選べるメンバーがいない時は false を返す
+func (chatRoom ChatRoom) successor(hostID string, successorName string) (User, bool) {
+	var candidate User
+	found := false
+	for _, member := range chatRoom.Users {
+		if member.Id == hostID {
+			continue
+		}
+		if chatRoom.HostDeparture == HostDepartureNominate && successorName != "" && member.Name == successorName {
+			return member, true
+		}
+		// 参加した時刻が同じ時も毎回同じメンバーを選ぶよう、id の順で決める
+		if !found || member.JoinedAt.Before(candidate.JoinedAt) || (member.JoinedAt.Equal(candidate.JoinedAt) && member.Id < candidate.Id) {
+			candidate = member
+			found = true
+		}
 	}
-
-	return user.Name, nil
+	return candidate, found
 }
 
-func (ds *DataStore) GetChatRoomByID(chatRoomID string) (ChatRoom, error) {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRoomID]
-	if exists {
-		return chatRoom, nil
+// upgradePassword は以前の形式で平文のまま保存されていたパスワードを、ハッシュに置き換える
+func (chatRoom *ChatRoom) upgradePassword() error {
+	if chatRoom.LegacyPassword == "" {
+		return nil
 	}
-	return ChatRoom{}, errors.New("designated ChatRoom does not exist")
+	passwordHash, err := HashPassword(chatRoom.LegacyPassword)
+	if err != nil {
+		return err
+	}
+	chatRoom.PasswordHash = passwordHash
+	chatRoom.LegacyPassword = ""
+	return nil
 }
 
-func (ds *DataStore) ConfirmPassword(chatRoomID string, password_input string) (bool, error) {
-	ds.Mu.Lock()
-	defer ds.Mu.Unlock()
-	chatRoom, exists := ds.ChatRooms[chatRoomID]
-	if exists {
-		savedPassword := chatRoom.Password
-		if savedPassword == "" || savedPassword == password_input {
-			return true, nil
-		} else {
-			return false, errors.New("invalid password")
-		}
+// clone はメンバーと履歴を共有しないチャットルームの複製を返す
+func (chatRoom ChatRoom) clone() ChatRoom {
+	chatRoom.Users = maps.Clone(chatRoom.Users)
+	if chatRoom.Users == nil {
+		chatRoom.Users = make(map[string]User)
 	}
-	return false, errors.New("designated Chatroom does not exist")
+	chatRoom.Messages = slices.Clone(chatRoom.Messages)
+	return chatRoom
 }
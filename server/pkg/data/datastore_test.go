@@ -0,0 +1,135 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestSuccessor(t *testing.T) {
+	// carol と dave は同じ時刻に参加している
+	members := map[string]User{
+		"user-alice": {Id: "user-alice", Name: "alice", IsHost: true, JoinedAt: testTime(0)},
+		"user-bob":   {Id: "user-bob", Name: "bob", JoinedAt: testTime(5)},
+		"user-dave":  {Id: "user-dave", Name: "dave", JoinedAt: testTime(1)},
+		"user-carol": {Id: "user-carol", Name: "carol", JoinedAt: testTime(1)},
+	}
+	cases := []struct {
+		name          string
+		hostDeparture string
+		hostID        string
+		successorName string
+		expected      string
+	}{
+		{"promote longest tenured", HostDeparturePromote, "user-alice", "", "user-carol"},
+		{"promote ignores nominee", HostDeparturePromote, "user-alice", "bob", "user-carol"},
+		{"nominate", HostDepartureNominate, "user-alice", "bob", "user-bob"},
+		{"nominate without nominee", HostDepartureNominate, "user-alice", "", "user-carol"},
+		{"nominate missing member", HostDepartureNominate, "user-alice", "mallory", "user-carol"},
+		{"nominate the leaving host", HostDepartureNominate, "user-alice", "alice", "user-carol"},
+		{"leaving member is not the first", HostDeparturePromote, "user-bob", "", "user-alice"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			room := ChatRoom{Id: "room-1", Users: members, HostDeparture: c.hostDeparture}
+			successor, found := room.successor(c.hostID, c.successorName)
+			if !found || successor.Id != c.expected {
+				t.Errorf("expected %s, got %q (found %v)", c.expected, successor.Id, found)
+			}
+		})
+	}
+
+	// 参加した時刻が同じメンバーの中からは、id の小さい方を選ぶ
+	room := ChatRoom{Id: "room-1", Users: map[string]User{
+		"user-alice": members["user-alice"],
+		"user-dave":  members["user-dave"],
+		"user-carol": members["user-carol"],
+	}, HostDeparture: HostDeparturePromote}
+	for i := 0; i < 10; i++ {
+		if successor, _ := room.successor("user-alice", ""); successor.Id != "user-carol" {
+			t.Fatalf("expected user-carol, got %s", successor.Id)
+		}
+	}
+
+	if _, found := (ChatRoom{Users: map[string]User{"user-alice": members["user-alice"]}}).successor("user-alice", ""); found {
+		t.Error("expected no successor when the host is alone")
+	}
+}
+
+func TestStoreHostDeparture(t *testing.T) {
+	cases := []struct {
+		name          string
+		hostDeparture string
+		leaving       string
+		successorName string
+		closed        bool
+		newHost       string
+	}{
+		{"close", HostDepartureClose, "user-alice", "", true, ""},
+		{"close by default", "", "user-alice", "", true, ""},
+		{"promote", HostDeparturePromote, "user-alice", "", false, "user-bob"},
+		{"nominate", HostDepartureNominate, "user-alice", "carol", false, "user-carol"},
+		{"nominate missing member", HostDepartureNominate, "user-alice", "mallory", false, "user-bob"},
+		{"member leaves", HostDepartureClose, "user-bob", "", false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			forEachStore(t, Config{}, func(t *testing.T, store Store) {
+				room := ChatRoom{Id: "room-1", Name: "General", Users: map[string]User{}, HostDeparture: c.hostDeparture}
+				if err := store.AddChatRooms(room.Id, room); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				for i, name := range []string{"alice", "bob", "carol"} {
+					if _, err := store.AddUsers(room.Id, User{Id: "user-" + name, Name: name, JoinedAt: testTime(i)}); err != nil {
+						t.Fatalf("expected no error, got %v", err)
+					}
+				}
+
+				departure, err := store.DeleteUsers(room.Id, c.leaving, c.successorName)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if departure.User.Id != c.leaving || departure.Closed != c.closed || departure.NewHost.Id != c.newHost {
+					t.Errorf("expected closed %v and new host %q, got %+v", c.closed, c.newHost, departure)
+				}
+
+				// 後任になったメンバーだけがホストとして記録される
+				after := getTestRoom(t, store)
+				for _, member := range after.Users {
+					isHost := member.Id == c.newHost || (c.newHost == "" && !c.closed && member.Id == "user-alice")
+					if member.IsHost != isHost {
+						t.Errorf("expected %s host %v, got %v", member.Id, isHost, member.IsHost)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestStoreHandsOverEmptyRoomToNextMember(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, store Store) {
+		room := ChatRoom{Id: "room-1", Name: "General", Users: map[string]User{}, HostDeparture: HostDeparturePromote}
+		if err := store.AddChatRooms(room.Id, room); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := store.AddUsers(room.Id, User{Id: "user-alice", Name: "alice"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		// 後任のいないホストが退出しても、チャットルームは閉じずに空のまま残す
+		departure, err := store.DeleteUsers(room.Id, "user-alice", "")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if departure.Closed || departure.NewHost.Id != "" {
+			t.Errorf("expected the room to stay without a host, got %+v", departure)
+		}
+
+		// 次に参加したユーザーがホストになる
+		bob, err := store.AddUsers(room.Id, User{Id: "user-bob", Name: "bob"})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bob.IsHost {
+			t.Error("expected the next member to become the host")
+		}
+	})
+}
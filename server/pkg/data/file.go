@@ -0,0 +1,354 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore はデータをメモリ上に保持しつつ、変更をディレクトリ内のファイルへ記録する Store
+//
+// 変更は 1 件ごとに json の 1 行として journal.log へ追記し、fsync してからメモリへ反映する (write-ahead log)
+// 定期的にその時点の全データを snapshot.json へ書き出してから journal.log を空にする
+// 開いた時は snapshot.json を読み込んでから journal.log の変更を順に反映し、前回の状態を復元する
+//
+// プロセスが途中で強制終了されても、メモリへ反映された変更は journal.log か snapshot.json のどちらかに残っている
+// journal.log の末尾に書きかけの行が残っている時は、反映されなかった変更として取り除く
+type FileStore struct {
+	*MemoryStore
+	dir string
+	log journalFile
+	// logSize は journal.log のうち、完全に書き込まれた記録の長さ
+	logSize int64
+	// records は最後にスナップショットを作成してから journal.log に追記した変更の数
+	records int
+	// lastIndex は最後に記録した変更の通し番号
+	lastIndex uint64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// journalFile は journal.log を追記するためのファイルで、*os.File が実装する
+type journalFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+const (
+	snapshotFileName = "snapshot.json"
+	journalFileName  = "journal.log"
+)
+
+// journal.log に記録する変更の種類
+const (
+	opAddChatRoom    = "add_chat_room"
+	opDeleteChatRoom = "delete_chat_room"
+	opAddUser        = "add_user"
+	opDeleteUser     = "delete_user"
+	opSaveUserAddr   = "save_user_addr"
+	opSaveSessionKey = "save_session_key"
+	opSaveCounter    = "save_counter"
+	opAppendMessage  = "append_message"
+)
+
+// journalRecord は journal.log の 1 行に記録する変更
+// Index は記録ごとに増える通し番号で、スナップショットに含まれている変更を読み込み直さないために使う
+type journalRecord struct {
+	Index   uint64       `json:"index"`
+	Op      string       `json:"op"`
+	RoomID  string       `json:"room_id"`
+	Room    *ChatRoom    `json:"room,omitempty"`
+	User    *User        `json:"user,omitempty"`
+	UserID  string       `json:"user_id,omitempty"`
+	HostID  string       `json:"host_id,omitempty"`
+	Addr    *net.UDPAddr `json:"addr,omitempty"`
+	Key     []byte       `json:"key,omitempty"`
+	Counter uint64       `json:"counter,omitempty"`
+	Message *Message     `json:"message,omitempty"`
+}
+
+// snapshotData は snapshot.json に書き出す全データ
+// LastIndex はスナップショットに含まれている最後の変更の通し番号
+type snapshotData struct {
+	LastIndex uint64              `json:"last_index"`
+	ChatRooms map[string]ChatRoom `json:"chat_rooms"`
+}
+
+// OpenFileStore は dir に記録されたデータを読み込んだ FileStore を作成する
+// dir が存在しない時は作成し、空の状態から始める
+// snapshotInterval ごとに、変更があればスナップショットを作成する
+func OpenFileStore(dir string, config Config, snapshotInterval time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		MemoryStore: NewMemoryStore(config),
+		dir:         dir,
+		done:        make(chan struct{}),
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// 作成した journal.log がディレクトリから消えないよう、ディレクトリも fsync する
+	if err := syncDir(dir); err != nil {
+		log.Close()
+		return nil, err
+	}
+	fs.log = log
+	fs.journal = fs.appendRecord
+
+	fs.wg.Add(1)
+	go fs.snapshotLoop(snapshotInterval)
+
+	return fs, nil
+}
+
+// load は snapshot.json と journal.log から前回の状態を復元する
+func (fs *FileStore) load() error {
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		s := snapshotData{}
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("failed to read %s: %w", snapshotFileName, err)
+		}
+		for id, room := range s.ChatRooms {
+			if err := room.upgradePassword(); err != nil {
+				return err
+			}
+			fs.applyAddChatRoom(id, room)
+		}
+		fs.lastIndex = s.LastIndex
+	}
+
+	path := filepath.Join(fs.dir, journalFileName)
+	log, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	reader := bufio.NewReader(log)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// 改行で終わっていない行や読めない最後の行は、書き込みの途中で止まった記録なので取り除く
+		// 途中の行が読めない時はファイルが壊れているので、復元をやめる
+		r := journalRecord{}
+		if err == io.EOF || json.Unmarshal(data, &r) != nil {
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("failed to read %s line %d: corrupted record", journalFileName, line)
+			}
+			fmt.Printf("Discarding incomplete record at the end of %s (%d bytes)\n", journalFileName, len(data))
+			return truncateFile(path, fs.logSize)
+		}
+		fs.logSize += int64(len(data))
+
+		// スナップショットを置き換えてから journal.log を空にするまでの間に止まった時は、
+		// スナップショットに含まれている変更が journal.log にも残っている
+		// 通し番号のない記録は通し番号を付ける前の形式で、常にスナップショットより後の変更
+		if r.Index != 0 && r.Index <= fs.lastIndex {
+			continue
+		}
+		if r.Room != nil {
+			if err := r.Room.upgradePassword(); err != nil {
+				return err
+			}
+		}
+		fs.apply(r)
+		fs.lastIndex = max(fs.lastIndex, r.Index)
+		fs.records++
+	}
+	return nil
+}
+
+// apply は journal.log から読み込んだ変更をメモリへ反映する
+func (fs *FileStore) apply(r journalRecord) {
+	switch r.Op {
+	case opAddChatRoom:
+		if r.Room != nil {
+			fs.applyAddChatRoom(r.RoomID, *r.Room)
+		}
+	case opDeleteChatRoom:
+		delete(fs.chatRooms, r.RoomID)
+	case opAddUser:
+		if r.User != nil {
+			fs.applyAddUser(r.RoomID, *r.User)
+		}
+	case opDeleteUser:
+		fs.applyDeleteUser(r.RoomID, r.UserID, r.HostID)
+	case opSaveUserAddr:
+		fs.applySaveUserAddr(r.RoomID, r.UserID, r.Addr)
+	case opSaveSessionKey:
+		fs.applySaveSessionKey(r.RoomID, r.UserID, r.Key)
+	case opSaveCounter:
+		fs.applySaveCounter(r.RoomID, r.UserID, r.Counter)
+	case opAppendMessage:
+		if r.Message != nil {
+			fs.applyAppendMessage(r.RoomID, *r.Message)
+		}
+	default:
+		fmt.Printf("Unknown record %q in %s is ignored\n", r.Op, journalFileName)
+	}
+}
+
+// appendRecord は変更を journal.log に追記し、fsync してから返る
+// MemoryStore のロックを保持したまま、メモリへ反映する前に呼ばれるので、記録の順番はメモリへ反映した順番と一致する
+func (fs *FileStore) appendRecord(r journalRecord) error {
+	r.Index = fs.lastIndex + 1
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	_, err = fs.log.Write(data)
+	if err == nil {
+		err = fs.log.Sync()
+	}
+	if err != nil {
+		// 書きかけの記録の後ろに次の記録を追記しないよう、完全に書き込まれた位置まで戻す
+		if truncateErr := fs.log.Truncate(fs.logSize); truncateErr != nil {
+			fmt.Println("Failed to discard incomplete record:", truncateErr)
+		}
+		return err
+	}
+
+	fs.logSize += int64(len(data))
+	fs.lastIndex = r.Index
+	fs.records++
+	return nil
+}
+
+// snapshot は現在の全データを snapshot.json に書き出し、journal.log を空にする
+// MemoryStore のロックを保持したまま呼び出す
+func (fs *FileStore) snapshot() error {
+	data, err := json.Marshal(snapshotData{LastIndex: fs.lastIndex, ChatRooms: fs.chatRooms})
+	if err != nil {
+		return err
+	}
+
+	// 書き出している途中で止まっても前のスナップショットが残るよう、別のファイルに書いて fsync してから置き換える
+	path := filepath.Join(fs.dir, snapshotFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(fs.dir); err != nil {
+		return err
+	}
+
+	// 新しいスナップショットが残ったので、それより前の変更は journal.log から消してよい
+	if err := fs.log.Truncate(0); err != nil {
+		return err
+	}
+	if err := fs.log.Sync(); err != nil {
+		return err
+	}
+	fs.logSize = 0
+	fs.records = 0
+	return nil
+}
+
+// writeFileSync は data をファイルに書き込み、fsync してから閉じる
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
+
+// truncateFile はファイルを size の長さに切り詰めて fsync する
+func truncateFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
+
+// syncDir はディレクトリを fsync し、ファイルの作成や名前の変更を永続化する
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// snapshotLoop は interval ごとに、変更があればスナップショットを作成する
+func (fs *FileStore) snapshotLoop(interval time.Duration) {
+	defer fs.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fs.done:
+			return
+		case <-ticker.C:
+			fs.mu.Lock()
+			if fs.records > 0 {
+				if err := fs.snapshot(); err != nil {
+					fmt.Println("Failed to write snapshot:", err)
+				}
+			}
+			fs.mu.Unlock()
+		}
+	}
+}
+
+// Close はスナップショットを作成してからファイルを閉じる
+// 閉じた後の変更はメモリにだけ反映される
+func (fs *FileStore) Close() error {
+	fs.closeOnce.Do(func() {
+		close(fs.done)
+		fs.wg.Wait()
+
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		fs.journal = nil
+		fs.closeErr = errors.Join(fs.snapshot(), fs.log.Close())
+	})
+	return fs.closeErr
+}
@@ -0,0 +1,352 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTime はファイルへ書き出して読み込み直しても同じ値になるよう、UTC の固定の時刻を返す
+func testTime(seconds int) time.Time {
+	return time.Date(2024, 1, 1, 0, 0, seconds, 0, time.UTC)
+}
+
+func openTestFileStore(t *testing.T, dir string) *FileStore {
+	t.Helper()
+	// スナップショットはテストの中で明示的に作成する
+	fs, err := OpenFileStore(dir, Config{MaxMessagesPerRoom: 100}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return fs
+}
+
+// crash はプロセスが強制終了された時と同じく、スナップショットを作成せずに FileStore を止める
+func crash(t *testing.T, fs *FileStore) {
+	t.Helper()
+	close(fs.done)
+	fs.wg.Wait()
+	fs.closeOnce.Do(func() {})
+	if err := fs.log.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+// populate はチャットルームを作成し、ホストとメンバー、履歴を記録する
+func populate(t *testing.T, store Store) {
+	t.Helper()
+	room := ChatRoom{Id: "room-1", Name: "General", PasswordHash: "", Users: map[string]User{}, HostDeparture: HostDeparturePromote}
+	if err := store.AddChatRooms(room.Id, room); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		user := User{Id: "user-" + name, Name: name, JoinedAt: testTime(i)}
+		if _, err := store.AddUsers(room.Id, user); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	if err := store.SaveUserUDPAddr(room.Id, "user-alice", addr); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := store.SaveSessionKey(room.Id, "user-bob", []byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := store.SaveCounter(room.Id, "user-bob", 7); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		appendTestMessage(t, store, "user-alice", "hello", testTime(10+i))
+	}
+	if _, err := store.DeleteUsers(room.Id, "user-carol", ""); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func appendTestMessage(t *testing.T, store Store, userID string, content string, now time.Time) Message {
+	t.Helper()
+	message := Message{Kind: 0, Content: content, Sender: Sender{Id: userID}, Timestamp: now}
+	accepted, err := store.AppendMessage("room-1", message, true, func(ChatRoom, Message) error { return nil })
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return accepted
+}
+
+func getTestRoom(t *testing.T, store Store) ChatRoom {
+	t.Helper()
+	room, err := store.GetChatRoomByID("room-1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return room
+}
+
+func journalSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return info.Size()
+}
+
+func TestFileStoreReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	expected := getTestRoom(t, fs)
+	crash(t, fs)
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no snapshot before the crash, got %v", err)
+	}
+
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	if restored := getTestRoom(t, reopened); !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %+v, got %+v", expected, restored)
+	}
+
+	// 復元した後も通し番号は続きから割り当てる
+	if next := appendTestMessage(t, reopened, "user-bob", "after restart", testTime(20)); next.Sequence != 4 {
+		t.Errorf("expected sequence 4, got %d", next.Sequence)
+	}
+}
+
+func TestFileStoreCloseWritesSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	expected := getTestRoom(t, fs)
+	if err := fs.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if size := journalSize(t, dir); size != 0 {
+		t.Errorf("expected journal to be empty after close, got %d bytes", size)
+	}
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	if restored := getTestRoom(t, reopened); !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %+v, got %+v", expected, restored)
+	}
+	if reopened.records != 0 {
+		t.Errorf("expected no records to replay, got %d", reopened.records)
+	}
+}
+
+func TestFileStoreSkipsRecordsIncludedInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+
+	// スナップショットを置き換えた後、journal.log を空にする前に止まった状態を作る
+	fs.mu.Lock()
+	data, err := json.Marshal(snapshotData{LastIndex: fs.lastIndex, ChatRooms: fs.chatRooms})
+	if err == nil {
+		err = writeFileSync(filepath.Join(dir, snapshotFileName), data)
+	}
+	fs.mu.Unlock()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	appendTestMessage(t, fs, "user-bob", "after snapshot", testTime(20))
+	expected := getTestRoom(t, fs)
+	crash(t, fs)
+
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	restored := getTestRoom(t, reopened)
+	if !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %+v, got %+v", expected, restored)
+	}
+	// スナップショットに含まれる履歴を二重に追加しない
+	if len(restored.Messages) != 4 || restored.LastSequence != 4 {
+		t.Errorf("expected 4 messages up to sequence 4, got %d up to %d", len(restored.Messages), restored.LastSequence)
+	}
+}
+
+func TestFileStoreDiscardsIncompleteLastRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		tail string
+	}{
+		{"half written line", `{"index":99,"op":"append_message","room_id":"room-1","mess`},
+		{"unreadable last line", "{\"index\":99,\"op\":\x00\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs := openTestFileStore(t, dir)
+			populate(t, fs)
+			expected := getTestRoom(t, fs)
+			crash(t, fs)
+
+			complete := journalSize(t, dir)
+			appendToJournal(t, dir, c.tail)
+
+			reopened := openTestFileStore(t, dir)
+			if restored := getTestRoom(t, reopened); !reflect.DeepEqual(restored, expected) {
+				t.Errorf("expected %+v, got %+v", expected, restored)
+			}
+			if size := journalSize(t, dir); size != complete {
+				t.Errorf("expected incomplete record to be truncated to %d bytes, got %d", complete, size)
+			}
+
+			// 取り除いた後に追記した記録も、次に開いた時に読み込める
+			appendTestMessage(t, reopened, "user-bob", "after recovery", testTime(20))
+			crash(t, reopened)
+			again := openTestFileStore(t, dir)
+			defer again.Close()
+			if restored := getTestRoom(t, again); len(restored.Messages) != 4 {
+				t.Errorf("expected 4 messages, got %d", len(restored.Messages))
+			}
+		})
+	}
+}
+
+func TestFileStoreRejectsCorruptedRecordInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	crash(t, fs)
+
+	journal, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	corrupted := append([]byte("not a record\n"), journal...)
+	if err := os.WriteFile(filepath.Join(dir, journalFileName), corrupted, 0o600); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, err := OpenFileStore(dir, Config{MaxMessagesPerRoom: 100}, time.Hour); err == nil {
+		t.Fatal("expected corrupted journal to be rejected")
+	}
+	// 壊れた journal.log を切り詰めて記録を失わないよう、ファイルには触れない
+	if size := journalSize(t, dir); size != int64(len(corrupted)) {
+		t.Errorf("expected journal to be left as is, got %d bytes", size)
+	}
+}
+
+// failingJournal は記録の途中まで書き込んだところで失敗する journalFile
+type failingJournal struct {
+	journalFile
+	written int
+}
+
+func (f *failingJournal) Write(data []byte) (int, error) {
+	n, err := f.journalFile.Write(data[:f.written])
+	if err != nil {
+		return n, err
+	}
+	return n, errors.New("no space left on device")
+}
+
+func TestFileStoreRollsBackFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	before := getTestRoom(t, fs)
+	complete := journalSize(t, dir)
+
+	healthy := fs.log
+	fs.log = &failingJournal{journalFile: healthy, written: 10}
+	_, err := fs.AppendMessage("room-1", Message{Content: "lost", Sender: Sender{Id: "user-alice"}, Timestamp: testTime(20)}, true, func(ChatRoom, Message) error {
+		t.Error("expected failed message not to be delivered")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected append to fail")
+	}
+	if size := journalSize(t, dir); size != complete {
+		t.Errorf("expected partial record to be truncated to %d bytes, got %d", complete, size)
+	}
+	if after := getTestRoom(t, fs); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected failed append not to change the chat room, got %+v", after)
+	}
+
+	// 書き込めるようになった後の記録は、失敗した記録と同じ通し番号から続く
+	fs.log = healthy
+	if next := appendTestMessage(t, fs, "user-alice", "kept", testTime(21)); next.Sequence != 4 {
+		t.Errorf("expected sequence 4, got %d", next.Sequence)
+	}
+	crash(t, fs)
+
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	restored := getTestRoom(t, reopened)
+	if len(restored.Messages) != 4 || restored.Messages[3].Content != "kept" {
+		t.Errorf("expected only the kept message to be restored, got %+v", restored.Messages)
+	}
+}
+
+func appendToJournal(t *testing.T, dir string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestFileStoreKeepsOnlySenderInHistory(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	crash(t, fs)
+
+	// 履歴には送信者の id と名前だけを記録し、SessionKey やアドレスは残さない
+	journal, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	messages := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(journal)), "\n") {
+		var r struct {
+			Op      string         `json:"op"`
+			Message map[string]any `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if r.Op != opAppendMessage {
+			continue
+		}
+		messages++
+		if sender := r.Message["User"]; !reflect.DeepEqual(sender, map[string]any{"Id": "user-alice", "Name": "alice"}) {
+			t.Errorf("expected only id and name of the sender, got %v", sender)
+		}
+	}
+	if messages != 3 {
+		t.Errorf("expected 3 messages in the journal, got %d", messages)
+	}
+}
+
+func TestFileStoreReadsLegacySender(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStore(t, dir)
+	populate(t, fs)
+	crash(t, fs)
+
+	// 以前の形式では送信者の User をそのまま記録していた
+	appendToJournal(t, dir, `{"index":100,"op":"append_message","room_id":"room-1","message":{"Kind":0,"Content":"legacy","User":{"Id":"user-bob","Name":"bob","SessionKey":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=","ResumeTokenHash":"abc"},"Timestamp":"2024-01-01T00:00:20Z","Sequence":4}}`+"\n")
+
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	room := getTestRoom(t, reopened)
+	last := room.Messages[len(room.Messages)-1]
+	if last.Content != "legacy" || last.Sender != (Sender{Id: "user-bob", Name: "bob"}) {
+		t.Errorf("expected legacy message from bob, got %+v", last)
+	}
+}
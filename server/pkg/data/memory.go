@@ -0,0 +1,366 @@
+package data
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore はすべてのデータをメモリ上に保持する Store
+// サーバーのプロセスが終了するとデータは失われる
+type MemoryStore struct {
+	config    Config
+	mu        sync.Mutex
+	chatRooms map[string]ChatRoom
+	// journal は変更をメモリへ反映する前に呼ばれ、エラーを返した時はその変更を取りやめる
+	// FileStore が変更をファイルへ記録するために使う
+	journal func(journalRecord) error
+}
+
+// NewMemoryStore は空の MemoryStore を作成する
+func NewMemoryStore(config Config) *MemoryStore {
+	return &MemoryStore{
+		config:    config,
+		chatRooms: make(map[string]ChatRoom),
+	}
+}
+
+// record は journal が設定されていれば変更を記録する
+func (ds *MemoryStore) record(r journalRecord) error {
+	if ds.journal == nil {
+		return nil
+	}
+	return ds.journal(r)
+}
+
+func (ds *MemoryStore) AddChatRooms(id string, room ChatRoom) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := ds.record(journalRecord{Op: opAddChatRoom, RoomID: id, Room: &room}); err != nil {
+		return err
+	}
+	ds.applyAddChatRoom(id, room)
+	return nil
+}
+
+func (ds *MemoryStore) DeleteChatRooms(id string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, exists := ds.chatRooms[id]; !exists {
+		return ErrChatRoomNotFound
+	}
+	if err := ds.record(journalRecord{Op: opDeleteChatRoom, RoomID: id}); err != nil {
+		return err
+	}
+	delete(ds.chatRooms, id)
+	return nil
+}
+
+func (ds *MemoryStore) GetChatRoomByID(chatRoomID string) (ChatRoom, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if exists {
+		return chatRoom.clone(), nil
+	}
+	return ChatRoom{}, ErrChatRoomNotFound
+}
+
+func (ds *MemoryStore) ChatRoomIDs() []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return slices.Collect(maps.Keys(ds.chatRooms))
+}
+
+func (ds *MemoryStore) ConfirmPassword(chatRoomID string, password_input string) (bool, error) {
+	ds.mu.Lock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	ds.mu.Unlock()
+	if !exists {
+		return false, ErrChatRoomNotFound
+	}
+	// ハッシュの計算には時間がかかるので、ロックを解放してから確認する
+	if !VerifyPassword(chatRoom.PasswordHash, password_input) {
+		return false, ErrInvalidPassword
+	}
+	return true, nil
+}
+
+func (ds *MemoryStore) AddUsers(chatRoomID string, user User) (User, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return User{}, ErrChatRoomNotFound
+	}
+	if ds.config.MaxUsersPerRoom > 0 && len(chatRoom.Users) >= ds.config.MaxUsersPerRoom {
+		return User{}, ErrChatRoomFull
+	}
+	// 同じチャットルーム内で同じユーザー名は使えない
+	hasHost := false
+	for _, member := range chatRoom.Users {
+		if member.Name == user.Name {
+			return User{}, ErrUserNameTaken
+		}
+		hasHost = hasHost || member.IsHost
+	}
+	// ホストが退出して空のまま残っていたチャットルームでは、最初に参加したユーザーがホストになる
+	if !hasHost {
+		user.IsHost = true
+	}
+	if err := ds.record(journalRecord{Op: opAddUser, RoomID: chatRoomID, User: &user}); err != nil {
+		return User{}, err
+	}
+	ds.applyAddUser(chatRoomID, user)
+
+	// chatroomにおける現在のメンバーを一覧にして表示
+	userList := []string{}
+	for _, currentUser := range ds.chatRooms[chatRoomID].Users {
+		userList = append(userList, currentUser.Name) // ユーザー名を取得して追加
+	}
+	fmt.Println("Current users in chat room:", strings.Join(userList, ", "))
+
+	return user, nil
+}
+
+func (ds *MemoryStore) DeleteUsers(chatRoomID string, userID string, successorName string) (Departure, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return Departure{}, ErrChatRoomNotFound
+	}
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return Departure{}, ErrUserNotFound
+	}
+
+	departure := Departure{User: user}
+	if user.IsHost {
+		if chatRoom.closesOnHostDeparture() {
+			departure.Closed = true
+		} else if newHost, found := chatRoom.successor(userID, successorName); found {
+			newHost.IsHost = true
+			departure.NewHost = newHost
+		}
+	}
+	if err := ds.record(journalRecord{Op: opDeleteUser, RoomID: chatRoomID, UserID: userID, HostID: departure.NewHost.Id}); err != nil {
+		return Departure{}, err
+	}
+	ds.applyDeleteUser(chatRoomID, userID, departure.NewHost.Id)
+
+	fmt.Printf("'id: %s, name: %s' is logged out from Chat room 'id: %s, name: %s'\n", user.Id, user.Name, chatRoomID, chatRoom.Name)
+	if departure.NewHost.Id != "" {
+		fmt.Printf("'id: %s, name: %s' is the new host of Chat room 'id: %s, name: %s'\n", departure.NewHost.Id, departure.NewHost.Name, chatRoomID, chatRoom.Name)
+	}
+	return departure, nil
+}
+
+// IsUserMemberOfChatRoom はそのユーザーが与えられた指定されたチャットルームに存在するかと、存在する場合はユーザ名を返す
+func (ds *MemoryStore) IsUserMemberOfChatRoom(chatRoomID string, userID string) (bool, User, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return false, User{}, ErrChatRoomNotFound
+	}
+
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return false, User{}, nil
+	}
+	return true, user, nil
+}
+
+func (ds *MemoryStore) SaveUserUDPAddr(chatRoomID string, userID string, addr *net.UDPAddr) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return ErrChatRoomNotFound
+	}
+	if _, exists := chatRoom.Users[userID]; !exists {
+		return ErrUserNotFound
+	}
+	if err := ds.record(journalRecord{Op: opSaveUserAddr, RoomID: chatRoomID, UserID: userID, Addr: addr}); err != nil {
+		return err
+	}
+	ds.applySaveUserAddr(chatRoomID, userID, addr)
+	return nil
+}
+
+func (ds *MemoryStore) SaveSessionKey(chatRoomID string, userID string, key []byte) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return ErrChatRoomNotFound
+	}
+	if _, exists := chatRoom.Users[userID]; !exists {
+		return ErrUserNotFound
+	}
+	if err := ds.record(journalRecord{Op: opSaveSessionKey, RoomID: chatRoomID, UserID: userID, Key: key}); err != nil {
+		return err
+	}
+	ds.applySaveSessionKey(chatRoomID, userID, key)
+	return nil
+}
+
+func (ds *MemoryStore) SaveCounter(chatRoomID string, userID string, counter uint64) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return ErrChatRoomNotFound
+	}
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	// 順番が入れ替わって届いたデータグラムで Counter を戻さない
+	if counter <= user.Counter {
+		return nil
+	}
+	if err := ds.record(journalRecord{Op: opSaveCounter, RoomID: chatRoomID, UserID: userID, Counter: counter}); err != nil {
+		return err
+	}
+	ds.applySaveCounter(chatRoomID, userID, counter)
+	return nil
+}
+
+func (ds *MemoryStore) AppendMessage(chatRoomID string, message Message, memberOnly bool, deliver func(ChatRoom, Message) error) (Message, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return Message{}, ErrChatRoomNotFound
+	}
+
+	// 送信者がチャットルームのメンバーであれば、保持している名前を使う
+	if member, exists := chatRoom.Users[message.Sender.Id]; exists {
+		message.Sender = member.Sender()
+	} else if memberOnly {
+		return Message{}, ErrUserNotFound
+	}
+
+	accepted := chatRoom.NewMessage(message.Kind, message.Sender, message.Content, message.Timestamp)
+	if err := ds.record(journalRecord{Op: opAppendMessage, RoomID: chatRoomID, Message: &accepted}); err != nil {
+		return Message{}, err
+	}
+	ds.applyAppendMessage(chatRoomID, accepted)
+
+	return accepted, deliver(ds.chatRooms[chatRoomID], accepted)
+}
+
+func (ds *MemoryStore) History(chatRoomID string, beforeSequence uint64, before time.Time, limit int) ([]Message, bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return nil, false, ErrChatRoomNotFound
+	}
+
+	// 履歴は sequence の順に並んでいるので、条件を満たす範囲の末尾を後ろから探す
+	end := len(chatRoom.Messages)
+	for end > 0 {
+		message := chatRoom.Messages[end-1]
+		if (beforeSequence == 0 || message.Sequence < beforeSequence) && (before.IsZero() || message.Timestamp.Before(before)) {
+			break
+		}
+		end--
+	}
+	first := max(0, end-limit)
+	return slices.Clone(chatRoom.Messages[first:end]), first > 0, nil
+}
+
+// Close は何もしない
+func (ds *MemoryStore) Close() error {
+	return nil
+}
+
+// 以下の apply* は記録された変更をメモリへ反映する
+// ロックを保持したまま呼び出し、FileStore が記録を読み込み直す時にも使う
+
+func (ds *MemoryStore) applyAddChatRoom(id string, room ChatRoom) {
+	ds.chatRooms[id] = room.clone()
+}
+
+func (ds *MemoryStore) applyAddUser(chatRoomID string, user User) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	chatRoom.Users[user.Id] = user
+	ds.chatRooms[chatRoomID] = chatRoom
+}
+
+// applyDeleteUser はユーザーをチャットルームから外し、hostID が空でなければそのメンバーをホストにする
+func (ds *MemoryStore) applyDeleteUser(chatRoomID string, userID string, hostID string) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	delete(chatRoom.Users, userID)
+	if host, exists := chatRoom.Users[hostID]; exists {
+		host.IsHost = true
+		chatRoom.Users[hostID] = host
+	}
+	ds.chatRooms[chatRoomID] = chatRoom
+}
+
+func (ds *MemoryStore) applySaveUserAddr(chatRoomID string, userID string, addr *net.UDPAddr) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return
+	}
+	user.Addr = addr
+	chatRoom.Users[userID] = user
+	ds.chatRooms[chatRoomID] = chatRoom
+}
+
+func (ds *MemoryStore) applySaveSessionKey(chatRoomID string, userID string, key []byte) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return
+	}
+	user.SessionKey = key
+	user.Counter = 0
+	chatRoom.Users[userID] = user
+	ds.chatRooms[chatRoomID] = chatRoom
+}
+
+func (ds *MemoryStore) applySaveCounter(chatRoomID string, userID string, counter uint64) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	user, exists := chatRoom.Users[userID]
+	if !exists {
+		return
+	}
+	user.Counter = max(user.Counter, counter)
+	chatRoom.Users[userID] = user
+	ds.chatRooms[chatRoomID] = chatRoom
+}
+
+func (ds *MemoryStore) applyAppendMessage(chatRoomID string, message Message) {
+	chatRoom, exists := ds.chatRooms[chatRoomID]
+	if !exists {
+		return
+	}
+	chatRoom.LastSequence = max(chatRoom.LastSequence, message.Sequence)
+	chatRoom.Record(message, ds.config.MaxMessagesPerRoom)
+	ds.chatRooms[chatRoomID] = chatRoom
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/okonomipizza/chat-protocol/pkg/protocol"
+)
+
+// チャットルームのパスワードは PBKDF2-HMAC-SHA256 でソルト付きのハッシュにしてから保存する
+// 保存する形式は "pbkdf2-sha256$<反復回数>$<ソルト (hex)>$<ハッシュ (hex)>" で、
+// 反復回数を含めておくことで、後から回数を増やしても保存済みのハッシュを確認できる
+
+const (
+	passwordHashScheme = "pbkdf2-sha256"
+	// passwordIterations は新しくハッシュを作成する時の反復回数 (OWASP が PBKDF2-HMAC-SHA256 に推奨している回数)
+	passwordIterations = 600000
+	passwordSaltLen    = 16
+	passwordKeyLen     = sha256.Size
+)
+
+// HashPassword はパスワードを新しいソルトでハッシュにした、保存するための文字列を返す
+// 空のパスワードはパスワードが設定されていないことを表すので、空の文字列を返す
+func HashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := protocol.PBKDF2SHA256([]byte(password), salt, passwordIterations, passwordKeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// VerifyPassword は入力されたパスワードが保存されているハッシュと一致するかを返す
+// ハッシュが空のチャットルームはパスワードが設定されていないので、入力に関係なく true を返す
+func VerifyPassword(passwordHash string, password string) bool {
+	if passwordHash == "" {
+		return true
+	}
+	iterations, salt, expected, ok := parsePasswordHash(passwordHash)
+	if !ok {
+		return false
+	}
+	// 一致するまでの時間からパスワードを推測されないよう、定数時間で比較する
+	key := protocol.PBKDF2SHA256([]byte(password), salt, iterations, len(expected))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func parsePasswordHash(passwordHash string) (int, []byte, []byte, bool) {
+	fields := strings.Split(passwordHash, "$")
+	if len(fields) != 4 || fields[0] != passwordHashScheme {
+		return 0, nil, nil, false
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, false
+	}
+	salt, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return 0, nil, nil, false
+	}
+	key, err := hex.DecodeString(fields[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, false
+	}
+	return iterations, salt, key, true
+}
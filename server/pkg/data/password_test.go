@@ -0,0 +1,109 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	passwordHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(passwordHash, "pbkdf2-sha256$600000$") || strings.Contains(passwordHash, "secret") {
+		t.Errorf("unexpected hash %q", passwordHash)
+	}
+
+	// 同じパスワードでもソルトが異なるので、別のハッシュになる
+	again, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if again == passwordHash {
+		t.Error("expected a new salt for every hash")
+	}
+
+	for _, c := range []struct {
+		password string
+		expected bool
+	}{
+		{"secret", true},
+		{"Secret", false},
+		{"secret ", false},
+		{"", false},
+	} {
+		if got := VerifyPassword(passwordHash, c.password); got != c.expected {
+			t.Errorf("VerifyPassword(%q) = %v, expected %v", c.password, got, c.expected)
+		}
+	}
+
+	// 空のパスワードはパスワードが設定されていないことを表す
+	if empty, err := HashPassword(""); err != nil || empty != "" {
+		t.Errorf("expected empty hash, got %q (error %v)", empty, err)
+	}
+	if !VerifyPassword("", "anything") {
+		t.Error("expected a chat room without password to accept any input")
+	}
+}
+
+func TestVerifyPasswordWithStoredHash(t *testing.T) {
+	// 反復回数は保存した時のものを使う (RFC 6070 のテストケースを HMAC-SHA256 で計算した値)
+	stored := "pbkdf2-sha256$1$" + "73616c74" + "$120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"
+	if !VerifyPassword(stored, "password") {
+		t.Error("expected stored hash to be verified")
+	}
+	if VerifyPassword(stored, "wrong") {
+		t.Error("expected wrong password to be rejected")
+	}
+
+	// 形式の分からないハッシュや平文のパスワードは、どの入力とも一致しない
+	for _, passwordHash := range []string{
+		"password",
+		"bcrypt$1$73616c74$120fb6cf",
+		"pbkdf2-sha256$0$73616c74$120fb6cf",
+		"pbkdf2-sha256$1$not-hex$120fb6cf",
+		"pbkdf2-sha256$1$73616c74$",
+	} {
+		if VerifyPassword(passwordHash, "password") {
+			t.Errorf("expected %q to be rejected", passwordHash)
+		}
+	}
+}
+
+func TestFileStoreUpgradesLegacyPassword(t *testing.T) {
+	// 以前の形式ではパスワードを平文のまま保存していた
+	dir := t.TempDir()
+	legacy := `{"last_index":1,"chat_rooms":{"room-1":{"Id":"room-1","Name":"General","Password":"secret","Users":{}}}}`
+	if err := os.WriteFile(filepath.Join(dir, snapshotFileName), []byte(legacy), 0o600); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	fs, err := OpenFileStore(dir, Config{}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	room := getTestRoom(t, fs)
+	if room.LegacyPassword != "" || !VerifyPassword(room.PasswordHash, "secret") || VerifyPassword(room.PasswordHash, "wrong") {
+		t.Fatalf("expected password to be replaced with a hash, got %+v", room)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// 閉じた時に作成したスナップショットには平文のパスワードが残らない
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(string(snapshot), "secret") {
+		t.Errorf("expected plain password to be removed, got %s", snapshot)
+	}
+	reopened := openTestFileStore(t, dir)
+	defer reopened.Close()
+	if restored := getTestRoom(t, reopened); restored.PasswordHash != room.PasswordHash {
+		t.Errorf("expected hash %q to be kept, got %q", room.PasswordHash, restored.PasswordHash)
+	}
+}
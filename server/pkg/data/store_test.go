@@ -0,0 +1,268 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStores は同じ振る舞いを確認する Store の実装の一覧
+var testStores = []struct {
+	name string
+	open func(t *testing.T, config Config) Store
+}{
+	{"memory", func(t *testing.T, config Config) Store {
+		return NewMemoryStore(config)
+	}},
+	{"file", func(t *testing.T, config Config) Store {
+		fs, err := OpenFileStore(t.TempDir(), config, time.Hour)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		t.Cleanup(func() { fs.Close() })
+		return fs
+	}},
+}
+
+// forEachStore は test をそれぞれの Store の実装に対して実行する
+func forEachStore(t *testing.T, config Config, test func(t *testing.T, store Store)) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			test(t, s.open(t, config))
+		})
+	}
+}
+
+// newTestRoom は alice と bob が参加したチャットルームを作成する
+func newTestRoom(t *testing.T, store Store) {
+	t.Helper()
+	if err := store.AddChatRooms("room-1", ChatRoom{Id: "room-1", Name: "General", Users: map[string]User{}}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for i, name := range []string{"alice", "bob"} {
+		if _, err := store.AddUsers("room-1", User{Id: "user-" + name, Name: name, JoinedAt: testTime(i)}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+}
+
+func sequences(messages []Message) []uint64 {
+	result := []uint64{}
+	for _, message := range messages {
+		result = append(result, message.Sequence)
+	}
+	return result
+}
+
+func TestStoreAppendMessage(t *testing.T) {
+	forEachStore(t, Config{MaxMessagesPerRoom: 10}, func(t *testing.T, store Store) {
+		newTestRoom(t, store)
+
+		var delivered []Message
+		deliver := func(room ChatRoom, message Message) error {
+			delivered = append(delivered, message)
+			return nil
+		}
+
+		// メンバーからのメッセージには 1 から順に通し番号を割り当て、保持しているユーザーの情報を使う
+		for i, userID := range []string{"user-alice", "user-bob"} {
+			accepted, err := store.AppendMessage("room-1", Message{Content: "hi", Sender: Sender{Id: userID}, Timestamp: testTime(10)}, true, deliver)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if accepted.Sequence != uint64(i+1) || accepted.Sender.Name == "" {
+				t.Errorf("unexpected message %+v", accepted)
+			}
+		}
+
+		// memberOnly の時はメンバー以外からのメッセージを受け付けず、通し番号も使わない
+		_, err := store.AppendMessage("room-1", Message{Content: "spoofed", Sender: Sender{Id: "user-mallory"}}, true, deliver)
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+
+		// システムからの通知は送信者がいなくても受け付ける
+		notice, err := store.AppendMessage("room-1", Message{Kind: 4, Content: "notice", Timestamp: testTime(11)}, false, deliver)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if notice.Sequence != 3 {
+			t.Errorf("expected sequence 3, got %d", notice.Sequence)
+		}
+
+		// 配信に失敗しても、通し番号を割り当てたメッセージは履歴に残す
+		failure := errors.New("send failed")
+		_, err = store.AppendMessage("room-1", Message{Content: "unsent", Sender: Sender{Id: "user-alice"}}, true, func(ChatRoom, Message) error { return failure })
+		if !errors.Is(err, failure) {
+			t.Errorf("expected delivery error, got %v", err)
+		}
+
+		if got := sequences(delivered); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+			t.Errorf("expected deliveries 1, 2, 3, got %v", got)
+		}
+		room, _ := store.GetChatRoomByID("room-1")
+		if got := sequences(room.Messages); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4}) || room.LastSequence != 4 {
+			t.Errorf("expected history 1 to 4, got %v (last %d)", got, room.LastSequence)
+		}
+
+		if _, err := store.AppendMessage("room-2", Message{}, false, deliver); !errors.Is(err, ErrChatRoomNotFound) {
+			t.Errorf("expected ErrChatRoomNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStoreHistory(t *testing.T) {
+	cases := []struct {
+		name           string
+		beforeSequence uint64
+		before         time.Time
+		limit          int
+		expected       []uint64
+		more           bool
+	}{
+		{"latest", 0, time.Time{}, 2, []uint64{4, 5}, true},
+		{"all", 0, time.Time{}, 10, []uint64{1, 2, 3, 4, 5}, false},
+		{"before sequence", 4, time.Time{}, 2, []uint64{2, 3}, true},
+		{"first page", 3, time.Time{}, 5, []uint64{1, 2}, false},
+		{"before time", 0, testTime(12), 5, []uint64{1, 2}, false},
+		{"both conditions", 5, testTime(12), 1, []uint64{2}, true},
+		{"nothing before", 1, time.Time{}, 5, []uint64{}, false},
+	}
+
+	forEachStore(t, Config{MaxMessagesPerRoom: 10}, func(t *testing.T, store Store) {
+		newTestRoom(t, store)
+		for i := 0; i < 5; i++ {
+			appendTestMessage(t, store, "user-alice", "hello", testTime(10+i))
+		}
+
+		for _, c := range cases {
+			messages, more, err := store.History("room-1", c.beforeSequence, c.before, c.limit)
+			if err != nil {
+				t.Fatalf("%s: expected no error, got %v", c.name, err)
+			}
+			if got := sequences(messages); !reflect.DeepEqual(got, c.expected) || more != c.more {
+				t.Errorf("%s: expected %v (more %v), got %v (more %v)", c.name, c.expected, c.more, got, more)
+			}
+		}
+
+		if _, _, err := store.History("room-2", 0, time.Time{}, 5); !errors.Is(err, ErrChatRoomNotFound) {
+			t.Errorf("expected ErrChatRoomNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStoreLimits(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      Config
+		history     []uint64
+		acceptsCarl bool
+	}{
+		{"unlimited users without history", Config{}, []uint64{}, true},
+		{"capped", Config{MaxUsersPerRoom: 2, MaxMessagesPerRoom: 3}, []uint64{3, 4, 5}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			forEachStore(t, c.config, func(t *testing.T, store Store) {
+				newTestRoom(t, store)
+
+				// 同じ名前のユーザーは人数に関係なく参加できない
+				if _, err := store.AddUsers("room-1", User{Id: "user-alice-2", Name: "alice"}); !errors.Is(err, ErrUserNameTaken) && !errors.Is(err, ErrChatRoomFull) {
+					t.Errorf("expected duplicate name to be rejected, got %v", err)
+				}
+				_, err := store.AddUsers("room-1", User{Id: "user-carl", Name: "carl"})
+				if c.acceptsCarl && err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				if !c.acceptsCarl && !errors.Is(err, ErrChatRoomFull) {
+					t.Errorf("expected ErrChatRoomFull, got %v", err)
+				}
+
+				// 履歴は新しいものから上限まで残し、通し番号は捨てたメッセージの分も進める
+				for i := 0; i < 5; i++ {
+					appendTestMessage(t, store, "user-alice", "hello", testTime(10+i))
+				}
+				room, _ := store.GetChatRoomByID("room-1")
+				if got := sequences(room.Messages); !reflect.DeepEqual(got, c.history) || room.LastSequence != 5 {
+					t.Errorf("expected history %v up to 5, got %v up to %d", c.history, got, room.LastSequence)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreReturnsCopies(t *testing.T) {
+	forEachStore(t, Config{MaxMessagesPerRoom: 10}, func(t *testing.T, store Store) {
+		added := ChatRoom{Id: "room-1", Name: "General", Users: map[string]User{}}
+		if err := store.AddChatRooms("room-1", added); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		// 追加した後に渡したチャットルームを変更しても Store には反映されない
+		added.Users["user-mallory"] = User{Id: "user-mallory", Name: "mallory"}
+		if _, err := store.AddUsers("room-1", User{Id: "user-alice", Name: "alice"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		appendTestMessage(t, store, "user-alice", "hello", testTime(10))
+
+		room, _ := store.GetChatRoomByID("room-1")
+		room.Users["user-bob"] = User{Id: "user-bob", Name: "bob"}
+		delete(room.Users, "user-alice")
+		room.Messages[0].Content = "changed"
+		history, _, _ := store.History("room-1", 0, time.Time{}, 10)
+		history[0].Content = "changed"
+
+		again, _ := store.GetChatRoomByID("room-1")
+		if len(again.Users) != 1 || again.Users["user-alice"].Name != "alice" {
+			t.Errorf("expected members not to be shared, got %+v", again.Users)
+		}
+		if again.Messages[0].Content != "hello" {
+			t.Errorf("expected history not to be shared, got %q", again.Messages[0].Content)
+		}
+		if isMember, _, _ := store.IsUserMemberOfChatRoom("room-1", "user-mallory"); isMember {
+			t.Error("expected added chat room not to be shared")
+		}
+	})
+}
+
+func TestStoreSaveCounter(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, store Store) {
+		newTestRoom(t, store)
+		counter := func() uint64 {
+			_, user, _ := store.IsUserMemberOfChatRoom("room-1", "user-alice")
+			return user.Counter
+		}
+
+		for _, c := range []struct {
+			counter  uint64
+			expected uint64
+		}{
+			{5, 5},
+			// 順番が入れ替わって届いた小さい counter では戻さない
+			{3, 5},
+			{9, 9},
+		} {
+			if err := store.SaveCounter("room-1", "user-alice", c.counter); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := counter(); got != c.expected {
+				t.Errorf("after %d: expected %d, got %d", c.counter, c.expected, got)
+			}
+		}
+
+		// SessionKey を発行し直すと 1 から数え直す
+		if err := store.SaveSessionKey("room-1", "user-alice", []byte("0123456789abcdef0123456789abcdef")); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := counter(); got != 0 {
+			t.Errorf("expected counter to be reset, got %d", got)
+		}
+
+		if err := store.SaveCounter("room-1", "user-mallory", 1); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+		if err := store.SaveCounter("room-2", "user-alice", 1); !errors.Is(err, ErrChatRoomNotFound) {
+			t.Errorf("expected ErrChatRoomNotFound, got %v", err)
+		}
+	})
+}
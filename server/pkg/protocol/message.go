@@ -1,7 +0,0 @@
-package protocol
-
-// func createUDPConnection(tcpConn net.Conn) (net.Conn, error) {
-// 	userIp := tcpConn.
-// }
-
-// ParseChatRoomProtocolはtcp接続により受信したbyte列を解析して構造体ChatRoomProtocolに変換する